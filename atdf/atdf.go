@@ -0,0 +1,308 @@
+// Package atdf builds simulated devices from the Microchip ATDF device
+// files shipped in the device packs.
+package atdf
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+type xmlFile struct {
+	Devices []xmlDevice `xml:"devices>device"`
+	Modules []xmlModule `xml:"modules>module"`
+}
+
+type xmlDevice struct {
+	Name         string         `xml:"name,attr"`
+	Architecture string         `xml:"architecture,attr"`
+	Family       string         `xml:"family,attr"`
+	Spaces       []xmlSpace     `xml:"address-spaces>address-space"`
+	Peripherals  []xmlModuleRef `xml:"peripherals>module"`
+	Interrupts   []xmlInterrupt `xml:"interrupts>interrupt"`
+	Properties   []xmlPropGroup `xml:"property-groups>property-group"`
+}
+
+type xmlSpace struct {
+	ID       string       `xml:"id,attr"`
+	Start    string       `xml:"start,attr"`
+	Size     string       `xml:"size,attr"`
+	Segments []xmlSegment `xml:"memory-segment"`
+}
+
+type xmlSegment struct {
+	Name     string `xml:"name,attr"`
+	Type     string `xml:"type,attr"`
+	Start    string `xml:"start,attr"`
+	Size     string `xml:"size,attr"`
+	PageSize string `xml:"pagesize,attr"`
+}
+
+type xmlModuleRef struct {
+	Name      string        `xml:"name,attr"`
+	Instances []xmlInstance `xml:"instance"`
+}
+
+type xmlInstance struct {
+	Name    string        `xml:"name,attr"`
+	Groups  []xmlGroupRef `xml:"register-group"`
+	Signals []xmlSignal   `xml:"signals>signal"`
+}
+
+type xmlGroupRef struct {
+	Name         string `xml:"name,attr"`
+	NameInModule string `xml:"name-in-module,attr"`
+	Offset       string `xml:"offset,attr"`
+	AddressSpace string `xml:"address-space,attr"`
+}
+
+type xmlSignal struct {
+	Group    string `xml:"group,attr"`
+	Function string `xml:"function,attr"`
+	Pad      string `xml:"pad,attr"`
+	Index    string `xml:"index,attr"`
+}
+
+type xmlInterrupt struct {
+	Index    string `xml:"index,attr"`
+	Name     string `xml:"name,attr"`
+	Instance string `xml:"module-instance,attr"`
+}
+
+type xmlPropGroup struct {
+	Name       string        `xml:"name,attr"`
+	Properties []xmlProperty `xml:"property"`
+}
+
+type xmlProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type xmlModule struct {
+	Name   string     `xml:"name,attr"`
+	Groups []xmlGroup `xml:"register-group"`
+}
+
+type xmlGroup struct {
+	Name      string        `xml:"name,attr"`
+	Registers []xmlRegister `xml:"register"`
+	Refs      []xmlGroupRef `xml:"register-group"`
+}
+
+type xmlRegister struct {
+	Name      string        `xml:"name,attr"`
+	Offset    string        `xml:"offset,attr"`
+	Size      string        `xml:"size,attr"`
+	Bitfields []xmlBitfield `xml:"bitfield"`
+}
+
+type xmlBitfield struct {
+	Name string `xml:"name,attr"`
+	Mask string `xml:"mask,attr"`
+}
+
+// LoadFile reads the device described by an ATDF file.
+func LoadFile(path string) (*Device, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// Load reads the device described by ATDF data.
+func Load(r io.Reader) (*Device, error) {
+	var file xmlFile
+	if err := xml.NewDecoder(r).Decode(&file); err != nil {
+		return nil, fmt.Errorf("atdf: %v", err)
+	}
+	if len(file.Devices) == 0 {
+		return nil, fmt.Errorf("atdf: no device")
+	}
+	return newDevice(&file.Devices[0], file.Modules)
+}
+
+func parseNum(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("atdf: bad number %q", s)
+	}
+	return int(n), nil
+}
+
+// A numParser parses numbers, keeping the first error.
+type numParser struct {
+	err error
+}
+
+func (p *numParser) num(s string) int {
+	n, err := parseNum(s)
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+	return n
+}
+
+func newDevice(x *xmlDevice, modules []xmlModule) (*Device, error) {
+	var p numParser
+	d := &Device{
+		Name:         x.Name,
+		Architecture: x.Architecture,
+		Family:       x.Family,
+		MappedFlash:  -1,
+		byName:       make(map[string]core.Addr),
+		byAddr:       make(map[core.Addr]string),
+	}
+
+	for _, space := range x.Spaces {
+		switch space.ID {
+		case "prog":
+			d.FlashBytes = p.num(space.Size)
+			for _, seg := range space.Segments {
+				if seg.Type == "flash" && d.FlashPageBytes == 0 {
+					d.FlashPageBytes = p.num(seg.PageSize)
+				}
+				if seg.Name == "BOOT_SECTION" {
+					d.BootStart = p.num(seg.Start)
+				}
+			}
+		case "eeprom":
+			d.EepromBytes = p.num(space.Size)
+		case "data":
+			for _, seg := range space.Segments {
+				start, size := p.num(seg.Start), p.num(seg.Size)
+				switch seg.Type {
+				case "regs":
+					d.RegisterFile = true
+					if start+size > d.PortCount {
+						d.PortCount = start + size
+					}
+				case "io":
+					if start+size > d.PortCount {
+						d.PortCount = start + size
+					}
+				case "ram":
+					if d.SramBytes == 0 {
+						d.SramStart, d.SramBytes = start, size
+					}
+				case "flash":
+					d.MappedFlash = start
+				}
+			}
+		}
+	}
+
+	for _, group := range x.Properties {
+		if group.Name != "SIGNATURES" {
+			continue
+		}
+		for _, prop := range group.Properties {
+			if strings.HasPrefix(prop.Name, "SIGNATURE") {
+				d.Signature = append(d.Signature, byte(p.num(prop.Value)))
+			}
+		}
+	}
+
+	for _, intr := range x.Interrupts {
+		index := p.num(intr.Index)
+		for len(d.Vectors) <= index {
+			d.Vectors = append(d.Vectors, "")
+		}
+		name := intr.Name
+		if intr.Instance != "" && !strings.HasPrefix(name, intr.Instance) {
+			name = intr.Instance + "_" + name
+		}
+		d.Vectors[index] = name
+	}
+
+	groups := make(map[string]map[string]*xmlGroup)
+	for i := range modules {
+		m := make(map[string]*xmlGroup)
+		for j := range modules[i].Groups {
+			m[modules[i].Groups[j].Name] = &modules[i].Groups[j]
+		}
+		groups[modules[i].Name] = m
+	}
+	for _, mod := range x.Peripherals {
+		for _, inst := range mod.Instances {
+			in := Instance{Module: mod.Name, Name: inst.Name}
+			for _, sig := range inst.Signals {
+				in.Signals = append(in.Signals, Signal{
+					Group:    sig.Group,
+					Function: sig.Function,
+					Pad:      sig.Pad,
+					Index:    p.num(sig.Index),
+				})
+			}
+			for i, ref := range inst.Groups {
+				if ref.AddressSpace != "" && ref.AddressSpace != "data" {
+					continue
+				}
+				base := p.num(ref.Offset)
+				if i == 0 {
+					in.Base = core.Addr(base)
+				}
+				// registers are qualified by instance, as in the avr-libc
+				// headers, except for the xmega CPU registers and the
+				// megas' unshared groups
+				prefix := ""
+				if ref.NameInModule != inst.Name ||
+					(d.Xmega() && mod.Name != "CPU") {
+					prefix = inst.Name + "_"
+				}
+				d.addGroup(&p, groups[mod.Name], ref.NameInModule, inst.Name,
+					prefix, base)
+			}
+			d.Instances = append(d.Instances, in)
+		}
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	sort.Slice(d.Registers, func(i, j int) bool {
+		return d.Registers[i].Addr < d.Registers[j].Addr
+	})
+	d.index()
+	return d, nil
+}
+
+// addGroup adds the registers of a module's register group, following
+// references to nested groups.
+func (d *Device) addGroup(p *numParser, groups map[string]*xmlGroup,
+	name, instance, prefix string, base int) {
+
+	group := groups[name]
+	if group == nil {
+		return
+	}
+	for _, reg := range group.Registers {
+		r := Register{
+			Name:     prefix + reg.Name,
+			Instance: instance,
+			Addr:     core.Addr(base + p.num(reg.Offset)),
+			Size:     p.num(reg.Size),
+		}
+		if r.Size == 0 {
+			r.Size = 1
+		}
+		for _, bf := range reg.Bitfields {
+			r.Bits = append(r.Bits, Bitfield{bf.Name, p.num(bf.Mask)})
+		}
+		d.Registers = append(d.Registers, r)
+	}
+	for _, ref := range group.Refs {
+		d.addGroup(p, groups, ref.NameInModule, instance,
+			prefix+ref.Name+"_", base+p.num(ref.Offset))
+	}
+}
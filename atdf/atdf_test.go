@@ -0,0 +1,321 @@
+package atdf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/instr"
+)
+
+// A trimmed ATmega328P description.
+const mega328p = `<?xml version="1.0" encoding="UTF-8"?>
+<avr-tools-device-file schema-version="0.3">
+  <devices>
+    <device name="ATmega328P" architecture="AVR8" family="megaAVR">
+      <address-spaces>
+        <address-space endianness="little" name="prog" id="prog" start="0x0000" size="0x8000">
+          <memory-segment start="0x0000" size="0x8000" type="flash" rw="RW" exec="1" name="FLASH" pagesize="0x80"/>
+        </address-space>
+        <address-space endianness="little" name="data" id="data" start="0x0000" size="0x0900">
+          <memory-segment external="false" type="regs" size="0x0020" start="0x0000" name="REGISTERS"/>
+          <memory-segment name="MAPPED_IO" start="0x0020" size="0x0040" type="io" external="false"/>
+          <memory-segment name="IO" start="0x0060" size="0x00a0" type="io" external="false"/>
+          <memory-segment name="IRAM" start="0x0100" size="0x0800" type="ram" external="false"/>
+        </address-space>
+        <address-space endianness="little" name="eeprom" id="eeprom" start="0x0000" size="0x0400">
+          <memory-segment start="0x0000" size="0x0400" type="eeprom" rw="RW" exec="0" name="EEPROM" pagesize="0x04"/>
+        </address-space>
+      </address-spaces>
+      <peripherals>
+        <module name="CPU">
+          <instance name="CPU">
+            <register-group name="CPU" name-in-module="CPU" offset="0x00" address-space="data"/>
+          </instance>
+        </module>
+        <module name="PORT">
+          <instance name="PORTB">
+            <register-group name="PORTB" name-in-module="PORTB" offset="0x00" address-space="data"/>
+          </instance>
+        </module>
+        <module name="SPI">
+          <instance name="SPI">
+            <register-group name="SPI" name-in-module="SPI" offset="0x00" address-space="data"/>
+            <signals>
+              <signal group="MISO" function="default" pad="PB4"/>
+              <signal group="SS" function="default" pad="PB2"/>
+            </signals>
+          </instance>
+        </module>
+        <module name="USART">
+          <instance name="USART0">
+            <register-group name="USART0" name-in-module="USART0" offset="0x00" address-space="data"/>
+          </instance>
+        </module>
+        <module name="EEPROM">
+          <instance name="EEPROM">
+            <register-group name="EEPROM" name-in-module="EEPROM" offset="0x00" address-space="data"/>
+          </instance>
+        </module>
+      </peripherals>
+      <interrupts>
+        <interrupt index="0" name="RESET"/>
+        <interrupt index="17" name="SPI_STC"/>
+        <interrupt index="18" name="USART_RX"/>
+        <interrupt index="19" name="USART_UDRE"/>
+        <interrupt index="20" name="USART_TX"/>
+        <interrupt index="22" name="EE_READY"/>
+        <interrupt index="25" name="SPM_READY"/>
+      </interrupts>
+      <property-groups>
+        <property-group name="SIGNATURES">
+          <property name="SIGNATURE0" value="0x1e"/>
+          <property name="SIGNATURE1" value="0x95"/>
+          <property name="SIGNATURE2" value="0x0f"/>
+        </property-group>
+      </property-groups>
+    </device>
+  </devices>
+  <modules>
+    <module name="CPU">
+      <register-group name="CPU">
+        <register name="SREG" offset="0x5f" size="1"/>
+        <register name="SP" offset="0x5d" size="2"/>
+      </register-group>
+    </module>
+    <module name="PORT">
+      <register-group name="PORTB">
+        <register name="PORTB" offset="0x25" size="1"/>
+        <register name="DDRB" offset="0x24" size="1"/>
+        <register name="PINB" offset="0x23" size="1"/>
+      </register-group>
+    </module>
+    <module name="SPI">
+      <register-group name="SPI">
+        <register name="SPDR" offset="0x4e" size="1"/>
+        <register name="SPSR" offset="0x4d" size="1"/>
+        <register name="SPCR" offset="0x4c" size="1"/>
+      </register-group>
+    </module>
+    <module name="USART">
+      <register-group name="USART0">
+        <register name="UDR0" offset="0xc6" size="1"/>
+        <register name="UCSR0A" offset="0xc0" size="1"/>
+        <register name="UCSR0B" offset="0xc1" size="1"/>
+        <register name="UCSR0C" offset="0xc2" size="1"/>
+        <register name="UBRR0" offset="0xc4" size="2"/>
+      </register-group>
+    </module>
+    <module name="EEPROM">
+      <register-group name="EEPROM">
+        <register name="EEAR" offset="0x41" size="2"/>
+        <register name="EEDR" offset="0x40" size="1"/>
+        <register name="EECR" offset="0x3f" size="1">
+          <bitfield name="EEPM" mask="0x30"/>
+          <bitfield name="EERE" mask="0x01"/>
+        </register>
+      </register-group>
+    </module>
+  </modules>
+</avr-tools-device-file>
+`
+
+// A trimmed ATxmega128A1 description.
+const xmega128a1 = `<?xml version="1.0" encoding="UTF-8"?>
+<avr-tools-device-file schema-version="0.3">
+  <devices>
+    <device name="ATxmega128A1" architecture="AVR8_XMEGA" family="AVR XMEGA">
+      <address-spaces>
+        <address-space endianness="little" name="prog" id="prog" start="0x0000" size="0x22000">
+          <memory-segment start="0x0000" size="0x20000" type="flash" name="APP_SECTION" pagesize="0x200"/>
+          <memory-segment start="0x20000" size="0x2000" type="flash" name="BOOT_SECTION" pagesize="0x200"/>
+        </address-space>
+        <address-space endianness="little" name="data" id="data" start="0x0000" size="0x1000000">
+          <memory-segment start="0x0000" size="0x1000" type="io" name="IO"/>
+          <memory-segment start="0x2000" size="0x2000" type="ram" name="INTERNAL_SRAM"/>
+        </address-space>
+      </address-spaces>
+      <peripherals>
+        <module name="CPU">
+          <instance name="CPU">
+            <register-group name="CPU" name-in-module="CPU" offset="0x0030" address-space="data"/>
+          </instance>
+        </module>
+        <module name="PMIC">
+          <instance name="PMIC">
+            <register-group name="PMIC" name-in-module="PMIC" offset="0x00a0" address-space="data"/>
+          </instance>
+        </module>
+        <module name="PORT">
+          <instance name="PORTC">
+            <register-group name="PORTC" name-in-module="PORT" offset="0x0640" address-space="data"/>
+          </instance>
+        </module>
+        <module name="TC0">
+          <instance name="TCC0">
+            <register-group name="TCC0" name-in-module="TC0" offset="0x0800" address-space="data"/>
+          </instance>
+        </module>
+      </peripherals>
+      <interrupts>
+        <interrupt index="2" module-instance="PORTC" name="INT0"/>
+        <interrupt index="3" module-instance="PORTC" name="INT1"/>
+        <interrupt index="14" module-instance="TCC0" name="OVF"/>
+        <interrupt index="15" module-instance="TCC0" name="ERR"/>
+        <interrupt index="16" module-instance="TCC0" name="CCA"/>
+        <interrupt index="17" module-instance="TCC0" name="CCB"/>
+        <interrupt index="18" module-instance="TCC0" name="CCC"/>
+        <interrupt index="19" module-instance="TCC0" name="CCD"/>
+      </interrupts>
+    </device>
+  </devices>
+  <modules>
+    <module name="CPU">
+      <register-group name="CPU">
+        <register name="CCP" offset="0x04" size="1"/>
+        <register name="RAMPD" offset="0x08" size="1"/>
+        <register name="RAMPX" offset="0x09" size="1"/>
+        <register name="RAMPY" offset="0x0a" size="1"/>
+        <register name="RAMPZ" offset="0x0b" size="1"/>
+        <register name="EIND" offset="0x0c" size="1"/>
+        <register name="SP" offset="0x0d" size="2"/>
+        <register name="SREG" offset="0x0f" size="1"/>
+      </register-group>
+    </module>
+    <module name="PMIC">
+      <register-group name="PMIC">
+        <register name="STATUS" offset="0x00" size="1"/>
+        <register name="INTPRI" offset="0x01" size="1"/>
+        <register name="CTRL" offset="0x02" size="1"/>
+      </register-group>
+    </module>
+    <module name="PORT">
+      <register-group name="PORT">
+        <register name="DIR" offset="0x00" size="1"/>
+        <register name="OUT" offset="0x04" size="1"/>
+        <register name="IN" offset="0x08" size="1"/>
+      </register-group>
+    </module>
+    <module name="TC0">
+      <register-group name="TC0">
+        <register name="CTRLA" offset="0x00" size="1"/>
+        <register name="CNT" offset="0x20" size="2"/>
+        <register name="PER" offset="0x26" size="2"/>
+      </register-group>
+    </module>
+  </modules>
+</avr-tools-device-file>
+`
+
+func TestLoadMega(t *testing.T) {
+	d, err := Load(strings.NewReader(mega328p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.FlashBytes != 0x8000 || d.FlashPageBytes != 0x80 ||
+		d.EepromBytes != 0x400 || d.SramStart != 0x100 ||
+		d.SramBytes != 0x800 || d.PortCount != 0x100 || !d.RegisterFile {
+		t.Error("Bad memory layout", d)
+	}
+	if len(d.Signature) != 3 || d.Signature[1] != 0x95 {
+		t.Error("Bad signature", d.Signature)
+	}
+	if addr, ok := d.Addr("UBRR0H"); !ok || addr != 0xc5 {
+		t.Error("Bad 16-bit register byte", addr)
+	}
+	if d.RegisterName(0x5e) != "SPH" || d.IOName(0x05) != "PORTB" {
+		t.Error("Bad register names")
+	}
+	if d.Vector("USART_RX") != 18 || len(d.Vectors) != 26 {
+		t.Error("Bad vectors")
+	}
+	set := d.Set()
+	if !set[instr.Mul] || !set[instr.Jmp] || set[instr.Elpm] ||
+		set[instr.Eijmp] || d.VectorWords() != 2 {
+		t.Error("Bad instruction set")
+	}
+	if d.CoreFamily() != core.Mega {
+		t.Error("Bad core family")
+	}
+}
+
+func TestSystemMega(t *testing.T) {
+	d, _ := Load(strings.NewReader(mega328p))
+	sys := NewSystem(d)
+	if sys.Cpu.GetSP() != 0x8ff {
+		t.Error("Bad initial SP", sys.Cpu.GetSP())
+	}
+	if _, err := sys.AddUSART("", nil, make(chan byte, 1)); err != nil {
+		t.Error(err)
+	}
+	if _, err := sys.AddSPI(); err != nil {
+		t.Error(err)
+	}
+	if _, err := sys.AddEEPROM(); err != nil {
+		t.Error(err)
+	}
+	if _, err := sys.AddTWI(nil); err == nil {
+		t.Error("Added missing TWI")
+	}
+	noEEAR := strings.Replace(mega328p, `name="EEAR"`, `name="EEADR"`, 1)
+	d2, _ := Load(strings.NewReader(noEEAR))
+	if _, err := NewSystem(d2).AddEEPROM(); err == nil {
+		t.Error("Added EEPROM without an address register")
+	}
+	for i, op := range []uint16{
+		0xef0f, // ldi r16, 0xff
+		0xb904, // out DDRB, r16
+		0xe50a, // ldi r16, 0x5a
+		0xb905, // out PORTB, r16
+	} {
+		sys.Memory.WriteProgram(core.Addr(i), op)
+	}
+	sys.Run(4)
+	if sys.Ports["PORTB"].Levels() != 0x5a {
+		t.Error("PORTB not wired", sys.Ports["PORTB"].Levels())
+	}
+}
+
+func TestSystemXmega(t *testing.T) {
+	d, err := Load(strings.NewReader(xmega128a1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.CoreFamily() != core.Xmega || d.RegisterFile ||
+		d.BootStart != 0x20000 {
+		t.Error("Bad xmega layout")
+	}
+	if addr, ok := d.Addr("PORTC_OUT"); !ok || addr != 0x644 {
+		t.Error("Bad qualified register", addr)
+	}
+	if addr, ok := d.Addr("SPL"); !ok || addr != 0x3d {
+		t.Error("Bad CPU register", addr)
+	}
+	if dm, _, _, zm, em := d.RampMasks(); dm != 0xff || zm != 0xff ||
+		em != 0x01 {
+		t.Error("Bad RAMP masks", dm, zm, em)
+	}
+	sys := NewSystem(d)
+	if sys.XPorts["PORTC"] == nil || sys.XTimers["TCC0"] == nil {
+		t.Fatal("Modules not instantiated")
+	}
+	for i, op := range []uint16{
+		0xef0f,         // ldi r16, 0xff
+		0x9300, 0x0640, // sts PORTC_DIR, r16
+		0xe50a,         // ldi r16, 0x5a
+		0xbf0b,         // out RAMPZ, r16
+		0x9300, 0x0644, // sts PORTC_OUT, r16
+		0xe407,         // ldi r16, 0x47
+		0x9300, 0x00a2, // sts PMIC_CTRL, r16
+		0x9110, 0x00a2, // lds r17, PMIC_CTRL
+	} {
+		sys.Memory.WriteProgram(core.Addr(i), op)
+	}
+	sys.Run(12)
+	if sys.Ports["PORTC"].Levels() != 0x5a || sys.Cpu.GetRamp(core.RampZ) != 0x5a {
+		t.Error("PORTC not wired", sys.Ports["PORTC"].Levels())
+	}
+	if sys.Cpu.GetReg(17) != 0x07 {
+		t.Error("Bad unprotected PMIC CTRL write", sys.Cpu.GetReg(17))
+	}
+}
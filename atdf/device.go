@@ -0,0 +1,346 @@
+package atdf
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/instr"
+)
+
+// Architectures
+const (
+	ArchAVR8      = "AVR8"
+	ArchReduced   = "AVR8L"
+	ArchXmega     = "AVR8_XMEGA"
+	ArchXmegaCore = "AVR8X"
+)
+
+// A Device describes an MCU: its memories, I/O registers, interrupt
+// vectors and peripheral module instances. Addresses are in the data
+// space.
+type Device struct {
+	Name           string
+	Architecture   string
+	Family         string
+	FlashBytes     int
+	FlashPageBytes int
+	// BootStart is the byte address of a fixed boot section (on
+	// xmegas), or 0.
+	BootStart   int
+	EepromBytes int
+	// RegisterFile is set if the register file is mapped at 0.
+	RegisterFile bool
+	// PortCount is the end of the I/O space.
+	PortCount int
+	SramStart int
+	SramBytes int
+	// MappedFlash is the address flash is mapped at, or -1.
+	MappedFlash int
+	Signature   []byte
+	Registers   []Register
+	Vectors     []string
+	Instances   []Instance
+	byName      map[string]core.Addr
+	byAddr      map[core.Addr]string
+}
+
+// A Register is an I/O register. Registers wider than a byte are also
+// named by byte, with L and H (and for 32 bits, 2 and 3) suffixes.
+type Register struct {
+	Name     string
+	Instance string
+	Addr     core.Addr
+	Size     int
+	Bits     []Bitfield
+}
+
+type Bitfield struct {
+	Name string
+	Mask int
+}
+
+// An Instance is a peripheral module instance; Module is its type.
+type Instance struct {
+	Module  string
+	Name    string
+	Base    core.Addr
+	Signals []Signal
+}
+
+// A Signal connects an instance to a pad, such as "PB2".
+type Signal struct {
+	Group    string
+	Function string
+	Pad      string
+	Index    int
+}
+
+var byteSuffixes = [][]string{
+	nil,
+	{""},
+	{"L", "H"},
+	{"0", "1", "2"},
+	{"0", "1", "2", "3"},
+}
+
+func (d *Device) index() {
+	for _, reg := range d.Registers {
+		names := []string{reg.Name}
+		if reg.Size > 1 && reg.Size < len(byteSuffixes) {
+			names = nil
+			for _, suffix := range byteSuffixes[reg.Size] {
+				names = append(names, reg.Name+suffix)
+			}
+			d.byName[reg.Name] = reg.Addr
+		}
+		for i, name := range names {
+			addr := reg.Addr + core.Addr(i)
+			if _, ok := d.byName[name]; !ok {
+				d.byName[name] = addr
+			}
+			if _, ok := d.byAddr[addr]; !ok {
+				d.byAddr[addr] = name
+			}
+		}
+	}
+}
+
+// Addr returns the address of a named register, or of one byte of it.
+func (d *Device) Addr(name string) (core.Addr, bool) {
+	addr, ok := d.byName[name]
+	return addr, ok
+}
+
+// RegisterName returns the name of the register byte at addr, or "".
+func (d *Device) RegisterName(addr core.Addr) string {
+	return d.byAddr[addr]
+}
+
+// IOName returns the name of the register at I/O address a, as used by
+// IN, OUT and the bit instructions, or "".
+func (d *Device) IOName(a int) string {
+	if d.RegisterFile {
+		a += 0x20
+	}
+	return d.RegisterName(core.Addr(a))
+}
+
+// Register returns the register named name, or nil.
+func (d *Device) Register(name string) *Register {
+	for i := range d.Registers {
+		if d.Registers[i].Name == name {
+			return &d.Registers[i]
+		}
+	}
+	return nil
+}
+
+// Vector returns the number of the named interrupt vector, or -1.
+func (d *Device) Vector(name string) int {
+	for i, vec := range d.Vectors {
+		if vec == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// InstancesOf returns the instances of a module type.
+func (d *Device) InstancesOf(module string) []Instance {
+	var insts []Instance
+	for _, inst := range d.Instances {
+		if inst.Module == module {
+			insts = append(insts, inst)
+		}
+	}
+	return insts
+}
+
+// Instance returns the named module instance, or nil.
+func (d *Device) Instance(name string) *Instance {
+	for i := range d.Instances {
+		if d.Instances[i].Name == name {
+			return &d.Instances[i]
+		}
+	}
+	return nil
+}
+
+// Pad returns the pad of the first signal of inst in group, such as
+// "PB2", or "".
+func (inst *Instance) Pad(group string) string {
+	for _, sig := range inst.Signals {
+		if sig.Group == group {
+			return sig.Pad
+		}
+	}
+	return ""
+}
+
+// Xmega reports whether the device has the xmega core, with I/O at 0
+// and no mapped register file; this includes the AVR8X tiny and mega
+// series.
+func (d *Device) Xmega() bool {
+	return d.Architecture == ArchXmega || d.Architecture == ArchXmegaCore
+}
+
+// CoreFamily returns the timing family of the CPU.
+func (d *Device) CoreFamily() core.Family {
+	switch {
+	case d.Architecture == ArchReduced:
+		return core.Tiny
+	case d.Xmega():
+		return core.Xmega
+	}
+	return core.Mega
+}
+
+// Set returns the instruction set. ATDF files do not list it, so it is
+// inferred from the architecture, family and flash size like the GCC
+// -mmcu classes: tinies get avr25 (or avr35 above 8K), megas avr4, avr5
+// or avr6. It is nil for reduced-core devices, which use
+// instr.NewReducedDecoder.
+func (d *Device) Set() instr.Set {
+	var set instr.Set
+	switch {
+	case d.Architecture == ArchReduced:
+		return nil
+	case d.Xmega():
+		set = instr.NewSetXmega()
+		if d.Architecture == ArchXmegaCore || !d.hasRegister("RAMPZ") {
+			set[instr.Elpm] = false
+			set[instr.ElpmEnhanced] = false
+		}
+		return set
+	case strings.HasPrefix(d.Family, "tiny"):
+		if d.FlashBytes > 0x2000 {
+			set = instr.NewSetClassic128k()
+			set[instr.Elpm] = false
+		} else {
+			set = instr.NewSetClassic8k()
+		}
+		set[instr.Movw] = true
+		set[instr.LpmEnhanced] = true
+		set[instr.Spm] = true
+		set[instr.Break] = true
+		return set
+	case d.FlashBytes <= 0x2000:
+		set = instr.NewSetEnhanced8k()
+		set[instr.Break] = true
+	case d.FlashBytes <= 0x20000:
+		set = instr.NewSetEnhanced128k()
+	default:
+		set = instr.NewSetEnhanced4m()
+	}
+	if d.FlashBytes <= 0x10000 {
+		set[instr.Elpm] = false
+		set[instr.ElpmEnhanced] = false
+	}
+	return set
+}
+
+// Decoder returns a decoder for the device's instruction set.
+func (d *Device) Decoder() instr.Decoder {
+	if d.Architecture == ArchReduced {
+		return instr.NewReducedDecoder()
+	}
+	return instr.NewDecoder(d.Set())
+}
+
+func (d *Device) hasRegister(name string) bool {
+	_, ok := d.byName[name]
+	return ok
+}
+
+// rampMask returns the mask for a RAMP register covering size bytes
+// beyond the first 64K, or 0 if the register does not exist.
+func (d *Device) rampMask(name string, size int) byte {
+	if !d.hasRegister(name) || size <= 0x10000 {
+		return 0
+	}
+	mask := byte(0)
+	for n := (size - 1) >> 16; n != 0; n >>= 1 {
+		mask = mask<<1 | 1
+	}
+	return mask
+}
+
+// RampMasks returns the masks of the RAMP and EIND registers, as
+// passed to core.NewCpu. On xmegas RAMPX, RAMPY, RAMPZ and RAMPD are
+// full width, since they also address external memory.
+func (d *Device) RampMasks() (dmask, xmask, ymask, zmask, emask byte) {
+	if d.Xmega() {
+		full := func(name string) byte {
+			if d.hasRegister(name) {
+				return 0xff
+			}
+			return 0
+		}
+		dmask, xmask, ymask = full("RAMPD"), full("RAMPX"), full("RAMPY")
+		zmask = full("RAMPZ")
+	} else {
+		zmask = d.rampMask("RAMPZ", d.FlashBytes)
+	}
+	emask = d.rampMask("EIND", d.FlashBytes/2)
+	return
+}
+
+// NewCpu returns a CPU for the device.
+func (d *Device) NewCpu() *core.Cpu {
+	dmask, xmask, ymask, zmask, emask := d.RampMasks()
+	cpu := core.NewCpu(d.CoreFamily(), dmask, xmask, ymask, zmask, emask)
+	if !d.Xmega() && d.hasRegister("RAMPZ") {
+		cpu.SetProgramRampZ(true)
+	}
+	return cpu
+}
+
+// VectorWords returns the size of each interrupt vector in words;
+// devices with more than 8K of flash use JMP.
+func (d *Device) VectorWords() int {
+	if d.FlashBytes > 0x2000 {
+		return 2
+	}
+	return 1
+}
+
+// instanceRegs returns the addresses of the register bytes of an
+// instance, named without the instance number (UDR for UDR0 of USART0)
+// or prefix.
+func (d *Device) instanceRegs(inst string) map[string]core.Addr {
+	regs := make(map[string]core.Addr)
+	num := instanceNumber(inst)
+	for _, reg := range d.Registers {
+		if reg.Instance != inst {
+			continue
+		}
+		name := strings.TrimPrefix(reg.Name, inst+"_")
+		if num != "" {
+			name = strings.Replace(name, num, "", 1)
+		}
+		suffixes := []string{""}
+		if reg.Size > 1 && reg.Size < len(byteSuffixes) {
+			suffixes = byteSuffixes[reg.Size]
+		}
+		for i, suffix := range suffixes {
+			if _, ok := regs[name+suffix]; !ok {
+				regs[name+suffix] = reg.Addr + core.Addr(i)
+			}
+		}
+	}
+	return regs
+}
+
+// instanceNumber returns the digits ending an instance name, as used in
+// its register names (UDR0 of USART0).
+func instanceNumber(name string) string {
+	i := len(name)
+	for i > 0 && name[i-1] >= '0' && name[i-1] <= '9' {
+		i--
+	}
+	if _, err := strconv.Atoi(name[i:]); err != nil {
+		return ""
+	}
+	return name[i:]
+}
@@ -0,0 +1,64 @@
+package atdf
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+// A Mem lays out the data space as a Device describes it: the register
+// file (if mapped), I/O registers up to PortCount, internal SRAM and
+// mapped flash. I/O addresses with no register in the device file are
+// reserved. Other addresses read as 0 and ignore writes.
+type Mem struct {
+	*core.MemMap
+}
+
+func NewMem(cpu *core.Cpu, d *Device) *Mem {
+	mem := &Mem{core.NewMemMap(d.FlashBytes / 2)}
+	ioStart := 0
+	if d.RegisterFile {
+		mem.AddRegisterFile(cpu)
+		ioStart = 32
+	}
+	mem.AddIO(core.Addr(ioStart), d.PortCount-ioStart)
+	mem.AddSRAM(core.Addr(d.SramStart), d.SramBytes)
+	if d.MappedFlash >= 0 {
+		start := core.Addr(d.MappedFlash)
+		mem.AddRegion(start, d.FlashBytes,
+			func(addr core.Addr) byte {
+				return mem.LoadProgram(addr - start)
+			}, ignoreWrite)
+	}
+
+	if len(d.Registers) > 0 {
+		for addr := core.Addr(ioStart); int(addr) < d.PortCount; addr++ {
+			if d.RegisterName(addr) == "" {
+				mem.Reserve(addr)
+			}
+		}
+	}
+
+	cpuRegs := []struct {
+		name string
+		r    core.MemRead
+		w    core.MemWrite
+	}{
+		{"RAMPD", cpu.MemReadRampD, cpu.MemWriteRampD},
+		{"RAMPX", cpu.MemReadRampX, cpu.MemWriteRampX},
+		{"RAMPY", cpu.MemReadRampY, cpu.MemWriteRampY},
+		{"RAMPZ", cpu.MemReadRampZ, cpu.MemWriteRampZ},
+		{"EIND", cpu.MemReadEind, cpu.MemWriteEind},
+		{"SPL", cpu.MemReadSPL, cpu.MemWriteSPL},
+		{"SPH", cpu.MemReadSPH, cpu.MemWriteSPH},
+		{"SREG", cpu.MemReadSreg, cpu.MemWriteSreg},
+	}
+	for _, reg := range cpuRegs {
+		if addr, ok := d.Addr(reg.name); ok && int(addr) < d.PortCount {
+			mem.SetRW(addr, reg.r, reg.w)
+		}
+	}
+
+	return mem
+}
+
+func ignoreWrite(addr core.Addr, val byte) {
+}
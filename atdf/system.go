@@ -0,0 +1,326 @@
+package atdf
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/edmccard/avr-sim/board"
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/dev"
+)
+
+// The RETI opcode, which the PMIC watches for to end an interrupt level
+const opReti = 0x9518
+
+// A System is a device built from its Device description. NewSystem
+// instantiates the modules whose models need no configuration: the
+// PORTs and, on xmegas, CCP, PMIC, the clock system and the TC0/TC1
+// timers. The others are added by the Add methods. Modules without a
+// model, and the AVR8X tiny and mega series' peripherals, are plain
+// registers.
+type System struct {
+	*board.Board
+	Device *Device
+	Memory *Mem
+	Intr   *core.Interrupts
+	// Ports holds the GPIO ports by instance name (PORTB); on xmegas
+	// they are the ports of XPorts.
+	Ports   map[string]*dev.Port
+	XPorts  map[string]*dev.XPort
+	XTimers map[string]*dev.XTimer
+	CCP     *dev.CCP
+	PMIC    *dev.PMIC
+	XClock  *dev.XClock
+}
+
+func NewSystem(d *Device) *System {
+	cpu := d.NewCpu()
+	decoder := d.Decoder()
+	vecCount := len(d.Vectors)
+	if vecCount == 0 {
+		vecCount = 1
+	}
+	mem := NewMem(cpu, d)
+	timer := core.NewTimer()
+	intr := core.NewInterrupts(vecCount)
+	sys := &System{
+		Device:  d,
+		Memory:  mem,
+		Intr:    intr,
+		Ports:   make(map[string]*dev.Port),
+		XPorts:  make(map[string]*dev.XPort),
+		XTimers: make(map[string]*dev.XTimer),
+	}
+	cpu.Reset(d.SramStart+d.SramBytes-1, 0)
+	var pending board.Interrupter = intr
+	vector := func(vec int) int { return d.VectorWords() * vec }
+	if d.Architecture == ArchXmega {
+		sys.PMIC = dev.NewPMIC(intr, len(d.Vectors))
+		pending, vector = sys.PMIC, sys.xmegaVector
+	}
+	sys.Board = board.New(cpu, &decoder, mem, timer, pending, vector)
+	// most parts run from the 8MHz RC oscillator divided by 8 as shipped
+	sys.Clock.SetSource(dev.FixedClock(1000000))
+	switch d.Architecture {
+	case ArchXmega:
+		sys.addXmega()
+	case ArchAVR8, ArchReduced:
+		for _, inst := range d.InstancesOf("PORT") {
+			sys.addPort(inst)
+		}
+	}
+	return sys
+}
+
+// addPort wires in a mega-style port, whose registers are PINx, DDRx
+// and PORTx.
+func (sys *System) addPort(inst Instance) {
+	letter := inst.Name[len("PORT"):]
+	pin, okPin := sys.Device.Addr("PIN" + letter)
+	ddr, okDdr := sys.Device.Addr("DDR" + letter)
+	out, okOut := sys.Device.Addr("PORT" + letter)
+	if !okPin || !okDdr || !okOut {
+		return
+	}
+	port := dev.NewPort()
+	board.MapPort(sys.Memory, port, pin, ddr, out)
+	sys.Ports[inst.Name] = port
+}
+
+func (sys *System) addXmega() {
+	d, mem := sys.Device, sys.Memory
+	sys.CCP = dev.NewCCP(sys.Timer)
+	sys.XClock = dev.NewXClock(sys.Timer)
+	sys.Clock.SetSource(sys.XClock)
+	sys.Blocked = sys.CCP.Active
+	sys.Executed = sys.executed
+	if addr, ok := d.Addr("CCP"); ok {
+		mem.SetRW(addr, sys.CCP.ReadCCP, sys.CCP.WriteCCP)
+	}
+	protect := sys.CCP.Protect
+	if inst := d.Instance("PMIC"); inst != nil {
+		mem.SetRW(inst.Base, sys.PMIC.ReadSTATUS, sys.PMIC.WriteSTATUS)
+		mem.SetRW(inst.Base+1, sys.PMIC.ReadINTPRI, sys.PMIC.WriteINTPRI)
+		mem.SetRW(inst.Base+2, sys.PMIC.ReadCTRL,
+			sys.PMIC.ProtectCTRL(sys.CCP))
+	}
+	clk := sys.XClock
+	if inst := d.Instance("CLK"); inst != nil {
+		mem.SetRW(inst.Base, clk.ReadCTRL,
+			protect(sys.Clock.Changes(clk.WriteCTRL)))
+		mem.SetRW(inst.Base+1, clk.ReadPSCTRL,
+			protect(sys.Clock.Changes(clk.WritePSCTRL)))
+		mem.SetRW(inst.Base+2, clk.ReadLOCK, protect(clk.WriteLOCK))
+		mem.SetRW(inst.Base+3, clk.ReadRTCCTRL, clk.WriteRTCCTRL)
+	}
+	if inst := d.Instance("OSC"); inst != nil {
+		mem.SetRW(inst.Base, clk.ReadOSCCTRL, clk.WriteOSCCTRL)
+		mem.SetRW(inst.Base+1, clk.ReadOSCSTATUS, clk.WriteOSCSTATUS)
+		mem.SetRW(inst.Base+2, clk.ReadXOSCCTRL, clk.WriteXOSCCTRL)
+		mem.SetRW(inst.Base+5, clk.ReadPLLCTRL, clk.WritePLLCTRL)
+	}
+	for _, inst := range d.InstancesOf("PORT") {
+		vec := d.Vector(inst.Name + "_INT0")
+		if vec < 0 {
+			continue
+		}
+		port := dev.NewXPort(sys.Intr, sys.PMIC, vec, vec+1)
+		mem.SetModule(inst.Base, dev.XPortSize, port.Read, port.Write)
+		sys.XPorts[inst.Name] = port
+		sys.Ports[inst.Name] = port.Port
+	}
+	// TCx0 has outputs on pins 0-3 of PORTx, and TCx1 on pins 4-5
+	for module, ch := range map[string]int{"TC0": 4, "TC1": 2} {
+		for _, inst := range d.InstancesOf(module) {
+			vec := d.Vector(inst.Name + "_OVF")
+			if vec < 0 {
+				continue
+			}
+			tc := dev.NewXTimer(sys.Timer, sys.Intr, sys.PMIC, vec, ch)
+			if port := sys.Ports["PORT"+inst.Name[2:3]]; port != nil {
+				tc.AttachOutputs(port, 4-ch)
+			}
+			mem.SetModule(inst.Base, dev.XTimerSize, tc.Read, tc.Write)
+			sys.XTimers[inst.Name] = tc
+		}
+	}
+}
+
+func (sys *System) LoadProgHex(data io.Reader) {
+	sys.Memory.LoadHex(data)
+}
+
+// xmegaVector returns the address of a PMIC vector, which is in the
+// boot section if IVSEL is set.
+func (sys *System) xmegaVector(vec int) int {
+	base := 0
+	if sys.PMIC.IVSEL() {
+		base = sys.Device.BootStart / 2
+	}
+	return base + 2*vec
+}
+
+// executed ends the current PMIC interrupt level after a RETI.
+func (sys *System) executed(pc int) {
+	if sys.Memory.ReadProgram(core.Addr(pc)) == opReti {
+		sys.PMIC.Reti()
+	}
+}
+
+// TraceRegister records the values written to the named I/O register
+// in vcd. Add the register's device first.
+func (sys *System) TraceRegister(vcd *dev.VCD, name string) error {
+	addr, ok := sys.Device.Addr(name)
+	if !ok || int(addr) >= sys.Device.PortCount {
+		return fmt.Errorf("atdf: no I/O register %s", name)
+	}
+	sys.Board.TraceRegister(vcd, name, addr)
+	return nil
+}
+
+// instance returns the registers of the named instance (or the only
+// instance of module, if name is ""), requiring the given ones.
+func (sys *System) instance(module, name string,
+	required ...string) (*Instance, map[string]core.Addr, error) {
+
+	var inst *Instance
+	if name == "" {
+		insts := sys.Device.InstancesOf(module)
+		if len(insts) == 1 {
+			inst = &insts[0]
+		}
+	} else {
+		inst = sys.Device.Instance(name)
+	}
+	if inst == nil || inst.Module != module {
+		return nil, nil, fmt.Errorf("atdf: no %s instance %q", module, name)
+	}
+	regs := sys.Device.instanceRegs(inst.Name)
+	for _, reg := range required {
+		if _, ok := regs[reg]; !ok {
+			return nil, nil, fmt.Errorf("atdf: %s has no %s", inst.Name, reg)
+		}
+	}
+	return inst, regs, nil
+}
+
+// vector returns the first of the named vectors that exists; each name
+// is tried alone and prefixed by the instance and module names.
+func (sys *System) vector(inst *Instance, names ...string) (int, error) {
+	for _, name := range names {
+		for _, prefix := range []string{"", inst.Name + "_", inst.Module + "_"} {
+			if vec := sys.Device.Vector(prefix + name); vec >= 0 {
+				return vec, nil
+			}
+		}
+	}
+	return -1, fmt.Errorf("atdf: no %s vector for %s", names[0], inst.Name)
+}
+
+// AddUSART wires in a mega-style USART, by instance name (USART0), or
+// the only one if name is "".
+func (sys *System) AddUSART(name string, read,
+	write chan byte) (*dev.USART, error) {
+
+	inst, regs, err := sys.instance("USART", name,
+		"UDR", "UCSRA", "UCSRB", "UCSRC", "UBRRL", "UBRRH")
+	if err != nil {
+		return nil, err
+	}
+	vec, err := sys.vector(inst, "RX", "RXC")
+	if err != nil {
+		return nil, err
+	}
+	usart := dev.NewUSART(read, write, sys.Timer, sys.Intr, vec)
+	usart.SharedUBRRH = regs["UBRRH"] == regs["UCSRC"]
+	mem := sys.Memory
+	mem.SetRW(regs["UDR"], usart.ReadUDR, usart.WriteUDR)
+	mem.SetRW(regs["UCSRA"], usart.ReadUCSRA, usart.WriteUCSRA)
+	mem.SetRW(regs["UCSRB"], usart.ReadUCSRB, usart.WriteUCSRB)
+	mem.SetRW(regs["UBRRL"], usart.ReadUBRRL, usart.WriteUBRRL)
+	if !usart.SharedUBRRH {
+		mem.SetRW(regs["UBRRH"], usart.ReadUBRRH, usart.WriteUBRRH)
+	}
+	mem.SetRW(regs["UCSRC"], usart.ReadUCSRC, usart.WriteUCSRC)
+	return usart, nil
+}
+
+// AddSPI wires in the SPI unit, with SS on the pad given by the
+// device's signals.
+func (sys *System) AddSPI() (*dev.SPI, error) {
+	inst, regs, err := sys.instance("SPI", "", "SPCR", "SPSR", "SPDR")
+	if err != nil {
+		return nil, err
+	}
+	vec, err := sys.vector(inst, "STC")
+	if err != nil {
+		return nil, err
+	}
+	pad := inst.Pad("SS")
+	if len(pad) != 3 || sys.Ports["PORT"+pad[1:2]] == nil {
+		return nil, fmt.Errorf("atdf: no SS pad for %s", inst.Name)
+	}
+	spi := dev.NewSPI(sys.Timer, sys.Intr, vec, sys.Ports["PORT"+pad[1:2]],
+		int(pad[2]-'0'))
+	sys.Memory.SetRW(regs["SPCR"], spi.ReadSPCR, spi.WriteSPCR)
+	sys.Memory.SetRW(regs["SPSR"], spi.ReadSPSR, spi.WriteSPSR)
+	sys.Memory.SetRW(regs["SPDR"], spi.ReadSPDR, spi.WriteSPDR)
+	return spi, nil
+}
+
+func (sys *System) AddTWI(bus *dev.I2CBus) (*dev.TWI, error) {
+	inst, regs, err := sys.instance("TWI", "",
+		"TWBR", "TWSR", "TWAR", "TWDR", "TWCR")
+	if err != nil {
+		return nil, err
+	}
+	vec, err := sys.vector(inst, inst.Name, inst.Module)
+	if err != nil {
+		return nil, err
+	}
+	twi := dev.NewTWI(sys.Timer, sys.Intr, vec, bus)
+	mem := sys.Memory
+	mem.SetRW(regs["TWBR"], twi.ReadTWBR, twi.WriteTWBR)
+	mem.SetRW(regs["TWSR"], twi.ReadTWSR, twi.WriteTWSR)
+	mem.SetRW(regs["TWAR"], twi.ReadTWAR, twi.WriteTWAR)
+	mem.SetRW(regs["TWDR"], twi.ReadTWDR, twi.WriteTWDR)
+	mem.SetRW(regs["TWCR"], twi.ReadTWCR, twi.WriteTWCR)
+	return twi, nil
+}
+
+// AddEEPROM wires in the EEPROM, with the programming modes enabled if
+// EECR has EEPM bits.
+func (sys *System) AddEEPROM() (*dev.EEPROM, error) {
+	inst, regs, err := sys.instance("EEPROM", "", "EEDR", "EECR")
+	if err != nil {
+		return nil, err
+	}
+	eearl, ok := regs["EEARL"]
+	if !ok {
+		if eearl, ok = regs["EEAR"]; !ok {
+			return nil, fmt.Errorf("atdf: %s has no EEARL or EEAR",
+				inst.Name)
+		}
+	}
+	vec, err := sys.vector(inst, "EE_READY", "EE_RDY", "READY")
+	if err != nil {
+		return nil, err
+	}
+	ee := dev.NewEEPROM(sys.Device.EepromBytes, sys.Timer, sys.Intr, vec,
+		sys.Clock)
+	mem := sys.Memory
+	if reg := sys.Device.Register("EECR"); reg != nil {
+		for _, bf := range reg.Bits {
+			if bf.Name == "EEPM" {
+				ee.EnableModes(3400, 1800)
+			}
+		}
+	}
+	mem.SetRW(eearl, ee.ReadEEARL, ee.WriteEEARL)
+	if eearh, ok := regs["EEARH"]; ok {
+		mem.SetRW(eearh, ee.ReadEEARH, ee.WriteEEARH)
+	}
+	mem.SetRW(regs["EEDR"], ee.ReadEEDR, ee.WriteEEDR)
+	mem.SetRW(regs["EECR"], ee.ReadEECR, ee.WriteEECR)
+	return ee, nil
+}
@@ -0,0 +1,229 @@
+package atmega2560
+
+import "github.com/edmccard/avr-sim/core"
+
+// Data-space addresses of the I/O registers.
+const (
+	PINA   core.Addr = 0x20
+	DDRA   core.Addr = 0x21
+	PORTA  core.Addr = 0x22
+	PINB   core.Addr = 0x23
+	DDRB   core.Addr = 0x24
+	PORTB  core.Addr = 0x25
+	PINC   core.Addr = 0x26
+	DDRC   core.Addr = 0x27
+	PORTC  core.Addr = 0x28
+	PIND   core.Addr = 0x29
+	DDRD   core.Addr = 0x2a
+	PORTD  core.Addr = 0x2b
+	PINE   core.Addr = 0x2c
+	DDRE   core.Addr = 0x2d
+	PORTE  core.Addr = 0x2e
+	PINF   core.Addr = 0x2f
+	DDRF   core.Addr = 0x30
+	PORTF  core.Addr = 0x31
+	PING   core.Addr = 0x32
+	DDRG   core.Addr = 0x33
+	PORTG  core.Addr = 0x34
+	TIFR0  core.Addr = 0x35
+	TIFR1  core.Addr = 0x36
+	TIFR2  core.Addr = 0x37
+	TIFR3  core.Addr = 0x38
+	TIFR4  core.Addr = 0x39
+	TIFR5  core.Addr = 0x3a
+	PCIFR  core.Addr = 0x3b
+	EIFR   core.Addr = 0x3c
+	EIMSK  core.Addr = 0x3d
+	GPIOR0 core.Addr = 0x3e
+	EECR   core.Addr = 0x3f
+	EEDR   core.Addr = 0x40
+	EEARL  core.Addr = 0x41
+	EEARH  core.Addr = 0x42
+	GTCCR  core.Addr = 0x43
+	TCCR0A core.Addr = 0x44
+	TCCR0B core.Addr = 0x45
+	TCNT0  core.Addr = 0x46
+	OCR0A  core.Addr = 0x47
+	OCR0B  core.Addr = 0x48
+	GPIOR1 core.Addr = 0x4a
+	GPIOR2 core.Addr = 0x4b
+	SPCR   core.Addr = 0x4c
+	SPSR   core.Addr = 0x4d
+	SPDR   core.Addr = 0x4e
+	ACSR   core.Addr = 0x50
+	OCDR   core.Addr = 0x51
+	SMCR   core.Addr = 0x53
+	MCUSR  core.Addr = 0x54
+	MCUCR  core.Addr = 0x55
+	SPMCSR core.Addr = 0x57
+	RAMPZ  core.Addr = 0x5b
+	EIND   core.Addr = 0x5c
+	SPL    core.Addr = 0x5d
+	SPH    core.Addr = 0x5e
+	SREG   core.Addr = 0x5f
+	WDTCSR core.Addr = 0x60
+	CLKPR  core.Addr = 0x61
+	PRR0   core.Addr = 0x64
+	PRR1   core.Addr = 0x65
+	OSCCAL core.Addr = 0x66
+	PCICR  core.Addr = 0x68
+	EICRA  core.Addr = 0x69
+	EICRB  core.Addr = 0x6a
+	PCMSK0 core.Addr = 0x6b
+	PCMSK1 core.Addr = 0x6c
+	PCMSK2 core.Addr = 0x6d
+	TIMSK0 core.Addr = 0x6e
+	TIMSK1 core.Addr = 0x6f
+	TIMSK2 core.Addr = 0x70
+	TIMSK3 core.Addr = 0x71
+	TIMSK4 core.Addr = 0x72
+	TIMSK5 core.Addr = 0x73
+	XMCRA  core.Addr = 0x74
+	XMCRB  core.Addr = 0x75
+	ADCL   core.Addr = 0x78
+	ADCH   core.Addr = 0x79
+	ADCSRA core.Addr = 0x7a
+	ADCSRB core.Addr = 0x7b
+	ADMUX  core.Addr = 0x7c
+	DIDR2  core.Addr = 0x7d
+	DIDR0  core.Addr = 0x7e
+	DIDR1  core.Addr = 0x7f
+	TCCR1A core.Addr = 0x80
+	TCCR1B core.Addr = 0x81
+	TCCR1C core.Addr = 0x82
+	TCNT1L core.Addr = 0x84
+	TCNT1H core.Addr = 0x85
+	ICR1L  core.Addr = 0x86
+	ICR1H  core.Addr = 0x87
+	OCR1AL core.Addr = 0x88
+	OCR1AH core.Addr = 0x89
+	OCR1BL core.Addr = 0x8a
+	OCR1BH core.Addr = 0x8b
+	OCR1CL core.Addr = 0x8c
+	OCR1CH core.Addr = 0x8d
+	TCCR3A core.Addr = 0x90
+	TCCR3B core.Addr = 0x91
+	TCCR3C core.Addr = 0x92
+	TCNT3L core.Addr = 0x94
+	TCNT3H core.Addr = 0x95
+	TCCR4A core.Addr = 0xa0
+	TCCR4B core.Addr = 0xa1
+	TCCR4C core.Addr = 0xa2
+	TCNT4L core.Addr = 0xa4
+	TCNT4H core.Addr = 0xa5
+	TCCR2A core.Addr = 0xb0
+	TCCR2B core.Addr = 0xb1
+	TCNT2  core.Addr = 0xb2
+	OCR2A  core.Addr = 0xb3
+	OCR2B  core.Addr = 0xb4
+	ASSR   core.Addr = 0xb6
+	TWBR   core.Addr = 0xb8
+	TWSR   core.Addr = 0xb9
+	TWAR   core.Addr = 0xba
+	TWDR   core.Addr = 0xbb
+	TWCR   core.Addr = 0xbc
+	TWAMR  core.Addr = 0xbd
+	UCSR0A core.Addr = 0xc0
+	UCSR0B core.Addr = 0xc1
+	UCSR0C core.Addr = 0xc2
+	UBRR0L core.Addr = 0xc4
+	UBRR0H core.Addr = 0xc5
+	UDR0   core.Addr = 0xc6
+	UCSR1A core.Addr = 0xc8
+	UCSR1B core.Addr = 0xc9
+	UCSR1C core.Addr = 0xca
+	UBRR1L core.Addr = 0xcc
+	UBRR1H core.Addr = 0xcd
+	UDR1   core.Addr = 0xce
+	UCSR2A core.Addr = 0xd0
+	UCSR2B core.Addr = 0xd1
+	UCSR2C core.Addr = 0xd2
+	UBRR2L core.Addr = 0xd4
+	UBRR2H core.Addr = 0xd5
+	UDR2   core.Addr = 0xd6
+	PINH   core.Addr = 0x100
+	DDRH   core.Addr = 0x101
+	PORTH  core.Addr = 0x102
+	PINJ   core.Addr = 0x103
+	DDRJ   core.Addr = 0x104
+	PORTJ  core.Addr = 0x105
+	PINK   core.Addr = 0x106
+	DDRK   core.Addr = 0x107
+	PORTK  core.Addr = 0x108
+	PINL   core.Addr = 0x109
+	DDRL   core.Addr = 0x10a
+	PORTL  core.Addr = 0x10b
+	TCCR5A core.Addr = 0x120
+	TCCR5B core.Addr = 0x121
+	TCCR5C core.Addr = 0x122
+	TCNT5L core.Addr = 0x124
+	TCNT5H core.Addr = 0x125
+	UCSR3A core.Addr = 0x130
+	UCSR3B core.Addr = 0x131
+	UCSR3C core.Addr = 0x132
+	UBRR3L core.Addr = 0x134
+	UBRR3H core.Addr = 0x135
+	UDR3   core.Addr = 0x136
+)
+
+// Interrupt vector numbers; each vector is two words long.
+const (
+	VecReset = iota
+	VecInt0
+	VecInt1
+	VecInt2
+	VecInt3
+	VecInt4
+	VecInt5
+	VecInt6
+	VecInt7
+	VecPCInt0
+	VecPCInt1
+	VecPCInt2
+	VecWDT
+	VecTimer2CompA
+	VecTimer2CompB
+	VecTimer2Ovf
+	VecTimer1Capt
+	VecTimer1CompA
+	VecTimer1CompB
+	VecTimer1CompC
+	VecTimer1Ovf
+	VecTimer0CompA
+	VecTimer0CompB
+	VecTimer0Ovf
+	VecSPI
+	VecUSART0RX
+	VecUSART0UDRE
+	VecUSART0TX
+	VecAnaComp
+	VecADC
+	VecEERdy
+	VecTimer3Capt
+	VecTimer3CompA
+	VecTimer3CompB
+	VecTimer3CompC
+	VecTimer3Ovf
+	VecUSART1RX
+	VecUSART1UDRE
+	VecUSART1TX
+	VecTWI
+	VecSPMRdy
+	VecTimer4Capt
+	VecTimer4CompA
+	VecTimer4CompB
+	VecTimer4CompC
+	VecTimer4Ovf
+	VecTimer5Capt
+	VecTimer5CompA
+	VecTimer5CompB
+	VecTimer5CompC
+	VecTimer5Ovf
+	VecUSART2RX
+	VecUSART2UDRE
+	VecUSART2TX
+	VecUSART3RX
+	VecUSART3UDRE
+	VecUSART3TX
+	VecCount
+)
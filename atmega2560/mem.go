@@ -0,0 +1,103 @@
+package atmega2560
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	FlashWords  = 0x20000
+	SramEnd     = 0x2200
+	PortCount   = 0x200
+	EepromBytes = 0x1000
+	XmemBytes   = 0x10000
+)
+
+const (
+	xmcraSRE = 0x80
+	xmcrbXMM = 0x07
+)
+
+// Data space above SramEnd is only accessible through the external
+// memory interface. Wait states (SRW) are not modelled.
+type Mem struct {
+	*core.MemMap
+	xmem  []byte
+	xmcra byte
+	xmcrb byte
+}
+
+// The reserved I/O addresses, as first-last ranges
+var reserved = [][2]core.Addr{
+	{0x49, 0x49}, {0x4f, 0x4f}, {0x52, 0x52}, {0x56, 0x56},
+	{0x58, 0x5a}, {0x62, 0x63}, {0x67, 0x67}, {0x76, 0x77},
+	{0x83, 0x83}, {0x8e, 0x8f}, {0x93, 0x93}, {0x9e, 0x9f},
+	{0xa3, 0xa3}, {0xae, 0xaf}, {0xb5, 0xb5}, {0xb7, 0xb7},
+	{0xbe, 0xbf}, {0xc3, 0xc3}, {0xc7, 0xc7}, {0xcb, 0xcb},
+	{0xcf, 0xcf}, {0xd3, 0xd3}, {0xd7, 0xff}, {0x10c, 0x11f},
+	{0x123, 0x123}, {0x12e, 0x12f}, {0x133, 0x133}, {0x137, 0x1ff},
+}
+
+func NewMem(cpu *core.Cpu) *Mem {
+	mem := &Mem{MemMap: core.NewMemMap(FlashWords)}
+	mem.Unmapped = core.Wrap
+	mem.Size = 0x10000
+	mem.AddRegisterFile(cpu)
+	mem.AddIO(0x20, 0x40)
+	mem.AddIO(0x60, PortCount-0x60)
+	mem.AddSRAM(PortCount, SramEnd-PortCount)
+	mem.AddRegion(SramEnd, 0x10000-SramEnd, mem.readXmem, mem.writeXmem)
+
+	for _, r := range reserved {
+		mem.ReserveRange(r[0], r[1])
+	}
+	mem.SetRW(RAMPZ, cpu.MemReadRampZ, cpu.MemWriteRampZ)
+	mem.SetRW(EIND, cpu.MemReadEind, cpu.MemWriteEind)
+	mem.SetRW(SPL, cpu.MemReadSPL, cpu.MemWriteSPL)
+	mem.SetRW(SPH, cpu.MemReadSPH, cpu.MemWriteSPH)
+	mem.SetRW(SREG, cpu.MemReadSreg, cpu.MemWriteSreg)
+	mem.SetRW(XMCRA, func(addr core.Addr) byte { return mem.xmcra },
+		func(addr core.Addr, val byte) { mem.xmcra = val })
+	mem.SetRW(XMCRB, func(addr core.Addr) byte { return mem.xmcrb },
+		func(addr core.Addr, val byte) {
+			mem.xmcrb = val & (0x80 | xmcrbXMM)
+		})
+
+	return mem
+}
+
+func ignoreWrite(addr core.Addr, val byte) {
+}
+
+// AttachXmem connects external SRAM (initially zero) to the external
+// memory interface, and returns it. It is accessible while SRE in XMCRA
+// is set; XMM in XMCRB masks the high address bits.
+func (mem *Mem) AttachXmem() []byte {
+	mem.xmem = make([]byte, XmemBytes)
+	return mem.xmem
+}
+
+// External address masks by XMM2:0, which releases PC7 down to PC1,
+// and with 7 all of port C.
+var xmmMasks = [8]int{0xffff, 0x7fff, 0x3fff, 0x1fff, 0x0fff, 0x07ff,
+	0x03ff, 0x00ff}
+
+// xaddr returns the external memory address for addr, or -1.
+func (mem *Mem) xaddr(addr core.Addr) int {
+	if mem.xmem == nil || (mem.xmcra&xmcraSRE) == 0 {
+		return -1
+	}
+	return int(addr) & xmmMasks[mem.xmcrb&xmcrbXMM]
+}
+
+func (mem *Mem) readXmem(addr core.Addr) byte {
+	if x := mem.xaddr(addr); x >= 0 {
+		return mem.xmem[x]
+	}
+	return 0xff
+}
+
+func (mem *Mem) writeXmem(addr core.Addr, val byte) {
+	if x := mem.xaddr(addr); x >= 0 {
+		mem.xmem[x] = val
+	}
+}
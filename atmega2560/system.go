@@ -0,0 +1,192 @@
+package atmega2560
+
+import (
+	"io"
+
+	"github.com/edmccard/avr-sim/board"
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/dev"
+	"github.com/edmccard/avr-sim/instr"
+)
+
+type System struct {
+	*board.Board
+	Memory *Mem
+	Intr   *core.Interrupts
+	PortA  *dev.Port
+	PortB  *dev.Port
+	PortC  *dev.Port
+	PortD  *dev.Port
+	PortE  *dev.Port
+	PortF  *dev.Port
+	PortG  *dev.Port
+	PortH  *dev.Port
+	PortJ  *dev.Port
+	PortK  *dev.Port
+	PortL  *dev.Port
+	// Osc is the internal RC oscillator; Clock starts from it divided
+	// by 8, the factory setting of CKDIV8.
+	Osc  *dev.RCOscillator
+	adc  *dev.ADC
+	comp *dev.Comparator
+}
+
+func NewSystem() *System {
+	set := instr.NewSetEnhanced4m()
+	set[instr.Break] = true
+	decoder := instr.NewDecoder(set)
+	// RAMPZ selects the upper 64K words of flash for ELPM/SPM; EIND
+	// selects the upper 128K words for EIJMP/EICALL.
+	cpu := core.NewCpu(core.Mega, 0, 0, 0, 0x03, 0x01)
+	cpu.SetProgramRampZ(true)
+	mem := NewMem(cpu)
+	intr := core.NewInterrupts(VecCount)
+	sys := &System{
+		Board: board.New(cpu, &decoder, mem, core.NewTimer(), intr,
+			func(vec int) int { return 2 * vec }),
+		Memory: mem,
+		Intr:   intr,
+		PortA:  dev.NewPort(),
+		PortB:  dev.NewPort(),
+		PortC:  dev.NewPort(),
+		PortD:  dev.NewPort(),
+		PortE:  dev.NewPort(),
+		PortF:  dev.NewPort(),
+		PortG:  dev.NewPort(),
+		PortH:  dev.NewPort(),
+		PortJ:  dev.NewPort(),
+		PortK:  dev.NewPort(),
+		PortL:  dev.NewPort(),
+	}
+	cpu.Reset(SramEnd-1, 0)
+	board.MapPort(mem, sys.PortA, PINA, DDRA, PORTA)
+	board.MapPort(mem, sys.PortB, PINB, DDRB, PORTB)
+	board.MapPort(mem, sys.PortC, PINC, DDRC, PORTC)
+	board.MapPort(mem, sys.PortD, PIND, DDRD, PORTD)
+	board.MapPort(mem, sys.PortE, PINE, DDRE, PORTE)
+	board.MapPort(mem, sys.PortF, PINF, DDRF, PORTF)
+	board.MapPort(mem, sys.PortG, PING, DDRG, PORTG)
+	board.MapPort(mem, sys.PortH, PINH, DDRH, PORTH)
+	board.MapPort(mem, sys.PortJ, PINJ, DDRJ, PORTJ)
+	board.MapPort(mem, sys.PortK, PINK, DDRK, PORTK)
+	board.MapPort(mem, sys.PortL, PINL, DDRL, PORTL)
+	mem.SetRW(ADCSRB, sys.readADCSRB, sys.writeADCSRB)
+	sys.Osc = dev.NewRCOscillator(8000000, 0x80)
+	sys.AddOsc(sys.Osc, OSCCAL)
+	sys.Clock.Reset(3)
+	mem.SetRW(CLKPR, sys.Clock.ReadCLKPR, sys.Clock.WriteCLKPR)
+	return sys
+}
+
+func (sys *System) LoadProgHex(data io.Reader) {
+	sys.Memory.LoadHex(data)
+}
+
+// AddXmem attaches 64K of external SRAM, and returns it.
+func (sys *System) AddXmem() []byte {
+	return sys.Memory.AttachXmem()
+}
+
+func (sys *System) AddADC(input dev.AnalogInput) *dev.ADC {
+	adc := dev.NewADC(sys.Timer, sys.Intr, VecADC, input)
+	adc.EnableMux5()
+	adc.InternalRef = 2.56
+	adc.AltInternalRef = 1.1
+	adc.Bandgap = 1.1
+	sys.Memory.SetRW(ADMUX, adc.ReadADMUX, adc.WriteADMUX)
+	sys.Memory.SetRW(ADCSRA, adc.ReadADCSRA, adc.WriteADCSRA)
+	sys.Memory.SetRW(ADCH, adc.ReadADCH, ignoreWrite)
+	sys.Memory.SetRW(ADCL, adc.ReadADCL, ignoreWrite)
+	sys.adc = adc
+	return adc
+}
+
+// AddComparator wires in the analog comparator, which samples its
+// inputs every sampleCycles cycles; adc may be nil if the ADC
+// multiplexer is not used.
+func (sys *System) AddComparator(input dev.AnalogInput, adc *dev.ADC,
+	sampleCycles int64) *dev.Comparator {
+
+	comp := dev.NewComparator(sys.Timer, sys.Intr, VecAnaComp, input, adc,
+		sampleCycles)
+	comp.Bandgap = 1.1
+	sys.Memory.SetRW(ACSR, comp.ReadACSR, comp.WriteACSR)
+	sys.comp = comp
+	return comp
+}
+
+// ADCSRB holds the ADC trigger source and MUX5, and the comparator's
+// ACME bit.
+func (sys *System) readADCSRB(addr core.Addr) byte {
+	var val byte
+	if sys.adc != nil {
+		val |= sys.adc.ReadADCSRB(addr)
+	}
+	if sys.comp != nil {
+		val |= sys.comp.ReadADCSRB(addr)
+	}
+	return val
+}
+
+func (sys *System) writeADCSRB(addr core.Addr, val byte) {
+	if sys.adc != nil {
+		sys.adc.WriteADCSRB(addr, val)
+	}
+	if sys.comp != nil {
+		sys.comp.WriteADCSRB(addr, val)
+	}
+}
+
+// AddSPI wires in the SPI unit, with SS on PB0.
+func (sys *System) AddSPI() *dev.SPI {
+	spi := dev.NewSPI(sys.Timer, sys.Intr, VecSPI, sys.PortB, 0)
+	sys.Memory.SetRW(SPCR, spi.ReadSPCR, spi.WriteSPCR)
+	sys.Memory.SetRW(SPSR, spi.ReadSPSR, spi.WriteSPSR)
+	sys.Memory.SetRW(SPDR, spi.ReadSPDR, spi.WriteSPDR)
+	return spi
+}
+
+func (sys *System) AddTWI(bus *dev.I2CBus) *dev.TWI {
+	twi := dev.NewTWI(sys.Timer, sys.Intr, VecTWI, bus)
+	sys.Memory.SetRW(TWBR, twi.ReadTWBR, twi.WriteTWBR)
+	sys.Memory.SetRW(TWSR, twi.ReadTWSR, twi.WriteTWSR)
+	sys.Memory.SetRW(TWAR, twi.ReadTWAR, twi.WriteTWAR)
+	sys.Memory.SetRW(TWDR, twi.ReadTWDR, twi.WriteTWDR)
+	sys.Memory.SetRW(TWCR, twi.ReadTWCR, twi.WriteTWCR)
+	return twi
+}
+
+var usarts = [4]struct {
+	ucsra core.Addr
+	vec   int
+}{
+	{UCSR0A, VecUSART0RX},
+	{UCSR1A, VecUSART1RX},
+	{UCSR2A, VecUSART2RX},
+	{UCSR3A, VecUSART3RX},
+}
+
+// AddUSART wires in USARTn (0-3).
+func (sys *System) AddUSART(n int, read, write chan byte) *dev.USART {
+	base, vec := usarts[n].ucsra, usarts[n].vec
+	usart := dev.NewUSART(read, write, sys.Timer, sys.Intr, vec)
+	usart.SharedUBRRH = false
+	sys.Memory.SetRW(base+6, usart.ReadUDR, usart.WriteUDR)
+	sys.Memory.SetRW(base, usart.ReadUCSRA, usart.WriteUCSRA)
+	sys.Memory.SetRW(base+1, usart.ReadUCSRB, usart.WriteUCSRB)
+	sys.Memory.SetRW(base+2, usart.ReadUCSRC, usart.WriteUCSRC)
+	sys.Memory.SetRW(base+4, usart.ReadUBRRL, usart.WriteUBRRL)
+	sys.Memory.SetRW(base+5, usart.ReadUBRRH, usart.WriteUBRRH)
+	return usart
+}
+
+func (sys *System) AddEEPROM() *dev.EEPROM {
+	ee := dev.NewEEPROM(EepromBytes, sys.Timer, sys.Intr, VecEERdy,
+		sys.Clock)
+	ee.EnableModes(3400, 1800)
+	sys.Memory.SetRW(EEARH, ee.ReadEEARH, ee.WriteEEARH)
+	sys.Memory.SetRW(EEARL, ee.ReadEEARL, ee.WriteEEARL)
+	sys.Memory.SetRW(EEDR, ee.ReadEEDR, ee.WriteEEDR)
+	sys.Memory.SetRW(EECR, ee.ReadEECR, ee.WriteEECR)
+	return ee
+}
@@ -0,0 +1,96 @@
+package atmega2560
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func load(sys *System, at int, ops ...uint16) {
+	for i, op := range ops {
+		sys.Memory.WriteProgram(core.Addr(at+i), op)
+	}
+}
+
+func TestSystemInterrupt(t *testing.T) {
+	sys := NewSystem()
+	read := make(chan byte, 1)
+	sys.AddUSART(1, read, make(chan byte, 1))
+	load(sys, 0,
+		0xef0f,         // ldi r16, 0xff
+		0xb904,         // out DDRB, r16
+		0xe908,         // ldi r16, 0x98
+		0x9300, 0x00c9, // sts UCSR1B, r16
+		0x9478, // sei
+		0xcfff, // rjmp .-1
+	)
+	load(sys, 2*VecUSART1RX,
+		0x9100, 0x00ce, // lds r16, UDR1
+		0xb905, // out PORTB, r16
+		0x9518, // reti
+	)
+	entered := false
+	sys.OnStep(func() {
+		if sys.Cpu.GetPC() == 2*VecUSART1RX {
+			entered = true
+		}
+	})
+	read <- 'A'
+	sys.Run(20000)
+	if !entered {
+		t.Error("Vector not taken")
+	}
+	if sys.PortB.Levels() != 'A' || sys.Cpu.GetSP() != SramEnd-1 ||
+		sys.Cpu.GetPC() != 6 {
+		t.Error("Bad interrupt", sys.PortB.Levels(), sys.Cpu.GetSP(),
+			sys.Cpu.GetPC())
+	}
+}
+
+func TestSystemEindXmem(t *testing.T) {
+	sys := NewSystem()
+	xmem := sys.AddXmem()
+	load(sys, 0,
+		0xe001,         // ldi r16, 0x01
+		0xbf0c,         // out EIND, r16
+		0xe1e0,         // ldi r30, 0x10
+		0xe0f0,         // ldi r31, 0x00
+		0x9519,         // eicall
+		0xe505,         // ldi r16, 0x55
+		0x9300, 0x3000, // sts 0x3000, r16
+		0x9130, 0x3000, // lds r19, 0x3000
+		0xe800,         // ldi r16, 0x80
+		0x9300, 0x0074, // sts XMCRA, r16
+		0xe606,         // ldi r16, 0x66
+		0x9300, 0x3000, // sts 0x3000, r16
+		0x9110, 0x3000, // lds r17, 0x3000
+		0xe001,         // ldi r16, 0x01
+		0x9300, 0x0075, // sts XMCRB, r16
+		0x9120, 0xb000, // lds r18, 0xb000
+		0xe007,         // ldi r16, 0x07
+		0x9300, 0x0075, // sts XMCRB, r16
+		0x9150, 0x3344, // lds r21, 0x3344
+		0xcfff, // rjmp .-1
+	)
+	xmem[0x44] = 0x77
+	load(sys, 0x10010,
+		0x9543, // inc r20
+		0x9508, // ret
+	)
+	sys.Run(200)
+	if sys.Cpu.GetReg(20) != 1 || sys.Cpu.GetSP() != SramEnd-1 {
+		t.Error("EICALL not taken", sys.Cpu.GetReg(20), sys.Cpu.GetSP())
+	}
+	if sys.Cpu.GetReg(19) != 0xff {
+		t.Error("Xmem enabled without SRE", sys.Cpu.GetReg(19))
+	}
+	if sys.Cpu.GetReg(17) != 0x66 || xmem[0x3000] != 0x66 {
+		t.Error("Xmem not mapped", sys.Cpu.GetReg(17), xmem[0x3000])
+	}
+	if sys.Cpu.GetReg(18) != 0x66 {
+		t.Error("XMM not masked", sys.Cpu.GetReg(18))
+	}
+	if sys.Cpu.GetReg(21) != 0x77 {
+		t.Error("Port C not released by XMM=7", sys.Cpu.GetReg(21))
+	}
+}
@@ -0,0 +1,125 @@
+package atmega328p
+
+import "github.com/edmccard/avr-sim/core"
+
+// Data-space addresses of the I/O registers.
+const (
+	PINB   core.Addr = 0x23
+	DDRB   core.Addr = 0x24
+	PORTB  core.Addr = 0x25
+	PINC   core.Addr = 0x26
+	DDRC   core.Addr = 0x27
+	PORTC  core.Addr = 0x28
+	PIND   core.Addr = 0x29
+	DDRD   core.Addr = 0x2a
+	PORTD  core.Addr = 0x2b
+	TIFR0  core.Addr = 0x35
+	TIFR1  core.Addr = 0x36
+	TIFR2  core.Addr = 0x37
+	PCIFR  core.Addr = 0x3b
+	EIFR   core.Addr = 0x3c
+	EIMSK  core.Addr = 0x3d
+	GPIOR0 core.Addr = 0x3e
+	EECR   core.Addr = 0x3f
+	EEDR   core.Addr = 0x40
+	EEARL  core.Addr = 0x41
+	EEARH  core.Addr = 0x42
+	GTCCR  core.Addr = 0x43
+	TCCR0A core.Addr = 0x44
+	TCCR0B core.Addr = 0x45
+	TCNT0  core.Addr = 0x46
+	OCR0A  core.Addr = 0x47
+	OCR0B  core.Addr = 0x48
+	GPIOR1 core.Addr = 0x4a
+	GPIOR2 core.Addr = 0x4b
+	SPCR   core.Addr = 0x4c
+	SPSR   core.Addr = 0x4d
+	SPDR   core.Addr = 0x4e
+	ACSR   core.Addr = 0x50
+	SMCR   core.Addr = 0x53
+	MCUSR  core.Addr = 0x54
+	MCUCR  core.Addr = 0x55
+	SPMCSR core.Addr = 0x57
+	SPL    core.Addr = 0x5d
+	SPH    core.Addr = 0x5e
+	SREG   core.Addr = 0x5f
+	WDTCSR core.Addr = 0x60
+	CLKPR  core.Addr = 0x61
+	PRR    core.Addr = 0x64
+	OSCCAL core.Addr = 0x66
+	PCICR  core.Addr = 0x68
+	EICRA  core.Addr = 0x69
+	PCMSK0 core.Addr = 0x6b
+	PCMSK1 core.Addr = 0x6c
+	PCMSK2 core.Addr = 0x6d
+	TIMSK0 core.Addr = 0x6e
+	TIMSK1 core.Addr = 0x6f
+	TIMSK2 core.Addr = 0x70
+	ADCL   core.Addr = 0x78
+	ADCH   core.Addr = 0x79
+	ADCSRA core.Addr = 0x7a
+	ADCSRB core.Addr = 0x7b
+	ADMUX  core.Addr = 0x7c
+	DIDR0  core.Addr = 0x7e
+	DIDR1  core.Addr = 0x7f
+	TCCR1A core.Addr = 0x80
+	TCCR1B core.Addr = 0x81
+	TCCR1C core.Addr = 0x82
+	TCNT1L core.Addr = 0x84
+	TCNT1H core.Addr = 0x85
+	ICR1L  core.Addr = 0x86
+	ICR1H  core.Addr = 0x87
+	OCR1AL core.Addr = 0x88
+	OCR1AH core.Addr = 0x89
+	OCR1BL core.Addr = 0x8a
+	OCR1BH core.Addr = 0x8b
+	TCCR2A core.Addr = 0xb0
+	TCCR2B core.Addr = 0xb1
+	TCNT2  core.Addr = 0xb2
+	OCR2A  core.Addr = 0xb3
+	OCR2B  core.Addr = 0xb4
+	ASSR   core.Addr = 0xb6
+	TWBR   core.Addr = 0xb8
+	TWSR   core.Addr = 0xb9
+	TWAR   core.Addr = 0xba
+	TWDR   core.Addr = 0xbb
+	TWCR   core.Addr = 0xbc
+	TWAMR  core.Addr = 0xbd
+	UCSR0A core.Addr = 0xc0
+	UCSR0B core.Addr = 0xc1
+	UCSR0C core.Addr = 0xc2
+	UBRR0L core.Addr = 0xc4
+	UBRR0H core.Addr = 0xc5
+	UDR0   core.Addr = 0xc6
+)
+
+// Interrupt vector numbers; each vector is two words long.
+const (
+	VecReset = iota
+	VecInt0
+	VecInt1
+	VecPCInt0
+	VecPCInt1
+	VecPCInt2
+	VecWDT
+	VecTimer2CompA
+	VecTimer2CompB
+	VecTimer2Ovf
+	VecTimer1Capt
+	VecTimer1CompA
+	VecTimer1CompB
+	VecTimer1Ovf
+	VecTimer0CompA
+	VecTimer0CompB
+	VecTimer0Ovf
+	VecSPI
+	VecUSARTRX
+	VecUSARTUDRE
+	VecUSARTTX
+	VecADC
+	VecEERdy
+	VecAnaComp
+	VecTWI
+	VecSPMRdy
+	VecCount
+)
@@ -0,0 +1,51 @@
+package atmega328p
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	FlashWords  = 0x4000
+	SramBytes   = 0x900
+	PortCount   = 0x100
+	EepromBytes = 0x400
+)
+
+// The data space is the register file, 64 standard and 160 extended
+// I/O registers and 2K of SRAM; addresses wrap at the end of SRAM,
+// unless access checking is enabled.
+type Mem struct {
+	*core.MemMap
+}
+
+// The reserved I/O addresses, as first-last ranges
+var reserved = [][2]core.Addr{
+	{0x20, 0x22}, {0x2c, 0x34}, {0x38, 0x3a}, {0x49, 0x49},
+	{0x4f, 0x4f}, {0x51, 0x52}, {0x56, 0x56}, {0x58, 0x5c},
+	{0x62, 0x63}, {0x65, 0x65}, {0x67, 0x67}, {0x6a, 0x6a},
+	{0x71, 0x77}, {0x7d, 0x7d}, {0x83, 0x83}, {0x8c, 0xaf},
+	{0xb5, 0xb5}, {0xb7, 0xb7}, {0xbe, 0xbf}, {0xc3, 0xc3},
+	{0xc7, 0xff},
+}
+
+func NewMem(cpu *core.Cpu) *Mem {
+	mem := &Mem{core.NewMemMap(FlashWords)}
+	mem.Unmapped = core.Wrap
+	mem.Size = SramBytes
+	mem.AddRegisterFile(cpu)
+	mem.AddIO(0x20, 0x40)
+	mem.AddIO(0x60, PortCount-0x60)
+	mem.AddSRAM(PortCount, SramBytes-PortCount)
+
+	for _, r := range reserved {
+		mem.ReserveRange(r[0], r[1])
+	}
+	mem.SetRW(0x5d, cpu.MemReadSPL, cpu.MemWriteSPL)
+	mem.SetRW(0x5e, cpu.MemReadSPH, cpu.MemWriteSPH)
+	mem.SetRW(0x5f, cpu.MemReadSreg, cpu.MemWriteSreg)
+
+	return mem
+}
+
+func ignoreWrite(addr core.Addr, val byte) {
+}
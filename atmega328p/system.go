@@ -0,0 +1,146 @@
+package atmega328p
+
+import (
+	"io"
+
+	"github.com/edmccard/avr-sim/board"
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/dev"
+	"github.com/edmccard/avr-sim/instr"
+)
+
+type System struct {
+	*board.Board
+	Memory *Mem
+	Intr   *core.Interrupts
+	PortB  *dev.Port
+	PortC  *dev.Port
+	PortD  *dev.Port
+	// Osc is the internal RC oscillator; Clock starts from it divided
+	// by 8, the factory setting of CKDIV8.
+	Osc  *dev.RCOscillator
+	adc  *dev.ADC
+	comp *dev.Comparator
+}
+
+func NewSystem() *System {
+	set := instr.NewSetEnhanced8k()
+	set[instr.Break] = true
+	decoder := instr.NewDecoder(set)
+	cpu := core.NewCpu(core.Mega, 0, 0, 0, 0, 0)
+	mem := NewMem(cpu)
+	intr := core.NewInterrupts(VecCount)
+	sys := &System{
+		Board: board.New(cpu, &decoder, mem, core.NewTimer(), intr,
+			func(vec int) int { return 2 * vec }),
+		Memory: mem,
+		Intr:   intr,
+		PortB:  dev.NewPort(),
+		PortC:  dev.NewPort(),
+		PortD:  dev.NewPort(),
+	}
+	cpu.Reset(SramBytes-1, 0)
+	board.MapPort(mem, sys.PortB, PINB, DDRB, PORTB)
+	board.MapPort(mem, sys.PortC, PINC, DDRC, PORTC)
+	board.MapPort(mem, sys.PortD, PIND, DDRD, PORTD)
+	mem.SetRW(ADCSRB, sys.readADCSRB, sys.writeADCSRB)
+	sys.Osc = dev.NewRCOscillator(8000000, 0x80)
+	sys.AddOsc(sys.Osc, OSCCAL)
+	sys.Clock.Reset(3)
+	mem.SetRW(CLKPR, sys.Clock.ReadCLKPR, sys.Clock.WriteCLKPR)
+	return sys
+}
+
+func (sys *System) LoadProgHex(data io.Reader) {
+	sys.Memory.LoadHex(data)
+}
+
+func (sys *System) AddADC(input dev.AnalogInput) *dev.ADC {
+	adc := dev.NewADC(sys.Timer, sys.Intr, VecADC, input)
+	adc.InternalRef = 1.1
+	adc.Bandgap = 1.1
+	adc.TempSensor = 0.314
+	sys.Memory.SetRW(ADMUX, adc.ReadADMUX, adc.WriteADMUX)
+	sys.Memory.SetRW(ADCSRA, adc.ReadADCSRA, adc.WriteADCSRA)
+	sys.Memory.SetRW(ADCH, adc.ReadADCH, ignoreWrite)
+	sys.Memory.SetRW(ADCL, adc.ReadADCL, ignoreWrite)
+	sys.adc = adc
+	return adc
+}
+
+// AddComparator wires in the analog comparator, which samples its
+// inputs every sampleCycles cycles; adc may be nil if the ADC
+// multiplexer is not used.
+func (sys *System) AddComparator(input dev.AnalogInput, adc *dev.ADC,
+	sampleCycles int64) *dev.Comparator {
+
+	comp := dev.NewComparator(sys.Timer, sys.Intr, VecAnaComp, input, adc,
+		sampleCycles)
+	comp.Bandgap = 1.1
+	sys.Memory.SetRW(ACSR, comp.ReadACSR, comp.WriteACSR)
+	sys.comp = comp
+	return comp
+}
+
+// ADCSRB holds the ADC trigger source and the comparator's ACME bit.
+func (sys *System) readADCSRB(addr core.Addr) byte {
+	var val byte
+	if sys.adc != nil {
+		val |= sys.adc.ReadADCSRB(addr)
+	}
+	if sys.comp != nil {
+		val |= sys.comp.ReadADCSRB(addr)
+	}
+	return val
+}
+
+func (sys *System) writeADCSRB(addr core.Addr, val byte) {
+	if sys.adc != nil {
+		sys.adc.WriteADCSRB(addr, val)
+	}
+	if sys.comp != nil {
+		sys.comp.WriteADCSRB(addr, val)
+	}
+}
+
+// AddSPI wires in the SPI unit, with SS on PB2.
+func (sys *System) AddSPI() *dev.SPI {
+	spi := dev.NewSPI(sys.Timer, sys.Intr, VecSPI, sys.PortB, 2)
+	sys.Memory.SetRW(SPCR, spi.ReadSPCR, spi.WriteSPCR)
+	sys.Memory.SetRW(SPSR, spi.ReadSPSR, spi.WriteSPSR)
+	sys.Memory.SetRW(SPDR, spi.ReadSPDR, spi.WriteSPDR)
+	return spi
+}
+
+func (sys *System) AddTWI(bus *dev.I2CBus) *dev.TWI {
+	twi := dev.NewTWI(sys.Timer, sys.Intr, VecTWI, bus)
+	sys.Memory.SetRW(TWBR, twi.ReadTWBR, twi.WriteTWBR)
+	sys.Memory.SetRW(TWSR, twi.ReadTWSR, twi.WriteTWSR)
+	sys.Memory.SetRW(TWAR, twi.ReadTWAR, twi.WriteTWAR)
+	sys.Memory.SetRW(TWDR, twi.ReadTWDR, twi.WriteTWDR)
+	sys.Memory.SetRW(TWCR, twi.ReadTWCR, twi.WriteTWCR)
+	return twi
+}
+
+func (sys *System) AddUSART(read, write chan byte) *dev.USART {
+	usart := dev.NewUSART(read, write, sys.Timer, sys.Intr, VecUSARTRX)
+	usart.SharedUBRRH = false
+	sys.Memory.SetRW(UDR0, usart.ReadUDR, usart.WriteUDR)
+	sys.Memory.SetRW(UCSR0A, usart.ReadUCSRA, usart.WriteUCSRA)
+	sys.Memory.SetRW(UCSR0B, usart.ReadUCSRB, usart.WriteUCSRB)
+	sys.Memory.SetRW(UCSR0C, usart.ReadUCSRC, usart.WriteUCSRC)
+	sys.Memory.SetRW(UBRR0L, usart.ReadUBRRL, usart.WriteUBRRL)
+	sys.Memory.SetRW(UBRR0H, usart.ReadUBRRH, usart.WriteUBRRH)
+	return usart
+}
+
+func (sys *System) AddEEPROM() *dev.EEPROM {
+	ee := dev.NewEEPROM(EepromBytes, sys.Timer, sys.Intr, VecEERdy,
+		sys.Clock)
+	ee.EnableModes(3400, 1800)
+	sys.Memory.SetRW(EEARH, ee.ReadEEARH, ee.WriteEEARH)
+	sys.Memory.SetRW(EEARL, ee.ReadEEARL, ee.WriteEEARL)
+	sys.Memory.SetRW(EEDR, ee.ReadEEDR, ee.WriteEEDR)
+	sys.Memory.SetRW(EECR, ee.ReadEECR, ee.WriteEECR)
+	return ee
+}
@@ -0,0 +1,94 @@
+package atmega328p
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func load(sys *System, at int, ops ...uint16) {
+	for i, op := range ops {
+		sys.Memory.WriteProgram(core.Addr(at+i), op)
+	}
+}
+
+func TestSystemInterrupt(t *testing.T) {
+	sys := NewSystem()
+	read := make(chan byte, 1)
+	sys.AddUSART(read, make(chan byte, 1))
+	load(sys, 0,
+		0xef0f,         // ldi r16, 0xff
+		0xb904,         // out DDRB, r16
+		0xe908,         // ldi r16, 0x98
+		0x9300, 0x00c1, // sts UCSR0B, r16
+		0x9478, // sei
+		0xcfff, // rjmp .-1
+	)
+	load(sys, 2*VecUSARTRX,
+		0x9100, 0x00c6, // lds r16, UDR0
+		0xb905, // out PORTB, r16
+		0x9518, // reti
+	)
+	entered := false
+	sys.OnStep(func() {
+		if sys.Cpu.GetPC() == 2*VecUSARTRX {
+			entered = true
+		}
+	})
+	read <- 'A'
+	sys.Run(20000)
+	if !entered {
+		t.Error("Vector not taken")
+	}
+	if sys.PortB.Levels() != 'A' || sys.Cpu.GetSP() != 0x8ff ||
+		sys.Cpu.GetPC() != 6 {
+		t.Error("Bad interrupt", sys.PortB.Levels(), sys.Cpu.GetSP(),
+			sys.Cpu.GetPC())
+	}
+}
+
+func TestSystemReserved(t *testing.T) {
+	sys := NewSystem()
+	sys.CheckAccess()
+	load(sys, 0,
+		0xef0f,         // ldi r16, 0xff
+		0x9300, 0x0150, // sts 0x150, r16
+		0x9300, 0x00c7, // sts 0xc7, r16
+		0x0000, // nop
+	)
+	sys.Run(10)
+	var f *core.MemFault
+	if !errors.As(sys.Err(), &f) || f.Kind != core.FaultReserved ||
+		f.Addr != 0xc7 || f.PC != 3 {
+		t.Fatal("Bad fault", sys.Err())
+	}
+	sys.ClearErr()
+	if sys.Err() != nil {
+		t.Error("Fault not cleared")
+	}
+}
+
+func TestSystemClock(t *testing.T) {
+	sys := NewSystem()
+	if sys.Clock.Hertz() != 1000000 {
+		t.Error("Bad factory clock", sys.Clock.Hertz())
+	}
+	load(sys, 0,
+		0xe800,         // ldi r16, 0x80
+		0x9300, 0x0061, // sts CLKPR, r16
+		0xe000,         // ldi r16, 0x00
+		0x9300, 0x0061, // sts CLKPR, r16
+		0xe402,         // ldi r16, 0x42
+		0x9300, 0x0066, // sts OSCCAL, r16
+	)
+	sys.Run(6)
+	if sys.Clock.Hertz() != 8000000 {
+		t.Error("CLKPR not wired", sys.Clock.Hertz())
+	}
+	sys.Run(2)
+	if sys.Osc.ReadOSCCAL(OSCCAL) != 0x42 ||
+		sys.Clock.Hertz() == 8000000 {
+		t.Error("OSCCAL not wired", sys.Clock.Hertz())
+	}
+}
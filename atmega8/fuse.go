@@ -0,0 +1,158 @@
+package atmega8
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+// Fuses holds the fuse and lock bits; as on the device, a bit is
+// programmed when it is 0.
+type Fuses struct {
+	Low  byte
+	High byte
+	Lock byte
+}
+
+// DefaultFuses are the factory settings: the 1MHz internal RC
+// oscillator with the longest startup time, and a 1K-word boot section.
+var DefaultFuses = Fuses{Low: 0xe1, High: 0xd9, Lock: 0xff}
+
+// Fuse bits
+const (
+	fuseCKSEL    = 0x0f // Low
+	fuseSUT      = 0x30
+	fuseBODEN    = 0x40
+	fuseBODLEVEL = 0x80
+	fuseBOOTRST  = 0x01 // High
+	fuseBOOTSZ   = 0x06
+	fuseEESAVE   = 0x08
+	fuseWDTON    = 0x40
+	lockBLB01    = 0x04 // Lock
+	lockBLB02    = 0x08
+	lockBLB11    = 0x10
+	lockBLB12    = 0x20
+)
+
+// NRWWStart is the start of the no-read-while-write section, which
+// holds the largest boot section.
+const NRWWStart = 0xc00
+
+// Boot section start word addresses, by BOOTSZ1:0.
+var bootStarts = [4]core.Addr{0xc00, 0xe00, 0xf00, 0xf80}
+
+// BootStart returns the word address of the boot section, which is
+// sized by BOOTSZ1:0.
+func (f Fuses) BootStart() core.Addr {
+	return bootStarts[(f.High&fuseBOOTSZ)>>1]
+}
+
+// ResetVector returns the word address the CPU starts at after reset:
+// the boot section if BOOTRST is programmed, otherwise 0.
+func (f Fuses) ResetVector() core.Addr {
+	if (f.High & fuseBOOTRST) == 0 {
+		return f.BootStart()
+	}
+	return 0
+}
+
+// WatchdogOn reports whether WDTON is programmed.
+func (f Fuses) WatchdogOn() bool {
+	return (f.High & fuseWDTON) == 0
+}
+
+// EESave reports whether EESAVE is programmed, which keeps the EEPROM
+// through a chip erase.
+func (f Fuses) EESave() bool {
+	return (f.High & fuseEESAVE) == 0
+}
+
+// BODEnabled reports whether BODEN is programmed.
+func (f Fuses) BODEnabled() bool {
+	return (f.Low & fuseBODEN) == 0
+}
+
+// BODLevel returns the brown-out trigger level selected by BODLEVEL.
+func (f Fuses) BODLevel() float64 {
+	if (f.Low & fuseBODLEVEL) == 0 {
+		return 4.0
+	}
+	return 2.7
+}
+
+// Internal RC frequencies, by CKSEL3:0 from 1.
+var rcHertz = [4]int{1000000, 2000000, 4000000, 8000000}
+
+// Hertz returns the clock frequency selected by CKSEL3:0; xtal is the
+// frequency of an external clock, RC network or crystal.
+func (f Fuses) Hertz(xtal int) int {
+	if hz, ok := f.internalRC(); ok {
+		return hz
+	}
+	if (f.Low & fuseCKSEL) == 9 {
+		return 32768
+	}
+	return xtal
+}
+
+// internalRC returns the nominal frequency of the internal RC oscillator,
+// if CKSEL3:0 selects it.
+func (f Fuses) internalRC() (int, bool) {
+	cksel := f.Low & fuseCKSEL
+	if cksel >= 1 && cksel <= 4 {
+		return rcHertz[cksel-1], true
+	}
+	return 0, false
+}
+
+// Startup delays, in clock cycles and microseconds.
+type startup struct {
+	ck int64
+	us int64
+}
+
+const (
+	ms4  = 4100
+	ms65 = 65000
+)
+
+// StartupCycles returns the delay from reset to the first instruction
+// selected by CKSEL3:0 and SUT1:0, in cycles at hertz.
+func (f Fuses) StartupCycles(hertz int) int64 {
+	cksel := f.Low & fuseCKSEL
+	sut := (f.Low & fuseSUT) >> 4
+	var s startup
+	switch {
+	case cksel <= 4:
+		// external clock or internal RC
+		s = [4]startup{{6, 0}, {6, ms4}, {6, ms65}, {6, ms65}}[sut]
+	case cksel <= 8:
+		// external RC
+		s = [4]startup{{18, 0}, {18, ms4}, {18, ms65}, {6, ms4}}[sut]
+	case cksel == 9:
+		// low-frequency crystal
+		s = [4]startup{{1024, ms4}, {1024, ms65}, {32768, ms65},
+			{32768, ms65}}[sut]
+	default:
+		// crystal; CKSEL0 and SUT1:0 together select the delay
+		s = [8]startup{{258, ms4}, {258, ms65}, {1024, 0}, {1024, ms4},
+			{1024, ms65}, {16384, 0}, {16384, ms4},
+			{16384, ms65}}[int(cksel&1)<<2|int(sut)]
+	}
+	return s.ck + int64(hertz)*s.us/1000000
+}
+
+// spmLocked reports whether SPM may not write the boot (or application)
+// section; lpmLocked whether LPM from the other section may not read
+// it.
+func (f Fuses) spmLocked(boot bool) bool {
+	if boot {
+		return (f.Lock & lockBLB11) == 0
+	}
+	return (f.Lock & lockBLB01) == 0
+}
+
+func (f Fuses) lpmLocked(boot bool) bool {
+	if boot {
+		return (f.Lock & lockBLB12) == 0
+	}
+	return (f.Lock & lockBLB02) == 0
+}
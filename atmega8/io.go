@@ -0,0 +1,92 @@
+package atmega8
+
+import "github.com/edmccard/avr-sim/core"
+
+// Data-space addresses of the I/O registers.
+const (
+	TWBR   core.Addr = 0x20
+	TWSR   core.Addr = 0x21
+	TWAR   core.Addr = 0x22
+	TWDR   core.Addr = 0x23
+	ADCL   core.Addr = 0x24
+	ADCH   core.Addr = 0x25
+	ADCSRA core.Addr = 0x26
+	ADMUX  core.Addr = 0x27
+	ACSR   core.Addr = 0x28
+	UBRRL  core.Addr = 0x29
+	UCSRB  core.Addr = 0x2a
+	UCSRA  core.Addr = 0x2b
+	UDR    core.Addr = 0x2c
+	SPCR   core.Addr = 0x2d
+	SPSR   core.Addr = 0x2e
+	SPDR   core.Addr = 0x2f
+	PIND   core.Addr = 0x30
+	DDRD   core.Addr = 0x31
+	PORTD  core.Addr = 0x32
+	PINC   core.Addr = 0x33
+	DDRC   core.Addr = 0x34
+	PORTC  core.Addr = 0x35
+	PINB   core.Addr = 0x36
+	DDRB   core.Addr = 0x37
+	PORTB  core.Addr = 0x38
+	EECR   core.Addr = 0x3c
+	EEDR   core.Addr = 0x3d
+	EEARL  core.Addr = 0x3e
+	EEARH  core.Addr = 0x3f
+	UBRRH  core.Addr = 0x40
+	UCSRC  core.Addr = 0x40
+	WDTCR  core.Addr = 0x41
+	ASSR   core.Addr = 0x42
+	OCR2   core.Addr = 0x43
+	TCNT2  core.Addr = 0x44
+	TCCR2  core.Addr = 0x45
+	ICR1L  core.Addr = 0x46
+	ICR1H  core.Addr = 0x47
+	OCR1BL core.Addr = 0x48
+	OCR1BH core.Addr = 0x49
+	OCR1AL core.Addr = 0x4a
+	OCR1AH core.Addr = 0x4b
+	TCNT1L core.Addr = 0x4c
+	TCNT1H core.Addr = 0x4d
+	TCCR1B core.Addr = 0x4e
+	TCCR1A core.Addr = 0x4f
+	SFIOR  core.Addr = 0x50
+	OSCCAL core.Addr = 0x51
+	TCNT0  core.Addr = 0x52
+	TCCR0  core.Addr = 0x53
+	MCUCSR core.Addr = 0x54
+	MCUCR  core.Addr = 0x55
+	TWCR   core.Addr = 0x56
+	SPMCR  core.Addr = 0x57
+	TIFR   core.Addr = 0x58
+	TIMSK  core.Addr = 0x59
+	GIFR   core.Addr = 0x5a
+	GICR   core.Addr = 0x5b
+	SPL    core.Addr = 0x5d
+	SPH    core.Addr = 0x5e
+	SREG   core.Addr = 0x5f
+)
+
+// Interrupt vector numbers.
+const (
+	VecReset = iota
+	VecInt0
+	VecInt1
+	VecTimer2Comp
+	VecTimer2Ovf
+	VecTimer1Capt
+	VecTimer1CompA
+	VecTimer1CompB
+	VecTimer1Ovf
+	VecTimer0Ovf
+	VecSPI
+	VecUSARTRXC
+	VecUSARTUDRE
+	VecUSARTTXC
+	VecADC
+	VecEERdy
+	VecAnaComp
+	VecTWI
+	VecSPMRdy
+	VecCount
+)
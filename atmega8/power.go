@@ -0,0 +1,76 @@
+package atmega8
+
+import (
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/dev"
+)
+
+// Power-on reset threshold, and brown-out detector hysteresis, in
+// volts.
+const (
+	VPOT  = 1.4
+	VHyst = 0.13
+)
+
+// DefaultVCC is the supply voltage when none is set.
+const DefaultVCC = 5.0
+
+// SetSupply sets the supply voltage to channel 0 of supply, which may
+// be a dev.Ramp or a dev.SampleStream read from a CSV profile; if nil,
+// it is DefaultVCC. The ADC's AVCC follows it, and analog inputs are
+// clamped to it.
+//
+// The device is held in reset while VCC is below VPOT, or, if BODEN is
+// programmed, has fallen below the brown-out level; it restarts with a
+// power-on or brown-out reset when VCC rises again.
+func (sys *System) SetSupply(supply dev.AnalogInput) {
+	sys.supply = supply
+	if sys.adc != nil {
+		sys.adc.Supply = supply
+	}
+	if sys.comp != nil {
+		sys.comp.Supply = supply
+	}
+	if supply == nil && sys.held {
+		sys.held = false
+		sys.Reset(sys.heldKind)
+	}
+}
+
+// VCC returns the current supply voltage.
+func (sys *System) VCC() float64 {
+	if sys.supply == nil {
+		return DefaultVCC
+	}
+	return sys.supply.Voltage(0, sys.Timer.GetCount())
+}
+
+// InReset reports whether the device is held in reset by low VCC.
+func (sys *System) InReset() bool {
+	return sys.held
+}
+
+func (sys *System) checkSupply() {
+	vcc := sys.VCC()
+	bod := sys.fuses.BODEnabled()
+	level := sys.fuses.BODLevel()
+	switch {
+	case vcc < VPOT:
+		if !sys.held || sys.heldKind != core.PowerOnReset {
+			sys.hold(core.PowerOnReset)
+		}
+	case bod && vcc < level-VHyst/2:
+		if !sys.held {
+			sys.hold(core.BrownOutReset)
+		}
+	case sys.held && !(bod && vcc < level+VHyst/2):
+		sys.held = false
+		sys.Reset(sys.heldKind)
+	}
+}
+
+func (sys *System) hold(kind core.ResetKind) {
+	sys.held = true
+	sys.heldKind = kind
+	sys.Reset(kind)
+}
@@ -0,0 +1,146 @@
+package atmega8
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+// SPMCR bits
+const (
+	spmcrSPMIE  = 0x80
+	spmcrRWWSB  = 0x40
+	spmcrRWWSRE = 0x10
+	spmcrBLBSET = 0x08
+	spmcrPGWRT  = 0x04
+	spmcrPGERS  = 0x02
+	spmcrSPMEN  = 0x01
+	spmcrOp     = 0x1f
+)
+
+const PageWords = 32
+
+// selfProg implements self-programming: SPM from the boot section, and
+// the boot lock bits, which also restrict LPM. Erase and write
+// complete immediately; RWWSB is set until the RWW section is
+// re-enabled.
+type selfProg struct {
+	sys    *System
+	spmcr  byte
+	buf    [PageWords]uint16
+	window *core.Counter
+}
+
+func newSelfProg(sys *System) *selfProg {
+	sp := &selfProg{sys: sys}
+	sp.clearBuffer()
+	return sp
+}
+
+func (sp *selfProg) clearBuffer() {
+	for i := range sp.buf {
+		sp.buf[i] = 0xffff
+	}
+}
+
+// inBoot reports whether the instruction before the current PC is in
+// the boot section.
+func (sp *selfProg) inBoot() bool {
+	return core.Addr(sp.sys.Cpu.GetPC()-1) >= sp.sys.fuses.BootStart()
+}
+
+func (sp *selfProg) ReadSPMCR(addr core.Addr) byte {
+	return sp.spmcr
+}
+
+// An SPM must follow within four cycles of writing SPMCR.
+func (sp *selfProg) WriteSPMCR(addr core.Addr, val byte) {
+	sp.spmcr = (sp.spmcr & spmcrRWWSB) | (val &^ spmcrRWWSB)
+	if sp.window != nil {
+		sp.sys.Timer.RemoveCounter(sp.window)
+		sp.window = nil
+	}
+	if (val & spmcrSPMEN) != 0 {
+		sp.window = core.NewCounter(4, func() bool {
+			sp.spmcr &^= spmcrOp
+			sp.window = nil
+			sp.updateIntr()
+			return false
+		})
+		sp.sys.Timer.AddCounter(sp.window)
+	}
+	sp.updateIntr()
+}
+
+func (sp *selfProg) updateIntr() {
+	sp.sys.Intr.Set(VecSPMRdy,
+		(sp.spmcr&spmcrSPMIE) != 0 && (sp.spmcr&spmcrSPMEN) == 0)
+}
+
+func (sp *selfProg) SPM(addr core.Addr, data uint16) {
+	op := sp.spmcr & spmcrOp
+	if (op&spmcrSPMEN) == 0 || !sp.inBoot() {
+		return
+	}
+	fuses := &sp.sys.fuses
+	word := (addr >> 1) & (FlashWords - 1)
+	page := word &^ (PageWords - 1)
+	boot := word >= fuses.BootStart()
+	switch op {
+	case spmcrSPMEN:
+		sp.buf[word&(PageWords-1)] = data
+	case spmcrPGERS | spmcrSPMEN:
+		if !fuses.spmLocked(boot) {
+			for i := core.Addr(0); i < PageWords; i++ {
+				sp.sys.Memory.WriteProgram(page+i, 0xffff)
+			}
+			sp.busy(page)
+		}
+	case spmcrPGWRT | spmcrSPMEN:
+		if !fuses.spmLocked(boot) {
+			for i, w := range sp.buf {
+				sp.sys.Memory.WriteProgram(page+core.Addr(i), w)
+			}
+			sp.busy(page)
+		}
+		sp.clearBuffer()
+	case spmcrBLBSET | spmcrSPMEN:
+		// only the boot lock bits can be programmed
+		fuses.Lock &= byte(data) | ^byte(lockBLB01|lockBLB02|lockBLB11|
+			lockBLB12)
+	case spmcrRWWSRE | spmcrSPMEN:
+		sp.spmcr &^= spmcrRWWSB
+	}
+	if sp.window != nil {
+		sp.sys.Timer.RemoveCounter(sp.window)
+		sp.window = nil
+	}
+	sp.spmcr &^= spmcrOp
+	sp.updateIntr()
+}
+
+func (sp *selfProg) busy(page core.Addr) {
+	if page < NRWWStart {
+		sp.spmcr |= spmcrRWWSB
+	}
+}
+
+// LPM reads the fuse and lock bits within four cycles of writing
+// BLBSET and SPMEN to SPMCR, and cannot read a section locked by
+// BLBx2 from the other section.
+func (sp *selfProg) load(addr core.Addr) (byte, bool) {
+	if (sp.spmcr & spmcrOp) == spmcrBLBSET|spmcrSPMEN {
+		switch addr {
+		case 0:
+			return sp.sys.fuses.Low, true
+		case 1:
+			return sp.sys.fuses.Lock, true
+		case 3:
+			return sp.sys.fuses.High, true
+		}
+		return 0xff, true
+	}
+	boot := (addr >> 1) >= sp.sys.fuses.BootStart()
+	if boot != sp.inBoot() && sp.sys.fuses.lpmLocked(boot) {
+		return 0xff, true
+	}
+	return 0, false
+}
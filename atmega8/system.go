@@ -1,19 +1,50 @@
 package atmega8
 
 import (
-	"fmt"
 	"io"
-	"time"
 
+	"github.com/edmccard/avr-sim/board"
 	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/dev"
 	"github.com/edmccard/avr-sim/instr"
 )
 
 type System struct {
-	Cpu     *core.Cpu
-	Decoder *instr.Decoder
-	Memory  *Mem
-	Timer   *core.Timer
+	*board.Board
+	Memory *Mem
+	Intr   *core.Interrupts
+	PortB  *dev.Port
+	PortC  *dev.Port
+	PortD  *dev.Port
+	// Osc is the internal RC oscillator, calibrated by OSCCAL; Clock
+	// follows it or an external source, as the fuses select.
+	Osc *dev.RCOscillator
+	// Watchdog is reset-only; WDTON forces it on.
+	Watchdog  *dev.Watchdog
+	xtalHertz int
+	fuses     Fuses
+	spm       *selfProg
+	eeprom    *dev.EEPROM
+	adc       *dev.ADC
+	comp      *dev.Comparator
+	timer1    *dev.ICPTimer
+	supply    dev.AnalogInput
+	// the device is held in reset while the supply is low
+	held     bool
+	heldKind core.ResetKind
+	mcucsr   byte
+	gicr     byte
+	ivce     *core.Counter
+	// interrupts stay disabled for the instruction after IVSEL changes
+	ivselHold bool
+	// cycles until the first instruction after reset
+	startup int64
+	resets  []func()
+	// stack and heap bounds; brkval is the address of malloc's break
+	// pointer, or -1
+	stackTop  int
+	heapStart int
+	brkval    core.Addr
 }
 
 func NewSystem() *System {
@@ -21,12 +52,212 @@ func NewSystem() *System {
 	set[instr.Jmp] = false
 	set[instr.Call] = false
 	decoder := instr.NewDecoder(set)
-	cpu := &core.Cpu{}
-	return &System{
-		Cpu:     cpu,
-		Decoder: &decoder,
-		Memory:  NewMem(cpu),
-		Timer:   core.NewTimer(),
+	cpu := core.NewCpu(core.Mega, 0, 0, 0, 0, 0)
+	mem := NewMem(cpu)
+	intr := core.NewInterrupts(VecCount)
+	sys := &System{
+		Memory: mem,
+		Intr:   intr,
+		PortB:  dev.NewPort(),
+		PortC:  dev.NewPort(),
+		PortD:  dev.NewPort(),
+	}
+	sys.Board = board.New(cpu, &decoder, mem, core.NewTimer(), intr,
+		func(vec int) int { return int(sys.VectorBase()) + vec })
+	sys.Wait = sys.wait
+	sys.Blocked = func() bool { return !sys.intrEnabled() }
+	sys.OnStep(sys.followHeap)
+	sys.stackTop = SramBytes - 1
+	sys.brkval = -1
+	cpu.SetStackGuard(0)
+	sys.fuses = DefaultFuses
+	sys.Osc = dev.NewRCOscillator(rcHertz[0], 0x80)
+	sys.Clock.SetSource(sys.Osc)
+	sys.Memory.SetRW(OSCCAL, sys.Osc.ReadOSCCAL, sys.writeOSCCAL)
+	sys.spm = newSelfProg(sys)
+	sys.Memory.spm = sys.spm
+	sys.Memory.SetRW(SPMCR, sys.spm.ReadSPMCR, sys.spm.WriteSPMCR)
+	cpu.SetSPM(sys.spm.SPM)
+	sys.Watchdog = dev.NewWatchdog(sys.Timer, sys.Clock, func() {
+		sys.Reset(core.WatchdogReset)
+	})
+	sys.Memory.SetRW(WDTCR, sys.Watchdog.ReadWDTCR, sys.Watchdog.WriteWDTCR)
+	cpu.SetWDR(sys.Watchdog.WDR)
+	sys.Memory.SetRW(MCUCSR, sys.readMCUCSR, sys.writeMCUCSR)
+	sys.mcucsr = core.PowerOnReset.Flag()
+	sys.Memory.SetRW(GICR, sys.readGICR, sys.writeGICR)
+	sys.resets = append(sys.resets, sys.resetGICR)
+	sys.addPort(sys.PortB, PINB, DDRB, PORTB)
+	sys.addPort(sys.PortC, PINC, DDRC, PORTC)
+	sys.addPort(sys.PortD, PIND, DDRD, PORTD)
+	return sys
+}
+
+func (sys *System) addPort(port *dev.Port, pin, ddr, out core.Addr) {
+	sys.resets = append(sys.resets, port.Reset)
+	sys.Memory.SetRW(pin, port.ReadPIN, ignoreWrite)
+	sys.Memory.SetRW(ddr, port.ReadDDR, port.WriteDDR)
+	sys.Memory.SetRW(out, port.ReadPORT, port.WritePORT)
+}
+
+func (sys *System) Fuses() Fuses {
+	return sys.fuses
+}
+
+// SetFuses programs the fuse and lock bits, and resets the system as
+// at power-on.
+func (sys *System) SetFuses(f Fuses) {
+	sys.fuses = f
+	sys.selectClock()
+	sys.Watchdog.Force(f.WatchdogOn())
+	sys.Reset(core.PowerOnReset)
+}
+
+// Hertz returns the CPU clock frequency.
+func (sys *System) Hertz() int {
+	return sys.Clock.Hertz()
+}
+
+// SetXtalHertz sets the frequency of the external clock, RC network or
+// crystal, used if the fuses select one.
+func (sys *System) SetXtalHertz(hertz int) {
+	sys.xtalHertz = hertz
+	sys.selectClock()
+}
+
+// selectClock sets the clock source from the fuses: the internal RC
+// oscillator at its nominal frequency, or an external source.
+func (sys *System) selectClock() {
+	if hz, ok := sys.fuses.internalRC(); ok {
+		sys.Clock.Changed()
+		sys.Osc.Nominal = hz
+		sys.Clock.SetSource(sys.Osc)
+	} else {
+		sys.Clock.SetSource(dev.FixedClock(sys.fuses.Hertz(sys.xtalHertz)))
+	}
+}
+
+// OSCCAL is reloaded with the factory calibration on reset.
+func (sys *System) writeOSCCAL(addr core.Addr, val byte) {
+	sys.Clock.Changed()
+	sys.Osc.WriteOSCCAL(addr, val)
+}
+
+// Reset resets the system from the source kind. I/O registers and
+// peripherals return to their initial values, the source is recorded
+// in MCUCSR, and the CPU starts at the reset vector after the startup
+// delay. Flash, EEPROM and SRAM are kept, but after power-on SRAM
+// counts as uninitialized.
+func (sys *System) Reset(kind core.ResetKind) {
+	if kind == core.PowerOnReset {
+		sys.mcucsr = 0
+		sys.Memory.InvalidateSRAM()
+	}
+	sys.mcucsr |= kind.Flag()
+	sys.Memory.ResetIO()
+	for _, f := range sys.resets {
+		f()
+	}
+	sys.writeOSCCAL(OSCCAL, sys.Osc.Calibrated)
+	sys.Watchdog.Reset()
+	sys.spm.spmcr = 0
+	sys.spm.clearBuffer()
+	sys.spm.updateIntr()
+	sys.Cpu.Reset(0, int(sys.fuses.ResetVector()))
+	sys.startup = sys.fuses.StartupCycles(sys.Hertz())
+}
+
+// The reset flags are cleared by writing 0 to them.
+func (sys *System) readMCUCSR(addr core.Addr) byte {
+	return sys.mcucsr
+}
+
+func (sys *System) writeMCUCSR(addr core.Addr, val byte) {
+	sys.mcucsr &= val
+}
+
+const (
+	gicrIVSEL = 0x02
+	gicrIVCE  = 0x01
+	gicrINT   = 0xc0
+)
+
+func (sys *System) readGICR(addr core.Addr) byte {
+	return sys.gicr
+}
+
+// IVSEL can only be changed within four cycles of writing IVCE, by a
+// write that clears IVCE. Interrupts are disabled from the write to
+// IVCE until the instruction after the write to IVSEL, or for four
+// cycles if IVSEL is not written.
+func (sys *System) writeGICR(addr core.Addr, val byte) {
+	sys.gicr = (sys.gicr & gicrIVSEL) | (val & gicrINT)
+	if sys.ivce != nil {
+		sys.Timer.RemoveCounter(sys.ivce)
+		sys.ivce = nil
+		if (val & gicrIVCE) == 0 {
+			sys.gicr = (sys.gicr &^ gicrIVSEL) | (val & gicrIVSEL)
+			sys.ivselHold = true
+			return
+		}
+	}
+	if (val & gicrIVCE) != 0 {
+		sys.gicr |= gicrIVCE
+		sys.ivce = core.NewCounter(4, func() bool {
+			sys.gicr &^= gicrIVCE
+			sys.ivce = nil
+			return false
+		})
+		sys.Timer.AddCounter(sys.ivce)
+	}
+}
+
+func (sys *System) resetGICR() {
+	if sys.ivce != nil {
+		sys.Timer.RemoveCounter(sys.ivce)
+		sys.ivce = nil
+	}
+	sys.gicr = 0
+	sys.ivselHold = false
+}
+
+// VectorBase returns the address of the interrupt vectors: the start
+// of the boot section if IVSEL is set, otherwise 0.
+func (sys *System) VectorBase() core.Addr {
+	if (sys.gicr & gicrIVSEL) != 0 {
+		return sys.fuses.BootStart()
+	}
+	return 0
+}
+
+// intrEnabled reports whether interrupts may be taken: not during the
+// IVSEL change sequence, nor while executing from the section without
+// the vectors if BLBx2 locks that section.
+func (sys *System) intrEnabled() bool {
+	if sys.ivselHold {
+		sys.ivselHold = false
+		return false
+	}
+	if sys.ivce != nil {
+		return false
+	}
+	vecBoot := (sys.gicr & gicrIVSEL) != 0
+	boot := core.Addr(sys.Cpu.GetPC()) >= sys.fuses.BootStart()
+	return vecBoot == boot || !sys.fuses.lpmLocked(boot)
+}
+
+// ChipErase erases flash and the lock bits, and the EEPROM unless
+// EESAVE is programmed.
+func (sys *System) ChipErase() {
+	for i := 0; i < FlashWords; i++ {
+		sys.Memory.WriteProgram(core.Addr(i), 0xffff)
+	}
+	sys.fuses.Lock = 0xff
+	if sys.eeprom != nil && !sys.fuses.EESave() {
+		data := sys.eeprom.Bytes()
+		for i := range data {
+			data[i] = 0xff
+		}
 	}
 }
 
@@ -34,39 +265,182 @@ func (sys *System) LoadProgHex(data io.Reader) {
 	sys.Memory.LoadHex(data)
 }
 
-func (sys *System) Step() uint {
-	elapsed := sys.Cpu.Step(sys.Memory, sys.Decoder)
-	sys.Timer.Tick(int64(elapsed))
-	return elapsed
-}
-
-func (sys *System) Go(hertz, slicePerSec int, onSlice SliceFunc) chan struct{} {
-	cycPerSlice := uint(hertz / slicePerSec)
-	quit := make(chan struct{})
-	ticker := time.NewTicker(time.Second / time.Duration(slicePerSec))
-
-	go func() {
-		cycles := uint(0)
-		for {
-			select {
-			case <-ticker.C:
-				for cycles < cycPerSlice {
-					cycles += sys.Step()
-				}
-				cycles -= cycPerSlice
-				err := onSlice()
-				if err != nil {
-					fmt.Println("ERROR:", err)
-					break
-				}
-			case <-quit:
-				break
-			}
+// LoadProgELF loads the program from an avr-gcc executable, and
+// programs the fuse and lock bits from its .fuse and .lock sections,
+// if any. If it defines __heap_start, the stack guard is set there,
+// and follows the heap as __brkval moves up; the stack top is taken
+// from __stack.
+func (sys *System) LoadProgELF(r io.ReaderAt) (*core.ELF, error) {
+	e, err := sys.Memory.LoadELF(r)
+	if err != nil {
+		return nil, err
+	}
+	if top, ok := e.Data("__stack"); ok {
+		sys.stackTop = int(top)
+	}
+	if start, ok := e.Data("__heap_start"); ok {
+		sys.heapStart = int(start)
+		sys.Cpu.SetStackGuard(sys.heapStart)
+	}
+	if brk, ok := e.Data("__brkval"); ok {
+		sys.brkval = brk
+	}
+	if e.Fuse != nil || e.Lock != nil {
+		f := sys.fuses
+		if len(e.Fuse) > 0 {
+			f.Low = e.Fuse[0]
+		}
+		if len(e.Fuse) > 1 {
+			f.High = e.Fuse[1]
 		}
-		ticker.Stop()
-	}()
+		if len(e.Lock) > 0 {
+			f.Lock = e.Lock[0]
+		}
+		sys.SetFuses(f)
+	}
+	return e, nil
+}
+
+// wait holds the CPU in reset while the supply is low, and for the
+// startup delay after reset.
+func (sys *System) wait() int64 {
+	if sys.supply != nil {
+		sys.checkSupply()
+		if sys.held {
+			return 1
+		}
+	}
+	cycles := sys.startup
+	sys.startup = 0
+	return cycles
+}
 
-	return quit
+// followHeap raises the stack guard to the heap's break pointer, which
+// is 0 until malloc is first called. It is read directly from SRAM, to
+// bypass access checking.
+func (sys *System) followHeap() {
+	if sys.brkval < 0 {
+		return
+	}
+	sram := sys.Memory.sram
+	i := int(sys.brkval) - PortCount
+	if i < 0 || i+1 >= len(sram) {
+		return
+	}
+	brk := int(sram[i]) | int(sram[i+1])<<8
+	if brk > sys.heapStart {
+		sys.Cpu.SetStackGuard(brk)
+	} else {
+		sys.Cpu.SetStackGuard(sys.heapStart)
+	}
 }
 
-type SliceFunc func() error
+// StackDepth returns the maximum stack depth, in bytes, since the last
+// call to Cpu.ResetStackLow.
+func (sys *System) StackDepth() int {
+	if low := sys.Cpu.StackLow(); low != 0 && low < sys.stackTop {
+		return sys.stackTop - low
+	}
+	return 0
+}
+
+func (sys *System) AddADC(input dev.AnalogInput) *dev.ADC {
+	adc := dev.NewADC(sys.Timer, sys.Intr, VecADC, input)
+	adc.Supply = sys.supply
+	sys.adc = adc
+	sys.Memory.SetRW(ADMUX, adc.ReadADMUX, adc.WriteADMUX)
+	sys.Memory.SetRW(ADCSRA, adc.ReadADCSRA, adc.WriteADCSRA)
+	sys.Memory.SetRW(ADCH, adc.ReadADCH, ignoreWrite)
+	sys.Memory.SetRW(ADCL, adc.ReadADCL, ignoreWrite)
+	sys.resets = append(sys.resets, adc.Reset)
+	return adc
+}
+
+// AddComparator wires in the analog comparator, which samples its
+// inputs every sampleCycles cycles; adc may be nil if the ADC
+// multiplexer is not used.
+func (sys *System) AddComparator(input dev.AnalogInput, adc *dev.ADC,
+	sampleCycles int64) *dev.Comparator {
+
+	comp := dev.NewComparator(sys.Timer, sys.Intr, VecAnaComp, input, adc,
+		sampleCycles)
+	comp.Supply = sys.supply
+	sys.comp = comp
+	if sys.timer1 != nil {
+		comp.Capture = sys.timer1.Capture
+	}
+	sys.Memory.SetRW(ACSR, comp.ReadACSR, comp.WriteACSR)
+	sys.Memory.SetRW(SFIOR, comp.ReadSFIOR, comp.WriteSFIOR)
+	sys.resets = append(sys.resets, comp.Reset)
+	return comp
+}
+
+// AddTimer1 wires in the counter and input capture unit of Timer1.
+// The capture input is ICP1 on PB0, or the analog comparator output if
+// ACIC is set.
+func (sys *System) AddTimer1() *dev.ICPTimer {
+	t := dev.NewICPTimer(sys.Timer, sys.Intr, VecTimer1Capt, VecTimer1Ovf)
+	sys.timer1 = t
+	sys.Memory.SetRW(TCCR1A, t.ReadTCCR1A, t.WriteTCCR1A)
+	sys.Memory.SetRW(TCCR1B, t.ReadTCCR1B, t.WriteTCCR1B)
+	sys.Memory.SetRW(TCNT1L, t.ReadTCNT1L, t.WriteTCNT1L)
+	sys.Memory.SetRW(TCNT1H, t.ReadTCNT1H, t.WriteTCNT1H)
+	sys.Memory.SetRW(ICR1L, t.ReadICR1L, t.WriteICR1L)
+	sys.Memory.SetRW(ICR1H, t.ReadICR1H, t.WriteICR1H)
+	sys.Memory.SetRW(TIMSK, t.ReadTIMSK, t.WriteTIMSK)
+	sys.Memory.SetRW(TIFR, t.ReadTIFR, t.WriteTIFR)
+	sys.PortB.OnChange(func(levels, changed byte) {
+		if (changed&0x01) != 0 && (sys.comp == nil || !sys.comp.Capturing()) {
+			t.Capture((levels & 0x01) != 0)
+		}
+	})
+	if sys.comp != nil {
+		sys.comp.Capture = t.Capture
+	}
+	sys.resets = append(sys.resets, t.Reset)
+	return t
+}
+
+// AddSPI wires in the SPI unit, with SS on PB2.
+func (sys *System) AddSPI() *dev.SPI {
+	spi := dev.NewSPI(sys.Timer, sys.Intr, VecSPI, sys.PortB, 2)
+	sys.Memory.SetRW(SPCR, spi.ReadSPCR, spi.WriteSPCR)
+	sys.Memory.SetRW(SPSR, spi.ReadSPSR, spi.WriteSPSR)
+	sys.Memory.SetRW(SPDR, spi.ReadSPDR, spi.WriteSPDR)
+	sys.resets = append(sys.resets, spi.Reset)
+	return spi
+}
+
+func (sys *System) AddTWI(bus *dev.I2CBus) *dev.TWI {
+	twi := dev.NewTWI(sys.Timer, sys.Intr, VecTWI, bus)
+	sys.Memory.SetRW(TWBR, twi.ReadTWBR, twi.WriteTWBR)
+	sys.Memory.SetRW(TWSR, twi.ReadTWSR, twi.WriteTWSR)
+	sys.Memory.SetRW(TWAR, twi.ReadTWAR, twi.WriteTWAR)
+	sys.Memory.SetRW(TWDR, twi.ReadTWDR, twi.WriteTWDR)
+	sys.Memory.SetRW(TWCR, twi.ReadTWCR, twi.WriteTWCR)
+	sys.resets = append(sys.resets, twi.Reset)
+	return twi
+}
+
+func (sys *System) AddUSART(read, write chan byte) *dev.USART {
+	usart := dev.NewUSART(read, write, sys.Timer, sys.Intr, VecUSARTRXC)
+	sys.Memory.SetRW(UDR, usart.ReadUDR, usart.WriteUDR)
+	sys.Memory.SetRW(UCSRA, usart.ReadUCSRA, usart.WriteUCSRA)
+	sys.Memory.SetRW(UCSRB, usart.ReadUCSRB, usart.WriteUCSRB)
+	sys.Memory.SetRW(UCSRC, usart.ReadUCSRC, usart.WriteUCSRC)
+	sys.Memory.SetRW(UBRRL, usart.ReadUBRRL, usart.WriteUBRRL)
+	sys.resets = append(sys.resets, usart.Reset)
+	return usart
+}
+
+func (sys *System) AddEEPROM() *dev.EEPROM {
+	ee := dev.NewEEPROM(EepromBytes, sys.Timer, sys.Intr, VecEERdy,
+		sys.Clock)
+	sys.eeprom = ee
+	sys.Memory.SetRW(EEARH, ee.ReadEEARH, ee.WriteEEARH)
+	sys.Memory.SetRW(EEARL, ee.ReadEEARL, ee.WriteEEARL)
+	sys.Memory.SetRW(EEDR, ee.ReadEEDR, ee.WriteEEDR)
+	sys.Memory.SetRW(EECR, ee.ReadEECR, ee.WriteEECR)
+	sys.resets = append(sys.resets, ee.Reset)
+	return ee
+}
@@ -0,0 +1,466 @@
+package atmega8
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/board"
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/dev"
+)
+
+func load(sys *System, at int, ops ...uint16) {
+	for i, op := range ops {
+		sys.Memory.WriteProgram(core.Addr(at+i), op)
+	}
+}
+
+func TestSystemInterrupt(t *testing.T) {
+	sys := NewSystem()
+	read := make(chan byte, 1)
+	sys.AddUSART(read, make(chan byte, 1))
+	load(sys, 0,
+		0xe004, // ldi r16, 0x04
+		0xbf0e, // out SPH, r16
+		0xe50f, // ldi r16, 0x5f
+		0xbf0d, // out SPL, r16
+		0xef0f, // ldi r16, 0xff
+		0xbb07, // out DDRB, r16
+		0xe908, // ldi r16, 0x98
+		0xb90a, // out UCSRB, r16
+		0x9478, // sei
+		0xcfff, // rjmp .-1
+	)
+	load(sys, VecUSARTRXC,
+		0xb10c, // in r16, UDR
+		0xbb08, // out PORTB, r16
+		0x9518, // reti
+	)
+	entered := false
+	sys.OnStep(func() {
+		if sys.Cpu.GetPC() == VecUSARTRXC {
+			entered = true
+		}
+	})
+	read <- 'A'
+	sys.Run(20000)
+	if !entered {
+		t.Error("Vector not taken")
+	}
+	if sys.PortB.Levels() != 'A' || sys.Cpu.GetSP() != SramBytes-1 ||
+		sys.Cpu.GetPC() != 9 {
+		t.Error("Bad interrupt", sys.PortB.Levels(), sys.Cpu.GetSP(),
+			sys.Cpu.GetPC())
+	}
+}
+
+func TestSystemNoXtal(t *testing.T) {
+	sys := NewSystem()
+	load(sys, 0, 0xcfff) // rjmp .-1
+	f := sys.Fuses()
+	f.Low |= 0x0f // external crystal
+	sys.SetFuses(f)
+	_, done := sys.Go(100, func() error { return nil })
+	if err := <-done; err != board.ErrNoClock {
+		t.Fatal("Ran with no crystal frequency", err)
+	}
+	sys.SetXtalHertz(100000)
+	quit, done := sys.Go(100, func() error { return nil })
+	close(quit)
+	if err := <-done; err != nil {
+		t.Error("Bad result with crystal", err)
+	}
+}
+
+func TestSystemSelfProgram(t *testing.T) {
+	sys := NewSystem()
+	// 1MHz RC, BOOTRST programmed
+	sys.SetFuses(Fuses{Low: 0xc1, High: 0xd8, Lock: 0xff})
+	if sys.Cpu.GetPC() != 0xc00 {
+		t.Fatal("Bad reset vector", sys.Cpu.GetPC())
+	}
+	sys.Memory.WriteProgram(0x21, 0xaaaa)
+	load(sys, 0xc00,
+		0xe304, // ldi r16, 0x34
+		0x2e00, // mov r0, r16
+		0xe102, // ldi r16, 0x12
+		0x2e10, // mov r1, r16
+		0xe4e0, // ldi r30, 0x40
+		0xe0f0, // ldi r31, 0x00
+		0xe011, // ldi r17, 0x01
+		0xbf17, // out SPMCR, r17
+		0x95e8, // spm (fill buffer)
+		0xe013, // ldi r17, 0x03
+		0xbf17, // out SPMCR, r17
+		0x95e8, // spm (page erase)
+		0xe015, // ldi r17, 0x05
+		0xbf17, // out SPMCR, r17
+		0x95e8, // spm (page write)
+		0xb727, // in r18, SPMCR
+		0xe111, // ldi r17, 0x11
+		0xbf17, // out SPMCR, r17
+		0x95e8, // spm (RWWSRE)
+		0xb737, // in r19, SPMCR
+		0xef0b, // ldi r16, 0xfb
+		0x2e00, // mov r0, r16
+		0xe019, // ldi r17, 0x09
+		0xbf17, // out SPMCR, r17
+		0x95e8, // spm (BLBSET)
+		0xe0e0, // ldi r30, 0x00
+		0xbf17, // out SPMCR, r17
+		0x95c8, // lpm
+		0x2d40, // mov r20, r0
+		0xe0e1, // ldi r30, 0x01
+		0xbf17, // out SPMCR, r17
+		0x95c8, // lpm
+		0x2d50, // mov r21, r0
+		0xe0e3, // ldi r30, 0x03
+		0xbf17, // out SPMCR, r17
+		0x95c8, // lpm
+		0x2d60, // mov r22, r0
+		0xcfff, // rjmp .-1
+	)
+	sys.Run(1000)
+	if sys.Memory.ReadProgram(0x20) != 0x1234 ||
+		sys.Memory.ReadProgram(0x21) != 0xffff {
+		t.Error("Bad page write", sys.Memory.ReadProgram(0x20),
+			sys.Memory.ReadProgram(0x21))
+	}
+	if sys.Cpu.GetReg(18)&spmcrRWWSB == 0 ||
+		sys.Cpu.GetReg(19)&spmcrRWWSB != 0 {
+		t.Error("Bad RWWSB", sys.Cpu.GetReg(18), sys.Cpu.GetReg(19))
+	}
+	if sys.Fuses().Lock != 0xfb {
+		t.Error("Bad BLBSET", sys.Fuses().Lock)
+	}
+	if sys.Cpu.GetReg(20) != 0xc1 || sys.Cpu.GetReg(21) != 0xfb ||
+		sys.Cpu.GetReg(22) != 0xd8 {
+		t.Error("Bad fuse read", sys.Cpu.GetReg(20), sys.Cpu.GetReg(21),
+			sys.Cpu.GetReg(22))
+	}
+
+	// BLB01 now locks the application section against SPM
+	sys.Memory.WriteProgram(0x20, 0x5555)
+	sys.SetFuses(sys.Fuses())
+	sys.Run(1000)
+	if sys.Memory.ReadProgram(0x20) != 0x5555 {
+		t.Error("Locked section written", sys.Memory.ReadProgram(0x20))
+	}
+
+	sys.SetFuses(Fuses{Low: 0xc1, High: 0xdc, Lock: 0xff})
+	if sys.Cpu.GetPC() != 0xf00 {
+		t.Error("Bad reset vector for BOOTSZ", sys.Cpu.GetPC())
+	}
+}
+
+func TestSystemBootLock(t *testing.T) {
+	sys := NewSystem()
+	sys.Memory.WriteProgram(0xc10, 0xbeef)
+	load(sys, 0,
+		0xe2e0, // ldi r30, 0x20
+		0xe1f8, // ldi r31, 0x18
+		0x95c8, // lpm
+		0xcfff, // rjmp .-1
+	)
+	// BLB12 programmed
+	sys.SetFuses(Fuses{Low: 0xc1, High: 0xd9, Lock: 0xdf})
+	sys.Run(100)
+	if sys.Cpu.GetReg(0) != 0xff {
+		t.Error("Boot section read from application", sys.Cpu.GetReg(0))
+	}
+	sys.SetFuses(Fuses{Low: 0xc1, High: 0xd9, Lock: 0xff})
+	sys.Run(100)
+	if sys.Cpu.GetReg(0) != 0xef {
+		t.Error("Bad LPM", sys.Cpu.GetReg(0))
+	}
+}
+
+func TestSystemReset(t *testing.T) {
+	sys := NewSystem()
+	sys.Memory.CheckUninit = true
+	load(sys, 0,
+		0xe008, // ldi r16, 0x08
+		0xbd01, // out WDTCR, r16
+		0xcfff, // rjmp .-1
+	)
+	if sys.Memory.ReadData(MCUCSR) != 0x01 {
+		t.Error("PORF not set", sys.Memory.ReadData(MCUCSR))
+	}
+	// 1MHz RC with 6 CK + 65ms
+	sys.Reset(core.PowerOnReset)
+	if n := sys.Step(); n != 65006 || sys.Cpu.GetPC() != 0 {
+		t.Fatal("Bad startup delay", n, sys.Cpu.GetPC())
+	}
+	sys.Step()
+	if sys.Cpu.GetPC() != 1 {
+		t.Fatal("First instruction not run", sys.Cpu.GetPC())
+	}
+
+	sys.Memory.WriteData(MCUCSR, 0)
+	sys.Memory.WriteData(PORTB, 0xff)
+	sys.Memory.WriteData(0x100, 0x55)
+	sys.Run(20000)
+	if sys.Memory.ReadData(MCUCSR) != 0x08 {
+		t.Fatal("WDRF not set", sys.Memory.ReadData(MCUCSR))
+	}
+	if sys.Memory.ReadData(PORTB) != 0 {
+		t.Error("I/O not reset", sys.Memory.ReadData(PORTB))
+	}
+	if sys.Memory.ReadData(0x100) != 0x55 || sys.Memory.Fault() != nil {
+		t.Error("SRAM invalidated by watchdog reset", sys.Memory.Fault())
+	}
+
+	sys.Reset(core.ExternalReset)
+	if sys.Memory.ReadData(MCUCSR) != 0x0a {
+		t.Error("EXTRF not set", sys.Memory.ReadData(MCUCSR))
+	}
+	sys.Reset(core.BrownOutReset)
+	if sys.Memory.ReadData(MCUCSR) != 0x0e {
+		t.Error("BORF not set", sys.Memory.ReadData(MCUCSR))
+	}
+	sys.Memory.WriteData(MCUCSR, 0xfb)
+	if sys.Memory.ReadData(MCUCSR) != 0x0a {
+		t.Error("Bad flag clear", sys.Memory.ReadData(MCUCSR))
+	}
+
+	sys.Reset(core.PowerOnReset)
+	if sys.Memory.ReadData(MCUCSR) != 0x01 {
+		t.Error("Flags not cleared by power-on", sys.Memory.ReadData(MCUCSR))
+	}
+	sys.Memory.ReadData(0x100)
+	if f := sys.Memory.Fault(); f == nil || f.Kind != core.FaultUninit {
+		t.Error("SRAM not invalidated by power-on", f)
+	}
+}
+
+// stepTo steps sys until the cycle count reaches count, and returns the
+// cycles taken by the last step.
+func stepTo(sys *System, count int64) int64 {
+	var n int64
+	for sys.Timer.GetCount() < count {
+		n = int64(sys.Step())
+	}
+	return n
+}
+
+func TestSystemBrownOut(t *testing.T) {
+	sys := NewSystem()
+	load(sys, 0,
+		0x9503, // inc r16
+		0xcffe, // rjmp .-2
+	)
+	// BODEN programmed at 2.7V
+	sys.SetFuses(Fuses{Low: 0xa1, High: 0xd9, Lock: 0xff})
+	sys.SetSupply(dev.Ramp{
+		{Cycle: 0, Volts: 5},
+		{Cycle: 100000, Volts: 5},
+		{Cycle: 101000, Volts: 2.5},
+		{Cycle: 110000, Volts: 2.5},
+		{Cycle: 111000, Volts: 2.75},
+		{Cycle: 120000, Volts: 2.75},
+		{Cycle: 121000, Volts: 5},
+	})
+	stepTo(sys, 100000)
+	if sys.InReset() || sys.Cpu.GetReg(16) == 0 {
+		t.Fatal("Not running at 5V")
+	}
+	sys.Memory.WriteData(MCUCSR, 0)
+	stepTo(sys, 105000)
+	if !sys.InReset() || sys.Cpu.GetPC() != 0 {
+		t.Error("Not held below BOD level", sys.VCC(), sys.Cpu.GetPC())
+	}
+	if sys.Memory.ReadData(MCUCSR) != 0x04 {
+		t.Error("BORF not set", sys.Memory.ReadData(MCUCSR))
+	}
+	stepTo(sys, 115000)
+	if !sys.InReset() {
+		t.Error("Released within hysteresis", sys.VCC())
+	}
+	var n int64
+	for sys.InReset() {
+		n = int64(sys.Step())
+	}
+	if n != 65006 || sys.Cpu.GetPC() != 0 {
+		t.Error("Bad startup delay on release", n, sys.Cpu.GetPC())
+	}
+	sys.Step()
+	if sys.Cpu.GetPC() != 1 || sys.Memory.ReadData(MCUCSR) != 0x04 {
+		t.Error("Bad release", sys.Cpu.GetPC(), sys.Memory.ReadData(MCUCSR))
+	}
+
+	// BODEN unprogrammed
+	sys.SetFuses(Fuses{Low: 0xe1, High: 0xd9, Lock: 0xff})
+	sys.SetSupply(dev.Ramp{{Cycle: 0, Volts: 2.5}})
+	sys.Step()
+	if sys.InReset() {
+		t.Error("Held with BOD disabled")
+	}
+
+	sys.SetSupply(dev.Ramp{{Cycle: 0, Volts: 3.5}})
+	sys.SetFuses(Fuses{Low: 0xa1, High: 0xd9, Lock: 0xff})
+	sys.Step()
+	if sys.InReset() {
+		t.Error("Held above 2.7V")
+	}
+	// BODLEVEL programmed at 4.0V
+	sys.SetFuses(Fuses{Low: 0x21, High: 0xd9, Lock: 0xff})
+	sys.Step()
+	if !sys.InReset() {
+		t.Error("Not held below 4.0V")
+	}
+}
+
+func TestSystemIVSEL(t *testing.T) {
+	sys := NewSystem()
+	boot := int(sys.Fuses().BootStart())
+	sys.Intr.SetAck(VecTimer0Ovf, func() {
+		sys.Intr.Set(VecTimer0Ovf, false)
+	})
+	load(sys, 0, 0xc01f) // rjmp 0x20
+	load(sys, 0x20,
+		0xe004, // ldi r16, 0x04
+		0xbf0e, // out SPH, r16
+		0xe50f, // ldi r16, 0x5f
+		0xbf0d, // out SPL, r16
+		0x9478, // sei
+		0xe001, // ldi r16, 0x01
+		0xbf0b, // out GICR, r16
+		0xe002, // ldi r16, 0x02
+		0xbf0b, // out GICR, r16
+		0x9563, // inc r22
+		0xcfff, // rjmp .-1
+	)
+	load(sys, VecTimer0Ovf,
+		0x9543, // inc r20
+		0x9518, // reti
+	)
+	load(sys, boot+VecTimer0Ovf,
+		0x9553, // inc r21
+		0x9518, // reti
+	)
+	for sys.Cpu.GetPC() != 0x27 {
+		sys.Step()
+	}
+	if sys.Memory.ReadData(GICR) != 0x01 {
+		t.Fatal("IVCE not set", sys.Memory.ReadData(GICR))
+	}
+	sys.Intr.Set(VecTimer0Ovf, true)
+	sys.Step()
+	if sys.Cpu.GetPC() != 0x28 {
+		t.Fatal("Interrupt taken during IVCE window", sys.Cpu.GetPC())
+	}
+	sys.Step()
+	if sys.Cpu.GetPC() != 0x29 || sys.Memory.ReadData(GICR) != 0x02 {
+		t.Fatal("Bad IVSEL write", sys.Cpu.GetPC(),
+			sys.Memory.ReadData(GICR))
+	}
+	sys.Step()
+	if sys.Cpu.GetReg(22) != 1 || sys.Cpu.GetPC() != boot+VecTimer0Ovf {
+		t.Fatal("Bad dispatch after IVSEL", sys.Cpu.GetReg(22),
+			sys.Cpu.GetPC())
+	}
+	sys.Run(20)
+	if sys.Cpu.GetReg(21) != 1 || sys.Cpu.GetReg(20) != 0 {
+		t.Error("Bad vector", sys.Cpu.GetReg(20), sys.Cpu.GetReg(21))
+	}
+
+	// IVSEL is only written within four cycles of IVCE
+	sys.Memory.WriteData(GICR, 0x01)
+	sys.Timer.Tick(4)
+	if sys.Memory.ReadData(GICR) != 0x02 {
+		t.Error("IVCE not cleared", sys.Memory.ReadData(GICR))
+	}
+	sys.Memory.WriteData(GICR, 0x00)
+	if sys.Memory.ReadData(GICR) != 0x02 {
+		t.Error("IVSEL cleared without IVCE")
+	}
+
+	// BLB02 blocks interrupts from the application section
+	sys.fuses.Lock &^= lockBLB02
+	sys.Intr.Set(VecTimer0Ovf, true)
+	sys.Run(20)
+	if sys.Cpu.GetReg(21) != 1 {
+		t.Error("Interrupt taken with BLB02 programmed")
+	}
+	sys.fuses.Lock = 0xff
+	sys.Run(20)
+	if sys.Cpu.GetReg(21) != 2 {
+		t.Error("Interrupt not taken", sys.Cpu.GetReg(21))
+	}
+
+	sys.Memory.WriteData(GICR, 0x01)
+	sys.Memory.WriteData(GICR, 0x00)
+	if sys.Memory.ReadData(GICR) != 0x00 || sys.VectorBase() != 0 {
+		t.Error("IVSEL not cleared", sys.Memory.ReadData(GICR))
+	}
+}
+
+func TestSystemBootLockInterrupt(t *testing.T) {
+	sys := NewSystem()
+	sys.Intr.SetAck(VecTimer0Ovf, func() {
+		sys.Intr.Set(VecTimer0Ovf, false)
+	})
+	load(sys, VecTimer0Ovf,
+		0x9543, // inc r20
+		0x9518, // reti
+	)
+	load(sys, 0xc00,
+		0xe004, // ldi r16, 0x04
+		0xbf0e, // out SPH, r16
+		0xe50f, // ldi r16, 0x5f
+		0xbf0d, // out SPL, r16
+		0x9478, // sei
+		0xcfff, // rjmp .-1
+	)
+	// BOOTRST and BLB12 programmed
+	sys.SetFuses(Fuses{Low: 0xc1, High: 0xd8, Lock: 0xdf})
+	sys.Intr.Set(VecTimer0Ovf, true)
+	sys.Run(100)
+	if sys.Cpu.GetReg(20) != 0 || sys.Cpu.GetPC() != 0xc05 {
+		t.Error("Interrupt taken with BLB12 programmed", sys.Cpu.GetPC())
+	}
+	sys.fuses.Lock = 0xff
+	sys.Run(20)
+	if sys.Cpu.GetReg(20) != 1 {
+		t.Error("Interrupt not taken", sys.Cpu.GetReg(20))
+	}
+}
+
+func TestSystemCapture(t *testing.T) {
+	sys := NewSystem()
+	load(sys, 0, 0xcfff) // rjmp .-1
+	sys.AddTimer1()
+	ain0 := 1.0
+	sys.AddComparator(dev.AnalogFunc(func(ch int, cyc int64) float64 {
+		if ch == dev.AIN0 {
+			return ain0
+		}
+		return 2.0
+	}), nil, 1)
+	sys.Memory.WriteData(TCCR1B, 0x41) // ICES1, clk/1
+	sys.Memory.WriteData(ACSR, 0x04)   // ACIC
+	sys.Run(1000)
+	ain0 = 3.0
+	sys.Run(10)
+	if sys.Memory.ReadData(TIFR)&0x20 == 0 {
+		t.Fatal("No capture with ACIC set")
+	}
+	icr := int(sys.Memory.ReadData(ICR1L))
+	icr |= int(sys.Memory.ReadData(ICR1H)) << 8
+	if icr < 1000 || icr > 1010 {
+		t.Error("Bad ICR1", icr)
+	}
+
+	sys.Memory.WriteData(TIFR, 0x20)
+	sys.Memory.WriteData(ACSR, 0x00)
+	ain0 = 1.0
+	sys.Run(10)
+	ain0 = 3.0
+	sys.Run(10)
+	if sys.Memory.ReadData(TIFR)&0x20 != 0 {
+		t.Error("Capture with ACIC clear")
+	}
+	sys.PortB.Drive(0, true)
+	if sys.Memory.ReadData(TIFR)&0x20 == 0 {
+		t.Error("No capture from ICP1")
+	}
+}
@@ -0,0 +1,69 @@
+package attiny10
+
+import "github.com/edmccard/avr-sim/core"
+
+// Data-space addresses of the I/O registers, which are the same as their
+// I/O addresses.
+const (
+	PINB   core.Addr = 0x00
+	DDRB   core.Addr = 0x01
+	PORTB  core.Addr = 0x02
+	PUEB   core.Addr = 0x03
+	PORTCR core.Addr = 0x0c
+	PCICR  core.Addr = 0x10
+	PCIFR  core.Addr = 0x11
+	PCMSK  core.Addr = 0x12
+	EIMSK  core.Addr = 0x13
+	EIFR   core.Addr = 0x14
+	EICRA  core.Addr = 0x15
+	DIDR0  core.Addr = 0x17
+	ADCL   core.Addr = 0x19
+	ADMUX  core.Addr = 0x1b
+	ADCSRB core.Addr = 0x1c
+	ADCSRA core.Addr = 0x1d
+	ACSR   core.Addr = 0x1f
+	ICR0L  core.Addr = 0x22
+	ICR0H  core.Addr = 0x23
+	OCR0BL core.Addr = 0x24
+	OCR0BH core.Addr = 0x25
+	OCR0AL core.Addr = 0x26
+	OCR0AH core.Addr = 0x27
+	TCNT0L core.Addr = 0x28
+	TCNT0H core.Addr = 0x29
+	TIFR0  core.Addr = 0x2a
+	TIMSK0 core.Addr = 0x2b
+	TCCR0C core.Addr = 0x2c
+	TCCR0B core.Addr = 0x2d
+	TCCR0A core.Addr = 0x2e
+	GTCCR  core.Addr = 0x2f
+	WDTCSR core.Addr = 0x31
+	NVMCSR core.Addr = 0x32
+	NVMCMD core.Addr = 0x33
+	VLMCSR core.Addr = 0x34
+	PRR    core.Addr = 0x35
+	CLKPSR core.Addr = 0x36
+	CLKMSR core.Addr = 0x37
+	OSCCAL core.Addr = 0x39
+	SMCR   core.Addr = 0x3a
+	RSTFLR core.Addr = 0x3b
+	CCP    core.Addr = 0x3c
+	SPL    core.Addr = 0x3d
+	SPH    core.Addr = 0x3e
+	SREG   core.Addr = 0x3f
+)
+
+// Interrupt vector numbers; each vector is one word long.
+const (
+	VecReset = iota
+	VecInt0
+	VecPCInt0
+	VecTimer0Capt
+	VecTimer0Ovf
+	VecTimer0CompA
+	VecTimer0CompB
+	VecAnaComp
+	VecWDT
+	VecVLM
+	VecADC
+	VecCount
+)
@@ -0,0 +1,74 @@
+package attiny10
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	FlashWords = 0x200
+	SramBytes  = 0x60
+	PortCount  = 0x40
+)
+
+// Data-space addresses of the non-volatile memory sections.
+const (
+	LockBits    core.Addr = 0x3f00
+	ConfigBits  core.Addr = 0x3f40
+	Calibration core.Addr = 0x3f80
+	DeviceID    core.Addr = 0x3fc0
+	FlashStart  core.Addr = 0x4000
+)
+
+var signature = [3]byte{0x1e, 0x90, 0x03}
+
+// The register file is not in the data space; I/O registers start at
+// 0, followed by SRAM, and flash can be read through FlashStart.
+// Writes to the non-volatile sections are ignored.
+type Mem struct {
+	*core.MemMap
+	Lock   byte
+	Config byte
+	Osccal byte
+}
+
+// The reserved I/O addresses, as first-last ranges
+var reserved = [][2]core.Addr{
+	{0x4, 0xb}, {0xd, 0xf}, {0x16, 0x16}, {0x18, 0x18},
+	{0x1a, 0x1a}, {0x1e, 0x1e}, {0x20, 0x21}, {0x30, 0x30},
+	{0x38, 0x38},
+}
+
+func NewMem(cpu *core.Cpu) *Mem {
+	mem := &Mem{
+		MemMap: core.NewMemMap(FlashWords),
+		Lock:   0xff,
+		Config: 0xff,
+	}
+	mem.AddIO(0, PortCount)
+	mem.AddSRAM(PortCount, SramBytes-PortCount)
+	mem.AddRegion(FlashStart, 2*FlashWords,
+		func(addr core.Addr) byte {
+			return mem.LoadProgram(addr - FlashStart)
+		}, ignoreWrite)
+	mem.AddRegion(LockBits, 1,
+		func(addr core.Addr) byte { return mem.Lock }, ignoreWrite)
+	mem.AddRegion(ConfigBits, 1,
+		func(addr core.Addr) byte { return mem.Config }, ignoreWrite)
+	mem.AddRegion(Calibration, 1,
+		func(addr core.Addr) byte { return mem.Osccal }, ignoreWrite)
+	mem.AddRegion(DeviceID, len(signature),
+		func(addr core.Addr) byte { return signature[addr-DeviceID] },
+		ignoreWrite)
+
+	for _, r := range reserved {
+		mem.ReserveRange(r[0], r[1])
+	}
+	mem.SetRW(SPL, cpu.MemReadSPL, cpu.MemWriteSPL)
+	mem.SetRW(SPH, cpu.MemReadSPH, cpu.MemWriteSPH)
+	mem.SetRW(SREG, cpu.MemReadSreg, cpu.MemWriteSreg)
+
+	return mem
+}
+
+func ignoreWrite(addr core.Addr, val byte) {
+}
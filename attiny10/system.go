@@ -0,0 +1,48 @@
+package attiny10
+
+import (
+	"io"
+
+	"github.com/edmccard/avr-sim/board"
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/dev"
+	"github.com/edmccard/avr-sim/instr"
+)
+
+type System struct {
+	*board.Board
+	Memory    *Mem
+	Intr      *core.Interrupts
+	PortB     *dev.Port
+	PinChange *dev.PinChange
+	Osc       *dev.RCOscillator
+}
+
+func NewSystem() *System {
+	decoder := instr.NewReducedDecoder()
+	cpu := core.NewCpu(core.Tiny, 0, 0, 0, 0, 0)
+	mem := NewMem(cpu)
+	intr := core.NewInterrupts(VecCount)
+	sys := &System{
+		Board: board.New(cpu, &decoder, mem, core.NewTimer(), intr,
+			func(vec int) int { return vec }),
+		Memory: mem,
+		Intr:   intr,
+		PortB:  dev.NewPort(),
+		Osc:    dev.NewRCOscillator(8000000, 0x80),
+	}
+	cpu.Reset(SramBytes-1, 0)
+	board.MapPort(mem, sys.PortB, PINB, DDRB, PORTB)
+	pc := dev.NewPinChange(sys.Intr, VecPCInt0, sys.PortB, 0x01)
+	sys.Memory.SetRW(PCMSK, pc.ReadPCMSK, pc.WritePCMSK)
+	sys.Memory.SetRW(PCICR, pc.ReadPCICR, pc.WritePCICR)
+	sys.Memory.SetRW(PCIFR, pc.ReadPCIFR, pc.WritePCIFR)
+	sys.PinChange = pc
+	sys.Memory.Osccal = sys.Osc.Calibrated
+	sys.AddOsc(sys.Osc, OSCCAL)
+	return sys
+}
+
+func (sys *System) LoadProgHex(data io.Reader) {
+	sys.Memory.LoadHex(data)
+}
@@ -0,0 +1,60 @@
+package attiny10
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func load(sys *System, at int, ops ...uint16) {
+	for i, op := range ops {
+		sys.Memory.WriteProgram(core.Addr(at+i), op)
+	}
+}
+
+func TestSystemPinChange(t *testing.T) {
+	sys := NewSystem()
+	load(sys, 0, 0xc01f)         // rjmp 0x20
+	load(sys, VecPCInt0, 0xc03d) // rjmp 0x40
+	load(sys, 0x20,
+		0xe0e0, // ldi r30, 0x00
+		0xe4f1, // ldi r31, 0x41
+		0x8100, // ld r16, Z
+		0xe01e, // ldi r17, 0x0e
+		0xb911, // out DDRB, r17
+		0xb902, // out PORTB, r16
+		0xe001, // ldi r16, 0x01
+		0xbb02, // out PCMSK, r16
+		0xbb00, // out PCICR, r16
+		0x9478, // sei
+		0xcfff, // rjmp .-1
+	)
+	load(sys, 0x40,
+		0xb110, // in r17, PINB
+		0x9543, // inc r20
+		0x9518, // reti
+	)
+	// read through the flash mapping at 0x4000
+	sys.Memory.WriteProgram(0x80, 0x0004)
+	entered := false
+	sys.OnStep(func() {
+		if sys.Cpu.GetPC() == VecPCInt0 {
+			entered = true
+		}
+	})
+	sys.Run(50)
+	if sys.PortB.Output() != 0x04 || sys.Cpu.GetReg(20) != 0 {
+		t.Fatal("Bad port output", sys.PortB.Output())
+	}
+	sys.PortB.Drive(0, true)
+	sys.Run(50)
+	if !entered || sys.Cpu.GetReg(20) != 1 {
+		t.Error("Vector not taken", sys.Cpu.GetReg(20))
+	}
+	if sys.Cpu.GetReg(17) != 0x05 {
+		t.Error("Bad port input", sys.Cpu.GetReg(17))
+	}
+	if sys.Cpu.GetSP() != SramBytes-1 || sys.Cpu.GetPC() != 0x2a {
+		t.Error("Bad return", sys.Cpu.GetSP(), sys.Cpu.GetPC())
+	}
+}
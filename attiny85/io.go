@@ -0,0 +1,79 @@
+package attiny85
+
+import "github.com/edmccard/avr-sim/core"
+
+// Data-space addresses of the I/O registers.
+const (
+	ADCSRB core.Addr = 0x23
+	ADCL   core.Addr = 0x24
+	ADCH   core.Addr = 0x25
+	ADCSRA core.Addr = 0x26
+	ADMUX  core.Addr = 0x27
+	ACSR   core.Addr = 0x28
+	USICR  core.Addr = 0x2d
+	USISR  core.Addr = 0x2e
+	USIDR  core.Addr = 0x2f
+	USIBR  core.Addr = 0x30
+	GPIOR0 core.Addr = 0x31
+	GPIOR1 core.Addr = 0x32
+	GPIOR2 core.Addr = 0x33
+	DIDR0  core.Addr = 0x34
+	PCMSK  core.Addr = 0x35
+	PINB   core.Addr = 0x36
+	DDRB   core.Addr = 0x37
+	PORTB  core.Addr = 0x38
+	EECR   core.Addr = 0x3c
+	EEDR   core.Addr = 0x3d
+	EEARL  core.Addr = 0x3e
+	EEARH  core.Addr = 0x3f
+	PRR    core.Addr = 0x40
+	WDTCR  core.Addr = 0x41
+	DWDR   core.Addr = 0x42
+	DTPS1  core.Addr = 0x43
+	DT1B   core.Addr = 0x44
+	DT1A   core.Addr = 0x45
+	CLKPR  core.Addr = 0x46
+	PLLCSR core.Addr = 0x47
+	OCR0B  core.Addr = 0x48
+	OCR0A  core.Addr = 0x49
+	TCCR0A core.Addr = 0x4a
+	OCR1B  core.Addr = 0x4b
+	GTCCR  core.Addr = 0x4c
+	OCR1C  core.Addr = 0x4d
+	OCR1A  core.Addr = 0x4e
+	TCNT1  core.Addr = 0x4f
+	TCCR1  core.Addr = 0x50
+	OSCCAL core.Addr = 0x51
+	TCNT0  core.Addr = 0x52
+	TCCR0B core.Addr = 0x53
+	MCUSR  core.Addr = 0x54
+	MCUCR  core.Addr = 0x55
+	SPMCSR core.Addr = 0x57
+	TIFR   core.Addr = 0x58
+	TIMSK  core.Addr = 0x59
+	GIFR   core.Addr = 0x5a
+	GIMSK  core.Addr = 0x5b
+	SPL    core.Addr = 0x5d
+	SPH    core.Addr = 0x5e
+	SREG   core.Addr = 0x5f
+)
+
+// Interrupt vector numbers; each vector is one word long.
+const (
+	VecReset = iota
+	VecInt0
+	VecPCInt0
+	VecTimer1CompA
+	VecTimer1Ovf
+	VecTimer0Ovf
+	VecEERdy
+	VecAnaComp
+	VecADC
+	VecTimer1CompB
+	VecTimer0CompA
+	VecTimer0CompB
+	VecWDT
+	VecUSIStart
+	VecUSIOvf
+	VecCount
+)
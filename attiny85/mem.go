@@ -0,0 +1,46 @@
+package attiny85
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	FlashWords  = 0x1000
+	SramBytes   = 0x260
+	PortCount   = 0x60
+	EepromBytes = 0x200
+)
+
+// The data space is the register file, 64 I/O registers and 512 bytes
+// of SRAM; addresses wrap at the end of SRAM, unless access checking
+// is enabled.
+type Mem struct {
+	*core.MemMap
+}
+
+// The reserved I/O addresses, as first-last ranges
+var reserved = [][2]core.Addr{
+	{0x20, 0x22}, {0x29, 0x2c}, {0x39, 0x3b}, {0x56, 0x56},
+	{0x5c, 0x5c},
+}
+
+func NewMem(cpu *core.Cpu) *Mem {
+	mem := &Mem{core.NewMemMap(FlashWords)}
+	mem.Unmapped = core.Wrap
+	mem.Size = SramBytes
+	mem.AddRegisterFile(cpu)
+	mem.AddIO(0x20, PortCount-0x20)
+	mem.AddSRAM(PortCount, SramBytes-PortCount)
+
+	for _, r := range reserved {
+		mem.ReserveRange(r[0], r[1])
+	}
+	mem.SetRW(0x5d, cpu.MemReadSPL, cpu.MemWriteSPL)
+	mem.SetRW(0x5e, cpu.MemReadSPH, cpu.MemWriteSPH)
+	mem.SetRW(0x5f, cpu.MemReadSreg, cpu.MemWriteSreg)
+
+	return mem
+}
+
+func ignoreWrite(addr core.Addr, val byte) {
+}
@@ -0,0 +1,147 @@
+package attiny85
+
+import (
+	"io"
+
+	"github.com/edmccard/avr-sim/board"
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/dev"
+	"github.com/edmccard/avr-sim/instr"
+)
+
+// External and pin change interrupt bits in GIMSK and GIFR
+const (
+	gimskINT0 = 0x40
+	gimskPCIE = 0x20
+	mcucrISC0 = 0x03
+)
+
+type System struct {
+	*board.Board
+	Memory    *Mem
+	Intr      *core.Interrupts
+	PortB     *dev.Port
+	Int0      *dev.ExtInt
+	PinChange *dev.PinChange
+	Osc       *dev.RCOscillator
+	mcucr     byte
+}
+
+func NewSystem() *System {
+	// avr25: the classic set plus MOVW, LPM Rd,Z, SPM and BREAK
+	set := instr.NewSetClassic8k()
+	set[instr.Movw] = true
+	set[instr.LpmEnhanced] = true
+	set[instr.Spm] = true
+	set[instr.Break] = true
+	decoder := instr.NewDecoder(set)
+	// the AVRe core times like the megas; core.Tiny is the reduced core
+	cpu := core.NewCpu(core.Mega, 0, 0, 0, 0, 0)
+	mem := NewMem(cpu)
+	intr := core.NewInterrupts(VecCount)
+	sys := &System{
+		Board: board.New(cpu, &decoder, mem, core.NewTimer(), intr,
+			func(vec int) int { return vec }),
+		Memory: mem,
+		Intr:   intr,
+		PortB:  dev.NewPort(),
+		Osc:    dev.NewRCOscillator(8000000, 0x80),
+	}
+	cpu.Reset(SramBytes-1, 0)
+	board.MapPort(mem, sys.PortB, PINB, DDRB, PORTB)
+	sys.Int0 = dev.NewExtInt(sys.Intr, VecInt0, sys.PortB, 2, gimskINT0, 0)
+	sys.PinChange = dev.NewPinChange(sys.Intr, VecPCInt0, sys.PortB,
+		gimskPCIE)
+	sys.Memory.SetRW(PCMSK, sys.PinChange.ReadPCMSK,
+		sys.PinChange.WritePCMSK)
+	sys.Memory.SetRW(GIMSK, sys.readGIMSK, sys.writeGIMSK)
+	sys.Memory.SetRW(GIFR, sys.readGIFR, sys.writeGIFR)
+	sys.Memory.SetRW(MCUCR, sys.readMCUCR, sys.writeMCUCR)
+	sys.AddOsc(sys.Osc, OSCCAL)
+	sys.Clock.Reset(3)
+	mem.SetRW(CLKPR, sys.Clock.ReadCLKPR, sys.Clock.WriteCLKPR)
+	return sys
+}
+
+// GIMSK and GIFR hold the bits of INT0 and the pin change interrupt.
+func (sys *System) readGIMSK(addr core.Addr) byte {
+	return sys.Int0.ReadEIMSK(addr) | sys.PinChange.ReadPCICR(addr)
+}
+
+func (sys *System) writeGIMSK(addr core.Addr, val byte) {
+	sys.Int0.WriteEIMSK(addr, val)
+	sys.PinChange.WritePCICR(addr, val)
+}
+
+func (sys *System) readGIFR(addr core.Addr) byte {
+	return sys.Int0.ReadEIFR(addr) | sys.PinChange.ReadPCIFR(addr)
+}
+
+func (sys *System) writeGIFR(addr core.Addr, val byte) {
+	sys.Int0.WriteEIFR(addr, val)
+	sys.PinChange.WritePCIFR(addr, val)
+}
+
+// MCUCR holds the INT0 sense control bits; the sleep and pull-up bits
+// are only stored.
+func (sys *System) readMCUCR(addr core.Addr) byte {
+	return sys.mcucr | sys.Int0.ReadEICR(addr)
+}
+
+func (sys *System) writeMCUCR(addr core.Addr, val byte) {
+	sys.mcucr = val &^ mcucrISC0
+	sys.Int0.WriteEICR(addr, val)
+}
+
+func (sys *System) LoadProgHex(data io.Reader) {
+	sys.Memory.LoadHex(data)
+}
+
+// AddUSI wires in the USI, with DI/SDA on PB0, DO on PB1 and USCK/SCL
+// on PB2.
+func (sys *System) AddUSI() *dev.USI {
+	usi := dev.NewUSI(sys.Intr, VecUSIStart, VecUSIOvf, sys.PortB, 0, 1, 2)
+	sys.Memory.SetRW(USICR, usi.ReadUSICR, usi.WriteUSICR)
+	sys.Memory.SetRW(USISR, usi.ReadUSISR, usi.WriteUSISR)
+	sys.Memory.SetRW(USIDR, usi.ReadUSIDR, usi.WriteUSIDR)
+	sys.Memory.SetRW(USIBR, usi.ReadUSIBR, ignoreWrite)
+	return usi
+}
+
+// AddTimer1 wires in Timer1, with OC1A on PB1 (inverted on PB0) and
+// OC1B on PB4 (inverted on PB3).
+func (sys *System) AddTimer1() *dev.PLLTimer {
+	t := dev.NewPLLTimer(sys.Timer, sys.Intr, VecTimer1CompA,
+		VecTimer1CompB, VecTimer1Ovf, sys.Clock)
+	t.AttachOutputs(sys.PortB, 1, 0, 4, 3)
+	sys.Memory.SetRW(TCCR1, t.ReadTCCR1, t.WriteTCCR1)
+	sys.Memory.SetRW(GTCCR, t.ReadGTCCR, t.WriteGTCCR)
+	sys.Memory.SetRW(TCNT1, t.ReadTCNT1, t.WriteTCNT1)
+	sys.Memory.SetRW(OCR1A, t.ReadOCR1A, t.WriteOCR1A)
+	sys.Memory.SetRW(OCR1B, t.ReadOCR1B, t.WriteOCR1B)
+	sys.Memory.SetRW(OCR1C, t.ReadOCR1C, t.WriteOCR1C)
+	sys.Memory.SetRW(TIMSK, t.ReadTIMSK, t.WriteTIMSK)
+	sys.Memory.SetRW(TIFR, t.ReadTIFR, t.WriteTIFR)
+	sys.Memory.SetRW(PLLCSR, t.ReadPLLCSR, t.WritePLLCSR)
+	return t
+}
+
+// AddSpeaker wires in a speaker following pin of port B. On PB1 or PB4,
+// driven by Timer1 in PWM mode, it works as a PWM DAC; LowPass stands
+// in for the filter on the pin.
+func (sys *System) AddSpeaker(pin int, backend dev.AudioBackend) *dev.Speaker {
+	spk := dev.NewSpeaker(sys.Clock, pin, backend)
+	spk.AttachPort(sys.PortB)
+	return spk
+}
+
+func (sys *System) AddEEPROM() *dev.EEPROM {
+	ee := dev.NewEEPROM(EepromBytes, sys.Timer, sys.Intr, VecEERdy,
+		sys.Clock)
+	ee.EnableModes(3400, 1800)
+	sys.Memory.SetRW(EEARH, ee.ReadEEARH, ee.WriteEEARH)
+	sys.Memory.SetRW(EEARL, ee.ReadEEARL, ee.WriteEEARL)
+	sys.Memory.SetRW(EEDR, ee.ReadEEDR, ee.WriteEEDR)
+	sys.Memory.SetRW(EECR, ee.ReadEECR, ee.WriteEECR)
+	return ee
+}
@@ -0,0 +1,130 @@
+package attiny85
+
+import (
+	"math"
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/dev"
+)
+
+func load(sys *System, at int, ops ...uint16) {
+	for i, op := range ops {
+		sys.Memory.WriteProgram(core.Addr(at+i), op)
+	}
+}
+
+func TestSystemPinChange(t *testing.T) {
+	sys := NewSystem()
+	load(sys, 0, 0xc01f)         // rjmp 0x20
+	load(sys, VecPCInt0, 0xc03d) // rjmp 0x40
+	load(sys, 0x20,
+		0xe001, // ldi r16, 0x01
+		0xbb07, // out DDRB, r16
+		0xe008, // ldi r16, 0x08
+		0xbb05, // out PCMSK, r16
+		0xe200, // ldi r16, 0x20
+		0xbf0b, // out GIMSK, r16
+		0x9478, // sei
+		0xcfff, // rjmp .-1
+	)
+	load(sys, 0x40,
+		0xb316, // in r17, PINB
+		0xe001, // ldi r16, 0x01
+		0xbb08, // out PORTB, r16
+		0x9543, // inc r20
+		0x9518, // reti
+	)
+	entered := false
+	sys.OnStep(func() {
+		if sys.Cpu.GetPC() == VecPCInt0 {
+			entered = true
+		}
+	})
+	sys.Run(100)
+	if sys.PortB.Levels()&0x01 != 0 {
+		t.Fatal("Interrupt before pin change")
+	}
+	sys.PortB.Drive(3, true)
+	sys.Run(100)
+	if !entered || sys.Cpu.GetReg(20) != 1 {
+		t.Error("Vector not taken", sys.Cpu.GetReg(20))
+	}
+	if sys.Cpu.GetReg(17)&0x08 == 0 || sys.PortB.Levels()&0x01 == 0 {
+		t.Error("Bad port I/O", sys.Cpu.GetReg(17), sys.PortB.Levels())
+	}
+	if sys.Cpu.GetSP() != SramBytes-1 || sys.Cpu.GetPC() != 0x27 {
+		t.Error("Bad return", sys.Cpu.GetSP(), sys.Cpu.GetPC())
+	}
+}
+
+func TestSystemSpeakerPWM(t *testing.T) {
+	sys := NewSystem()
+	sys.AddTimer1()
+	buf := dev.NewAudioBuffer(44100)
+	spk := sys.AddSpeaker(1, buf)
+	spk.LowPass = 1000
+	load(sys, 0,
+		0xe800, // ldi r16, 0x80
+		0xe010, // ldi r17, 0x00
+		0xbd06, // out CLKPR, r16
+		0xbd16, // out CLKPR, r17
+		0xe002, // ldi r16, 0x02
+		0xbb07, // out DDRB, r16
+		0xef0f, // ldi r16, 0xff
+		0xbd0d, // out OCR1C, r16
+		0xe400, // ldi r16, 0x40
+		0xbd0e, // out OCR1A, r16
+		0xe501, // ldi r16, 0x51
+		0xbf00, // out TCCR1, r16
+		0xcfff, // rjmp .-1
+	)
+	sys.Run(8000000)
+	spk.Close()
+	if sys.Clock.Hertz() != 8000000 {
+		t.Fatal("Bad clock", sys.Clock.Hertz())
+	}
+	var sum float64
+	tail := buf.Samples[len(buf.Samples)/2:]
+	for _, s := range tail {
+		sum += float64(s)
+	}
+	if mean := sum / float64(len(tail)); math.Abs(mean+0.5) > 0.02 {
+		t.Error("Bad DAC level", mean)
+	}
+}
+
+func TestSystemInt0(t *testing.T) {
+	sys := NewSystem()
+	load(sys, 0, 0xc01f)       // rjmp 0x20
+	load(sys, VecInt0, 0xc03e) // rjmp 0x40
+	load(sys, 0x20,
+		0xe002, // ldi r16, 0x02
+		0xbf05, // out MCUCR, r16
+		0xe600, // ldi r16, 0x60
+		0xbf0b, // out GIMSK, r16
+		0xb71b, // in r17, GIMSK
+		0xb725, // in r18, MCUCR
+		0x9478, // sei
+		0xcfff, // rjmp .-1
+	)
+	load(sys, 0x40,
+		0x9543, // inc r20
+		0x9518, // reti
+	)
+	sys.Run(100)
+	if sys.Cpu.GetReg(17) != 0x60 || sys.Cpu.GetReg(18) != 0x02 {
+		t.Error("Bad shared registers", sys.Cpu.GetReg(17),
+			sys.Cpu.GetReg(18))
+	}
+	sys.PortB.Drive(2, true)
+	sys.Run(100)
+	if sys.Cpu.GetReg(20) != 0 {
+		t.Fatal("Rising edge taken for falling sense")
+	}
+	sys.PortB.Drive(2, false)
+	sys.Run(100)
+	if sys.Cpu.GetReg(20) != 1 || sys.Cpu.GetPC() != 0x27 {
+		t.Error("INT0 not taken", sys.Cpu.GetReg(20), sys.Cpu.GetPC())
+	}
+}
@@ -0,0 +1,193 @@
+package atxmega128a1
+
+import "github.com/edmccard/avr-sim/core"
+
+// Data-space addresses of the CPU, virtual port and system registers.
+const (
+	GPIO0    core.Addr = 0x00
+	VPORT0   core.Addr = 0x10
+	VPORT1   core.Addr = 0x14
+	VPORT2   core.Addr = 0x18
+	VPORT3   core.Addr = 0x1c
+	CCP      core.Addr = 0x34
+	RAMPD    core.Addr = 0x38
+	RAMPX    core.Addr = 0x39
+	RAMPY    core.Addr = 0x3a
+	RAMPZ    core.Addr = 0x3b
+	EIND     core.Addr = 0x3c
+	SPL      core.Addr = 0x3d
+	SPH      core.Addr = 0x3e
+	SREG     core.Addr = 0x3f
+	CLKCTRL  core.Addr = 0x40
+	PSCTRL   core.Addr = 0x41
+	CLKLOCK  core.Addr = 0x42
+	RTCCTRL  core.Addr = 0x43
+	OSCCTRL  core.Addr = 0x50
+	OSCSTAT  core.Addr = 0x51
+	XOSCCTRL core.Addr = 0x52
+	PLLCTRL  core.Addr = 0x55
+	PMSTATUS core.Addr = 0xa0
+	INTPRI   core.Addr = 0xa1
+	PMCTRL   core.Addr = 0xa2
+	VPCTRLA  core.Addr = 0xb2
+	VPCTRLB  core.Addr = 0xb3
+)
+
+// Base addresses of the PORT modules; a port's number in VPCTRLA/B is
+// its offset from PortBase divided by dev.XPortSize.
+const (
+	PortBase core.Addr = 0x600
+	PORTA    core.Addr = 0x600
+	PORTB    core.Addr = 0x620
+	PORTC    core.Addr = 0x640
+	PORTD    core.Addr = 0x660
+	PORTE    core.Addr = 0x680
+	PORTF    core.Addr = 0x6a0
+	PORTH    core.Addr = 0x6e0
+	PORTJ    core.Addr = 0x700
+	PORTK    core.Addr = 0x720
+	PORTQ    core.Addr = 0x7c0
+	PORTR    core.Addr = 0x7e0
+)
+
+// Base addresses of the timer/counter modules.
+const (
+	TCC0 core.Addr = 0x800
+	TCC1 core.Addr = 0x840
+	TCD0 core.Addr = 0x900
+	TCD1 core.Addr = 0x940
+	TCE0 core.Addr = 0xa00
+	TCE1 core.Addr = 0xa40
+	TCF0 core.Addr = 0xb00
+	TCF1 core.Addr = 0xb40
+)
+
+// Interrupt vectors.
+const (
+	VecReset = iota
+	VecOscXoscf
+	VecPortCInt0
+	VecPortCInt1
+	VecPortRInt0
+	VecPortRInt1
+	VecDmaCh0
+	VecDmaCh1
+	VecDmaCh2
+	VecDmaCh3
+	VecRtcOvf
+	VecRtcComp
+	VecTwicSlave
+	VecTwicMaster
+	VecTcc0Ovf
+	VecTcc0Err
+	VecTcc0CCA
+	VecTcc0CCB
+	VecTcc0CCC
+	VecTcc0CCD
+	VecTcc1Ovf
+	VecTcc1Err
+	VecTcc1CCA
+	VecTcc1CCB
+	VecSpic
+	VecUsartc0Rxc
+	VecUsartc0Dre
+	VecUsartc0Txc
+	VecUsartc1Rxc
+	VecUsartc1Dre
+	VecUsartc1Txc
+	VecAes
+	VecNvmEe
+	VecNvmSpm
+	VecPortBInt0
+	VecPortBInt1
+	VecAcbAc0
+	VecAcbAc1
+	VecAcbAcw
+	VecAdcbCh0
+	VecAdcbCh1
+	VecAdcbCh2
+	VecAdcbCh3
+	VecPortEInt0
+	VecPortEInt1
+	VecTwieSlave
+	VecTwieMaster
+	VecTce0Ovf
+	VecTce0Err
+	VecTce0CCA
+	VecTce0CCB
+	VecTce0CCC
+	VecTce0CCD
+	VecTce1Ovf
+	VecTce1Err
+	VecTce1CCA
+	VecTce1CCB
+	VecSpie
+	VecUsarte0Rxc
+	VecUsarte0Dre
+	VecUsarte0Txc
+	VecUsarte1Rxc
+	VecUsarte1Dre
+	VecUsarte1Txc
+	VecPortDInt0
+	VecPortDInt1
+	VecPortAInt0
+	VecPortAInt1
+	VecAcaAc0
+	VecAcaAc1
+	VecAcaAcw
+	VecAdcaCh0
+	VecAdcaCh1
+	VecAdcaCh2
+	VecAdcaCh3
+	VecTwidSlave
+	VecTwidMaster
+	VecTcd0Ovf
+	VecTcd0Err
+	VecTcd0CCA
+	VecTcd0CCB
+	VecTcd0CCC
+	VecTcd0CCD
+	VecTcd1Ovf
+	VecTcd1Err
+	VecTcd1CCA
+	VecTcd1CCB
+	VecSpid
+	VecUsartd0Rxc
+	VecUsartd0Dre
+	VecUsartd0Txc
+	VecUsartd1Rxc
+	VecUsartd1Dre
+	VecUsartd1Txc
+	VecPortQInt0
+	VecPortQInt1
+	VecPortHInt0
+	VecPortHInt1
+	VecPortJInt0
+	VecPortJInt1
+	VecPortKInt0
+	VecPortKInt1
+	vecReserved102
+	vecReserved103
+	VecPortFInt0
+	VecPortFInt1
+	VecTwifSlave
+	VecTwifMaster
+	VecTcf0Ovf
+	VecTcf0Err
+	VecTcf0CCA
+	VecTcf0CCB
+	VecTcf0CCC
+	VecTcf0CCD
+	VecTcf1Ovf
+	VecTcf1Err
+	VecTcf1CCA
+	VecTcf1CCB
+	VecSpif
+	VecUsartf0Rxc
+	VecUsartf0Dre
+	VecUsartf0Txc
+	VecUsartf1Rxc
+	VecUsartf1Dre
+	VecUsartf1Txc
+	VecCount
+)
@@ -0,0 +1,50 @@
+package atxmega128a1
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	FlashWords = 0x11000
+	BootStart  = 0x10000
+	PortCount  = 0x1000
+	SramStart  = 0x2000
+	SramBytes  = 0x2000
+)
+
+// The register file is not in the data space; I/O starts at 0, and
+// internal SRAM at SramStart. The mapped EEPROM and the external bus
+// interface are not modelled, and read as 0. Data addresses are
+// extended to 24 bits by the RAMP registers.
+type Mem struct {
+	*core.MemMap
+}
+
+// The reserved I/O addresses, as first-last ranges
+var reserved = [][2]core.Addr{
+	{0x20, 0x33}, {0x35, 0x37}, {0x6c0, 0x6df}, {0x740, 0x7bf},
+	{0xc00, 0xfff},
+}
+
+func NewMem(cpu *core.Cpu) *Mem {
+	mem := &Mem{core.NewMemMap(FlashWords)}
+	mem.AddIO(0, PortCount)
+	mem.AddSRAM(SramStart, SramBytes)
+
+	for _, r := range reserved {
+		mem.ReserveRange(r[0], r[1])
+	}
+	mem.SetRW(RAMPD, cpu.MemReadRampD, cpu.MemWriteRampD)
+	mem.SetRW(RAMPX, cpu.MemReadRampX, cpu.MemWriteRampX)
+	mem.SetRW(RAMPY, cpu.MemReadRampY, cpu.MemWriteRampY)
+	mem.SetRW(RAMPZ, cpu.MemReadRampZ, cpu.MemWriteRampZ)
+	mem.SetRW(EIND, cpu.MemReadEind, cpu.MemWriteEind)
+	mem.SetRW(SPL, cpu.MemReadSPL, cpu.MemWriteSPL)
+	mem.SetRW(SPH, cpu.MemReadSPH, cpu.MemWriteSPH)
+	mem.SetRW(SREG, cpu.MemReadSreg, cpu.MemWriteSreg)
+
+	return mem
+}
+
+func ignoreWrite(addr core.Addr, val byte) {
+}
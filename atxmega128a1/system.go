@@ -0,0 +1,189 @@
+package atxmega128a1
+
+import (
+	"io"
+
+	"github.com/edmccard/avr-sim/board"
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/dev"
+	"github.com/edmccard/avr-sim/instr"
+)
+
+// The RETI opcode, which the PMIC watches for to end an interrupt level
+const opReti = 0x9518
+
+type System struct {
+	*board.Board
+	Memory *Mem
+	Intr   *core.Interrupts
+	CCP    *dev.CCP
+	PMIC   *dev.PMIC
+	XClock *dev.XClock
+	PortA  *dev.XPort
+	PortB  *dev.XPort
+	PortC  *dev.XPort
+	PortD  *dev.XPort
+	PortE  *dev.XPort
+	PortF  *dev.XPort
+	PortH  *dev.XPort
+	PortJ  *dev.XPort
+	PortK  *dev.XPort
+	PortQ  *dev.XPort
+	PortR  *dev.XPort
+	ports  [16]*dev.XPort
+	vpctrl [2]byte
+}
+
+func NewSystem() *System {
+	// avrxmega7: no XCH, LAS, LAC or LAT
+	set := instr.NewSetXmega()
+	set[instr.Xch] = false
+	set[instr.Las] = false
+	set[instr.Lac] = false
+	set[instr.Lat] = false
+	set[instr.Break] = true
+	decoder := instr.NewDecoder(set)
+	cpu := core.NewCpu(core.Xmega, 0xff, 0xff, 0xff, 0xff, 0x01)
+	intr := core.NewInterrupts(VecCount)
+	timer := core.NewTimer()
+	mem := NewMem(cpu)
+	pmic := dev.NewPMIC(intr, VecCount)
+	sys := &System{
+		Memory: mem,
+		Intr:   intr,
+		CCP:    dev.NewCCP(timer),
+		PMIC:   pmic,
+		XClock: dev.NewXClock(timer),
+		vpctrl: [2]byte{0x10, 0x32},
+	}
+	sys.Board = board.New(cpu, &decoder, mem, timer, pmic, sys.vector)
+	sys.Clock.SetSource(sys.XClock)
+	sys.Blocked = sys.CCP.Active
+	sys.Executed = sys.executed
+	cpu.Reset(SramStart+SramBytes-1, 0)
+	mem.SetRW(CCP, sys.CCP.ReadCCP, sys.CCP.WriteCCP)
+
+	mem.SetRW(PMSTATUS, pmic.ReadSTATUS, pmic.WriteSTATUS)
+	mem.SetRW(INTPRI, pmic.ReadINTPRI, pmic.WriteINTPRI)
+	mem.SetRW(PMCTRL, pmic.ReadCTRL, pmic.ProtectCTRL(sys.CCP))
+
+	clk := sys.XClock
+	mem.SetRW(CLKCTRL, clk.ReadCTRL,
+		sys.CCP.Protect(sys.Clock.Changes(clk.WriteCTRL)))
+	mem.SetRW(PSCTRL, clk.ReadPSCTRL,
+		sys.CCP.Protect(sys.Clock.Changes(clk.WritePSCTRL)))
+	mem.SetRW(CLKLOCK, clk.ReadLOCK, sys.CCP.Protect(clk.WriteLOCK))
+	mem.SetRW(RTCCTRL, clk.ReadRTCCTRL, clk.WriteRTCCTRL)
+	mem.SetRW(OSCCTRL, clk.ReadOSCCTRL, clk.WriteOSCCTRL)
+	mem.SetRW(OSCSTAT, clk.ReadOSCSTATUS, clk.WriteOSCSTATUS)
+	mem.SetRW(XOSCCTRL, clk.ReadXOSCCTRL, clk.WriteXOSCCTRL)
+	mem.SetRW(PLLCTRL, clk.ReadPLLCTRL, clk.WritePLLCTRL)
+
+	sys.PortA = sys.addPort(PORTA, VecPortAInt0)
+	sys.PortB = sys.addPort(PORTB, VecPortBInt0)
+	sys.PortC = sys.addPort(PORTC, VecPortCInt0)
+	sys.PortD = sys.addPort(PORTD, VecPortDInt0)
+	sys.PortE = sys.addPort(PORTE, VecPortEInt0)
+	sys.PortF = sys.addPort(PORTF, VecPortFInt0)
+	sys.PortH = sys.addPort(PORTH, VecPortHInt0)
+	sys.PortJ = sys.addPort(PORTJ, VecPortJInt0)
+	sys.PortK = sys.addPort(PORTK, VecPortKInt0)
+	sys.PortQ = sys.addPort(PORTQ, VecPortQInt0)
+	sys.PortR = sys.addPort(PORTR, VecPortRInt0)
+	for i := 0; i < 2; i++ {
+		i := i
+		mem.SetRW(VPCTRLA+core.Addr(i),
+			func(addr core.Addr) byte { return sys.vpctrl[i] },
+			func(addr core.Addr, val byte) { sys.vpctrl[i] = val })
+	}
+	mem.SetModule(VPORT0, 16, sys.readVPort, sys.writeVPort)
+	return sys
+}
+
+func (sys *System) addPort(base core.Addr, vecInt0 int) *dev.XPort {
+	port := dev.NewXPort(sys.Intr, sys.PMIC, vecInt0, vecInt0+1)
+	sys.Memory.SetModule(base, dev.XPortSize, port.Read, port.Write)
+	sys.ports[(base-PortBase)/dev.XPortSize] = port
+	return port
+}
+
+// vport returns the port mapped to a virtual port register, and the
+// matching register offset in the PORT module.
+func (sys *System) vport(addr core.Addr) (*dev.XPort, core.Addr) {
+	n := uint(addr-VPORT0) / 4
+	sel := (sys.vpctrl[n/2] >> (4 * (n % 2))) & 0x0f
+	return sys.ports[sel], [4]core.Addr{0x00, 0x04, 0x08, 0x0c}[addr&3]
+}
+
+func (sys *System) readVPort(addr core.Addr) byte {
+	port, off := sys.vport(addr)
+	if port == nil {
+		return 0
+	}
+	return port.Read(off)
+}
+
+func (sys *System) writeVPort(addr core.Addr, val byte) {
+	if port, off := sys.vport(addr); port != nil {
+		port.Write(off, val)
+	}
+}
+
+func (sys *System) LoadProgHex(data io.Reader) {
+	sys.Memory.LoadHex(data)
+}
+
+// vector returns the address of a PMIC vector, which is in the boot
+// section if IVSEL is set.
+func (sys *System) vector(vec int) int {
+	base := 0
+	if sys.PMIC.IVSEL() {
+		base = BootStart
+	}
+	return base + 2*vec
+}
+
+// executed ends the current interrupt level after a RETI.
+func (sys *System) executed(pc int) {
+	if sys.Memory.ReadProgram(core.Addr(pc)) == opReti {
+		sys.PMIC.Reti()
+	}
+}
+
+// The timer/counters of ports C to F, and their first vectors
+var timers = [4]struct {
+	port   core.Addr
+	tc0    core.Addr
+	vecTC0 int
+	vecTC1 int
+}{
+	{PORTC, TCC0, VecTcc0Ovf, VecTcc1Ovf},
+	{PORTD, TCD0, VecTcd0Ovf, VecTcd1Ovf},
+	{PORTE, TCE0, VecTce0Ovf, VecTce1Ovf},
+	{PORTF, TCF0, VecTcf0Ovf, VecTcf1Ovf},
+}
+
+func (sys *System) port(base core.Addr) *dev.XPort {
+	return sys.ports[(base-PortBase)/dev.XPortSize]
+}
+
+// AddTC0 wires in timer/counter 0 of port C, D, E or F (n from 0 to
+// 3), with its compare outputs on pins 0-3 of that port.
+func (sys *System) AddTC0(n int) *dev.XTimer {
+	t := timers[n]
+	tc := dev.NewXTimer(sys.Timer, sys.Intr, sys.PMIC, t.vecTC0, 4)
+	tc.AttachOutputs(sys.port(t.port).Port, 0)
+	sys.Memory.SetModule(t.tc0, dev.XTimerSize, tc.Read, tc.Write)
+	return tc
+}
+
+// AddTC1 wires in timer/counter 1 of port C, D, E or F (n from 0 to
+// 3), with its compare outputs on pins 4 and 5 of that port.
+func (sys *System) AddTC1(n int) *dev.XTimer {
+	t := timers[n]
+	tc := dev.NewXTimer(sys.Timer, sys.Intr, sys.PMIC, t.vecTC1, 2)
+	tc.AttachOutputs(sys.port(t.port).Port, 4)
+	sys.Memory.SetModule(t.tc0+TCC1-TCC0, dev.XTimerSize, tc.Read,
+		tc.Write)
+	return tc
+}
@@ -0,0 +1,103 @@
+package atxmega128a1
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func load(sys *System, at int, ops ...uint16) {
+	for i, op := range ops {
+		sys.Memory.WriteProgram(core.Addr(at+i), op)
+	}
+}
+
+// timerProg sets PORTC pins 0-3 as outputs, drives 0x05 on them, and
+// starts TCC0 overflowing every 100 cycles at low level.
+var timerProg = []uint16{
+	0xe00f,         // ldi r16, 0x0f
+	0x9300, 0x0640, // sts PORTC_DIR, r16
+	0xe005,         // ldi r16, 0x05
+	0x9300, 0x0644, // sts PORTC_OUT, r16
+	0xe603,         // ldi r16, 99
+	0x9300, 0x0826, // sts TCC0_PERL, r16
+	0xe000,         // ldi r16, 0
+	0x9300, 0x0827, // sts TCC0_PERH, r16
+	0xe001,         // ldi r16, 0x01
+	0x9300, 0x0806, // sts TCC0_INTCTRLA, r16
+	0x9300, 0x0800, // sts TCC0_CTRLA, r16
+}
+
+func TestSystemInterrupt(t *testing.T) {
+	sys := NewSystem()
+	sys.AddTC0(0)
+	load(sys, 0, 0x940c, 0x0100)            // jmp 0x100
+	load(sys, 2*VecTcc0Ovf, 0x940c, 0x0200) // jmp 0x200
+	load(sys, 0x100, timerProg...)
+	load(sys, 0x100+len(timerProg),
+		0x9300, 0x00a2, // sts PMIC_CTRL, r16
+		0x9478, // sei
+		0xcfff, // rjmp .-1
+	)
+	load(sys, 0x200,
+		0x9110, 0x0648, // lds r17, PORTC_IN
+		0x9120, 0x00a0, // lds r18, PMIC_STATUS
+		0x9543, // inc r20
+		0x9518, // reti
+	)
+	entered := false
+	sys.OnStep(func() {
+		if sys.Cpu.GetPC() == 2*VecTcc0Ovf {
+			entered = true
+		}
+	})
+	sys.PortC.Port.Drive(4, true)
+	sys.Run(150)
+	if !entered || sys.Cpu.GetReg(20) != 1 {
+		t.Fatal("Vector not taken", sys.Cpu.GetReg(20))
+	}
+	if sys.Cpu.GetReg(17) != 0x15 || sys.PortC.Port.Levels() != 0x15 {
+		t.Error("Bad port I/O", sys.Cpu.GetReg(17), sys.PortC.Port.Levels())
+	}
+	if sys.Cpu.GetReg(18) != 0x01 {
+		t.Error("Low level not executing", sys.Cpu.GetReg(18))
+	}
+	if sys.PMIC.ReadSTATUS(PMSTATUS) != 0 ||
+		sys.Cpu.GetSP() != SramStart+SramBytes-1 {
+		t.Error("RETI did not end the level", sys.PMIC.ReadSTATUS(PMSTATUS),
+			sys.Cpu.GetSP())
+	}
+	sys.Run(100)
+	if sys.Cpu.GetReg(20) != 2 {
+		t.Error("Second interrupt not taken", sys.Cpu.GetReg(20))
+	}
+}
+
+func TestSystemIVSEL(t *testing.T) {
+	sys := NewSystem()
+	sys.AddTC0(0)
+	load(sys, 0, 0x940c, 0x0100) // jmp 0x100
+	load(sys, 0x100, timerProg...)
+	load(sys, 0x100+len(timerProg),
+		0xed18,         // ldi r17, 0xd8
+		0xe401,         // ldi r16, 0x41
+		0x9300, 0x00a2, // sts PMIC_CTRL, r16
+		0xbf14,         // out CCP, r17
+		0x9300, 0x00a2, // sts PMIC_CTRL, r16
+		0x9478, // sei
+		0xcfff, // rjmp .-1
+	)
+	load(sys, 2*VecTcc0Ovf,
+		0x9543, // inc r20
+		0x9518, // reti
+	)
+	load(sys, BootStart+2*VecTcc0Ovf,
+		0x9553, // inc r21
+		0x9518, // reti
+	)
+	sys.Run(150)
+	if sys.Cpu.GetReg(20) != 0 || sys.Cpu.GetReg(21) != 1 {
+		t.Error("Vector not in boot section", sys.Cpu.GetReg(20),
+			sys.Cpu.GetReg(21))
+	}
+}
@@ -0,0 +1,228 @@
+// Package board holds what the device packages' Systems share: stepping
+// the CPU and its timer and taking interrupts, tracing, and running as
+// fast as possible or in real time.
+package board
+
+import (
+	"errors"
+	"time"
+
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/dev"
+	"github.com/edmccard/avr-sim/instr"
+)
+
+// Memory is the data and program memory of a system: a core.MemMap,
+// possibly with some methods replaced by the device.
+type Memory interface {
+	core.Memory
+	SetRW(addr core.Addr, r core.MemRead, w core.MemWrite)
+	Writer(addr core.Addr) core.MemWrite
+	SetWriter(addr core.Addr, f core.MemWrite)
+	CheckAccess()
+	Fault() *core.MemFault
+	ClearFault()
+}
+
+// An Interrupter chooses the interrupt to take next, as
+// core.Interrupts and dev.PMIC do.
+type Interrupter interface {
+	Pending() int
+	Ack(vec int)
+}
+
+// ErrNoClock is returned by Go when the CPU clock frequency is 0, as
+// when an external clock is selected but its frequency was never set.
+var ErrNoClock = errors.New("board: CPU clock frequency is 0")
+
+// A Board steps a CPU and its timer. After each instruction it takes
+// the pending interrupt, if the CPU allows it, at the address given by
+// the vector function, and then calls the functions added by OnStep.
+// The hooks let a device change this.
+type Board struct {
+	Cpu     *core.Cpu
+	Decoder *instr.Decoder
+	Timer   *core.Timer
+	// Clock is the CPU clock, which Go follows; its source is 0 Hz
+	// until the device sets it.
+	Clock *dev.Clock
+	// Wait, if not nil, is called before each instruction; if it
+	// returns a positive count, the CPU idles for that many cycles
+	// instead, as it does in reset.
+	Wait func() int64
+	// Blocked, if not nil, is called after each instruction, and
+	// reports whether interrupts are held off.
+	Blocked func() bool
+	// Executed, if not nil, is called after each instruction with the
+	// address it was fetched from.
+	Executed func(pc int)
+	mem      Memory
+	intr     Interrupter
+	vector   func(vec int) int
+	onStep   []func()
+	err      error
+}
+
+// New returns a board running cpu on mem, taking interrupts from intr;
+// vector returns the word address of vector vec.
+func New(cpu *core.Cpu, decoder *instr.Decoder, mem Memory,
+	timer *core.Timer, intr Interrupter, vector func(vec int) int) *Board {
+
+	return &Board{
+		Cpu:     cpu,
+		Decoder: decoder,
+		Timer:   timer,
+		Clock:   dev.NewClock(timer, dev.FixedClock(0)),
+		mem:     mem,
+		intr:    intr,
+		vector:  vector,
+	}
+}
+
+// MapPort wires a mega-style port into mem at its PINx, DDRx and PORTx
+// addresses.
+func MapPort(mem Memory, port *dev.Port, pin, ddr, out core.Addr) {
+	mem.SetRW(pin, port.ReadPIN, port.WritePIN)
+	mem.SetRW(ddr, port.ReadDDR, port.WriteDDR)
+	mem.SetRW(out, port.ReadPORT, port.WritePORT)
+}
+
+// AddOsc makes the internal RC oscillator osc the source of Clock, and
+// maps its OSCCAL register at osccal.
+func (b *Board) AddOsc(osc *dev.RCOscillator, osccal core.Addr) {
+	b.Clock.SetSource(osc)
+	b.mem.SetRW(osccal, osc.ReadOSCCAL, b.Clock.Changes(osc.WriteOSCCAL))
+}
+
+func (b *Board) Step() uint {
+	if b.Wait != nil {
+		if cycles := b.Wait(); cycles > 0 {
+			b.Timer.Tick(cycles)
+			return uint(cycles)
+		}
+	}
+	pc := b.Cpu.GetPC()
+	elapsed := b.Cpu.Step(b.mem, b.Decoder)
+	if b.Executed != nil {
+		b.Executed(pc)
+	}
+	b.Timer.Tick(int64(elapsed))
+	blocked := b.Blocked != nil && b.Blocked()
+	if !blocked && b.Cpu.Interruptible() {
+		if vec := b.intr.Pending(); vec >= 0 {
+			b.intr.Ack(vec)
+			cycles := b.Cpu.Interrupt(b.mem, b.vector(vec))
+			b.Timer.Tick(int64(cycles))
+			elapsed += cycles
+		}
+	}
+	if f := b.mem.Fault(); f != nil && b.err == nil {
+		f.PC = pc
+		b.err = f
+	}
+	if f := b.Cpu.StackFault(); f != nil && b.err == nil {
+		f.PC = pc
+		b.err = f
+	}
+	for _, f := range b.onStep {
+		f()
+	}
+	return elapsed
+}
+
+// CheckAccess enables access checking: accesses to unmapped or reserved
+// addresses, and reads of SRAM that has not been written, stop the
+// system with a *core.MemFault.
+func (b *Board) CheckAccess() {
+	b.mem.CheckAccess()
+}
+
+// Err returns the reason the system stopped, or nil.
+func (b *Board) Err() error {
+	return b.err
+}
+
+// ClearErr clears the stop reason, so that the system can be resumed.
+func (b *Board) ClearErr() {
+	b.err = nil
+	b.mem.ClearFault()
+	b.Cpu.ClearStackFault()
+}
+
+// OnStep adds a function to be called after every step.
+func (b *Board) OnStep(f func()) {
+	b.onStep = append(b.onStep, f)
+}
+
+// TraceCPU records the CPU state in vcd after every step.
+func (b *Board) TraceCPU(vcd *dev.VCD) {
+	vcd.AddCPU(b.Cpu)
+	b.OnStep(vcd.SampleCPU)
+}
+
+// TraceRegister records the values written to the I/O register at addr
+// in vcd. Add the register's device first.
+func (b *Board) TraceRegister(vcd *dev.VCD, name string, addr core.Addr) {
+	b.mem.SetWriter(addr, vcd.TraceWrite(name, b.mem.Writer(addr)))
+}
+
+// Run steps the system for at least cycles cycles, as fast as possible,
+// and returns the cycles used. It stops early if Err is not nil.
+func (b *Board) Run(cycles int64) int64 {
+	elapsed := int64(0)
+	for elapsed < cycles && b.err == nil {
+		elapsed += int64(b.Step())
+	}
+	return elapsed
+}
+
+type SliceFunc func() error
+
+// Go runs the system in real time, following Clock, and calls onSlice
+// after each 1/slicePerSec seconds. It stops when quit is closed, or
+// when Err or onSlice returns an error, or with ErrNoClock; done then
+// receives the error, or nil, and is closed.
+func (b *Board) Go(slicePerSec int,
+	onSlice SliceFunc) (quit chan struct{}, done <-chan error) {
+
+	slice := time.Second / time.Duration(slicePerSec)
+	quit = make(chan struct{})
+	result := make(chan error, 1)
+	ticker := time.NewTicker(slice)
+
+	go func() {
+		defer close(result)
+		defer ticker.Stop()
+		next := b.Clock.Now()
+		for {
+			select {
+			case <-ticker.C:
+				next += slice
+				err := b.runUntil(next)
+				if err == nil {
+					err = onSlice()
+				}
+				if err != nil {
+					result <- err
+					return
+				}
+			case <-quit:
+				result <- nil
+				return
+			}
+		}
+	}()
+
+	return quit, result
+}
+
+// runUntil steps the system until Clock reaches next.
+func (b *Board) runUntil(next time.Duration) error {
+	for b.err == nil && b.Clock.Now() < next {
+		if b.Clock.Hertz() == 0 {
+			return ErrNoClock
+		}
+		b.Step()
+	}
+	return b.err
+}
@@ -0,0 +1,134 @@
+package board
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/avr-sim/dev"
+	"github.com/edmccard/avr-sim/instr"
+)
+
+func newTestBoard() (*Board, *core.MemMap, *core.Interrupts) {
+	cpu := core.NewCpu(core.Mega, 0, 0, 0, 0, 0)
+	decoder := instr.NewDecoder(instr.NewSetEnhanced8k())
+	mem := core.NewMemMap(0x1000)
+	mem.Size = 0x200
+	mem.AddRegisterFile(cpu)
+	mem.AddIO(0x20, 0x40)
+	mem.AddSRAM(0x60, 0x200-0x60)
+	mem.SetRW(0x5d, cpu.MemReadSPL, cpu.MemWriteSPL)
+	mem.SetRW(0x5e, cpu.MemReadSPH, cpu.MemWriteSPH)
+	mem.SetRW(0x5f, cpu.MemReadSreg, cpu.MemWriteSreg)
+	cpu.Reset(0x1ff, 0)
+	intr := core.NewInterrupts(4)
+	b := New(cpu, &decoder, mem, core.NewTimer(), intr,
+		func(vec int) int { return 0x40 + 3*vec })
+	return b, mem, intr
+}
+
+func TestStepInterrupt(t *testing.T) {
+	b, mem, intr := newTestBoard()
+	for i, op := range []uint16{
+		0x9478, // sei
+		0x0000, // nop
+		0xcfff, // rjmp .-1
+	} {
+		mem.WriteProgram(core.Addr(i), op)
+	}
+	intr.SetAck(2, func() { intr.Set(2, false) })
+	blocked := true
+	b.Blocked = func() bool { return blocked }
+	b.Run(2)
+	intr.Set(2, true)
+	b.Run(4)
+	if b.Cpu.GetPC() != 2 {
+		t.Error("Interrupt taken while blocked", b.Cpu.GetPC())
+	}
+	blocked = false
+	b.Step()
+	if b.Cpu.GetPC() != 0x46 || intr.IsSet(2) {
+		t.Error("Bad vector address", b.Cpu.GetPC())
+	}
+}
+
+func TestStepHooks(t *testing.T) {
+	b, mem, _ := newTestBoard()
+	mem.WriteProgram(0, 0xcfff) // rjmp .-1
+	wait := int64(100)
+	b.Wait = func() int64 {
+		w := wait
+		wait = 0
+		return w
+	}
+	var pcs []int
+	b.Executed = func(pc int) { pcs = append(pcs, pc) }
+	steps := 0
+	b.OnStep(func() { steps++ })
+	if elapsed := b.Step(); elapsed != 100 || len(pcs) != 0 {
+		t.Error("Wait did not idle", elapsed, pcs)
+	}
+	b.Step()
+	if len(pcs) != 1 || pcs[0] != 0 || steps != 1 {
+		t.Error("Bad hooks", pcs, steps)
+	}
+}
+
+func TestRunFault(t *testing.T) {
+	b, mem, _ := newTestBoard()
+	mem.Unmapped = core.Trap
+	for i, op := range []uint16{
+		0x9100, 0x0400, // lds r16, 0x0400
+		0x0000, // nop
+	} {
+		mem.WriteProgram(core.Addr(i), op)
+	}
+	b.Run(100)
+	var f *core.MemFault
+	if !errors.As(b.Err(), &f) || f.PC != 0 || b.Cpu.GetPC() != 2 {
+		t.Fatal("No fault", b.Err())
+	}
+	b.ClearErr()
+	if b.Err() != nil || mem.Fault() != nil {
+		t.Error("Fault not cleared")
+	}
+}
+
+func TestGoDone(t *testing.T) {
+	b, mem, _ := newTestBoard()
+	mem.WriteProgram(0, 0xcfff) // rjmp .-1
+	b.Clock.SetSource(dev.FixedClock(100000))
+	stop := errors.New("stop")
+	slices := 0
+	_, done := b.Go(100, func() error {
+		if slices++; slices == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err := <-done; err != stop {
+		t.Error("Bad result", err)
+	}
+	if _, ok := <-done; ok {
+		t.Error("done not closed")
+	}
+
+	if cycles := b.Timer.GetCount(); cycles < 3000 {
+		t.Error("Too few cycles", cycles)
+	}
+
+	quit, done := b.Go(100, func() error { return nil })
+	close(quit)
+	if err := <-done; err != nil {
+		t.Error("Bad result after quit", err)
+	}
+}
+
+func TestGoNoClock(t *testing.T) {
+	b, mem, _ := newTestBoard()
+	mem.WriteProgram(0, 0xcfff) // rjmp .-1
+	_, done := b.Go(100, func() error { return nil })
+	if err := <-done; err != ErrNoClock {
+		t.Error("Bad result with no clock", err)
+	}
+}
@@ -10,9 +10,19 @@ type Cpu struct {
 	ramp   [5]int // D,X,Y,Z,EIND
 	rmask  [5]int
 	skip   bool
+	iblock bool
 	ops    instr.Operands
 	cycles uint
 	family Family
+	progZ  bool
+	stack  *stackCheck
+	hooks  *cpuHooks
+}
+
+// Handlers for instructions that act outside the CPU.
+type cpuHooks struct {
+	wdr func()
+	spm func(addr Addr, data uint16)
 }
 
 func NewCpu(family Family, dmask, xmask, ymask, zmask, emask byte) *Cpu {
@@ -66,6 +76,7 @@ func (c *Cpu) Reset(sp int, pc int) {
 
 func (c *Cpu) Step(mem Memory, d *instr.Decoder) uint {
 	c.cycles = 0
+	ie := c.flags[FlagI]
 	op, op2, mnem := c.fetch(mem, d)
 	d.DecodeOperands(&c.ops, mnem, op, op2)
 	opFuncs[mnem](c, &c.ops, mem)
@@ -73,6 +84,26 @@ func (c *Cpu) Step(mem Memory, d *instr.Decoder) uint {
 		c.skip = false
 		c.fetch(mem, d)
 	}
+	// the instruction after SEI or RETI always executes before any
+	// pending interrupt is serviced
+	c.iblock = !ie && c.flags[FlagI]
+	return c.cycles
+}
+
+func (c *Cpu) Interruptible() bool {
+	return c.flags[FlagI] && !c.iblock
+}
+
+// Interrupt pushes the return address and jumps to the vector at pc,
+// returning the number of cycles taken.
+func (c *Cpu) Interrupt(mem Memory, pc int) uint {
+	c.cycles = 0
+	pushPC(c, mem)
+	if c.family != Xmega {
+		c.flags[FlagI] = false
+	}
+	c.SetPC(pc)
+	c.cycles += 2
 	return c.cycles
 }
 
@@ -90,6 +121,23 @@ func (c *Cpu) fetch(mem Memory, d *instr.Decoder) (instr.Opcode, instr.Opcode,
 	return op, op2, mnem
 }
 
+// SetWDR sets the function called by the WDR instruction.
+func (c *Cpu) SetWDR(f func()) {
+	if c.hooks == nil {
+		c.hooks = &cpuHooks{}
+	}
+	c.hooks.wdr = f
+}
+
+// SetSPM sets the function called by the SPM instruction, with the Z
+// address (extended by RAMPZ) and R1:R0.
+func (c *Cpu) SetSPM(f func(addr Addr, data uint16)) {
+	if c.hooks == nil {
+		c.hooks = &cpuHooks{}
+	}
+	c.hooks.spm = f
+}
+
 func (c *Cpu) GetReg(r int) byte {
 	return byte(c.reg[r])
 }
@@ -173,6 +221,53 @@ func (c *Cpu) setRmask(reg Ramp, mask byte) {
 	c.rmask[reg] = (int(mask) << 16)
 }
 
+// SetProgramRampZ makes RAMPZ extend only program memory addresses
+// (ELPM and SPM), as on megas with more than 64K of flash; otherwise it
+// also extends data addresses through Z.
+func (c *Cpu) SetProgramRampZ(progOnly bool) {
+	c.progZ = progOnly
+}
+
+func (c *Cpu) MemReadRampD(addr Addr) byte {
+	return c.GetRamp(RampD)
+}
+
+func (c *Cpu) MemWriteRampD(addr Addr, val byte) {
+	c.SetRamp(RampD, val)
+}
+
+func (c *Cpu) MemReadRampX(addr Addr) byte {
+	return c.GetRamp(RampX)
+}
+
+func (c *Cpu) MemWriteRampX(addr Addr, val byte) {
+	c.SetRamp(RampX, val)
+}
+
+func (c *Cpu) MemReadRampY(addr Addr) byte {
+	return c.GetRamp(RampY)
+}
+
+func (c *Cpu) MemWriteRampY(addr Addr, val byte) {
+	c.SetRamp(RampY, val)
+}
+
+func (c *Cpu) MemReadRampZ(addr Addr) byte {
+	return c.GetRamp(RampZ)
+}
+
+func (c *Cpu) MemWriteRampZ(addr Addr, val byte) {
+	c.SetRamp(RampZ, val)
+}
+
+func (c *Cpu) MemReadEind(addr Addr) byte {
+	return c.GetRamp(Eind)
+}
+
+func (c *Cpu) MemWriteEind(addr Addr, val byte) {
+	c.SetRamp(Eind, val)
+}
+
 func (c *Cpu) GetSP() uint16 {
 	return uint16(c.sp)
 }
@@ -199,6 +294,9 @@ func (c *Cpu) SetSP(sp uint16) {
 
 func (c *Cpu) SetSPL(spl byte) {
 	c.sp = (c.sp & 0xff00) | int(spl)
+	if c.stack != nil {
+		c.checkSP()
+	}
 }
 
 func (c *Cpu) MemWriteSPL(addr Addr, val byte) {
@@ -222,26 +320,40 @@ func (c *Cpu) SetPC(pc int) {
 }
 
 func (c *Cpu) indirect(ireg instr.IndexReg, q int) int {
+	return c.index(ireg, q, !c.progZ || ireg.Base() != instr.Z)
+}
+
+// index computes an indirect address, extended by the matching RAMP
+// register if useRamp is set.
+func (c *Cpu) index(ireg instr.IndexReg, q int, useRamp bool) int {
 	base := ireg.Base()
 	action := ireg.Action()
 	r := 24 + base*2
-	addr := c.ramp[base] | c.reg[r] | (c.reg[r+1] << 8)
+	ramp, rmask := 0, 0
+	if useRamp {
+		ramp, rmask = c.ramp[base], c.rmask[base]
+	}
+	addr := ramp | c.reg[r] | (c.reg[r+1] << 8)
 	switch action {
 	case instr.NoAction:
 		c.cycles++
-		addr = (addr + int(q)) & (c.rmask[base] | 0xffff)
+		addr = (addr + int(q)) & (rmask | 0xffff)
 	case instr.PreDec:
 		c.cycles += 2
-		addr = (addr - 1) & (c.rmask[base] | 0xffff)
+		addr = (addr - 1) & (rmask | 0xffff)
 		c.reg[r] = addr & 0xff
 		c.reg[r+1] = (addr >> 8) & 0xff
-		c.ramp[base] = addr & c.rmask[base]
+		if useRamp {
+			c.ramp[base] = addr & rmask
+		}
 	case instr.PostInc:
 		c.cycles++
-		a2 := (addr + 1) & (c.rmask[base] | 0xffff)
+		a2 := (addr + 1) & (rmask | 0xffff)
 		c.reg[r] = a2 & 0xff
 		c.reg[r+1] = (a2 >> 8) & 0xff
-		c.ramp[base] = a2 & c.rmask[base]
+		if useRamp {
+			c.ramp[base] = a2 & rmask
+		}
 	}
 	if c.family != Mega {
 		c.cycles--
@@ -249,9 +361,22 @@ func (c *Cpu) indirect(ireg instr.IndexReg, q int) int {
 	return addr
 }
 
+// ioAddr returns the data address of an I/O register; on xmegas and
+// reduced-core tinies the register file is not mapped, and I/O starts
+// at 0.
+func (c *Cpu) ioAddr(a int) Addr {
+	if c.family != Mega {
+		return Addr(a)
+	}
+	return Addr(a + 0x20)
+}
+
 func (c *Cpu) spInc(offset int) {
 	c.sp = (c.sp + offset) & 0xffff
 	c.cycles++
+	if offset < 0 && c.stack != nil {
+		c.checkSP()
+	}
 }
 
 func (c *Cpu) pcInc(offset int) {
@@ -650,10 +775,18 @@ func sts(cpu *Cpu, o *instr.Operands, mem Memory) {
 	mem.WriteData(Addr(cpu.ramp[RampD]|o.Off), byte(cpu.reg[o.Src]))
 }
 
+func lds16(cpu *Cpu, o *instr.Operands, mem Memory) {
+	cpu.reg[o.Dst] = int(mem.ReadData(Addr(o.Off)))
+}
+
+func sts16(cpu *Cpu, o *instr.Operands, mem Memory) {
+	mem.WriteData(Addr(o.Off), byte(cpu.reg[o.Src]))
+}
+
 func push(cpu *Cpu, o *instr.Operands, mem Memory) {
 	mem.WriteData(Addr(cpu.sp), byte(cpu.reg[o.Src]))
 	cpu.spInc(-1)
-	if cpu.family == Xmega {
+	if cpu.family != Mega {
 		cpu.cycles--
 	}
 }
@@ -661,6 +794,9 @@ func push(cpu *Cpu, o *instr.Operands, mem Memory) {
 func pop(cpu *Cpu, o *instr.Operands, mem Memory) {
 	cpu.spInc(1)
 	cpu.reg[o.Dst] = int(mem.ReadData(Addr(cpu.sp)))
+	if cpu.family == Tiny {
+		cpu.cycles++
+	}
 }
 
 func brbs(cpu *Cpu, o *instr.Operands, mem Memory) {
@@ -753,13 +889,20 @@ func ret(cpu *Cpu, o *instr.Operands, mem Memory) {
 	popPC(cpu, mem)
 }
 
+// On xmegas the interrupt controller tracks interrupt levels, and RETI
+// leaves the I flag alone.
 func reti(cpu *Cpu, o *instr.Operands, mem Memory) {
 	popPC(cpu, mem)
-	cpu.flags[FlagI] = true
+	if cpu.family != Xmega {
+		cpu.flags[FlagI] = true
+	}
 }
 
 func popPC(cpu *Cpu, mem Memory) {
 	cpu.cycles++
+	if cpu.family == Tiny {
+		cpu.cycles += 2
+	}
 	cpu.pc = 0
 	if cpu.rmask[Eind] != 0 {
 		cpu.spInc(1)
@@ -822,27 +965,27 @@ func cpse(cpu *Cpu, o *instr.Operands, mem Memory) {
 }
 
 func sbic(cpu *Cpu, o *instr.Operands, mem Memory) {
-	if (mem.ReadData(Addr(o.Src+0x20)) & (1 << uint(o.Off))) == 0 {
+	if (mem.ReadData(cpu.ioAddr(o.Src)) & (1 << uint(o.Off))) == 0 {
 		cpu.skip = true
 	}
 }
 
 func sbis(cpu *Cpu, o *instr.Operands, mem Memory) {
-	if (mem.ReadData(Addr(o.Src+0x20)) & (1 << uint(o.Off))) != 0 {
+	if (mem.ReadData(cpu.ioAddr(o.Src)) & (1 << uint(o.Off))) != 0 {
 		cpu.skip = true
 	}
 }
 
 func in(cpu *Cpu, o *instr.Operands, mem Memory) {
-	cpu.reg[o.Dst] = int(mem.ReadData(Addr(o.Src + 0x20)))
+	cpu.reg[o.Dst] = int(mem.ReadData(cpu.ioAddr(o.Src)))
 }
 
 func out(cpu *Cpu, o *instr.Operands, mem Memory) {
-	mem.WriteData(Addr(o.Dst+0x20), byte(cpu.reg[o.Src]))
+	mem.WriteData(cpu.ioAddr(o.Dst), byte(cpu.reg[o.Src]))
 }
 
 func cbi(cpu *Cpu, o *instr.Operands, mem Memory) {
-	addr := Addr(o.Dst + 0x20)
+	addr := cpu.ioAddr(o.Dst)
 	val := mem.ReadData(addr) & ^(1 << uint(o.Off))
 	mem.WriteData(addr, val)
 	if cpu.family == Mega {
@@ -851,7 +994,7 @@ func cbi(cpu *Cpu, o *instr.Operands, mem Memory) {
 }
 
 func sbi(cpu *Cpu, o *instr.Operands, mem Memory) {
-	addr := Addr(o.Dst + 0x20)
+	addr := cpu.ioAddr(o.Dst)
 	val := mem.ReadData(addr) | (1 << uint(o.Off))
 	mem.WriteData(addr, val)
 	if cpu.family == Mega {
@@ -886,7 +1029,7 @@ func loadProgMem(cpu *Cpu, o *instr.Operands, mem Memory, noramp bool) {
 		tmpRamp = cpu.ramp[RampZ]
 		cpu.rmask[RampZ] = 0
 	}
-	addr := Addr(cpu.indirect(instr.IndexReg(o.Src), 0))
+	addr := Addr(cpu.index(instr.IndexReg(o.Src), 0, true))
 	cpu.reg[o.Dst] = int(mem.LoadProgram(addr))
 	if noramp {
 		cpu.rmask[RampZ] = tmpMask
@@ -895,6 +1038,19 @@ func loadProgMem(cpu *Cpu, o *instr.Operands, mem Memory, noramp bool) {
 	cpu.cycles = 3
 }
 
+func wdr(cpu *Cpu, o *instr.Operands, mem Memory) {
+	if cpu.hooks != nil && cpu.hooks.wdr != nil {
+		cpu.hooks.wdr()
+	}
+}
+
+func spm(cpu *Cpu, o *instr.Operands, mem Memory) {
+	if cpu.hooks != nil && cpu.hooks.spm != nil {
+		addr := Addr(cpu.index(instr.Z, 0, true))
+		cpu.hooks.spm(addr, uint16(cpu.reg[0])|uint16(cpu.reg[1])<<8)
+	}
+}
+
 type opFunc func(*Cpu, *instr.Operands, Memory)
 
 var opFuncs = [...]opFunc{
@@ -958,7 +1114,7 @@ var opFuncs = [...]opFunc{
 	ldd,    // Ldd
 	ldi,    // Ldi
 	lds,    // Lds
-	nop,    // Lds16 ****
+	lds16,  // Lds16
 	lpm,    // Lpm
 	lpme,   // LpmEnhanced
 	lsr,    // Lsr
@@ -999,7 +1155,7 @@ var opFuncs = [...]opFunc{
 	sbrs,   // Sbrs
 	sbrs,   // SbrsReduced
 	nop,    // Sleep ****
-	nop,    // Spm ****
+	spm,    // Spm
 	nop,    // SpmXmega ****
 	st,     // StClassic
 	st,     // StClassicReduced
@@ -1007,12 +1163,12 @@ var opFuncs = [...]opFunc{
 	st,     // StMinimalReduced
 	std,    // Std
 	sts,    // Sts
-	nop,    // Sts16 ****
+	sts16,  // Sts16
 	sub,    // Sub
 	sub,    // SubReduced
 	subi,   // Subi
 	swap,   // Swap
 	swap,   // SwapReduced
-	nop,    // Wdr ****
+	wdr,    // Wdr
 	xch,    // Xch
 }
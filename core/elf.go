@@ -0,0 +1,85 @@
+package core
+
+import (
+	"debug/elf"
+	"errors"
+	"io"
+)
+
+// Offsets of the address spaces in avr-gcc executables.
+const (
+	ELFData   = 0x800000
+	ELFEeprom = 0x810000
+)
+
+// An ELF holds what LoadELF read from an executable besides the
+// program.
+type ELF struct {
+	// Symbols maps names to values as in the file; data addresses are
+	// offset by ELFData.
+	Symbols map[string]int
+	// Fuse and Lock are the contents of the .fuse (low byte first) and
+	// .lock sections, or nil.
+	Fuse []byte
+	Lock []byte
+}
+
+// Data returns the data-space address of the symbol name.
+func (e *ELF) Data(name string) (Addr, bool) {
+	val, ok := e.Symbols[name]
+	if !ok || val < ELFData || val >= ELFEeprom {
+		return 0, false
+	}
+	return Addr(val - ELFData), true
+}
+
+// LoadELF loads the flash segments of an AVR executable; .data is
+// loaded at its flash address, to be copied by the startup code.
+func (m *MemMap) LoadELF(r io.ReaderAt) (*ELF, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if f.Machine != elf.EM_AVR {
+		return nil, errors.New("not an AVR executable")
+	}
+
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || p.Paddr >= ELFData || p.Filesz == 0 {
+			continue
+		}
+		data := make([]byte, p.Filesz+1)
+		if _, err := p.ReadAt(data[:p.Filesz], 0); err != nil {
+			return nil, err
+		}
+		addr := Addr(p.Paddr >> 1)
+		for i := uint64(0); i < p.Filesz; i += 2 {
+			m.WriteProgram(addr, uint16(data[i])|uint16(data[i+1])<<8)
+			addr++
+		}
+	}
+
+	e := &ELF{Symbols: make(map[string]int)}
+	for _, sec := range []struct {
+		name string
+		data *[]byte
+	}{{".fuse", &e.Fuse}, {".lock", &e.Lock}} {
+		if s := f.Section(sec.name); s != nil {
+			if *sec.data, err = s.Data(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	syms, err := f.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, err
+	}
+	for _, s := range syms {
+		if s.Name != "" {
+			e.Symbols[s.Name] = int(s.Value)
+		}
+	}
+	return e, nil
+}
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type elfSection struct {
+	name string
+	addr uint32
+	data []byte
+}
+
+// buildELF builds a minimal AVR executable, with a segment (at its
+// address) for each section, and a symbol table.
+func buildELF(sections []elfSection, syms map[string]uint32) []byte {
+	le := binary.LittleEndian
+	strtab := []byte("\x00.symtab\x00.strtab\x00")
+	var symtab bytes.Buffer
+	symtab.Write(make([]byte, 16))
+	for name, val := range syms {
+		var ent [16]byte
+		le.PutUint32(ent[0:], uint32(len(strtab)))
+		le.PutUint32(ent[4:], val)
+		le.PutUint16(ent[14:], 0xfff1) // SHN_ABS
+		symtab.Write(ent[:])
+		strtab = append(strtab, name...)
+		strtab = append(strtab, 0)
+	}
+	var names []uint32
+	for _, s := range sections {
+		names = append(names, uint32(len(strtab)))
+		strtab = append(strtab, s.name...)
+		strtab = append(strtab, 0)
+	}
+
+	const ehsize, phsize, shsize = 52, 32, 40
+	off := uint32(ehsize + phsize*len(sections))
+	var body bytes.Buffer
+	var phdrs, shdrs bytes.Buffer
+	shdrs.Write(make([]byte, shsize))
+	shdr := func(name, typ, offset, size, link, entsize uint32, addr uint32) {
+		var h [shsize]byte
+		le.PutUint32(h[0:], name)
+		le.PutUint32(h[4:], typ)
+		le.PutUint32(h[12:], addr)
+		le.PutUint32(h[16:], offset)
+		le.PutUint32(h[20:], size)
+		le.PutUint32(h[24:], link)
+		le.PutUint32(h[32:], 1)
+		le.PutUint32(h[36:], entsize)
+		shdrs.Write(h[:])
+	}
+	shdr(1, 2, off, uint32(symtab.Len()), 2, 16, 0)
+	body.Write(symtab.Bytes())
+	shdr(9, 3, off+uint32(body.Len()), uint32(len(strtab)), 0, 0, 0)
+	body.Write(strtab)
+	for i, s := range sections {
+		offset := off + uint32(body.Len())
+		shdr(names[i], 1, offset, uint32(len(s.data)), 0, 0, s.addr)
+		var h [phsize]byte
+		le.PutUint32(h[0:], 1) // PT_LOAD
+		le.PutUint32(h[4:], offset)
+		le.PutUint32(h[8:], s.addr)
+		le.PutUint32(h[12:], s.addr)
+		le.PutUint32(h[16:], uint32(len(s.data)))
+		le.PutUint32(h[20:], uint32(len(s.data)))
+		phdrs.Write(h[:])
+		body.Write(s.data)
+	}
+
+	var eh [ehsize]byte
+	copy(eh[:], "\x7fELF\x01\x01\x01")
+	le.PutUint16(eh[16:], 2)  // ET_EXEC
+	le.PutUint16(eh[18:], 83) // EM_AVR
+	le.PutUint32(eh[20:], 1)
+	le.PutUint32(eh[28:], ehsize)
+	le.PutUint32(eh[32:], off+uint32(body.Len()))
+	le.PutUint16(eh[40:], ehsize)
+	le.PutUint16(eh[42:], phsize)
+	le.PutUint16(eh[44:], uint16(len(sections)))
+	le.PutUint16(eh[46:], shsize)
+	le.PutUint16(eh[48:], uint16(shdrs.Len()/shsize))
+	le.PutUint16(eh[50:], 2)
+
+	var out bytes.Buffer
+	out.Write(eh[:])
+	out.Write(phdrs.Bytes())
+	out.Write(body.Bytes())
+	out.Write(shdrs.Bytes())
+	return out.Bytes()
+}
+
+func TestLoadELF(t *testing.T) {
+	exe := buildELF([]elfSection{
+		{".text", 0, []byte{0x0c, 0x94, 0x34, 0x00}},
+		{".data", 0x800100, []byte{0x55}},
+	}, map[string]uint32{"__stack": 0x80045f, "main": 0x68})
+	m := NewMemMap(0x100)
+	e, err := m.LoadELF(bytes.NewReader(exe))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ReadProgram(0) != 0x940c || m.ReadProgram(1) != 0x0034 {
+		t.Error("Bad program", m.ReadProgram(0), m.ReadProgram(1))
+	}
+	if m.ReadProgram(0x80) != 0 {
+		t.Error("Data segment loaded into flash")
+	}
+	if a, ok := e.Data("__stack"); !ok || a != 0x45f {
+		t.Error("Bad data symbol", a, ok)
+	}
+	if _, ok := e.Data("main"); ok || e.Symbols["main"] != 0x68 {
+		t.Error("Bad text symbol")
+	}
+	if e.Fuse != nil || e.Lock != nil {
+		t.Error("Unexpected fuses")
+	}
+	if _, err := m.LoadELF(bytes.NewReader([]byte("junk"))); err == nil {
+		t.Error("No error for bad file")
+	}
+}
+
+func TestLoadELFFuses(t *testing.T) {
+	exe := buildELF([]elfSection{
+		{".text", 0, []byte{0xff, 0xcf}},
+		{".fuse", 0x820000, []byte{0xe4, 0xd8}},
+		{".lock", 0x830000, []byte{0xcf}},
+	}, nil)
+	m := NewMemMap(0x100)
+	e, err := m.LoadELF(bytes.NewReader(exe))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Fuse) != 2 || e.Fuse[0] != 0xe4 || e.Fuse[1] != 0xd8 {
+		t.Error("Bad fuses", e.Fuse)
+	}
+	if len(e.Lock) != 1 || e.Lock[0] != 0xcf {
+		t.Error("Bad lock", e.Lock)
+	}
+	if m.ReadProgram(0) != 0xcfff || m.ReadProgram(0x10000) != 0xcfff {
+		t.Error("Bad program")
+	}
+}
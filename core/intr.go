@@ -0,0 +1,60 @@
+package core
+
+// Interrupts tracks the state of the interrupt request lines of a
+// device. Peripherals assert or release their line whenever their
+// flag/enable bits change; the device services the lowest-numbered
+// active vector.
+type Interrupts struct {
+	lines  []bool
+	acks   []func()
+	active int
+}
+
+func NewInterrupts(count int) *Interrupts {
+	return &Interrupts{
+		lines: make([]bool, count),
+		acks:  make([]func(), count),
+	}
+}
+
+func (in *Interrupts) Set(vec int, active bool) {
+	if in.lines[vec] == active {
+		return
+	}
+	in.lines[vec] = active
+	if active {
+		in.active++
+	} else {
+		in.active--
+	}
+}
+
+func (in *Interrupts) IsSet(vec int) bool {
+	return in.lines[vec]
+}
+
+// SetAck registers a function to be called when vec is serviced, for
+// peripherals whose flags are cleared by hardware on interrupt entry.
+func (in *Interrupts) SetAck(vec int, ack func()) {
+	in.acks[vec] = ack
+}
+
+// Pending returns the highest-priority active vector, or -1 if there
+// is none.
+func (in *Interrupts) Pending() int {
+	if in.active == 0 {
+		return -1
+	}
+	for vec, line := range in.lines {
+		if line {
+			return vec
+		}
+	}
+	return -1
+}
+
+func (in *Interrupts) Ack(vec int) {
+	if ack := in.acks[vec]; ack != nil {
+		ack()
+	}
+}
@@ -0,0 +1,58 @@
+package core
+
+import "testing"
+
+func TestInterruptsPending(t *testing.T) {
+	acked := 0
+	intr := NewInterrupts(8)
+	intr.SetAck(3, func() {
+		acked++
+		intr.Set(3, false)
+	})
+	if intr.Pending() != -1 {
+		t.Error("Pending with no active lines")
+	}
+	intr.Set(5, true)
+	intr.Set(3, true)
+	intr.Set(3, true)
+	if intr.Pending() != 3 {
+		t.Error("Lowest vector not given priority")
+	}
+	intr.Ack(3)
+	if acked != 1 || intr.Pending() != 5 {
+		t.Error("Ack did not release line")
+	}
+	intr.Set(5, false)
+	if intr.Pending() != -1 {
+		t.Error("Released line still pending")
+	}
+}
+
+func TestInterruptEntry(t *testing.T) {
+	s := newsystem()
+	s.cpu.pc = 0x123
+	s.cpu.sp = 0x45f
+	s.cpu.flags[FlagI] = true
+	cycles := s.cpu.Interrupt(&s.mem, 0x0e)
+	if cycles != 4 || s.cpu.pc != 0x0e || s.cpu.sp != 0x45d ||
+		s.cpu.flags[FlagI] {
+		t.Error("Bad interrupt entry state")
+	}
+	if s.mem.data[0x45f] != 0x23 || s.mem.data[0x45e] != 0x01 {
+		t.Error("Bad interrupt return address")
+	}
+}
+
+func TestInterruptBlocked(t *testing.T) {
+	s := newsystem()
+	s.mem.prog[0] = 0x9478 // sei
+	s.mem.prog[1] = 0x0000 // nop
+	s.cpu.Step(&s.mem, &decoder)
+	if s.cpu.Interruptible() {
+		t.Error("Interrupt allowed immediately after SEI")
+	}
+	s.cpu.Step(&s.mem, &decoder)
+	if !s.cpu.Interruptible() {
+		t.Error("Interrupt not allowed after SEI+1")
+	}
+}
@@ -0,0 +1,350 @@
+package core
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/edmccard/ihex"
+)
+
+// Unmapped-address policies
+type Unmapped int
+
+const (
+	// Unmapped reads return 0, and writes are ignored.
+	ReadZero Unmapped = iota
+	// Addresses wrap modulo the size of the data space.
+	Wrap
+	// Unmapped accesses record a MemFault.
+	Trap
+)
+
+// Kinds of MemFault
+type FaultKind int
+
+const (
+	// An address outside every region.
+	FaultUnmapped FaultKind = iota
+	// A reserved I/O address.
+	FaultReserved
+	// A read of SRAM that has not been written.
+	FaultUninit
+)
+
+// A MemFault is a checked access to an unmapped or reserved address, or
+// to uninitialized SRAM. PC, a word address, is filled in by the
+// system that steps the CPU.
+type MemFault struct {
+	Kind  FaultKind
+	Addr  Addr
+	Write bool
+	PC    int
+}
+
+func (f *MemFault) Error() string {
+	op := "read"
+	if f.Write {
+		op = "write"
+	}
+	what := "unmapped address"
+	switch f.Kind {
+	case FaultReserved:
+		what = "reserved I/O address"
+	case FaultUninit:
+		what = "uninitialized address"
+	}
+	return fmt.Sprintf("%s of %s 0x%04x at PC 0x%04x", op, what,
+		int(f.Addr), f.PC)
+}
+
+type memRegion struct {
+	start Addr
+	end   Addr
+	read  MemRead
+	write MemWrite
+}
+
+// A MemMap is a Memory whose data space is declared as a list of
+// regions: the register file and I/O registers, which have a handler
+// for each address, and ranges such as SRAM or external memory windows
+// with a handler for the whole range.
+type MemMap struct {
+	// Unmapped is the policy for addresses outside every region.
+	Unmapped Unmapped
+	// Size is the size of the data space, for the Wrap policy.
+	Size int
+	// CheckUninit enables faults for reads of SRAM bytes that have not
+	// been written.
+	CheckUninit bool
+	// OnFault, if not nil, is called for each fault.
+	OnFault  func(f *MemFault)
+	prog     []uint16
+	inports  []MemRead
+	outports []MemWrite
+	reserved []bool
+	regions  []memRegion
+	fault    *MemFault
+	ioRegs   [][]byte
+	valid    [][]bool
+}
+
+func NewMemMap(flashWords int) *MemMap {
+	return &MemMap{prog: make([]uint16, flashWords)}
+}
+
+func (m *MemMap) growPorts(end int) {
+	for len(m.inports) < end {
+		m.inports = append(m.inports, nil)
+		m.outports = append(m.outports, nil)
+		m.reserved = append(m.reserved, false)
+	}
+}
+
+// AddRegisterFile maps the CPU registers at addresses 0-31.
+func (m *MemMap) AddRegisterFile(cpu *Cpu) {
+	m.growPorts(32)
+	for i := 0; i < 32; i++ {
+		m.inports[i] = cpu.MemReadReg
+		m.outports[i] = cpu.MemWriteReg
+	}
+}
+
+// AddIO maps count I/O registers from start, which act as plain memory
+// until a device sets their handlers. Standard and extended I/O are
+// added separately, so that reserved ranges between them stay
+// unmapped.
+func (m *MemMap) AddIO(start Addr, count int) {
+	m.growPorts(int(start) + count)
+	regs := make([]byte, count)
+	m.ioRegs = append(m.ioRegs, regs)
+	read := func(addr Addr) byte {
+		return regs[addr-start]
+	}
+	write := func(addr Addr, val byte) {
+		regs[addr-start] = val
+	}
+	for i := 0; i < count; i++ {
+		m.inports[int(start)+i] = read
+		m.outports[int(start)+i] = write
+	}
+}
+
+// AddSRAM maps size bytes of RAM from start, and returns them. Each
+// byte has a shadow bit recording whether it has been written, for
+// CheckUninit.
+func (m *MemMap) AddSRAM(start Addr, size int) []byte {
+	data := make([]byte, size)
+	valid := make([]bool, size)
+	m.valid = append(m.valid, valid)
+	m.AddRegion(start, size,
+		func(addr Addr) byte {
+			if m.CheckUninit && !valid[addr-start] {
+				m.addFault(FaultUninit, addr, false)
+			}
+			return data[addr-start]
+		},
+		func(addr Addr, val byte) {
+			data[addr-start] = val
+			valid[addr-start] = true
+		})
+	return data
+}
+
+// ResetIO clears the I/O registers that have no device handlers.
+func (m *MemMap) ResetIO() {
+	for _, regs := range m.ioRegs {
+		for i := range regs {
+			regs[i] = 0
+		}
+	}
+}
+
+// InvalidateSRAM marks all of SRAM as not written, as after power-on.
+func (m *MemMap) InvalidateSRAM() {
+	for _, valid := range m.valid {
+		for i := range valid {
+			valid[i] = false
+		}
+	}
+}
+
+// Reserve unmaps the I/O register at addr; it is treated like an
+// unmapped address, but faults as reserved.
+func (m *MemMap) Reserve(addr Addr) {
+	m.SetRW(addr, nil, nil)
+	m.reserved[addr] = true
+}
+
+// ReserveRange reserves the I/O registers from first to last.
+func (m *MemMap) ReserveRange(first, last Addr) {
+	for addr := first; addr <= last; addr++ {
+		m.Reserve(addr)
+	}
+}
+
+// AddRegion maps size addresses from start to handlers, such as those
+// of an external memory window. Regions are kept in address order, so
+// that lookups can stop early.
+func (m *MemMap) AddRegion(start Addr, size int, r MemRead, w MemWrite) {
+	i := 0
+	for i < len(m.regions) && m.regions[i].start < start {
+		i++
+	}
+	m.regions = append(m.regions, memRegion{})
+	copy(m.regions[i+1:], m.regions[i:])
+	m.regions[i] = memRegion{start, start + Addr(size), r, w}
+}
+
+func (m *MemMap) SetWriter(addr Addr, f MemWrite) {
+	m.outports[addr] = f
+}
+
+func (m *MemMap) SetReader(addr Addr, f MemRead) {
+	m.inports[addr] = f
+}
+
+func (m *MemMap) Writer(addr Addr) MemWrite {
+	return m.outports[addr]
+}
+
+func (m *MemMap) Reader(addr Addr) MemRead {
+	return m.inports[addr]
+}
+
+func (m *MemMap) SetRW(addr Addr, r MemRead, w MemWrite) {
+	m.SetReader(addr, r)
+	m.SetWriter(addr, w)
+}
+
+// SetModule sets the handlers of size registers from base, as for an
+// xmega peripheral module.
+func (m *MemMap) SetModule(base Addr, size int, r MemRead, w MemWrite) {
+	for i := 0; i < size; i++ {
+		m.SetRW(base+Addr(i), r, w)
+	}
+}
+
+// CheckAccess enables access checking: accesses outside every region
+// or to reserved I/O registers, and reads of SRAM that has not been
+// written, record a MemFault.
+func (m *MemMap) CheckAccess() {
+	m.Unmapped = Trap
+	m.CheckUninit = true
+}
+
+// Fault returns the first fault since the last ClearFault, or
+// nil.
+func (m *MemMap) Fault() *MemFault {
+	return m.fault
+}
+
+func (m *MemMap) ClearFault() {
+	m.fault = nil
+}
+
+func (m *MemMap) unmapped(addr Addr, write bool) {
+	if m.Unmapped != Trap {
+		return
+	}
+	kind := FaultUnmapped
+	if int(addr) < len(m.reserved) && m.reserved[addr] {
+		kind = FaultReserved
+	}
+	m.addFault(kind, addr, write)
+}
+
+func (m *MemMap) addFault(kind FaultKind, addr Addr, write bool) {
+	f := &MemFault{Kind: kind, Addr: addr, Write: write}
+	if m.fault == nil {
+		m.fault = f
+	}
+	if m.OnFault != nil {
+		m.OnFault(f)
+	}
+}
+
+func (m *MemMap) region(addr Addr) *memRegion {
+	for i := range m.regions {
+		if addr < m.regions[i].start {
+			break
+		}
+		if addr < m.regions[i].end {
+			return &m.regions[i]
+		}
+	}
+	return nil
+}
+
+func (m *MemMap) ReadData(addr Addr) byte {
+	if m.Unmapped == Wrap && m.Size > 0 {
+		addr %= Addr(m.Size)
+	}
+	if int(addr) < len(m.inports) && m.inports[addr] != nil {
+		return m.inports[addr](addr)
+	}
+	if r := m.region(addr); r != nil {
+		return r.read(addr)
+	}
+	m.unmapped(addr, false)
+	return 0
+}
+
+func (m *MemMap) WriteData(addr Addr, val byte) {
+	if m.Unmapped == Wrap && m.Size > 0 {
+		addr %= Addr(m.Size)
+	}
+	if int(addr) < len(m.outports) && m.outports[addr] != nil {
+		m.outports[addr](addr, val)
+		return
+	}
+	if r := m.region(addr); r != nil {
+		r.write(addr, val)
+		return
+	}
+	m.unmapped(addr, true)
+}
+
+// Program addresses wrap at the end of flash when its size is a power
+// of two; otherwise reads beyond it return 0xffff.
+func (m *MemMap) ReadProgram(addr Addr) uint16 {
+	n := len(m.prog)
+	if n&(n-1) == 0 {
+		return m.prog[int(addr)&(n-1)]
+	}
+	if int(addr) >= n {
+		return 0xffff
+	}
+	return m.prog[addr]
+}
+
+func (m *MemMap) LoadProgram(addr Addr) byte {
+	shift := (uint(addr) & 0x1) * 8
+	return byte(m.ReadProgram(addr>>1) >> shift)
+}
+
+func (m *MemMap) WriteProgram(addr Addr, val uint16) {
+	if n := len(m.prog); n&(n-1) == 0 {
+		m.prog[int(addr)&(n-1)] = val
+	} else if int(addr) < n {
+		m.prog[addr] = val
+	}
+}
+
+func (m *MemMap) LoadHex(data io.Reader) {
+	loadRecord := func(rec ihex.Record) {
+		addr := rec.Address >> 1
+		for i := 0; i < len(rec.Bytes); i += 2 {
+			val := uint16(rec.Bytes[i]) | (uint16(rec.Bytes[i+1]) << 8)
+			m.prog[addr] = val
+			addr++
+		}
+	}
+
+	parser := ihex.NewParser(data)
+	for parser.Parse() {
+		loadRecord(parser.Data())
+	}
+	if parser.Err() != nil {
+		panic("bad hex data")
+	}
+}
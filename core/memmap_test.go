@@ -0,0 +1,162 @@
+package core
+
+import (
+	"testing"
+)
+
+func testMap(policy Unmapped) *MemMap {
+	m := NewMemMap(0x100)
+	m.Unmapped = policy
+	m.Size = 0x200
+	m.AddIO(0x20, 0x40)
+	m.AddSRAM(0x100, 0x80)
+	return m
+}
+
+func TestMemMapRegions(t *testing.T) {
+	m := testMap(ReadZero)
+	cpu := NewCpu(Mega, 0, 0, 0, 0, 0)
+	m.AddRegisterFile(cpu)
+	m.WriteData(5, 0x11)
+	if cpu.reg[5] != 0x11 || m.ReadData(5) != 0x11 {
+		t.Error("Register file not mapped")
+	}
+	m.WriteData(0x25, 0x22)
+	m.WriteData(0x105, 0x33)
+	if m.ReadData(0x25) != 0x22 || m.ReadData(0x105) != 0x33 {
+		t.Error("Bad I/O or SRAM access")
+	}
+
+	var last byte
+	m.AddRegion(0x180, 0x10,
+		func(addr Addr) byte { return byte(addr) },
+		func(addr Addr, val byte) { last = val })
+	m.WriteData(0x181, 0x44)
+	if last != 0x44 || m.ReadData(0x18f) != 0x8f {
+		t.Error("Bad region access")
+	}
+
+	m.AddRegion(0x190, 0x10,
+		func(addr Addr) byte { return 0x66 }, nil)
+	m.AddRegion(0x80, 0x10,
+		func(addr Addr) byte { return 0x77 }, nil)
+	if m.ReadData(0x85) != 0x77 || m.ReadData(0x105) != 0x33 ||
+		m.ReadData(0x195) != 0x66 || m.ReadData(0x90) != 0 {
+		t.Error("Regions added out of order")
+	}
+
+	m.SetRW(0x30, func(addr Addr) byte { return 0x55 }, nil)
+	if m.ReadData(0x30) != 0x55 {
+		t.Error("Handler not set")
+	}
+}
+
+func TestMemMapReadZero(t *testing.T) {
+	m := testMap(ReadZero)
+	m.WriteData(0x70, 0x11)
+	m.WriteData(0x205, 0x11)
+	if m.ReadData(0x70) != 0 || m.ReadData(0x205) != 0 {
+		t.Error("Unmapped read not zero")
+	}
+	if m.Fault() != nil {
+		t.Error("Unexpected fault")
+	}
+}
+
+func TestMemMapWrap(t *testing.T) {
+	m := testMap(Wrap)
+	m.WriteData(0x305, 0x11)
+	if m.ReadData(0x105) != 0x11 {
+		t.Error("Address did not wrap")
+	}
+}
+
+func TestMemMapTrap(t *testing.T) {
+	m := testMap(Trap)
+	var faults int
+	m.OnFault = func(f *MemFault) { faults++ }
+	m.WriteData(0x70, 0x11)
+	m.ReadData(0x205)
+	f := m.Fault()
+	if f == nil || f.Addr != 0x70 || !f.Write || faults != 2 {
+		t.Error("Bad fault", f, faults)
+	}
+	m.ClearFault()
+	if m.Fault() != nil {
+		t.Error("Fault not cleared")
+	}
+}
+
+func TestMemMapProgram(t *testing.T) {
+	m := NewMemMap(0x100)
+	m.WriteProgram(0x101, 0x1234)
+	if m.ReadProgram(1) != 0x1234 || m.LoadProgram(3) != 0x12 {
+		t.Error("Program address did not wrap")
+	}
+	m = NewMemMap(0x180)
+	m.WriteProgram(0x181, 0x1234)
+	if m.ReadProgram(0x181) != 0xffff || m.ReadProgram(1) != 0 {
+		t.Error("Bad read beyond flash")
+	}
+}
+
+func TestMemMapReserved(t *testing.T) {
+	m := testMap(Trap)
+	m.Reserve(0x30)
+	m.ReadData(0x30)
+	if f := m.Fault(); f == nil || f.Kind != FaultReserved {
+		t.Error("Bad reserved fault", f)
+	}
+	m = testMap(ReadZero)
+	m.ReserveRange(0x30, 0x32)
+	m.CheckAccess()
+	m.WriteData(0x32, 0x11)
+	if f := m.Fault(); f == nil || f.Kind != FaultReserved || !f.Write {
+		t.Error("Range not reserved", f)
+	}
+	m = testMap(ReadZero)
+	m.Reserve(0x30)
+	m.WriteData(0x30, 0x11)
+	if m.ReadData(0x30) != 0 || m.Fault() != nil {
+		t.Error("Bad reserved access")
+	}
+}
+
+func TestMemMapUninit(t *testing.T) {
+	m := testMap(ReadZero)
+	m.ReadData(0x105)
+	if m.Fault() != nil {
+		t.Error("Unexpected fault")
+	}
+	m.CheckUninit = true
+	m.WriteData(0x105, 0x11)
+	m.ReadData(0x105)
+	if m.Fault() != nil {
+		t.Error("Fault for written address")
+	}
+	m.ReadData(0x106)
+	f := m.Fault()
+	if f == nil || f.Kind != FaultUninit || f.Addr != 0x106 || f.Write {
+		t.Error("Bad uninitialized fault", f)
+	}
+	f.PC = 0x12
+	if f.Error() != "read of uninitialized address 0x0106 at PC 0x0012" {
+		t.Error("Bad message", f.Error())
+	}
+}
+
+func TestMemMapReset(t *testing.T) {
+	m := testMap(ReadZero)
+	m.CheckUninit = true
+	m.WriteData(0x25, 0x11)
+	m.WriteData(0x105, 0x22)
+	m.ResetIO()
+	m.ReadData(0x105)
+	if m.ReadData(0x25) != 0 || m.Fault() != nil {
+		t.Error("Bad I/O reset")
+	}
+	m.InvalidateSRAM()
+	if m.ReadData(0x105) != 0x22 || m.Fault() == nil {
+		t.Error("Bad SRAM invalidate")
+	}
+}
@@ -497,3 +497,21 @@ func bstCases() branch {
 	}
 	return append(setcases, clrcases...)
 }
+
+func TestWdrSpm(t *testing.T) {
+	s := newsystem()
+	var wdr bool
+	var addr Addr
+	var data uint16
+	s.cpu.SetWDR(func() { wdr = true })
+	s.cpu.SetSPM(func(a Addr, d uint16) { addr, data = a, d })
+	s.cpu.reg[0], s.cpu.reg[1] = 0x34, 0x12
+	s.cpu.reg[30], s.cpu.reg[31] = 0x40, 0x01
+	s.mem.prog[0] = 0x95a8 // wdr
+	s.mem.prog[1] = 0x95e8 // spm
+	s.cpu.Step(&s.mem, &decoder)
+	s.cpu.Step(&s.mem, &decoder)
+	if !wdr || addr != 0x140 || data != 0x1234 {
+		t.Error("Bad WDR/SPM", wdr, addr, data)
+	}
+}
@@ -0,0 +1,38 @@
+package core
+
+import "testing"
+
+func TestProgramRampZ(t *testing.T) {
+	s := newsystem()
+	s.cpu = *NewCpu(Mega, 0, 0, 0, 0x03, 0x01)
+	s.cpu.SetProgramRampZ(true)
+	s.cpu.MemWriteRampZ(0, 0x01)
+	s.cpu.reg[30], s.cpu.reg[31] = 0x00, 0x01
+	s.mem.data[0x100] = 0x42
+	s.mem.prog[0x8080] = 0x1234
+	s.mem.prog[0] = 0x8100 // ld r16, Z
+	s.mem.prog[1] = 0x9116 // elpm r17, Z
+	s.cpu.Step(&s.mem, &decoder)
+	s.cpu.Step(&s.mem, &decoder)
+	if s.cpu.reg[16] != 0x42 {
+		t.Error("RAMPZ applied to data access")
+	}
+	if s.cpu.reg[17] != 0x34 {
+		t.Error("RAMPZ not applied to ELPM")
+	}
+}
+
+func TestInterruptEntryEind(t *testing.T) {
+	s := newsystem()
+	s.cpu = *NewCpu(Mega, 0, 0, 0, 0x03, 0x01)
+	s.cpu.pc = 0x12345
+	s.cpu.sp = 0x21ff
+	cycles := s.cpu.Interrupt(&s.mem, 0x0e)
+	if cycles != 5 || s.cpu.sp != 0x21fc {
+		t.Error("Bad interrupt entry state", cycles, s.cpu.sp)
+	}
+	if s.mem.data[0x21ff] != 0x45 || s.mem.data[0x21fe] != 0x23 ||
+		s.mem.data[0x21fd] != 0x01 {
+		t.Error("Bad interrupt return address")
+	}
+}
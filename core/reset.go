@@ -0,0 +1,31 @@
+package core
+
+// Reset sources, in the order of their flags in MCUCSR (MCUSR on newer
+// devices).
+type ResetKind int
+
+const (
+	PowerOnReset ResetKind = iota
+	ExternalReset
+	BrownOutReset
+	WatchdogReset
+)
+
+// Flag returns the reset flag bit for k.
+func (k ResetKind) Flag() byte {
+	return 1 << uint(k)
+}
+
+func (k ResetKind) String() string {
+	switch k {
+	case PowerOnReset:
+		return "power-on"
+	case ExternalReset:
+		return "external"
+	case BrownOutReset:
+		return "brown-out"
+	case WatchdogReset:
+		return "watchdog"
+	}
+	return "unknown"
+}
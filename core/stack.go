@@ -0,0 +1,80 @@
+package core
+
+import "fmt"
+
+// A StackFault is SP moving below the stack guard. PC, a word address,
+// is filled in by the system that steps the CPU.
+type StackFault struct {
+	SP    int
+	Guard int
+	PC    int
+}
+
+func (f *StackFault) Error() string {
+	return fmt.Sprintf("stack overflow: SP 0x%04x below 0x%04x at PC 0x%04x",
+		f.SP, f.Guard, f.PC)
+}
+
+type stackCheck struct {
+	guard int
+	low   int
+	fault *StackFault
+}
+
+// SetStackGuard enables stack checking, with guard the lowest address
+// the stack may grow into; if it is 0, only the low-water mark is
+// kept. SP is checked when pushes and calls decrement it, and when SPL
+// is written, since compilers write it after SPH.
+func (c *Cpu) SetStackGuard(guard int) {
+	if c.stack == nil {
+		c.stack = &stackCheck{}
+	}
+	c.stack.guard = guard
+}
+
+func (c *Cpu) StackGuard() int {
+	if c.stack == nil {
+		return 0
+	}
+	return c.stack.guard
+}
+
+// StackFault returns the first overflow since the last
+// ClearStackFault, or nil.
+func (c *Cpu) StackFault() *StackFault {
+	if c.stack == nil {
+		return nil
+	}
+	return c.stack.fault
+}
+
+func (c *Cpu) ClearStackFault() {
+	if c.stack != nil {
+		c.stack.fault = nil
+	}
+}
+
+// StackLow returns the lowest SP seen by the checks since the last
+// ResetStackLow, or 0 if there were none.
+func (c *Cpu) StackLow() int {
+	if c.stack == nil {
+		return 0
+	}
+	return c.stack.low
+}
+
+func (c *Cpu) ResetStackLow() {
+	if c.stack != nil {
+		c.stack.low = 0
+	}
+}
+
+func (c *Cpu) checkSP() {
+	s := c.stack
+	if s.low == 0 || c.sp < s.low {
+		s.low = c.sp
+	}
+	if c.sp < s.guard && s.fault == nil {
+		s.fault = &StackFault{SP: c.sp, Guard: s.guard}
+	}
+}
@@ -0,0 +1,49 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestStackGuard(t *testing.T) {
+	s := newsystem()
+	s.cpu.sp = 0x102
+	s.cpu.SetStackGuard(0x100)
+	for i, op := range []uint16{
+		0x930f, // push r16
+		0x930f, // push r16
+		0x930f, // push r16
+	} {
+		s.mem.prog[Addr(i)] = op
+	}
+	s.cpu.Step(&s.mem, &decoder)
+	s.cpu.Step(&s.mem, &decoder)
+	if s.cpu.StackFault() != nil {
+		t.Error("Unexpected stack fault")
+	}
+	s.cpu.Step(&s.mem, &decoder)
+	f := s.cpu.StackFault()
+	if f == nil || f.SP != 0xff || f.Guard != 0x100 {
+		t.Error("Bad stack fault", f)
+	}
+	if s.cpu.StackLow() != 0xff {
+		t.Error("Bad stack low", s.cpu.StackLow())
+	}
+	s.cpu.ClearStackFault()
+	s.cpu.ResetStackLow()
+	if s.cpu.StackFault() != nil || s.cpu.StackLow() != 0 {
+		t.Error("Stack state not cleared")
+	}
+}
+
+func TestStackGuardSP(t *testing.T) {
+	var c Cpu
+	c.SetStackGuard(0x100)
+	c.MemWriteSPH(0, 0x00)
+	if c.StackFault() != nil {
+		t.Error("Stack checked on SPH write")
+	}
+	c.MemWriteSPL(0, 0xf0)
+	if c.StackFault() == nil || c.StackLow() != 0xf0 {
+		t.Error("Stack not checked on SPL write")
+	}
+}
@@ -45,6 +45,24 @@ func (t *Timer) AddCounter(ctr *Counter) {
 	t.insertCounter(ctr)
 }
 
+// RemoveCounter cancels a pending counter; it does nothing if ctr is
+// not scheduled. A counter's action must not remove the counter itself.
+func (t *Timer) RemoveCounter(ctr *Counter) {
+	var prev *Counter
+	for next := t.counters; next != nil; next = next.next {
+		if next == ctr {
+			if prev == nil {
+				t.counters = next.next
+			} else {
+				prev.next = next.next
+			}
+			t.fuse = t.counters.end - t.cycleCount
+			return
+		}
+		prev = next
+	}
+}
+
 func (t *Timer) insertCounter(ctr *Counter) {
 	var prev *Counter
 	next := t.counters
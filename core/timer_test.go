@@ -69,3 +69,31 @@ func TestTimerMulti(t *testing.T) {
 		t.Error("Multiple timer error")
 	}
 }
+
+func TestTimerRemove(t *testing.T) {
+	witness := 0
+	timer := NewTimer()
+	first := NewCounter(10, func() bool {
+		witness++
+		return true
+	})
+	second := NewCounter(20, func() bool {
+		witness += 10
+		return false
+	})
+	timer.AddCounter(first)
+	timer.AddCounter(second)
+	timer.Tick(15)
+	timer.RemoveCounter(first)
+	timer.Tick(15)
+	if witness != 11 {
+		t.Error("Removed timer fired")
+	}
+	timer.RemoveCounter(second)
+	timer.AddCounter(second)
+	timer.RemoveCounter(second)
+	timer.Tick(100)
+	if witness != 11 {
+		t.Error("Removed head timer fired")
+	}
+}
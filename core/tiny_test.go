@@ -0,0 +1,42 @@
+package core
+
+import (
+	"testing"
+
+	it "github.com/edmccard/avr-sim/instr"
+)
+
+func TestReducedCore(t *testing.T) {
+	rdecoder := it.NewReducedDecoder()
+	s := newsystem()
+	s.cpu = *NewCpu(Tiny, 0, 0, 0, 0, 0)
+	s.cpu.sp = 0x5f
+	s.cpu.reg[17] = 0x11
+	s.mem.data[0x45] = 0x42
+	for i, op := range []uint16{
+		0xa105, // lds r16, 0x45
+		0xa916, // sts 0x46, r17
+		0xb905, // out 0x05, r16
+		0x930f, // push r16
+		0x912f, // pop r18
+		0xd000, // rcall .+0
+		0x9508, // ret
+	} {
+		s.mem.prog[Addr(i)] = op
+	}
+	for i, cycles := range []uint{1, 1, 1, 1, 3, 4, 6} {
+		if n := s.cpu.Step(&s.mem, &rdecoder); n != cycles {
+			t.Errorf("Instruction %d took %d cycles, expected %d",
+				i, n, cycles)
+		}
+	}
+	if s.cpu.reg[16] != 0x42 || s.mem.data[0x46] != 0x11 {
+		t.Error("Bad LDS/STS")
+	}
+	if s.mem.data[0x05] != 0x42 {
+		t.Error("OUT not mapped to I/O address 0")
+	}
+	if s.cpu.reg[18] != 0x42 || s.cpu.sp != 0x5f || s.cpu.pc != 6 {
+		t.Error("Bad stack state", s.cpu.sp, s.cpu.pc)
+	}
+}
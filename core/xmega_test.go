@@ -0,0 +1,28 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestXmegaCore(t *testing.T) {
+	s := newsystem()
+	s.cpu = *NewCpu(Xmega, 0xff, 0xff, 0xff, 0xff, 0x01)
+	s.cpu.sp = 0x3fff
+	s.cpu.reg[16] = 0x42
+	for i, op := range []uint16{
+		0xbf0b, // out 0x3b, r16
+		0xd000, // rcall .+0
+		0x9518, // reti
+	} {
+		s.mem.prog[Addr(i)] = op
+	}
+	s.cpu.Step(&s.mem, &decoder)
+	if s.mem.data[0x3b] != 0x42 {
+		t.Error("OUT not mapped to I/O address 0")
+	}
+	s.cpu.Step(&s.mem, &decoder)
+	s.cpu.Step(&s.mem, &decoder)
+	if s.cpu.flags[FlagI] || s.cpu.pc != 2 {
+		t.Error("Bad RETI", s.cpu.flags[FlagI], s.cpu.pc)
+	}
+}
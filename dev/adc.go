@@ -0,0 +1,278 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	adcsraADEN = 0x80
+	adcsraADSC = 0x40
+	adcsraADFR = 0x20
+	adcsraADIF = 0x10
+	adcsraADIE = 0x08
+	adcsraADPS = 0x07
+	admuxREFS  = 0xc0
+	admuxADLAR = 0x20
+	admuxMUX   = 0x0f
+	adcsrbADTS = 0x07
+	adcsrbMUX5 = 0x08
+)
+
+var adcPrescale = [8]int64{2, 2, 4, 8, 16, 32, 64, 128}
+
+type ADC struct {
+	AREF        float64
+	AVCC        float64
+	InternalRef float64
+	Bandgap     float64
+	// TempSensor is the voltage of the temperature sensor on mux
+	// channel 8, where a device has one.
+	TempSensor float64
+	// AltInternalRef is the reference selected by REFS=10 on devices
+	// with two internal references; if zero, AREF is used.
+	AltInternalRef float64
+	// Supply, if not nil, gives the supply voltage on channel 0; AVCC
+	// follows it, and inputs are clamped to it.
+	Supply     AnalogInput
+	timer      *core.Timer
+	intr       *core.Interrupts
+	vec        int
+	input      AnalogInput
+	admux      byte
+	adcsra     byte
+	adcsrb     byte
+	data       uint16
+	locked     bool
+	first      bool
+	conv       *core.Counter
+	convMux    byte
+	convMux5   bool
+	mux5       bool
+	convSample int64
+}
+
+func NewADC(timer *core.Timer, intr *core.Interrupts, vec int,
+	input AnalogInput) *ADC {
+
+	adc := &ADC{
+		AREF:        5.0,
+		AVCC:        5.0,
+		InternalRef: 2.56,
+		Bandgap:     1.30,
+		timer:       timer,
+		intr:        intr,
+		vec:         vec,
+		input:       input,
+	}
+	intr.SetAck(vec, func() {
+		adc.adcsra &^= adcsraADIF
+		adc.updateIntr()
+	})
+	return adc
+}
+
+// Reset stops any conversion, and clears the registers.
+func (adc *ADC) Reset() {
+	adc.stop()
+	adc.admux = 0
+	adc.adcsra = 0
+	adc.adcsrb = 0
+	adc.data = 0
+	adc.locked = false
+	adc.updateIntr()
+}
+
+func (adc *ADC) ReadADMUX(addr core.Addr) byte {
+	return adc.admux
+}
+
+func (adc *ADC) WriteADMUX(addr core.Addr, val byte) {
+	if !adc.mux5 {
+		val &^= 0x10
+	}
+	adc.admux = val
+}
+
+// EnableMux5 extends the multiplexer to the sixteen single-ended
+// channels of larger devices, selected by MUX5 in ADCSRB and MUX4:0 in
+// ADMUX. Differential channels are not supported.
+func (adc *ADC) EnableMux5() {
+	adc.mux5 = true
+}
+
+func (adc *ADC) ReadADCSRA(addr core.Addr) byte {
+	val := adc.adcsra
+	if adc.conv != nil {
+		val |= adcsraADSC
+	}
+	return val
+}
+
+func (adc *ADC) WriteADCSRA(addr core.Addr, val byte) {
+	// ADIF is cleared by writing a one to it
+	flag := adc.adcsra & adcsraADIF
+	if (val & adcsraADIF) != 0 {
+		flag = 0
+	}
+	wasEnabled := (adc.adcsra & adcsraADEN) != 0
+	adc.adcsra = (val &^ (adcsraADSC | adcsraADIF)) | flag
+
+	if (val & adcsraADEN) == 0 {
+		adc.stop()
+	} else {
+		if !wasEnabled {
+			adc.first = true
+		}
+		if (val&adcsraADSC) != 0 && adc.conv == nil {
+			adc.start()
+		}
+	}
+	adc.updateIntr()
+}
+
+// ADCSRB selects the auto trigger source on newer devices, where ADFR
+// is ADATE; only free running mode (source 0) is supported.
+func (adc *ADC) ReadADCSRB(addr core.Addr) byte {
+	return adc.adcsrb
+}
+
+func (adc *ADC) WriteADCSRB(addr core.Addr, val byte) {
+	mask := byte(adcsrbADTS)
+	if adc.mux5 {
+		mask |= adcsrbMUX5
+	}
+	adc.adcsrb = val & mask
+}
+
+// Reading ADCL locks the data registers until ADCH is read, so that
+// a completing conversion cannot split the result.
+func (adc *ADC) ReadADCL(addr core.Addr) byte {
+	adc.locked = true
+	if (adc.admux & admuxADLAR) != 0 {
+		return byte(adc.data << 6)
+	}
+	return byte(adc.data)
+}
+
+func (adc *ADC) ReadADCH(addr core.Addr) byte {
+	adc.locked = false
+	if (adc.admux & admuxADLAR) != 0 {
+		return byte(adc.data >> 2)
+	}
+	return byte(adc.data >> 8)
+}
+
+func (adc *ADC) Enabled() bool {
+	return (adc.adcsra & adcsraADEN) != 0
+}
+
+func (adc *ADC) Mux() int {
+	return int(adc.admux & admuxMUX)
+}
+
+func (adc *ADC) start() {
+	presc := adcPrescale[adc.adcsra&adcsraADPS]
+	cycles, hold := 13*presc, 3*presc/2
+	if adc.first {
+		cycles, hold = 25*presc, 27*presc/2
+		adc.first = false
+	}
+	adc.convMux = adc.admux
+	adc.convMux5 = (adc.adcsrb & adcsrbMUX5) != 0
+	adc.convSample = adc.timer.GetCount() + hold
+	adc.conv = core.NewCounter(cycles, adc.complete)
+	adc.timer.AddCounter(adc.conv)
+}
+
+func (adc *ADC) stop() {
+	if adc.conv != nil {
+		adc.timer.RemoveCounter(adc.conv)
+		adc.conv = nil
+	}
+}
+
+func (adc *ADC) complete() bool {
+	adc.conv = nil
+	if !adc.locked {
+		adc.data = adc.convert()
+	}
+	// the interrupt triggers even if a locked result is lost
+	adc.adcsra |= adcsraADIF
+	adc.updateIntr()
+	if (adc.adcsra&adcsraADFR) != 0 && (adc.adcsrb&adcsrbADTS) == 0 {
+		adc.start()
+	}
+	return false
+}
+
+func (adc *ADC) convert() uint16 {
+	var vin float64
+	if adc.mux5 {
+		switch mux := int(adc.convMux & 0x1f); {
+		case mux < 8 && adc.convMux5:
+			vin = adc.Voltage(mux+8, adc.convSample)
+		case mux < 8:
+			vin = adc.Voltage(mux, adc.convSample)
+		case mux == 0x1e && !adc.convMux5:
+			vin = adc.Bandgap
+		}
+	} else {
+		switch mux := int(adc.convMux & admuxMUX); {
+		case mux < 8:
+			vin = adc.Voltage(mux, adc.convSample)
+		case mux == 8:
+			vin = adc.TempSensor
+		case mux == 14:
+			vin = adc.Bandgap
+		}
+	}
+
+	var vref float64
+	switch adc.convMux & admuxREFS {
+	case 0x80:
+		vref = adc.AltInternalRef
+		if vref == 0 {
+			vref = adc.AREF
+		}
+	case 0x00:
+		vref = adc.AREF
+	case 0x40:
+		vref = adc.AVCC
+		if adc.Supply != nil {
+			vref = adc.Supply.Voltage(0, adc.convSample)
+		}
+	case 0xc0:
+		vref = adc.InternalRef
+	}
+
+	if vref <= 0 || vin <= 0 {
+		return 0
+	}
+	res := int(vin * 1024 / vref)
+	if res > 0x3ff {
+		res = 0x3ff
+	}
+	return uint16(res)
+}
+
+func (adc *ADC) Voltage(channel int, cycle int64) float64 {
+	if adc.input == nil {
+		return 0
+	}
+	return clampSupply(adc.input.Voltage(channel, cycle), adc.Supply, cycle)
+}
+
+// clampSupply limits a pin voltage to the supply, if there is one.
+func clampSupply(v float64, supply AnalogInput, cycle int64) float64 {
+	if supply != nil {
+		if vcc := supply.Voltage(0, cycle); v > vcc {
+			return vcc
+		}
+	}
+	return v
+}
+
+func (adc *ADC) updateIntr() {
+	adc.intr.Set(adc.vec, (adc.adcsra&adcsraADIF) != 0 &&
+		(adc.adcsra&adcsraADIE) != 0)
+}
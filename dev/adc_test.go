@@ -0,0 +1,127 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func newTestADC(volts float64) (*ADC, *core.Timer, *core.Interrupts) {
+	timer := core.NewTimer()
+	intr := core.NewInterrupts(1)
+	input := AnalogFunc(func(ch int, cyc int64) float64 {
+		return volts * float64(ch+1)
+	})
+	return NewADC(timer, intr, 0, input), timer, intr
+}
+
+func TestADCConversion(t *testing.T) {
+	adc, timer, intr := newTestADC(1.25)
+	adc.WriteADMUX(0, 0x40)
+	adc.WriteADCSRA(0, 0xc8)
+	timer.Tick(25*2 - 1)
+	if adc.ReadADCSRA(0)&adcsraADSC == 0 {
+		t.Error("First conversion finished early")
+	}
+	timer.Tick(1)
+	if adc.ReadADCSRA(0)&(adcsraADSC|adcsraADIF) != adcsraADIF {
+		t.Error("First conversion not finished")
+	}
+	if !intr.IsSet(0) {
+		t.Error("ADC interrupt not raised")
+	}
+	if lo, hi := adc.ReadADCL(0), adc.ReadADCH(0); lo != 0x00 || hi != 0x01 {
+		t.Errorf("Bad result %02x%02x", hi, lo)
+	}
+	intr.Ack(0)
+	if intr.IsSet(0) || adc.ReadADCSRA(0)&adcsraADIF != 0 {
+		t.Error("ADIF not cleared by interrupt entry")
+	}
+
+	adc.WriteADMUX(0, 0x61)
+	adc.WriteADCSRA(0, 0xc0)
+	timer.Tick(13 * 2)
+	if hi := adc.ReadADCH(0); hi != 0x80 {
+		t.Errorf("Bad left-adjusted result %02x", hi)
+	}
+}
+
+func TestADCLock(t *testing.T) {
+	adc, timer, _ := newTestADC(1.25)
+	adc.WriteADMUX(0, 0x40)
+	adc.WriteADCSRA(0, 0xe0)
+	timer.Tick(25 * 2)
+	adc.ReadADCL(0)
+	adc.WriteADMUX(0, 0x41)
+	timer.Tick(2 * 13 * 2)
+	if hi := adc.ReadADCH(0); hi != 0x01 {
+		t.Error("Locked result was updated")
+	}
+	timer.Tick(13 * 2)
+	if hi := adc.ReadADCH(0); hi != 0x02 {
+		t.Error("Unlocked result not updated")
+	}
+}
+
+func TestADCMux5(t *testing.T) {
+	adc, timer, _ := newTestADC(0.1)
+	adc.EnableMux5()
+	adc.AltInternalRef = 1.1
+	adc.WriteADCSRB(0, adcsrbMUX5)
+	adc.WriteADMUX(0, 0x41)
+	adc.WriteADCSRA(0, 0xc0)
+	timer.Tick(25 * 2)
+	if lo, hi := adc.ReadADCL(0), adc.ReadADCH(0); lo != 0xcc || hi != 0x00 {
+		t.Errorf("Bad ADC9 result %02x%02x", hi, lo)
+	}
+	adc.WriteADMUX(0, 0x81)
+	adc.WriteADCSRA(0, 0xc0)
+	timer.Tick(13 * 2)
+	if lo, hi := adc.ReadADCL(0), adc.ReadADCH(0); lo != 0xa2 || hi != 0x03 {
+		t.Errorf("Bad 1.1V reference result %02x%02x", hi, lo)
+	}
+}
+
+func TestADCReset(t *testing.T) {
+	adc, timer, intr := newTestADC(1.25)
+	adc.WriteADCSRA(0, 0xc8)
+	timer.Tick(25 * 2)
+	adc.WriteADCSRA(0, 0xc8)
+	adc.Reset()
+	if adc.ReadADCSRA(0) != 0 || adc.ReadADMUX(0) != 0 || intr.IsSet(0) {
+		t.Error("Registers not reset")
+	}
+	timer.Tick(25 * 2)
+	if adc.ReadADCSRA(0) != 0 {
+		t.Error("Conversion not stopped")
+	}
+}
+
+func TestADCSupply(t *testing.T) {
+	adc, timer, _ := newTestADC(1.25)
+	adc.Supply = Ramp{{0, 2.5}, {100, 2.5}, {200, 5.0}}
+	adc.WriteADMUX(0, 0x40)
+	adc.WriteADCSRA(0, 0xc0)
+	timer.Tick(25 * 2)
+	if lo, hi := adc.ReadADCL(0), adc.ReadADCH(0); lo != 0x00 || hi != 0x02 {
+		t.Errorf("Bad result %02x%02x", hi, lo)
+	}
+	adc.WriteADMUX(0, 0x43)
+	adc.WriteADCSRA(0, 0xc0)
+	timer.Tick(13 * 2)
+	if lo, hi := adc.ReadADCL(0), adc.ReadADCH(0); lo != 0xff || hi != 0x03 {
+		t.Errorf("Input not clamped to supply: %02x%02x", hi, lo)
+	}
+}
+
+func TestRamp(t *testing.T) {
+	r := Ramp{{10, 1.0}, {20, 3.0}, {40, 2.0}}
+	for _, c := range []struct {
+		cycle int64
+		volts float64
+	}{{0, 1.0}, {10, 1.0}, {15, 2.0}, {20, 3.0}, {30, 2.5}, {50, 2.0}} {
+		if v := r.Voltage(0, c.cycle); v != c.volts {
+			t.Errorf("At %d: got %v, want %v", c.cycle, v, c.volts)
+		}
+	}
+}
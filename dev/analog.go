@@ -0,0 +1,132 @@
+package dev
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// An AnalogInput supplies the voltage on an analog channel at a given
+// cycle.
+type AnalogInput interface {
+	Voltage(channel int, cycle int64) float64
+}
+
+type AnalogFunc func(channel int, cycle int64) float64
+
+func (f AnalogFunc) Voltage(channel int, cycle int64) float64 {
+	return f(channel, cycle)
+}
+
+// A Ramp is a piecewise-linear voltage through points in order of
+// cycle, the same on every channel. It holds the first and last values
+// outside them.
+type Ramp []RampPoint
+
+type RampPoint struct {
+	Cycle int64
+	Volts float64
+}
+
+func (r Ramp) Voltage(channel int, cycle int64) float64 {
+	if len(r) == 0 {
+		return 0
+	}
+	if cycle <= r[0].Cycle {
+		return r[0].Volts
+	}
+	for i := 1; i < len(r); i++ {
+		if cycle < r[i].Cycle {
+			p, q := r[i-1], r[i]
+			frac := float64(cycle-p.Cycle) / float64(q.Cycle-p.Cycle)
+			return p.Volts + frac*(q.Volts-p.Volts)
+		}
+	}
+	return r[len(r)-1].Volts
+}
+
+// A SampleStream plays back recorded voltages, one frame of channel
+// values every cycPerSample cycles.
+type SampleStream struct {
+	frames       [][]float64
+	cycPerSample float64
+	Loop         bool
+}
+
+func NewSampleStream(frames [][]float64, cycPerSample float64) *SampleStream {
+	return &SampleStream{frames: frames, cycPerSample: cycPerSample}
+}
+
+func (s *SampleStream) Voltage(channel int, cycle int64) float64 {
+	if len(s.frames) == 0 {
+		return 0
+	}
+	idx := int(float64(cycle) / s.cycPerSample)
+	if idx >= len(s.frames) {
+		if s.Loop {
+			idx %= len(s.frames)
+		} else {
+			idx = len(s.frames) - 1
+		}
+	}
+	frame := s.frames[idx]
+	if channel >= len(frame) {
+		return 0
+	}
+	return frame[channel]
+}
+
+// ReadCSVStream reads a SampleStream with one row of voltages per
+// frame and one column per channel. A leading header row is skipped.
+func ReadCSVStream(r io.Reader, cycPerSample float64) (*SampleStream, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var frames [][]float64
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		frame := make([]float64, len(record))
+		for i, field := range record {
+			frame[i], err = strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("csv line %d: %v", line, err)
+		}
+		frames = append(frames, frame)
+	}
+	return NewSampleStream(frames, cycPerSample), nil
+}
+
+// ReadWAVStream reads a SampleStream from a WAV file, with one channel
+// per WAV channel; full-scale samples map to 0 and vref volts.
+func ReadWAVStream(r io.Reader, hertz int, vref float64) (*SampleStream, error) {
+	wav, err := readWAV(r)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([][]float64, len(wav.samples)/wav.channels)
+	for i := range frames {
+		frame := make([]float64, wav.channels)
+		for ch := range frame {
+			sample := wav.samples[i*wav.channels+ch]
+			frame[ch] = (sample + 1) / 2 * vref
+		}
+		frames[i] = frame
+	}
+	cycPerSample := float64(hertz) / float64(wav.rate)
+	return NewSampleStream(frames, cycPerSample), nil
+}
@@ -0,0 +1,32 @@
+package dev
+
+// An AudioBackend consumes mono samples (from -1.0 to 1.0) generated
+// by a Speaker. WriteSamples must not keep a reference to samples.
+type AudioBackend interface {
+	SampleRate() int
+	WriteSamples(samples []float32) error
+	Close() error
+}
+
+// An AudioBuffer is an AudioBackend that keeps all samples in memory.
+type AudioBuffer struct {
+	Rate    int
+	Samples []float32
+}
+
+func NewAudioBuffer(rate int) *AudioBuffer {
+	return &AudioBuffer{Rate: rate}
+}
+
+func (buf *AudioBuffer) SampleRate() int {
+	return buf.Rate
+}
+
+func (buf *AudioBuffer) WriteSamples(samples []float32) error {
+	buf.Samples = append(buf.Samples, samples...)
+	return nil
+}
+
+func (buf *AudioBuffer) Close() error {
+	return nil
+}
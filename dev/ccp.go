@@ -0,0 +1,77 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+// CCP signatures
+const (
+	ccpSPM   = 0x9d
+	ccpIOREG = 0xd8
+)
+
+// Cycles a CCP signature stays valid
+const ccpCycles = 4
+
+// A CCP implements xmega Configuration Change Protection: protected
+// registers can only be written in the four cycles after the IOREG
+// signature is written to CCP, and interrupts are held off meanwhile.
+type CCP struct {
+	timer *core.Timer
+	io    int64
+	spm   int64
+}
+
+func NewCCP(timer *core.Timer) *CCP {
+	return &CCP{timer: timer, io: -ccpCycles - 1, spm: -ccpCycles - 1}
+}
+
+// ReadCCP returns 1 while protected I/O writes are enabled, and 2 while
+// SPM/LPM is.
+func (ccp *CCP) ReadCCP(addr core.Addr) byte {
+	var val byte
+	if ccp.IOEnabled() {
+		val |= 0x01
+	}
+	if ccp.SPMEnabled() {
+		val |= 0x02
+	}
+	return val
+}
+
+func (ccp *CCP) WriteCCP(addr core.Addr, val byte) {
+	switch val {
+	case ccpIOREG:
+		ccp.io = ccp.timer.GetCount()
+	case ccpSPM:
+		ccp.spm = ccp.timer.GetCount()
+	}
+}
+
+// IOEnabled reports whether protected I/O registers can be written. The
+// signature is written during the instruction that starts at the
+// recorded count, so the window covers the following four cycles.
+func (ccp *CCP) IOEnabled() bool {
+	return ccp.timer.GetCount()-ccp.io <= ccpCycles
+}
+
+// SPMEnabled reports whether protected SPM/LPM operations are allowed.
+func (ccp *CCP) SPMEnabled() bool {
+	return ccp.timer.GetCount()-ccp.spm <= ccpCycles
+}
+
+// Active reports whether a signature is pending, during which
+// interrupts are not serviced.
+func (ccp *CCP) Active() bool {
+	return ccp.IOEnabled() || ccp.SPMEnabled()
+}
+
+// Protect wraps the writer for a protected register so that writes
+// outside the CCP window are ignored.
+func (ccp *CCP) Protect(w core.MemWrite) core.MemWrite {
+	return func(addr core.Addr, val byte) {
+		if ccp.IOEnabled() {
+			w(addr, val)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func TestCCP(t *testing.T) {
+	timer := core.NewTimer()
+	ccp := NewCCP(timer)
+	var reg byte
+	write := ccp.Protect(func(addr core.Addr, val byte) { reg = val })
+
+	write(0, 1)
+	if reg != 0 {
+		t.Error("Protected write allowed without signature")
+	}
+	ccp.WriteCCP(0, ccpIOREG)
+	timer.Tick(1)
+	if !ccp.Active() || ccp.ReadCCP(0) != 0x01 {
+		t.Error("Signature not recorded")
+	}
+	timer.Tick(3)
+	write(0, 2)
+	if reg != 2 {
+		t.Error("Protected write refused inside window")
+	}
+	timer.Tick(1)
+	write(0, 3)
+	if reg != 2 || ccp.Active() {
+		t.Error("Protected write allowed after window")
+	}
+	ccp.WriteCCP(0, ccpSPM)
+	if !ccp.SPMEnabled() || ccp.ReadCCP(0) != 0x02 {
+		t.Error("SPM signature not recorded")
+	}
+}
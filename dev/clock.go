@@ -0,0 +1,161 @@
+package dev
+
+import (
+	"time"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+// A ClockSource gives the frequency of a system clock, which may change
+// as the system runs.
+type ClockSource interface {
+	Hertz() int
+}
+
+// FixedClock is a ClockSource that never changes.
+type FixedClock int
+
+func (hz FixedClock) Hertz() int {
+	return int(hz)
+}
+
+const (
+	clkprCLKPCE = 0x80
+	clkprCLKPS  = 0x0f
+)
+
+// A Clock is the CPU clock of a system: a source (an external clock or
+// crystal, or an RCOscillator) divided by the system clock prescaler.
+// It keeps the real time elapsed across changes of frequency, so that
+// devices can convert between cycles and time. Call Changed before the
+// source's frequency changes other than through the Clock.
+type Clock struct {
+	timer     *core.Timer
+	src       ClockSource
+	clkps     byte
+	clkpce    *core.Counter
+	baseCycle int64
+	baseTime  time.Duration
+	baseSecs  float64
+}
+
+func NewClock(timer *core.Timer, src ClockSource) *Clock {
+	return &Clock{timer: timer, src: src}
+}
+
+func (clk *Clock) Source() ClockSource {
+	return clk.src
+}
+
+func (clk *Clock) SetSource(src ClockSource) {
+	clk.Changed()
+	clk.src = src
+}
+
+// Hertz returns the CPU clock frequency.
+func (clk *Clock) Hertz() int {
+	return clk.src.Hertz() >> clk.clkps
+}
+
+// Changed records the time elapsed at the current frequency.
+func (clk *Clock) Changed() {
+	clk.baseTime = clk.Now()
+	clk.baseSecs = clk.Seconds()
+	clk.baseCycle = clk.timer.GetCount()
+}
+
+// Now returns the real time elapsed since the clock started.
+func (clk *Clock) Now() time.Duration {
+	return clk.baseTime + clk.Duration(clk.timer.GetCount()-clk.baseCycle)
+}
+
+// Changes wraps the write handler of a register that can change the
+// source's frequency, so that Changed is called first.
+func (clk *Clock) Changes(w core.MemWrite) core.MemWrite {
+	return func(addr core.Addr, val byte) {
+		clk.Changed()
+		w(addr, val)
+	}
+}
+
+// Seconds returns the real time elapsed since the clock started, in
+// seconds; unlike Now, it is not rounded to whole nanoseconds.
+func (clk *Clock) Seconds() float64 {
+	hz := clk.Hertz()
+	if hz == 0 {
+		return clk.baseSecs
+	}
+	return clk.baseSecs +
+		float64(clk.timer.GetCount()-clk.baseCycle)/float64(hz)
+}
+
+// Duration converts cycles at the current frequency to time.
+func (clk *Clock) Duration(cycles int64) time.Duration {
+	hz := int64(clk.Hertz())
+	if hz == 0 {
+		return 0
+	}
+	return time.Duration(cycles * int64(time.Second) / hz)
+}
+
+// Cycles converts time to cycles at the current frequency, rounding up
+// to at least one.
+func (clk *Clock) Cycles(d time.Duration) int64 {
+	return cyclesAt(clk.Hertz(), d)
+}
+
+func cyclesAt(hertz int, d time.Duration) int64 {
+	cycles := int64(hertz) * int64(d) / int64(time.Second)
+	if cycles == 0 {
+		cycles = 1
+	}
+	return cycles
+}
+
+// SetPrescale divides the source by 1<<clkps.
+func (clk *Clock) SetPrescale(clkps byte) {
+	clk.Changed()
+	clk.clkps = clkps
+}
+
+// Reset restores the prescaler to clkps, as set by the CKDIV8 fuse on
+// devices that have it.
+func (clk *Clock) Reset(clkps byte) {
+	if clk.clkpce != nil {
+		clk.timer.RemoveCounter(clk.clkpce)
+		clk.clkpce = nil
+	}
+	clk.SetPrescale(clkps)
+}
+
+func (clk *Clock) ReadCLKPR(addr core.Addr) byte {
+	val := clk.clkps
+	if clk.clkpce != nil {
+		val |= clkprCLKPCE
+	}
+	return val
+}
+
+// WriteCLKPR changes the prescaler only within four cycles of setting
+// CLKPCE alone.
+func (clk *Clock) WriteCLKPR(addr core.Addr, val byte) {
+	if val == clkprCLKPCE {
+		if clk.clkpce != nil {
+			clk.timer.RemoveCounter(clk.clkpce)
+		}
+		clk.clkpce = core.NewCounter(4, func() bool {
+			clk.clkpce = nil
+			return false
+		})
+		clk.timer.AddCounter(clk.clkpce)
+		return
+	}
+	if clk.clkpce == nil || (val&clkprCLKPCE) != 0 {
+		return
+	}
+	clk.timer.RemoveCounter(clk.clkpce)
+	clk.clkpce = nil
+	if clkps := val & clkprCLKPS; clkps <= 8 {
+		clk.SetPrescale(clkps)
+	}
+}
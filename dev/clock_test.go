@@ -0,0 +1,63 @@
+package dev
+
+import (
+	"testing"
+	"time"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func TestClockNow(t *testing.T) {
+	timer := core.NewTimer()
+	osc := NewRCOscillator(1000000, 0x80)
+	clk := NewClock(timer, osc)
+	timer.Tick(1000)
+	if now := clk.Now(); now != time.Millisecond {
+		t.Errorf("Bad time %v at 1MHz", now)
+	}
+	clk.Changed()
+	osc.WriteOSCCAL(0, 0x80+100)
+	if hz := clk.Hertz(); hz != 1500000 {
+		t.Errorf("Bad frequency %d after OSCCAL", hz)
+	}
+	timer.Tick(3000)
+	if now := clk.Now(); now != 3*time.Millisecond {
+		t.Errorf("Bad time %v at 1.5MHz", now)
+	}
+	if cycles := clk.Cycles(time.Millisecond); cycles != 1500 {
+		t.Errorf("Bad cycles %d", cycles)
+	}
+	clk.SetSource(FixedClock(8000000))
+	timer.Tick(8000)
+	if now := clk.Now(); now != 4*time.Millisecond {
+		t.Errorf("Bad time %v at 8MHz", now)
+	}
+}
+
+func TestClockPrescaler(t *testing.T) {
+	timer := core.NewTimer()
+	clk := NewClock(timer, FixedClock(8000000))
+	clk.WriteCLKPR(0, 0x03)
+	if clk.Hertz() != 8000000 {
+		t.Error("Prescaler changed without CLKPCE")
+	}
+	clk.WriteCLKPR(0, clkprCLKPCE)
+	timer.Tick(4)
+	clk.WriteCLKPR(0, 0x03)
+	if clk.Hertz() != 8000000 {
+		t.Error("Prescaler changed after CLKPCE timed out")
+	}
+	clk.WriteCLKPR(0, clkprCLKPCE)
+	if clk.ReadCLKPR(0) != clkprCLKPCE {
+		t.Error("CLKPCE not set")
+	}
+	timer.Tick(3)
+	clk.WriteCLKPR(0, 0x03)
+	if clk.Hertz() != 1000000 || clk.ReadCLKPR(0) != 0x03 {
+		t.Errorf("Bad frequency %d with CLKPS=3", clk.Hertz())
+	}
+	clk.Reset(0)
+	if clk.Hertz() != 8000000 {
+		t.Error("Prescaler not reset")
+	}
+}
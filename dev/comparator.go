@@ -0,0 +1,190 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	acsrACD    = 0x80
+	acsrACBG   = 0x40
+	acsrACO    = 0x20
+	acsrACI    = 0x10
+	acsrACIE   = 0x08
+	acsrACIC   = 0x04
+	acsrACIS   = 0x03
+	sfiorACME  = 0x08
+	adcsrbACME = 0x40
+)
+
+// Analog input channels of a Comparator.
+const (
+	AIN0 = iota
+	AIN1
+)
+
+type Comparator struct {
+	Bandgap float64
+	// Capture, if not nil, is called with the new output level on every
+	// output change while ACIC is set; a device connects it to the input
+	// capture trigger of Timer1.
+	Capture func(high bool)
+	// Supply, if not nil, gives the supply voltage on channel 0, to
+	// which inputs are clamped.
+	Supply  AnalogInput
+	timer   *core.Timer
+	intr    *core.Interrupts
+	vec     int
+	input   AnalogInput
+	adc     *ADC
+	acsr    byte
+	sfior   byte
+	sampler *core.Counter
+}
+
+// NewComparator returns an analog comparator sampling its inputs every
+// sampleCycles cycles. AIN0 and AIN1 come from input, and the ADC
+// multiplexer inputs (when ACME is set) from adc, which may be nil.
+func NewComparator(timer *core.Timer, intr *core.Interrupts, vec int,
+	input AnalogInput, adc *ADC, sampleCycles int64) *Comparator {
+
+	comp := &Comparator{
+		Bandgap: 1.30,
+		timer:   timer,
+		intr:    intr,
+		vec:     vec,
+		input:   input,
+		adc:     adc,
+	}
+	intr.SetAck(vec, func() {
+		comp.acsr &^= acsrACI
+		comp.updateIntr()
+	})
+	comp.sampler = core.NewCounter(sampleCycles, func() bool {
+		comp.sample()
+		return true
+	})
+	timer.AddCounter(comp.sampler)
+	return comp
+}
+
+// Reset clears the registers, which enables the comparator.
+func (comp *Comparator) Reset() {
+	if (comp.acsr & acsrACD) != 0 {
+		comp.timer.AddCounter(comp.sampler)
+	}
+	comp.acsr &= acsrACO
+	comp.sfior = 0
+	comp.sample()
+	comp.updateIntr()
+}
+
+func (comp *Comparator) ReadACSR(addr core.Addr) byte {
+	comp.sample()
+	return comp.acsr
+}
+
+func (comp *Comparator) WriteACSR(addr core.Addr, val byte) {
+	flag := comp.acsr & acsrACI
+	if (val & acsrACI) != 0 {
+		flag = 0
+	}
+	wasEnabled := (comp.acsr & acsrACD) == 0
+	comp.acsr = (val &^ (acsrACO | acsrACI)) | (comp.acsr & acsrACO) | flag
+	enabled := (val & acsrACD) == 0
+	if enabled && !wasEnabled {
+		comp.timer.AddCounter(comp.sampler)
+	} else if !enabled && wasEnabled {
+		comp.timer.RemoveCounter(comp.sampler)
+	}
+	comp.sample()
+	comp.updateIntr()
+}
+
+// SFIOR is shared with other units; only ACME affects the comparator.
+func (comp *Comparator) ReadSFIOR(addr core.Addr) byte {
+	return comp.sfior
+}
+
+func (comp *Comparator) WriteSFIOR(addr core.Addr, val byte) {
+	comp.sfior = val
+	comp.sample()
+}
+
+// On newer devices ACME is in ADCSRB, which is shared with the ADC.
+func (comp *Comparator) ReadADCSRB(addr core.Addr) byte {
+	if (comp.sfior & sfiorACME) != 0 {
+		return adcsrbACME
+	}
+	return 0
+}
+
+func (comp *Comparator) WriteADCSRB(addr core.Addr, val byte) {
+	comp.sfior &^= sfiorACME
+	if (val & adcsrbACME) != 0 {
+		comp.sfior |= sfiorACME
+	}
+	comp.sample()
+}
+
+func (comp *Comparator) Output() bool {
+	return (comp.acsr & acsrACO) != 0
+}
+
+// Capturing reports whether ACIC selects the comparator output, rather
+// than the ICP pin, as the input capture trigger.
+func (comp *Comparator) Capturing() bool {
+	return (comp.acsr & acsrACIC) != 0
+}
+
+func (comp *Comparator) sample() {
+	if (comp.acsr & acsrACD) != 0 {
+		return
+	}
+	cycle := comp.timer.GetCount()
+	var pos, neg float64
+	if (comp.acsr & acsrACBG) != 0 {
+		pos = comp.Bandgap
+	} else {
+		pos = comp.voltage(AIN0, cycle)
+	}
+	if (comp.sfior&sfiorACME) != 0 && comp.adc != nil && !comp.adc.Enabled() {
+		neg = comp.adc.Voltage(comp.adc.Mux()&0x07, cycle)
+	} else {
+		neg = comp.voltage(AIN1, cycle)
+	}
+
+	out := pos > neg
+	if out == comp.Output() {
+		return
+	}
+	comp.acsr ^= acsrACO
+	switch comp.acsr & acsrACIS {
+	case 0x00:
+		comp.acsr |= acsrACI
+	case 0x02:
+		if !out {
+			comp.acsr |= acsrACI
+		}
+	case 0x03:
+		if out {
+			comp.acsr |= acsrACI
+		}
+	}
+	if comp.Capturing() && comp.Capture != nil {
+		comp.Capture(out)
+	}
+	comp.updateIntr()
+}
+
+func (comp *Comparator) voltage(channel int, cycle int64) float64 {
+	if comp.input == nil {
+		return 0
+	}
+	return clampSupply(comp.input.Voltage(channel, cycle), comp.Supply,
+		cycle)
+}
+
+func (comp *Comparator) updateIntr() {
+	comp.intr.Set(comp.vec, (comp.acsr&(acsrACI|acsrACIE)) ==
+		(acsrACI|acsrACIE))
+}
@@ -0,0 +1,91 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func TestComparatorEdges(t *testing.T) {
+	timer := core.NewTimer()
+	intr := core.NewInterrupts(1)
+	ain0 := 1.0
+	input := AnalogFunc(func(ch int, cyc int64) float64 {
+		if ch == AIN0 {
+			return ain0
+		}
+		return 2.0
+	})
+	comp := NewComparator(timer, intr, 0, input, nil, 4)
+	var captures []bool
+	comp.Capture = func(high bool) {
+		captures = append(captures, high)
+	}
+	comp.WriteACSR(0, acsrACIE|acsrACIC|0x03)
+	if comp.Output() || intr.IsSet(0) {
+		t.Fatal("Bad initial state")
+	}
+
+	ain0 = 3.0
+	timer.Tick(4)
+	if !comp.Output() || !intr.IsSet(0) {
+		t.Error("Rising edge not detected")
+	}
+	intr.Ack(0)
+	if intr.IsSet(0) || comp.ReadACSR(0)&acsrACI != 0 {
+		t.Error("ACI not cleared by interrupt entry")
+	}
+
+	ain0 = 1.0
+	timer.Tick(4)
+	if comp.Output() || intr.IsSet(0) {
+		t.Error("Falling edge triggered rising-edge interrupt")
+	}
+	if len(captures) != 2 || !captures[0] || captures[1] {
+		t.Error("Bad capture triggers", captures)
+	}
+	comp.WriteACSR(0, acsrACBG|acsrACIE|0x00)
+	if comp.Output() {
+		t.Error("Bandgap below AIN1 gave high output")
+	}
+
+	comp.WriteACSR(0, 0x00)
+	ain0 = 3.0
+	timer.Tick(4)
+	if !comp.Output() || len(captures) != 2 {
+		t.Error("Capture triggered with ACIC clear", captures)
+	}
+}
+
+func TestComparatorADCMux(t *testing.T) {
+	timer := core.NewTimer()
+	intr := core.NewInterrupts(2)
+	input := AnalogFunc(func(ch int, cyc int64) float64 {
+		return float64(ch)
+	})
+	adc := NewADC(timer, intr, 1, input)
+	comp := NewComparator(timer, intr, 0, AnalogFunc(
+		func(ch int, cyc int64) float64 {
+			if ch == AIN0 {
+				return 2.5
+			}
+			return 1.0
+		}), adc, 4)
+	comp.WriteSFIOR(0, sfiorACME)
+	adc.WriteADMUX(0, 0x03)
+	timer.Tick(4)
+	if comp.Output() {
+		t.Error("ADC3 input not selected")
+	}
+	adc.WriteADMUX(0, 0x02)
+	timer.Tick(4)
+	if !comp.Output() {
+		t.Error("ADC2 input not selected")
+	}
+	adc.WriteADCSRA(0, adcsraADEN)
+	adc.WriteADMUX(0, 0x03)
+	timer.Tick(4)
+	if !comp.Output() {
+		t.Error("ADC multiplexer used while ADC enabled")
+	}
+}
@@ -0,0 +1,122 @@
+package dev
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// A Console drives a USART from Go code, for scripted firmware tests.
+// Pass Read and Write to NewUSART (or AddUSART); time only advances
+// through the step function, so all timeouts are in simulated cycles.
+type Console struct {
+	Read    chan byte
+	Write   chan byte
+	step    func() uint
+	pending []byte
+	output  []byte
+	mark    int
+	cycles  int64
+}
+
+// An ExpectError reports output that did not appear in time.
+type ExpectError struct {
+	Pattern    string
+	Cycles     int64
+	Transcript string
+}
+
+func (e *ExpectError) Error() string {
+	return fmt.Sprintf("no match for %q after %d cycles; output:\n%s",
+		e.Pattern, e.Cycles, e.Transcript)
+}
+
+// NewConsole returns a console that runs the simulation by calling
+// step, which returns the cycles it used (as System.Step does).
+func NewConsole(step func() uint) *Console {
+	return &Console{
+		Read:  make(chan byte, 16),
+		Write: make(chan byte, 256),
+		step:  step,
+	}
+}
+
+// Send queues s for the receiver; it is delivered at line speed as
+// the simulation runs.
+func (con *Console) Send(s string) {
+	con.pending = append(con.pending, s...)
+	con.feed()
+}
+
+// Expect runs for up to cycles cycles until the output since the end
+// of the last match matches re, and returns the match and its
+// submatches.
+func (con *Console) Expect(re *regexp.Regexp, cycles int64) ([]string, error) {
+	start := con.cycles
+	for {
+		if loc := re.FindSubmatchIndex(con.output[con.mark:]); loc != nil {
+			match := make([]string, len(loc)/2)
+			for i := range match {
+				if loc[2*i] >= 0 {
+					match[i] = string(con.output[con.mark+loc[2*i] : con.mark+loc[2*i+1]])
+				}
+			}
+			con.mark += loc[1]
+			return match, nil
+		}
+		n := len(con.output)
+		for len(con.output) == n {
+			if con.cycles-start >= cycles {
+				return nil, &ExpectError{re.String(), cycles, con.Transcript()}
+			}
+			con.runStep()
+		}
+	}
+}
+
+// ExpectString is Expect with a pattern compiled by regexp.MustCompile.
+func (con *Console) ExpectString(pattern string, cycles int64) ([]string, error) {
+	return con.Expect(regexp.MustCompile(pattern), cycles)
+}
+
+// Run runs the simulation for at least cycles cycles, collecting
+// output.
+func (con *Console) Run(cycles int64) {
+	end := con.cycles + cycles
+	for con.cycles < end {
+		con.runStep()
+	}
+}
+
+// Transcript returns all output received so far.
+func (con *Console) Transcript() string {
+	return string(con.output)
+}
+
+// Cycles returns the cycles run by the console.
+func (con *Console) Cycles() int64 {
+	return con.cycles
+}
+
+func (con *Console) runStep() {
+	con.feed()
+	con.cycles += int64(con.step())
+	for {
+		select {
+		case c := <-con.Write:
+			con.output = append(con.output, c)
+		default:
+			return
+		}
+	}
+}
+
+func (con *Console) feed() {
+	for len(con.pending) > 0 {
+		select {
+		case con.Read <- con.pending[0]:
+			con.pending = con.pending[1:]
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package dev
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+// newEchoConsole returns a console attached to a USART whose
+// "firmware" echoes received bytes in upper case.
+func newEchoConsole() *Console {
+	timer := core.NewTimer()
+	var usart *USART
+	con := NewConsole(func() uint {
+		timer.Tick(4)
+		if (usart.ReadUCSRA(0) & (ucsraRXC | ucsraUDRE)) ==
+			(ucsraRXC | ucsraUDRE) {
+			c := usart.ReadUDR(0)
+			usart.WriteUDR(0, strings.ToUpper(string(c))[0])
+		}
+		return 4
+	})
+	usart = NewUSART(con.Read, con.Write, timer, core.NewInterrupts(3), 0)
+	usart.WriteUCSRB(0, ucsrbRXEN|ucsrbTXEN)
+	return con
+}
+
+func TestConsoleExpect(t *testing.T) {
+	con := newEchoConsole()
+	con.Send("ok 42\n")
+	m, err := con.ExpectString(`OK (\d+)\n`, 10000)
+	if err != nil || m[1] != "42" {
+		t.Fatal("Bad match", m, err)
+	}
+	// 6 frames of 160 cycles, one frame of latency
+	if con.Cycles() < 7*160 || con.Cycles() > 8*160 {
+		t.Error("Bad cycle count", con.Cycles())
+	}
+	if _, err := con.ExpectString(`OK`, 1000); err == nil {
+		t.Error("Matched consumed output")
+	}
+}
+
+func TestConsoleTimeout(t *testing.T) {
+	con := newEchoConsole()
+	con.Send("abc")
+	_, err := con.ExpectString(`ABCD`, 2000)
+	e, ok := err.(*ExpectError)
+	if !ok || e.Transcript != "ABC" || e.Cycles != 2000 {
+		t.Fatal("Bad error", err)
+	}
+	if con.Cycles() < 2000 || con.Cycles() > 2004 {
+		t.Error("Bad cycle count", con.Cycles())
+	}
+}
@@ -0,0 +1,244 @@
+package dev
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/edmccard/avr-sim/core"
+	"github.com/edmccard/ihex"
+)
+
+const (
+	eecrEEPM  = 0x30
+	eecrEERIE = 0x08
+	eecrEEMWE = 0x04
+	eecrEEWE  = 0x02
+	eecrEERE  = 0x01
+)
+
+// Programming time: 8448 cycles of the 1MHz calibrated RC oscillator.
+const eepromWriteTime = 8448 * time.Microsecond
+
+type EEPROM struct {
+	data      []byte
+	timer     *core.Timer
+	intr      *core.Interrupts
+	vec       int
+	clock     ClockSource
+	writeTime time.Duration
+	eraseTime time.Duration
+	modes     bool
+	eear      int
+	eedr      byte
+	eecr      byte
+	// address and data latched when a write starts
+	writeAddr int
+	writeData byte
+	mwe       *core.Counter
+	write     *core.Counter
+	file      *os.File
+	err       error
+}
+
+func NewEEPROM(size int, timer *core.Timer, intr *core.Interrupts, vec int,
+	clock ClockSource) *EEPROM {
+
+	ee := &EEPROM{
+		data:      make([]byte, size),
+		timer:     timer,
+		intr:      intr,
+		vec:       vec,
+		clock:     clock,
+		writeTime: eepromWriteTime,
+	}
+	for i := range ee.data {
+		ee.data[i] = 0xff
+	}
+	return ee
+}
+
+// Reset clears the registers; a write in progress completes first.
+func (ee *EEPROM) Reset() {
+	if ee.write != nil {
+		ee.timer.RemoveCounter(ee.write)
+		ee.finishWrite()
+	}
+	if ee.mwe != nil {
+		ee.timer.RemoveCounter(ee.mwe)
+		ee.mwe = nil
+	}
+	ee.eecr = 0
+	ee.eear = 0
+	ee.eedr = 0
+	ee.updateIntr()
+}
+
+// EnableModes enables the programming mode bits (EEPM1:0) of newer
+// devices, where an atomic erase and write takes atomicUs and an erase
+// or write alone takes splitUs microseconds.
+func (ee *EEPROM) EnableModes(atomicUs, splitUs int) {
+	ee.modes = true
+	ee.writeTime = time.Duration(atomicUs) * time.Microsecond
+	ee.eraseTime = time.Duration(splitUs) * time.Microsecond
+}
+
+func (ee *EEPROM) Bytes() []byte {
+	return ee.data
+}
+
+// SetBackingFile loads the contents of the EEPROM from path (if it
+// exists) and writes every completed write through to it.
+func (ee *EEPROM) SetBackingFile(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	n, err := file.ReadAt(ee.data, 0)
+	if err != nil && err != io.EOF {
+		file.Close()
+		return err
+	}
+	if n < len(ee.data) {
+		if _, err := file.WriteAt(ee.data[n:], int64(n)); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	ee.Close()
+	ee.file = file
+	return nil
+}
+
+// Err returns the first error that occurred writing to the backing
+// file.
+func (ee *EEPROM) Err() error {
+	return ee.err
+}
+
+func (ee *EEPROM) Close() error {
+	if ee.file == nil {
+		return nil
+	}
+	err := ee.file.Close()
+	ee.file = nil
+	return err
+}
+
+// LoadHex loads EEPROM contents from an Intel hex (.eep) file.
+func (ee *EEPROM) LoadHex(data io.Reader) error {
+	parser := ihex.NewParser(data)
+	for parser.Parse() {
+		rec := parser.Data()
+		addr := int(rec.Address)
+		if addr+len(rec.Bytes) > len(ee.data) {
+			return errors.New("eeprom hex data out of range")
+		}
+		copy(ee.data[addr:], rec.Bytes)
+	}
+	if parser.Err() != nil {
+		return parser.Err()
+	}
+	if ee.file != nil {
+		_, err := ee.file.WriteAt(ee.data, 0)
+		return err
+	}
+	return nil
+}
+
+func (ee *EEPROM) ReadEEARL(addr core.Addr) byte {
+	return byte(ee.eear)
+}
+
+func (ee *EEPROM) WriteEEARL(addr core.Addr, val byte) {
+	if ee.write == nil {
+		ee.eear = ((ee.eear &^ 0xff) | int(val)) & (len(ee.data) - 1)
+	}
+}
+
+func (ee *EEPROM) ReadEEARH(addr core.Addr) byte {
+	return byte(ee.eear >> 8)
+}
+
+func (ee *EEPROM) WriteEEARH(addr core.Addr, val byte) {
+	if ee.write == nil {
+		ee.eear = ((ee.eear & 0xff) | int(val)<<8) & (len(ee.data) - 1)
+	}
+}
+
+func (ee *EEPROM) ReadEEDR(addr core.Addr) byte {
+	return ee.eedr
+}
+
+func (ee *EEPROM) WriteEEDR(addr core.Addr, val byte) {
+	ee.eedr = val
+}
+
+func (ee *EEPROM) ReadEECR(addr core.Addr) byte {
+	val := ee.eecr
+	if ee.write != nil {
+		val |= eecrEEWE
+	}
+	return val
+}
+
+func (ee *EEPROM) WriteEECR(addr core.Addr, val byte) {
+	mode := ee.eecr & eecrEEPM
+	if ee.modes && ee.write == nil {
+		mode = val & eecrEEPM
+	}
+	ee.eecr = (ee.eecr & eecrEEMWE) | (val & eecrEERIE) | mode
+
+	// EEWE only starts a write within four cycles of setting EEMWE
+	if (val&eecrEEWE) != 0 && (ee.eecr&eecrEEMWE) != 0 && ee.write == nil {
+		d := ee.writeTime
+		if mode != 0 {
+			d = ee.eraseTime
+		}
+		cycles := cyclesAt(ee.clock.Hertz(), d)
+		ee.writeAddr = ee.eear
+		ee.writeData = ee.eedr
+		ee.write = core.NewCounter(cycles, ee.finishWrite)
+		ee.timer.AddCounter(ee.write)
+	}
+	if (val & eecrEEMWE) != 0 {
+		ee.eecr |= eecrEEMWE
+		if ee.mwe != nil {
+			ee.timer.RemoveCounter(ee.mwe)
+		}
+		ee.mwe = core.NewCounter(4, func() bool {
+			ee.eecr &^= eecrEEMWE
+			ee.mwe = nil
+			return false
+		})
+		ee.timer.AddCounter(ee.mwe)
+	}
+
+	if (val&eecrEERE) != 0 && ee.write == nil {
+		ee.eedr = ee.data[ee.eear]
+	}
+	ee.updateIntr()
+}
+
+func (ee *EEPROM) finishWrite() bool {
+	ee.write = nil
+	addr := ee.writeAddr
+	switch ee.eecr & eecrEEPM {
+	case 0x00:
+		ee.data[addr] = ee.writeData
+	case 0x10:
+		ee.data[addr] = 0xff
+	case 0x20:
+		ee.data[addr] &= ee.writeData
+	}
+	if ee.file != nil && ee.err == nil {
+		_, ee.err = ee.file.WriteAt(ee.data[addr:addr+1], int64(addr))
+	}
+	ee.updateIntr()
+	return false
+}
+
+func (ee *EEPROM) updateIntr() {
+	ee.intr.Set(ee.vec, (ee.eecr&eecrEERIE) != 0 && ee.write == nil)
+}
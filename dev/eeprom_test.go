@@ -0,0 +1,139 @@
+package dev
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+// Programming time at 1MHz.
+const eepromWriteCycles = 8448
+
+func newTestEEPROM() (*EEPROM, *core.Timer, *core.Interrupts) {
+	timer := core.NewTimer()
+	intr := core.NewInterrupts(1)
+	return NewEEPROM(512, timer, intr, 0, FixedClock(1000000)), timer, intr
+}
+
+func eepromWrite(ee *EEPROM, timer *core.Timer, addr int, val byte) {
+	eepromWriteMode(ee, timer, addr, val, 0)
+}
+
+func eepromWriteMode(ee *EEPROM, timer *core.Timer, addr int, val byte,
+	mode byte) {
+
+	ee.WriteEEARH(0, byte(addr>>8))
+	ee.WriteEEARL(0, byte(addr))
+	ee.WriteEEDR(0, val)
+	ee.WriteEECR(0, mode|eecrEEMWE)
+	timer.Tick(1)
+	ee.WriteEECR(0, mode|eecrEEWE)
+}
+
+func TestEEPROMWrite(t *testing.T) {
+	ee, timer, intr := newTestEEPROM()
+	eepromWrite(ee, timer, 0x123, 0x5a)
+	if ee.ReadEECR(0)&eecrEEWE == 0 {
+		t.Fatal("Write did not start")
+	}
+	ee.WriteEEARL(0, 0)
+	ee.WriteEEDR(0, 0xa5)
+	timer.Tick(eepromWriteCycles - 1)
+	if ee.ReadEECR(0)&eecrEEWE == 0 {
+		t.Error("Write finished early")
+	}
+	timer.Tick(1)
+	if ee.ReadEECR(0)&eecrEEWE != 0 || ee.Bytes()[0x123] != 0x5a {
+		t.Error("Write did not finish")
+	}
+	ee.WriteEECR(0, eecrEERIE|eecrEERE)
+	if ee.ReadEEDR(0) != 0x5a || !intr.IsSet(0) {
+		t.Error("Bad read or interrupt")
+	}
+}
+
+func TestEEPROMWriteTimeout(t *testing.T) {
+	ee, timer, _ := newTestEEPROM()
+	ee.WriteEECR(0, eecrEEMWE)
+	timer.Tick(4)
+	ee.WriteEECR(0, eecrEEWE)
+	if ee.ReadEECR(0)&(eecrEEWE|eecrEEMWE) != 0 {
+		t.Error("Write started after EEMWE expired")
+	}
+}
+
+func TestEEPROMBackingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eeprom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "eeprom.bin")
+
+	ee, timer, _ := newTestEEPROM()
+	if err := ee.SetBackingFile(path); err != nil {
+		t.Fatal(err)
+	}
+	eepromWrite(ee, timer, 7, 0x42)
+	timer.Tick(eepromWriteCycles)
+	ee.Close()
+
+	ee, _, _ = newTestEEPROM()
+	if err := ee.SetBackingFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if ee.Bytes()[7] != 0x42 || ee.Bytes()[8] != 0xff {
+		t.Error("Contents not persisted")
+	}
+	ee.Close()
+}
+
+func TestEEPROMLoadHex(t *testing.T) {
+	ee, _, _ := newTestEEPROM()
+	err := ee.LoadHex(strings.NewReader(
+		":0400100001020304E2\n:00000001FF\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ee.Bytes()[0x10] != 1 || ee.Bytes()[0x13] != 4 {
+		t.Error("Hex data not loaded")
+	}
+}
+
+func TestEEPROMModes(t *testing.T) {
+	ee, timer, _ := newTestEEPROM()
+	ee.EnableModes(3400, 1800)
+	eepromWrite(ee, timer, 0x10, 0xf0)
+	timer.Tick(3400)
+	eepromWriteMode(ee, timer, 0x10, 0x3c, 0x20)
+	timer.Tick(1800)
+	if ee.ReadEECR(0)&eecrEEWE != 0 || ee.Bytes()[0x10] != 0x30 {
+		t.Fatal("Bad write-only result", ee.Bytes()[0x10])
+	}
+	eepromWriteMode(ee, timer, 0x10, 0x00, 0x10)
+	// EEPM cannot change during a write
+	ee.WriteEECR(0, 0)
+	if ee.ReadEECR(0)&eecrEEPM != 0x10 {
+		t.Error("EEPM changed")
+	}
+	timer.Tick(1800)
+	if ee.Bytes()[0x10] != 0xff {
+		t.Error("Bad erase-only result", ee.Bytes()[0x10])
+	}
+}
+
+func TestEEPROMReset(t *testing.T) {
+	ee, timer, _ := newTestEEPROM()
+	eepromWrite(ee, timer, 0x12, 0x34)
+	ee.Reset()
+	if ee.Bytes()[0x12] != 0x34 {
+		t.Error("Write in progress lost")
+	}
+	if ee.ReadEECR(0) != 0 || ee.ReadEEARL(0) != 0 {
+		t.Error("Registers not reset")
+	}
+}
@@ -0,0 +1,114 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+// Sense control values of ISCn1:0
+const (
+	eiscLow = iota
+	eiscChange
+	eiscFalling
+	eiscRising
+)
+
+// An ExtInt is an external interrupt, INTn, on one pin of a port.
+// ISCn1:0 select a low level, any change, a falling or a rising edge.
+// Like a PinChange, its bits live in registers shared with other
+// interrupts: mask selects its enable and flag bit (EIMSK/EIFR on
+// megas, GIMSK/GIFR on tinies), and iscShift the position of ISCn1:0
+// in its control register (EICRA or MCUCR). A low level raises the
+// interrupt for as long as it lasts, without setting the flag.
+type ExtInt struct {
+	intr     *core.Interrupts
+	vec      int
+	port     *Port
+	pin      byte
+	mask     byte
+	iscShift uint
+	isc      byte
+	enable   bool
+	flag     bool
+}
+
+func NewExtInt(intr *core.Interrupts, vec int, port *Port, pin int,
+	mask byte, iscShift uint) *ExtInt {
+
+	ext := &ExtInt{
+		intr:     intr,
+		vec:      vec,
+		port:     port,
+		pin:      1 << uint(pin),
+		mask:     mask,
+		iscShift: iscShift,
+	}
+	intr.SetAck(vec, func() {
+		ext.flag = false
+		ext.updateIntr()
+	})
+	port.OnChange(ext.pinsChanged)
+	return ext
+}
+
+// ReadEICR returns the ISCn1:0 bits of the shared control register.
+func (ext *ExtInt) ReadEICR(addr core.Addr) byte {
+	return ext.isc << ext.iscShift
+}
+
+func (ext *ExtInt) WriteEICR(addr core.Addr, val byte) {
+	ext.isc = (val >> ext.iscShift) & 0x03
+	ext.updateIntr()
+}
+
+// ReadEIMSK returns the enable bit of the shared mask register.
+func (ext *ExtInt) ReadEIMSK(addr core.Addr) byte {
+	if ext.enable {
+		return ext.mask
+	}
+	return 0
+}
+
+func (ext *ExtInt) WriteEIMSK(addr core.Addr, val byte) {
+	ext.enable = (val & ext.mask) != 0
+	ext.updateIntr()
+}
+
+// ReadEIFR returns the flag bit of the shared flag register.
+func (ext *ExtInt) ReadEIFR(addr core.Addr) byte {
+	if ext.flag {
+		return ext.mask
+	}
+	return 0
+}
+
+// The flag is cleared by writing a one to it.
+func (ext *ExtInt) WriteEIFR(addr core.Addr, val byte) {
+	if (val & ext.mask) != 0 {
+		ext.flag = false
+		ext.updateIntr()
+	}
+}
+
+func (ext *ExtInt) pinsChanged(levels, changed byte) {
+	if (changed & ext.pin) == 0 {
+		return
+	}
+	high := (levels & ext.pin) != 0
+	switch ext.isc {
+	case eiscChange:
+		ext.flag = true
+	case eiscFalling:
+		ext.flag = ext.flag || !high
+	case eiscRising:
+		ext.flag = ext.flag || high
+	}
+	ext.updateIntr()
+}
+
+func (ext *ExtInt) updateIntr() {
+	pending := ext.flag
+	if ext.isc == eiscLow {
+		pending = (ext.port.Levels() & ext.pin) == 0
+	}
+	ext.intr.Set(ext.vec, pending && ext.enable)
+}
@@ -0,0 +1,43 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func TestExtInt(t *testing.T) {
+	intr := core.NewInterrupts(1)
+	port := NewPort()
+	port.Drive(2, true)
+	ext := NewExtInt(intr, 0, port, 2, 0x40, 2)
+	ext.WriteEICR(0, eiscFalling<<2)
+	ext.WriteEIMSK(0, 0xff)
+	if ext.ReadEIMSK(0) != 0x40 || ext.ReadEICR(0) != 0x08 {
+		t.Error("Bad register bits", ext.ReadEIMSK(0), ext.ReadEICR(0))
+	}
+	port.Drive(1, false)
+	port.Drive(2, false)
+	if ext.ReadEIFR(0) != 0x40 || !intr.IsSet(0) {
+		t.Fatal("Falling edge not flagged")
+	}
+	intr.Ack(0)
+	port.Drive(2, true)
+	if intr.IsSet(0) || ext.ReadEIFR(0) != 0 {
+		t.Error("Rising edge flagged for falling sense")
+	}
+
+	ext.WriteEICR(0, eiscLow<<2)
+	port.Drive(2, false)
+	if !intr.IsSet(0) || ext.ReadEIFR(0) != 0 {
+		t.Error("Low level not raised")
+	}
+	intr.Ack(0)
+	if !intr.IsSet(0) {
+		t.Error("Low level dropped while held")
+	}
+	port.Drive(2, true)
+	if intr.IsSet(0) {
+		t.Error("Low level raised while high")
+	}
+}
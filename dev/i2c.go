@@ -0,0 +1,66 @@
+package dev
+
+// An I2CTarget is a simulated device attached to an I2CBus.
+type I2CTarget interface {
+	// Start is called when the target is addressed after a START or
+	// repeated START; it returns false to NACK its address.
+	Start(read bool) bool
+	// Write receives a byte from the master, returning false to NACK.
+	Write(data byte) bool
+	// Read returns the next byte to send to the master.
+	Read() byte
+	// Stop is called when a STOP condition ends the transaction, or a
+	// repeated START addresses another target.
+	Stop()
+}
+
+type I2CBus struct {
+	targets map[byte]I2CTarget
+	cur     I2CTarget
+}
+
+func NewI2CBus() *I2CBus {
+	return &I2CBus{targets: make(map[byte]I2CTarget)}
+}
+
+// Attach connects a target at a 7-bit address.
+func (bus *I2CBus) Attach(addr byte, target I2CTarget) {
+	bus.targets[addr&0x7f] = target
+}
+
+func (bus *I2CBus) Detach(addr byte) {
+	delete(bus.targets, addr&0x7f)
+}
+
+func (bus *I2CBus) address(addr byte, read bool) bool {
+	target := bus.targets[addr&0x7f]
+	if bus.cur != nil && bus.cur != target {
+		bus.cur.Stop()
+	}
+	bus.cur = target
+	if target == nil {
+		return false
+	}
+	return target.Start(read)
+}
+
+func (bus *I2CBus) write(data byte) bool {
+	if bus.cur == nil {
+		return false
+	}
+	return bus.cur.Write(data)
+}
+
+func (bus *I2CBus) read() byte {
+	if bus.cur == nil {
+		return 0xff
+	}
+	return bus.cur.Read()
+}
+
+func (bus *I2CBus) stop() {
+	if bus.cur != nil {
+		bus.cur.Stop()
+		bus.cur = nil
+	}
+}
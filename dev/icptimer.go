@@ -0,0 +1,214 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	tccr1bICES1  = 0x40
+	tccr1bCS1    = 0x07
+	timskTICIE1  = 0x20
+	tifrICF1     = 0x20
+	icpTimerMask = 0xffff
+)
+
+// Clock divisors by CS12:0; 0 stops the counter, as do the external
+// clock selections.
+var icpPrescale = [8]int64{0, 1, 8, 64, 256, 1024, 0, 0}
+
+// An ICPTimer is the counter and input capture unit of a 16-bit Timer1,
+// like that of the ATmega8. The counter runs in normal mode from the
+// system clock through a 1-1024 prescaler, and ICR1 latches it on the
+// edge of the capture input selected by ICES1. The compare units, the
+// PWM modes and the noise canceler are not modelled; TCCR1A, WGM13:12
+// and ICNC1 are stored only.
+type ICPTimer struct {
+	timer   *core.Timer
+	intr    *core.Interrupts
+	vecCapt int
+	vecOvf  int
+	tccr1a  byte
+	tccr1b  byte
+	tcnt    uint16
+	icr     uint16
+	temp    byte
+	timsk   byte
+	tifr    byte
+	last    int64
+	frac    int64
+	event   *core.Counter
+}
+
+// NewICPTimer returns a timer with interrupt vectors for input capture
+// and overflow.
+func NewICPTimer(timer *core.Timer, intr *core.Interrupts,
+	vecCapt, vecOvf int) *ICPTimer {
+
+	t := &ICPTimer{
+		timer:   timer,
+		intr:    intr,
+		vecCapt: vecCapt,
+		vecOvf:  vecOvf,
+	}
+	vecs := [2]int{vecCapt, vecOvf}
+	for i, flag := range [2]byte{tifrICF1, tifrTOV1} {
+		flag := flag
+		intr.SetAck(vecs[i], func() {
+			t.tifr &^= flag
+			t.updateIntr()
+		})
+	}
+	return t
+}
+
+// Reset stops the counter and clears the registers.
+func (t *ICPTimer) Reset() {
+	t.tccr1a = 0
+	t.tccr1b = 0
+	t.tcnt = 0
+	t.icr = 0
+	t.temp = 0
+	t.timsk = 0
+	t.tifr = 0
+	t.frac = 0
+	t.last = t.timer.GetCount()
+	t.schedule()
+	t.updateIntr()
+}
+
+// Capture is the input capture trigger, called with the new level of
+// the capture input on each change.
+func (t *ICPTimer) Capture(high bool) {
+	if high != ((t.tccr1b & tccr1bICES1) != 0) {
+		return
+	}
+	t.sync()
+	t.icr = t.tcnt
+	t.tifr |= tifrICF1
+	t.updateIntr()
+}
+
+func (t *ICPTimer) ReadTCCR1A(addr core.Addr) byte {
+	return t.tccr1a
+}
+
+func (t *ICPTimer) WriteTCCR1A(addr core.Addr, val byte) {
+	t.tccr1a = val
+}
+
+func (t *ICPTimer) ReadTCCR1B(addr core.Addr) byte {
+	return t.tccr1b
+}
+
+func (t *ICPTimer) WriteTCCR1B(addr core.Addr, val byte) {
+	t.sync()
+	t.tccr1b = val
+	t.schedule()
+}
+
+// The 16-bit registers are accessed through TEMP: reading the low byte
+// latches the high byte, and writing the low byte writes both.
+func (t *ICPTimer) ReadTCNT1L(addr core.Addr) byte {
+	t.sync()
+	t.temp = byte(t.tcnt >> 8)
+	return byte(t.tcnt)
+}
+
+func (t *ICPTimer) ReadTCNT1H(addr core.Addr) byte {
+	return t.temp
+}
+
+func (t *ICPTimer) WriteTCNT1L(addr core.Addr, val byte) {
+	t.sync()
+	t.tcnt = uint16(t.temp)<<8 | uint16(val)
+	t.schedule()
+}
+
+func (t *ICPTimer) WriteTCNT1H(addr core.Addr, val byte) {
+	t.temp = val
+}
+
+func (t *ICPTimer) ReadICR1L(addr core.Addr) byte {
+	t.temp = byte(t.icr >> 8)
+	return byte(t.icr)
+}
+
+func (t *ICPTimer) ReadICR1H(addr core.Addr) byte {
+	return t.temp
+}
+
+// ICR1 is only writable in the PWM modes, which are not modelled.
+func (t *ICPTimer) WriteICR1L(addr core.Addr, val byte) {}
+
+func (t *ICPTimer) WriteICR1H(addr core.Addr, val byte) {
+	t.temp = val
+}
+
+// ReadTIMSK returns the Timer1 capture and overflow bits of TIMSK.
+func (t *ICPTimer) ReadTIMSK(addr core.Addr) byte {
+	return t.timsk
+}
+
+func (t *ICPTimer) WriteTIMSK(addr core.Addr, val byte) {
+	t.timsk = val & (timskTICIE1 | timskTOIE1)
+	t.updateIntr()
+}
+
+// ReadTIFR returns the Timer1 capture and overflow bits of TIFR.
+func (t *ICPTimer) ReadTIFR(addr core.Addr) byte {
+	t.sync()
+	return t.tifr
+}
+
+// Flags are cleared by writing a one to them.
+func (t *ICPTimer) WriteTIFR(addr core.Addr, val byte) {
+	t.sync()
+	t.tifr &^= val
+	t.updateIntr()
+}
+
+func (t *ICPTimer) prescale() int64 {
+	return icpPrescale[t.tccr1b&tccr1bCS1]
+}
+
+func (t *ICPTimer) sync() {
+	now := t.timer.GetCount()
+	elapsed := now - t.last
+	t.last = now
+	div := t.prescale()
+	if div == 0 {
+		return
+	}
+	total := t.frac + elapsed
+	t.frac = total % div
+	ticks := total / div
+	if int64(t.tcnt)+ticks > icpTimerMask {
+		t.tifr |= tifrTOV1
+	}
+	t.tcnt = uint16(int64(t.tcnt) + ticks)
+	t.updateIntr()
+}
+
+func (t *ICPTimer) schedule() {
+	if t.event != nil {
+		t.timer.RemoveCounter(t.event)
+		t.event = nil
+	}
+	div := t.prescale()
+	if div == 0 {
+		return
+	}
+	cycles := (icpTimerMask+1-int64(t.tcnt))*div - t.frac
+	t.event = core.NewCounter(cycles, func() bool {
+		t.event = nil
+		t.sync()
+		t.schedule()
+		return false
+	})
+	t.timer.AddCounter(t.event)
+}
+
+func (t *ICPTimer) updateIntr() {
+	t.intr.Set(t.vecCapt, (t.tifr&t.timsk&tifrICF1) != 0)
+	t.intr.Set(t.vecOvf, (t.tifr&t.timsk&tifrTOV1) != 0)
+}
@@ -0,0 +1,51 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func TestICPTimerCount(t *testing.T) {
+	timer := core.NewTimer()
+	intr := core.NewInterrupts(2)
+	it := NewICPTimer(timer, intr, 0, 1)
+	it.WriteTIMSK(0, timskTOIE1)
+	it.WriteTCNT1H(0, 0xff)
+	it.WriteTCNT1L(0, 0xf0)
+	it.WriteTCCR1B(0, 0x02) // clk/8
+	timer.Tick(8*0x0f + 7)
+	if it.ReadTCNT1L(0) != 0xff || it.ReadTCNT1H(0) != 0xff || intr.IsSet(1) {
+		t.Fatal("Bad count before overflow", it.ReadTCNT1L(0))
+	}
+	timer.Tick(1)
+	if !intr.IsSet(1) || it.ReadTCNT1L(0) != 0 || it.ReadTCNT1H(0) != 0 {
+		t.Error("No overflow", it.ReadTCNT1L(0))
+	}
+	intr.Ack(1)
+	if intr.IsSet(1) || it.ReadTIFR(0)&tifrTOV1 != 0 {
+		t.Error("TOV1 not cleared by interrupt entry")
+	}
+}
+
+func TestICPTimerCapture(t *testing.T) {
+	timer := core.NewTimer()
+	intr := core.NewInterrupts(2)
+	it := NewICPTimer(timer, intr, 0, 1)
+	it.WriteTIMSK(0, timskTICIE1)
+	it.WriteTCCR1B(0, tccr1bICES1|0x01)
+	timer.Tick(0x1234)
+	it.Capture(false)
+	if intr.IsSet(0) {
+		t.Fatal("Captured on the wrong edge")
+	}
+	it.Capture(true)
+	timer.Tick(100)
+	if !intr.IsSet(0) || it.ReadICR1L(0) != 0x34 || it.ReadICR1H(0) != 0x12 {
+		t.Error("Bad capture", intr.IsSet(0), it.ReadICR1L(0))
+	}
+	it.WriteTIFR(0, tifrICF1)
+	if intr.IsSet(0) {
+		t.Error("ICF1 not cleared")
+	}
+}
@@ -0,0 +1,44 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+// An RCOscillator is a calibrated internal RC oscillator. Its
+// frequency changes by Step (a fraction of Nominal) for each step of
+// OSCCAL away from the factory value Calibrated, at which it runs at
+// Nominal. The overlapping OSCCAL ranges of real parts are not
+// modelled.
+type RCOscillator struct {
+	Nominal    int
+	Calibrated byte
+	Step       float64
+	osccal     byte
+}
+
+func NewRCOscillator(nominal int, calibrated byte) *RCOscillator {
+	return &RCOscillator{
+		Nominal:    nominal,
+		Calibrated: calibrated,
+		Step:       0.005,
+		osccal:     calibrated,
+	}
+}
+
+func (osc *RCOscillator) ReadOSCCAL(addr core.Addr) byte {
+	return osc.osccal
+}
+
+func (osc *RCOscillator) WriteOSCCAL(addr core.Addr, val byte) {
+	osc.osccal = val
+}
+
+// Hertz returns the current frequency.
+func (osc *RCOscillator) Hertz() int {
+	delta := float64(int(osc.osccal) - int(osc.Calibrated))
+	hz := float64(osc.Nominal) * (1 + osc.Step*delta)
+	if hz < 0 {
+		return 0
+	}
+	return int(hz + 0.5)
+}
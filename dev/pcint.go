@@ -0,0 +1,78 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+// A PinChange raises an interrupt when any pin of a port selected in
+// PCMSK changes level. Its enable and flag bits live in registers
+// shared with other interrupts (PCICR/PCIFR on megas, GIMSK/GIFR on
+// tinies); mask selects its bit in both.
+type PinChange struct {
+	intr   *core.Interrupts
+	vec    int
+	mask   byte
+	pcmsk  byte
+	enable bool
+	flag   bool
+}
+
+func NewPinChange(intr *core.Interrupts, vec int, port *Port,
+	mask byte) *PinChange {
+
+	pc := &PinChange{intr: intr, vec: vec, mask: mask}
+	intr.SetAck(vec, func() {
+		pc.flag = false
+		pc.updateIntr()
+	})
+	port.OnChange(pc.pinsChanged)
+	return pc
+}
+
+func (pc *PinChange) ReadPCMSK(addr core.Addr) byte {
+	return pc.pcmsk
+}
+
+func (pc *PinChange) WritePCMSK(addr core.Addr, val byte) {
+	pc.pcmsk = val
+}
+
+// ReadPCICR returns the enable bit of the shared control register.
+func (pc *PinChange) ReadPCICR(addr core.Addr) byte {
+	if pc.enable {
+		return pc.mask
+	}
+	return 0
+}
+
+func (pc *PinChange) WritePCICR(addr core.Addr, val byte) {
+	pc.enable = (val & pc.mask) != 0
+	pc.updateIntr()
+}
+
+// ReadPCIFR returns the flag bit of the shared flag register.
+func (pc *PinChange) ReadPCIFR(addr core.Addr) byte {
+	if pc.flag {
+		return pc.mask
+	}
+	return 0
+}
+
+// The flag is cleared by writing a one to it.
+func (pc *PinChange) WritePCIFR(addr core.Addr, val byte) {
+	if (val & pc.mask) != 0 {
+		pc.flag = false
+		pc.updateIntr()
+	}
+}
+
+func (pc *PinChange) pinsChanged(levels, changed byte) {
+	if (changed & pc.pcmsk) != 0 {
+		pc.flag = true
+		pc.updateIntr()
+	}
+}
+
+func (pc *PinChange) updateIntr() {
+	pc.intr.Set(pc.vec, pc.flag && pc.enable)
+}
@@ -0,0 +1,39 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func TestPinChange(t *testing.T) {
+	intr := core.NewInterrupts(1)
+	port := NewPort()
+	pc := NewPinChange(intr, 0, port, 0x20)
+	pc.WritePCMSK(0, 0x04)
+	pc.WritePCICR(0, 0xff)
+	if pc.ReadPCICR(0) != 0x20 {
+		t.Error("Bad enable bit")
+	}
+	port.Drive(1, true)
+	if pc.ReadPCIFR(0) != 0 {
+		t.Error("Masked pin raised flag")
+	}
+	port.Drive(2, true)
+	if pc.ReadPCIFR(0) != 0x20 || !intr.IsSet(0) {
+		t.Error("Pin change not flagged")
+	}
+	intr.Ack(0)
+	if intr.IsSet(0) {
+		t.Error("Flag not cleared by interrupt entry")
+	}
+	pc.WritePCICR(0, 0)
+	port.Drive(2, false)
+	if intr.IsSet(0) || pc.ReadPCIFR(0) == 0 {
+		t.Error("Disabled pin change raised interrupt")
+	}
+	pc.WritePCIFR(0, 0x20)
+	if pc.ReadPCIFR(0) != 0 {
+		t.Error("Flag not cleared by writing one")
+	}
+}
@@ -0,0 +1,406 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	tccr1CTC1   = 0x80
+	tccr1PWM1A  = 0x40
+	tccr1COM1A  = 0x30
+	tccr1CS1    = 0x0f
+	gtccrPWM1B  = 0x40
+	gtccrCOM1B  = 0x30
+	gtccrFOC1B  = 0x08
+	gtccrFOC1A  = 0x04
+	gtccrPSR1   = 0x02
+	timskOCIE1A = 0x40
+	timskOCIE1B = 0x20
+	timskTOIE1  = 0x04
+	tifrOCF1A   = 0x40
+	tifrOCF1B   = 0x20
+	tifrTOV1    = 0x04
+	pllcsrLSM   = 0x80
+	pllcsrPCKE  = 0x04
+	pllcsrPLLE  = 0x02
+	pllcsrPLOCK = 0x01
+)
+
+// PLL lock time in microseconds
+const pllLockUs = 100
+
+type pllChannel struct {
+	ocr    byte
+	oc     bool
+	port   *Port
+	pin    byte
+	invPin byte
+}
+
+// A PLLTimer is an 8-bit timer/counter with OCR1C as its top value,
+// clocked from the system clock or from the PLL through a 1-16384
+// prescaler, like Timer1 of the ATtiny25/45/85. Dead time generation
+// and the synchronous mode of the asynchronous clock are not modelled.
+type PLLTimer struct {
+	// PLLHertz is the frequency of the locked PLL with LSM clear.
+	PLLHertz int
+	timer    *core.Timer
+	intr     *core.Interrupts
+	vecs     [3]int
+	sysClock ClockSource
+	tccr1    byte
+	gtccr    byte
+	tcnt     byte
+	ocr1c    byte
+	timsk    byte
+	tifr     byte
+	pllcsr   byte
+	ch       [2]pllChannel
+	last     int64
+	frac     int64
+	event    *core.Counter
+	lock     *core.Counter
+}
+
+// NewPLLTimer returns a timer for a system clocked by sysClock, with
+// interrupt vectors for compare matches A and B and overflow.
+func NewPLLTimer(timer *core.Timer, intr *core.Interrupts,
+	vecCompA, vecCompB, vecOvf int, sysClock ClockSource) *PLLTimer {
+
+	t := &PLLTimer{
+		PLLHertz: 64000000,
+		timer:    timer,
+		intr:     intr,
+		vecs:     [3]int{vecCompA, vecCompB, vecOvf},
+		sysClock: sysClock,
+		ocr1c:    0xff,
+	}
+	for i, flag := range [3]byte{tifrOCF1A, tifrOCF1B, tifrTOV1} {
+		flag := flag
+		intr.SetAck(t.vecs[i], func() {
+			t.tifr &^= flag
+			t.updateIntr()
+		})
+	}
+	return t
+}
+
+// AttachOutputs connects the compare outputs to pins of port; invA and
+// invB are the inverted outputs used in PWM mode. Pass -1 for pins that
+// are not connected.
+func (t *PLLTimer) AttachOutputs(port *Port, pinA, invA, pinB, invB int) {
+	for i, pins := range [2][2]int{{pinA, invA}, {pinB, invB}} {
+		t.ch[i].port = port
+		t.ch[i].pin = pinMask(pins[0])
+		t.ch[i].invPin = pinMask(pins[1])
+	}
+}
+
+func pinMask(pin int) byte {
+	if pin < 0 {
+		return 0
+	}
+	return 1 << uint(pin)
+}
+
+func (t *PLLTimer) ReadTCCR1(addr core.Addr) byte {
+	return t.tccr1
+}
+
+func (t *PLLTimer) WriteTCCR1(addr core.Addr, val byte) {
+	t.sync()
+	t.tccr1 = val
+	t.updateOutputs()
+	t.schedule()
+}
+
+// ReadGTCCR returns the Timer1 bits of GTCCR.
+func (t *PLLTimer) ReadGTCCR(addr core.Addr) byte {
+	return t.gtccr
+}
+
+func (t *PLLTimer) WriteGTCCR(addr core.Addr, val byte) {
+	t.sync()
+	t.gtccr = val & (gtccrPWM1B | gtccrCOM1B)
+	if (val & gtccrPSR1) != 0 {
+		t.frac = 0
+	}
+	for i, foc := range [2]byte{gtccrFOC1A, gtccrFOC1B} {
+		if (val&foc) != 0 && !t.pwm(i) {
+			t.compareOutput(i)
+		}
+	}
+	t.updateOutputs()
+	t.schedule()
+}
+
+func (t *PLLTimer) ReadTCNT1(addr core.Addr) byte {
+	t.sync()
+	return t.tcnt
+}
+
+func (t *PLLTimer) WriteTCNT1(addr core.Addr, val byte) {
+	t.sync()
+	t.tcnt = val
+	t.schedule()
+}
+
+func (t *PLLTimer) ReadOCR1A(addr core.Addr) byte {
+	return t.ch[0].ocr
+}
+
+func (t *PLLTimer) WriteOCR1A(addr core.Addr, val byte) {
+	t.sync()
+	t.ch[0].ocr = val
+	t.schedule()
+}
+
+func (t *PLLTimer) ReadOCR1B(addr core.Addr) byte {
+	return t.ch[1].ocr
+}
+
+func (t *PLLTimer) WriteOCR1B(addr core.Addr, val byte) {
+	t.sync()
+	t.ch[1].ocr = val
+	t.schedule()
+}
+
+func (t *PLLTimer) ReadOCR1C(addr core.Addr) byte {
+	return t.ocr1c
+}
+
+func (t *PLLTimer) WriteOCR1C(addr core.Addr, val byte) {
+	t.sync()
+	t.ocr1c = val
+	t.schedule()
+}
+
+// ReadTIMSK returns the Timer1 bits of TIMSK.
+func (t *PLLTimer) ReadTIMSK(addr core.Addr) byte {
+	return t.timsk
+}
+
+func (t *PLLTimer) WriteTIMSK(addr core.Addr, val byte) {
+	t.timsk = val & (timskOCIE1A | timskOCIE1B | timskTOIE1)
+	t.updateIntr()
+}
+
+// ReadTIFR returns the Timer1 bits of TIFR.
+func (t *PLLTimer) ReadTIFR(addr core.Addr) byte {
+	t.sync()
+	return t.tifr
+}
+
+// Flags are cleared by writing a one to them.
+func (t *PLLTimer) WriteTIFR(addr core.Addr, val byte) {
+	t.sync()
+	t.tifr &^= val
+	t.updateIntr()
+}
+
+func (t *PLLTimer) ReadPLLCSR(addr core.Addr) byte {
+	return t.pllcsr
+}
+
+func (t *PLLTimer) WritePLLCSR(addr core.Addr, val byte) {
+	t.sync()
+	if (val & pllcsrPLLE) == 0 {
+		if t.lock != nil {
+			t.timer.RemoveCounter(t.lock)
+			t.lock = nil
+		}
+		val &^= pllcsrPCKE
+		t.pllcsr = 0
+	} else if (t.pllcsr&pllcsrPLLE) == 0 && t.lock == nil {
+		t.lock = core.NewCounter(int64(t.sysClock.Hertz())*pllLockUs/1000000+1,
+			func() bool {
+				t.lock = nil
+				t.pllcsr |= pllcsrPLOCK
+				return false
+			})
+		t.timer.AddCounter(t.lock)
+	}
+	t.pllcsr = (t.pllcsr & pllcsrPLOCK) |
+		(val & (pllcsrLSM | pllcsrPCKE | pllcsrPLLE))
+	t.schedule()
+}
+
+// clock returns the prescaler input frequency.
+func (t *PLLTimer) clock() int64 {
+	if (t.pllcsr & pllcsrPCKE) == 0 {
+		return int64(t.sysClock.Hertz())
+	}
+	if (t.pllcsr & pllcsrLSM) != 0 {
+		return int64(t.PLLHertz / 2)
+	}
+	return int64(t.PLLHertz)
+}
+
+// A timer tick lasts num/den CPU cycles; num is 0 when stopped.
+func (t *PLLTimer) tickRate() (num, den int64) {
+	cs := t.tccr1 & tccr1CS1
+	if cs == 0 {
+		return 0, 1
+	}
+	return int64(t.sysClock.Hertz()) << (cs - 1), t.clock()
+}
+
+func (t *PLLTimer) pwm(ch int) bool {
+	if ch == 0 {
+		return (t.tccr1 & tccr1PWM1A) != 0
+	}
+	return (t.gtccr & gtccrPWM1B) != 0
+}
+
+func (t *PLLTimer) com(ch int) byte {
+	if ch == 0 {
+		return (t.tccr1 & tccr1COM1A) >> 4
+	}
+	return (t.gtccr & gtccrCOM1B) >> 4
+}
+
+// top returns the value after which the counter returns to zero.
+func (t *PLLTimer) top() int {
+	top := 0xff
+	if t.pwm(0) || t.pwm(1) || (t.tccr1&tccr1CTC1) != 0 {
+		top = int(t.ocr1c)
+	}
+	if int(t.tcnt) > top {
+		top = 0xff
+	}
+	return top
+}
+
+// nextEvent returns the number of ticks until the counter next wraps
+// or matches a compare register.
+func (t *PLLTimer) nextEvent() int64 {
+	tcnt, top := int(t.tcnt), t.top()
+	d := top - tcnt + 1
+	for _, ch := range t.ch {
+		ocr := int(ch.ocr)
+		if ocr > tcnt && ocr <= top && ocr-tcnt < d {
+			d = ocr - tcnt
+		}
+	}
+	return int64(d)
+}
+
+func (t *PLLTimer) sync() {
+	now := t.timer.GetCount()
+	elapsed := now - t.last
+	t.last = now
+	num, den := t.tickRate()
+	if num == 0 {
+		return
+	}
+	total := t.frac + elapsed*den
+	t.frac = total % num
+	t.advance(total / num)
+}
+
+func (t *PLLTimer) advance(ticks int64) {
+	for ticks > 0 {
+		d := t.nextEvent()
+		if ticks < d {
+			t.tcnt += byte(ticks)
+			break
+		}
+		ticks -= d
+		if top := t.top(); int(t.tcnt)+int(d) > top {
+			t.tcnt = 0
+			t.wrap(top)
+		} else {
+			t.tcnt += byte(d)
+		}
+		for i := range t.ch {
+			if t.tcnt == t.ch[i].ocr {
+				t.tifr |= [2]byte{tifrOCF1A, tifrOCF1B}[i]
+				t.compareOutput(i)
+			}
+		}
+		t.updateOutputs()
+	}
+	t.updateIntr()
+}
+
+func (t *PLLTimer) wrap(top int) {
+	if top == 0xff || t.pwm(0) || t.pwm(1) {
+		t.tifr |= tifrTOV1
+	}
+	for i := range t.ch {
+		if t.pwm(i) && t.com(i) != 0 {
+			t.ch[i].oc = t.com(i) != 3
+		}
+	}
+}
+
+func (t *PLLTimer) compareOutput(i int) {
+	ch := &t.ch[i]
+	switch com := t.com(i); {
+	case t.pwm(i) && com != 0:
+		ch.oc = com == 3
+	case com == 1:
+		ch.oc = !ch.oc
+	case com == 2:
+		ch.oc = false
+	case com == 3:
+		ch.oc = true
+	}
+}
+
+func (t *PLLTimer) updateOutputs() {
+	for i := range t.ch {
+		ch := &t.ch[i]
+		if ch.port == nil {
+			continue
+		}
+		com := t.com(i)
+		if com == 0 {
+			ch.port.ClearOverride(ch.pin | ch.invPin)
+			continue
+		}
+		var val byte
+		if ch.oc {
+			val = ch.pin
+		}
+		ch.port.Override(ch.pin, val)
+		if t.pwm(i) && com == 1 {
+			var inv byte
+			if !ch.oc {
+				inv = ch.invPin
+			}
+			ch.port.Override(ch.invPin, inv)
+		} else {
+			ch.port.ClearOverride(ch.invPin)
+		}
+	}
+}
+
+func (t *PLLTimer) schedule() {
+	if t.event != nil {
+		t.timer.RemoveCounter(t.event)
+		t.event = nil
+	}
+	num, den := t.tickRate()
+	if num == 0 {
+		return
+	}
+	cycles := (t.nextEvent()*num - t.frac + den - 1) / den
+	if cycles < 1 {
+		cycles = 1
+	}
+	t.event = core.NewCounter(cycles, func() bool {
+		t.event = nil
+		t.sync()
+		t.schedule()
+		return false
+	})
+	t.timer.AddCounter(t.event)
+}
+
+func (t *PLLTimer) updateIntr() {
+	// the flag and enable bits share positions
+	for i, flag := range [3]byte{tifrOCF1A, tifrOCF1B, tifrTOV1} {
+		t.intr.Set(t.vecs[i], (t.tifr&t.timsk&flag) != 0)
+	}
+}
@@ -0,0 +1,80 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func TestPLLTimerClock(t *testing.T) {
+	timer := core.NewTimer()
+	intr := core.NewInterrupts(3)
+	pt := NewPLLTimer(timer, intr, 0, 1, 2, FixedClock(8000000))
+	pt.WriteTCCR1(0, 0x03)
+	timer.Tick(40)
+	if n := pt.ReadTCNT1(0); n != 10 {
+		t.Error("Bad prescaled count", n)
+	}
+
+	pt.WritePLLCSR(0, pllcsrPLLE)
+	timer.Tick(800)
+	if pt.ReadPLLCSR(0)&pllcsrPLOCK != 0 {
+		t.Error("PLL locked early")
+	}
+	timer.Tick(1)
+	if pt.ReadPLLCSR(0)&pllcsrPLOCK == 0 {
+		t.Error("PLL not locked")
+	}
+	pt.WritePLLCSR(0, pllcsrPLLE|pllcsrPCKE)
+	pt.WriteTCCR1(0, 0x01)
+	pt.WriteTCNT1(0, 0)
+	pt.WriteTIMSK(0, timskTOIE1)
+	timer.Tick(31)
+	if n := pt.ReadTCNT1(0); n != 248 || intr.IsSet(2) {
+		t.Error("Bad PLL count", n)
+	}
+	timer.Tick(1)
+	if !intr.IsSet(2) {
+		t.Error("Overflow interrupt not raised")
+	}
+	intr.Ack(2)
+	if pt.ReadTIFR(0)&tifrTOV1 != 0 {
+		t.Error("TOV1 not cleared by interrupt entry")
+	}
+}
+
+func TestPLLTimerPWM(t *testing.T) {
+	timer := core.NewTimer()
+	intr := core.NewInterrupts(3)
+	port := NewPort()
+	port.WriteDDR(0, 0x03)
+	pt := NewPLLTimer(timer, intr, 0, 1, 2, FixedClock(8000000))
+	pt.AttachOutputs(port, 1, 0, -1, -1)
+	pt.WriteOCR1C(0, 99)
+	pt.WriteOCR1A(0, 25)
+	pt.WriteTCCR1(0, tccr1PWM1A|0x10|0x01)
+	// OC1A is set at the first BOTTOM
+	timer.Tick(100)
+
+	var high, low int
+	for i := 0; i < 1000; i++ {
+		timer.Tick(1)
+		switch port.Levels() & 0x03 {
+		case 0x02:
+			high++
+		case 0x01:
+			low++
+		default:
+			t.Fatal("Outputs not complementary", port.Levels())
+		}
+	}
+	if high != 250 || low != 750 {
+		t.Error("Bad duty cycle", high, low)
+	}
+	if intr.IsSet(0) || pt.ReadTIFR(0)&tifrOCF1A == 0 {
+		t.Error("Bad compare flag state")
+	}
+	if port.Output() != 0 {
+		t.Error("PORTB changed by compare output")
+	}
+}
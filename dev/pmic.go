@@ -0,0 +1,151 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	pmicRREN     = 0x80
+	pmicIVSEL    = 0x40
+	pmicLVLEN    = 0x07
+	pmicLVLEX    = 0x07
+	pmicCtrlMask = pmicRREN | pmicIVSEL | pmicLVLEN
+)
+
+// Interrupt levels
+const (
+	IntOff = iota
+	IntLo
+	IntMed
+	IntHi
+)
+
+// A PMIC is the xmega Programmable Multilevel Interrupt Controller.
+// Peripherals raise their interrupt lines in intr whenever their flags
+// are set, and set each vector's level here; a vector is only serviced
+// if its level is enabled and above every level being executed. Within
+// a level lower vectors win, except that low-level interrupts are taken
+// in round-robin order when RREN is set. NMIs are not modelled.
+type PMIC struct {
+	intr   *core.Interrupts
+	levels []byte
+	status byte
+	intpri byte
+	ctrl   byte
+}
+
+func NewPMIC(intr *core.Interrupts, count int) *PMIC {
+	return &PMIC{intr: intr, levels: make([]byte, count)}
+}
+
+func (p *PMIC) SetLevel(vec int, level byte) {
+	p.levels[vec] = level & 0x03
+}
+
+func (p *PMIC) Level(vec int) byte {
+	return p.levels[vec]
+}
+
+// IVSEL reports whether the vectors are in the boot section.
+func (p *PMIC) IVSEL() bool {
+	return (p.ctrl & pmicIVSEL) != 0
+}
+
+func (p *PMIC) ReadSTATUS(addr core.Addr) byte {
+	return p.status
+}
+
+func (p *PMIC) WriteSTATUS(addr core.Addr, val byte) {
+}
+
+func (p *PMIC) ReadINTPRI(addr core.Addr) byte {
+	return p.intpri
+}
+
+func (p *PMIC) WriteINTPRI(addr core.Addr, val byte) {
+	p.intpri = val
+}
+
+func (p *PMIC) ReadCTRL(addr core.Addr) byte {
+	return p.ctrl
+}
+
+// WriteCTRL writes every bit; map CTRL with ProtectCTRL to protect
+// IVSEL.
+func (p *PMIC) WriteCTRL(addr core.Addr, val byte) {
+	p.ctrl = val & pmicCtrlMask
+}
+
+// ProtectCTRL returns a writer for CTRL in which IVSEL only changes
+// while ccp allows protected I/O writes; the level enables and RREN
+// are not protected.
+func (p *PMIC) ProtectCTRL(ccp *CCP) core.MemWrite {
+	return func(addr core.Addr, val byte) {
+		if !ccp.IOEnabled() {
+			val = (val &^ pmicIVSEL) | (p.ctrl & pmicIVSEL)
+		}
+		p.WriteCTRL(addr, val)
+	}
+}
+
+// executing returns the highest level being executed.
+func (p *PMIC) executing() byte {
+	switch {
+	case (p.status & 0x04) != 0:
+		return IntHi
+	case (p.status & 0x02) != 0:
+		return IntMed
+	case (p.status & 0x01) != 0:
+		return IntLo
+	}
+	return IntOff
+}
+
+// Pending returns the vector to service next, or -1 if there is none.
+func (p *PMIC) Pending() int {
+	if p.intr.Pending() < 0 {
+		return -1
+	}
+	best, bestLevel := -1, p.executing()
+	for vec, level := range p.levels {
+		if level <= bestLevel || (p.ctrl&(1<<(level-1))) == 0 ||
+			!p.intr.IsSet(vec) {
+			continue
+		}
+		best, bestLevel = vec, level
+	}
+	if bestLevel == IntLo && (p.ctrl&pmicRREN) != 0 {
+		best = p.roundRobin()
+	}
+	return best
+}
+
+// roundRobin returns the first pending low-level vector after the last
+// one serviced.
+func (p *PMIC) roundRobin() int {
+	n := len(p.levels)
+	for i := 1; i <= n; i++ {
+		vec := (int(p.intpri) + i) % n
+		if p.levels[vec] == IntLo && p.intr.IsSet(vec) {
+			return vec
+		}
+	}
+	return -1
+}
+
+// Ack records that vec is being serviced.
+func (p *PMIC) Ack(vec int) {
+	level := p.levels[vec]
+	p.status |= 1 << (level - 1)
+	if level == IntLo {
+		p.intpri = byte(vec)
+	}
+	p.intr.Ack(vec)
+}
+
+// Reti ends the highest level being executed.
+func (p *PMIC) Reti() {
+	if level := p.executing(); level != IntOff {
+		p.status &^= 1 << (level - 1)
+	}
+}
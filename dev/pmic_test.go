@@ -0,0 +1,90 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func TestPMICLevels(t *testing.T) {
+	intr := core.NewInterrupts(4)
+	pmic := NewPMIC(intr, 4)
+	pmic.SetLevel(1, IntLo)
+	pmic.SetLevel(2, IntHi)
+	pmic.SetLevel(3, IntMed)
+	intr.Set(0, true)
+	intr.Set(1, true)
+	intr.Set(3, true)
+	if vec := pmic.Pending(); vec != -1 {
+		t.Error("Disabled levels serviced", vec)
+	}
+	pmic.WriteCTRL(0, 0x07)
+	if vec := pmic.Pending(); vec != 3 {
+		t.Error("Expected medium level vector, got", vec)
+	}
+	pmic.Ack(3)
+	intr.Set(3, false)
+	if pmic.ReadSTATUS(0) != 0x02 {
+		t.Error("Bad status", pmic.ReadSTATUS(0))
+	}
+	if vec := pmic.Pending(); vec != -1 {
+		t.Error("Low level interrupted medium level", vec)
+	}
+	intr.Set(2, true)
+	if vec := pmic.Pending(); vec != 2 {
+		t.Error("High level did not preempt medium level", vec)
+	}
+	pmic.Ack(2)
+	intr.Set(2, false)
+	pmic.Reti()
+	if pmic.ReadSTATUS(0) != 0x02 {
+		t.Error("RETI ended wrong level", pmic.ReadSTATUS(0))
+	}
+	pmic.Reti()
+	if vec := pmic.Pending(); vec != 1 {
+		t.Error("Expected low level vector, got", vec)
+	}
+}
+
+func TestPMICRoundRobin(t *testing.T) {
+	intr := core.NewInterrupts(3)
+	pmic := NewPMIC(intr, 3)
+	pmic.WriteCTRL(0, pmicRREN|0x01)
+	for vec := 0; vec < 3; vec++ {
+		pmic.SetLevel(vec, IntLo)
+		intr.Set(vec, true)
+	}
+	// INTPRI starts at 0, so vector 1 is first
+	for _, want := range []int{1, 2, 0, 1} {
+		vec := pmic.Pending()
+		if vec != want {
+			t.Error("Expected vector", want, "got", vec)
+		}
+		pmic.Ack(vec)
+		pmic.Reti()
+	}
+	if pmic.ReadINTPRI(0) != 1 {
+		t.Error("Bad INTPRI", pmic.ReadINTPRI(0))
+	}
+}
+
+func TestPMICProtectCTRL(t *testing.T) {
+	timer := core.NewTimer()
+	ccp := NewCCP(timer)
+	pmic := NewPMIC(core.NewInterrupts(1), 1)
+	write := pmic.ProtectCTRL(ccp)
+	write(0, pmicIVSEL|0x07)
+	if pmic.ReadCTRL(0) != 0x07 {
+		t.Error("Bad write without signature", pmic.ReadCTRL(0))
+	}
+	ccp.WriteCCP(0, ccpIOREG)
+	write(0, pmicIVSEL|0x01)
+	if pmic.ReadCTRL(0) != pmicIVSEL|0x01 {
+		t.Error("IVSEL not written inside window", pmic.ReadCTRL(0))
+	}
+	timer.Tick(5)
+	write(0, 0x03)
+	if pmic.ReadCTRL(0) != pmicIVSEL|0x03 {
+		t.Error("IVSEL cleared after window", pmic.ReadCTRL(0))
+	}
+}
@@ -0,0 +1,130 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+// A Port models a GPIO port (PORTx/DDRx/PINx) along with the levels
+// driven onto its input pins from outside.
+type Port struct {
+	port      byte
+	ddr       byte
+	input     byte
+	driven    byte
+	levels    byte
+	ovMask    byte
+	ovVal     byte
+	listeners []func(levels, changed byte)
+}
+
+func NewPort() *Port {
+	return &Port{}
+}
+
+// Reset returns PORTx and DDRx to 0, leaving the pins driven from
+// outside unchanged.
+func (p *Port) Reset() {
+	p.port = 0
+	p.ddr = 0
+	p.update()
+}
+
+// OnChange registers a function to be called whenever the level of
+// any pin changes.
+func (p *Port) OnChange(f func(levels, changed byte)) {
+	p.listeners = append(p.listeners, f)
+}
+
+func (p *Port) ReadPORT(addr core.Addr) byte {
+	return p.port
+}
+
+func (p *Port) WritePORT(addr core.Addr, val byte) {
+	p.port = val
+	p.update()
+}
+
+func (p *Port) ReadDDR(addr core.Addr) byte {
+	return p.ddr
+}
+
+func (p *Port) WriteDDR(addr core.Addr, val byte) {
+	p.ddr = val
+	p.update()
+}
+
+func (p *Port) ReadPIN(addr core.Addr) byte {
+	return p.levels
+}
+
+// WritePIN toggles the PORTx bits written as ones, as on newer devices;
+// older ones ignore writes to PINx.
+func (p *Port) WritePIN(addr core.Addr, val byte) {
+	p.WritePORT(addr, p.port^val)
+}
+
+// Drive sets the level applied to a pin from outside; it only affects
+// pins configured as inputs.
+func (p *Port) Drive(pin int, high bool) {
+	mask := byte(1) << uint(pin)
+	p.driven |= mask
+	if high {
+		p.input |= mask
+	} else {
+		p.input &^= mask
+	}
+	p.update()
+}
+
+// Release stops driving a pin from outside, leaving it pulled up if
+// its PORTx bit is set and low otherwise.
+func (p *Port) Release(pin int) {
+	p.driven &^= byte(1) << uint(pin)
+	p.update()
+}
+
+// Override replaces the PORTx value of the pins in mask with val, as a
+// peripheral's output does; the pins are still only driven when they
+// are set as outputs. PORTx itself is unchanged.
+func (p *Port) Override(mask, val byte) {
+	p.ovMask |= mask
+	p.ovVal = (p.ovVal &^ mask) | (val & mask)
+	p.update()
+}
+
+// ClearOverride returns the pins in mask to PORTx control.
+func (p *Port) ClearOverride(mask byte) {
+	p.ovMask &^= mask
+	p.ovVal &^= mask
+	p.update()
+}
+
+func (p *Port) Levels() byte {
+	return p.levels
+}
+
+func (p *Port) Level(pin int) bool {
+	return (p.levels & (1 << uint(pin))) != 0
+}
+
+func (p *Port) Output() byte {
+	return p.port
+}
+
+func (p *Port) Direction() byte {
+	return p.ddr
+}
+
+func (p *Port) update() {
+	out := (p.port &^ p.ovMask) | p.ovVal
+	in := (p.input & p.driven) | (p.port &^ p.driven)
+	levels := (out & p.ddr) | (in &^ p.ddr)
+	changed := levels ^ p.levels
+	if changed == 0 {
+		return
+	}
+	p.levels = levels
+	for _, f := range p.listeners {
+		f(levels, changed)
+	}
+}
@@ -0,0 +1,76 @@
+//go:build !noaudio
+// +build !noaudio
+
+package dev
+
+import (
+	"code.google.com/p/portaudio-go/portaudio"
+)
+
+// A PortAudio backend plays samples on the default output device.
+// Build with the noaudio tag to leave it (and the portaudio
+// dependency) out.
+type PortAudio struct {
+	stream  *portaudio.Stream
+	channel chan float32
+	rate    int
+	started bool
+}
+
+func NewPortAudio(rate int) (*PortAudio, error) {
+	pa := &PortAudio{rate: rate}
+	host, err := portaudio.DefaultHostApi()
+	if err != nil {
+		return nil, err
+	}
+	parameters := portaudio.HighLatencyParameters(nil, host.DefaultOutputDevice)
+	parameters.Output.Channels = 1
+	parameters.SampleRate = float64(pa.rate)
+	stream, err := portaudio.OpenStream(parameters, pa.Callback)
+	if err != nil {
+		return nil, err
+	}
+	pa.stream = stream
+	pa.channel = make(chan float32, 8192)
+	return pa, nil
+}
+
+func (pa *PortAudio) SampleRate() int {
+	return pa.rate
+}
+
+// WriteSamples blocks while the output buffer is full, which keeps a
+// running system from getting ahead of the sound card.
+func (pa *PortAudio) WriteSamples(samples []float32) error {
+	if !pa.started {
+		pa.started = true
+		if err := pa.stream.Start(); err != nil {
+			return err
+		}
+	}
+	for _, sample := range samples {
+		pa.channel <- sample
+	}
+	return nil
+}
+
+func (pa *PortAudio) Close() error {
+	if pa.started {
+		pa.started = false
+		if err := pa.stream.Stop(); err != nil {
+			return err
+		}
+	}
+	return pa.stream.Close()
+}
+
+func (pa *PortAudio) Callback(out []float32) {
+	for i := range out {
+		select {
+		case sample := <-pa.channel:
+			out[i] = sample
+		default:
+			out[i] = 0
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package dev
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ioctl goes through SyscallConn rather than Fd, which would switch f
+// to blocking mode, so that Close could not wake a pending Read.
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req,
+			uintptr(arg))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// OpenSerialPTY connects a USART to a new pseudo-terminal; terminal
+// programs open the slave device given by Name. The slave starts in
+// raw mode and is held open, so clients may come and go.
+func OpenSerialPTY() (*SerialBridge, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	slave, err := openPTYSlave(master)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	b := NewSerialBridge(master, master)
+	b.Name = slave.Name()
+	b.closers = []io.Closer{master, slave}
+	return b, nil
+}
+
+func openPTYSlave(master *os.File) (*os.File, error) {
+	var unlock int32
+	var ptn uint32
+	if err := ioctl(master, syscall.TIOCSPTLCK,
+		unsafe.Pointer(&unlock)); err != nil {
+		return nil, err
+	}
+	if err := ioctl(master, syscall.TIOCGPTN,
+		unsafe.Pointer(&ptn)); err != nil {
+		return nil, err
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", ptn),
+		os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var tio syscall.Termios
+	if err := ioctl(slave, syscall.TCGETS,
+		unsafe.Pointer(&tio)); err != nil {
+		slave.Close()
+		return nil, err
+	}
+	tio.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK |
+		syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL |
+		syscall.IXON
+	tio.Oflag &^= syscall.OPOST
+	tio.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON |
+		syscall.ISIG | syscall.IEXTEN
+	tio.Cflag &^= syscall.CSIZE | syscall.PARENB
+	tio.Cflag |= syscall.CS8
+	if err := ioctl(slave, syscall.TCSETS,
+		unsafe.Pointer(&tio)); err != nil {
+		slave.Close()
+		return nil, err
+	}
+	return slave, nil
+}
@@ -0,0 +1,206 @@
+package dev
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// A SerialBridge connects the channels of a USART to a host endpoint.
+// Pass Read and Write to NewUSART (or AddUSART).
+type SerialBridge struct {
+	Read  chan byte
+	Write chan byte
+	// Name is the path or address clients use to reach the bridge,
+	// if it has one.
+	Name    string
+	mu      sync.Mutex
+	out     io.Writer
+	conn    io.Closer
+	closers []io.Closer
+	done    chan struct{}
+	once    sync.Once
+	err     error
+}
+
+func newSerialBridge() *SerialBridge {
+	return &SerialBridge{
+		Read:  make(chan byte, 256),
+		Write: make(chan byte, 256),
+		done:  make(chan struct{}),
+	}
+}
+
+// NewSerialBridge feeds the receiver from r and sends transmitted
+// bytes to w; either may be nil.
+func NewSerialBridge(r io.Reader, w io.Writer) *SerialBridge {
+	b := newSerialBridge()
+	b.out = w
+	if r != nil {
+		go b.copyIn(r)
+	}
+	go b.copyOut()
+	return b
+}
+
+// NewStdioSerial connects a USART to the standard input and output.
+func NewStdioSerial() *SerialBridge {
+	return NewSerialBridge(os.Stdin, os.Stdout)
+}
+
+// OpenSerialFiles replays the file at replay into the receiver and
+// captures transmitted bytes to the file at capture. Either path may
+// be empty.
+func OpenSerialFiles(replay, capture string) (*SerialBridge, error) {
+	var r io.Reader
+	var w io.Writer
+	var closers []io.Closer
+	if replay != "" {
+		in, err := os.Open(replay)
+		if err != nil {
+			return nil, err
+		}
+		r = in
+		closers = append(closers, in)
+	}
+	if capture != "" {
+		out, err := os.Create(capture)
+		if err != nil {
+			for _, c := range closers {
+				c.Close()
+			}
+			return nil, err
+		}
+		w = out
+		closers = append(closers, out)
+	}
+	b := NewSerialBridge(r, w)
+	b.closers = closers
+	return b, nil
+}
+
+// ListenSerialTCP accepts TCP connections on addr, one at a time.
+// Transmitted bytes are dropped while no client is connected.
+func ListenSerialTCP(addr string) (*SerialBridge, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	b := newSerialBridge()
+	b.Name = ln.Addr().String()
+	b.closers = []io.Closer{ln}
+	go b.accept(ln)
+	go b.copyOut()
+	return b, nil
+}
+
+func (b *SerialBridge) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-b.done:
+			default:
+				b.setErr(err)
+			}
+			return
+		}
+		b.mu.Lock()
+		b.out = conn
+		b.conn = conn
+		b.mu.Unlock()
+		b.copyIn(conn)
+		b.mu.Lock()
+		b.out = nil
+		b.conn = nil
+		b.mu.Unlock()
+		conn.Close()
+	}
+}
+
+func (b *SerialBridge) copyIn(r io.Reader) {
+	buf := make([]byte, 256)
+	for {
+		n, err := r.Read(buf)
+		for _, c := range buf[:n] {
+			select {
+			case b.Read <- c:
+			case <-b.done:
+				return
+			}
+		}
+		if err != nil {
+			select {
+			case <-b.done:
+			default:
+				if err != io.EOF {
+					b.setErr(err)
+				}
+			}
+			return
+		}
+	}
+}
+
+func (b *SerialBridge) copyOut() {
+	buf := make([]byte, 0, 256)
+	for {
+		select {
+		case c := <-b.Write:
+			buf = append(buf[:0], c)
+		case <-b.done:
+			return
+		}
+	drain:
+		for len(buf) < cap(buf) {
+			select {
+			case c := <-b.Write:
+				buf = append(buf, c)
+			default:
+				break drain
+			}
+		}
+		b.mu.Lock()
+		out := b.out
+		b.mu.Unlock()
+		if out != nil {
+			if _, err := out.Write(buf); err != nil {
+				b.setErr(err)
+			}
+		}
+	}
+}
+
+func (b *SerialBridge) setErr(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.mu.Unlock()
+}
+
+// Err returns the first I/O error seen by the bridge.
+func (b *SerialBridge) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+func (b *SerialBridge) Close() error {
+	var err error
+	b.once.Do(func() {
+		close(b.done)
+		b.mu.Lock()
+		if b.conn != nil {
+			b.conn.Close()
+		}
+		b.mu.Unlock()
+		for _, c := range b.closers {
+			if cerr := c.Close(); err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,108 @@
+package dev
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func readBytes(t *testing.T, ch chan byte, n int) []byte {
+	var got []byte
+	for len(got) < n {
+		select {
+		case c := <-ch:
+			got = append(got, c)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out after", got)
+		}
+	}
+	return got
+}
+
+func TestSerialBridge(t *testing.T) {
+	pr, pw := io.Pipe()
+	b := NewSerialBridge(bytes.NewReader([]byte("hi")), pw)
+	defer b.Close()
+	if got := readBytes(t, b.Read, 2); string(got) != "hi" {
+		t.Errorf("Read %q", got)
+	}
+	b.Write <- 'x'
+	buf := make([]byte, 1)
+	if _, err := pr.Read(buf); err != nil || buf[0] != 'x' {
+		t.Errorf("Wrote %q (%v)", buf, err)
+	}
+}
+
+func TestSerialTCP(t *testing.T) {
+	b, err := ListenSerialTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	conn, err := net.Dial("tcp", b.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	if got := readBytes(t, b.Read, 4); string(got) != "ping" {
+		t.Errorf("Read %q", got)
+	}
+	b.Write <- 'o'
+	b.Write <- 'k'
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ok" {
+		t.Errorf("Wrote %q (%v)", buf, err)
+	}
+	conn.Close()
+}
+
+func TestSerialPTY(t *testing.T) {
+	b, err := OpenSerialPTY()
+	if err != nil {
+		t.Skip("No pty:", err)
+	}
+	defer b.Close()
+	tty, err := os.OpenFile(b.Name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+	tty.Write([]byte("a\r"))
+	if got := readBytes(t, b.Read, 2); string(got) != "a\r" {
+		t.Errorf("Read %q", got)
+	}
+	b.Write <- '\n'
+	buf := make([]byte, 1)
+	if _, err := tty.Read(buf); err != nil || buf[0] != '\n' {
+		t.Errorf("Wrote %q (%v)", buf, err)
+	}
+}
+
+func TestSerialPTYClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	b, err := OpenSerialPTY()
+	if err != nil {
+		t.Skip("No pty:", err)
+	}
+	// a client holding the slave open keeps the master readable
+	tty, err := os.OpenFile(b.Name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+	// let the reader block on the master
+	time.Sleep(10 * time.Millisecond)
+	b.Close()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatal("Reader still running after Close")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -1,122 +1,209 @@
 package dev
 
 import (
-	"code.google.com/p/portaudio-go/portaudio"
+	"math"
+
 	"github.com/edmccard/avr-sim/core"
 )
 
-type Speaker struct {
-	stream       *portaudio.Stream
-	channel      chan float32
-	timer        *core.Timer
-	curSample    float32
-	avgBuf       []float32
-	avgIdx       int
-	cycPerSample uint
-	pin          byte
-	mask         byte
-	lastToggle   int64
-	started      bool
-}
-
-func NewSpeaker(timer *core.Timer, hertz uint, pin int) (*Speaker, error) {
-	spk := &Speaker{curSample: -1.0}
-	host, err := portaudio.DefaultHostApi()
-	if err != nil {
-		return nil, err
+// Samples are handed to the backend in blocks of this size.
+const speakerBlock = 1024
+
+// Level changes are rendered as band-limited steps: an integrated,
+// Blackman-windowed sinc spanning blepWidth samples on either side.
+const (
+	blepWidth  = 8
+	blepRes    = 64
+	blepCutoff = 0.45
+)
+
+var blepTable = makeBLEP()
+
+func makeBLEP() []float64 {
+	n := 2 * blepWidth * blepRes
+	table := make([]float64, n+1)
+	sum, prev := 0.0, 0.0
+	for i := 0; i <= n; i++ {
+		x := float64(i)/blepRes - blepWidth
+		arg := 2 * math.Pi * float64(i) / float64(n)
+		h := 2 * blepCutoff * (0.42 - 0.5*math.Cos(arg) + 0.08*math.Cos(2*arg))
+		if x != 0 {
+			h *= math.Sin(2*math.Pi*blepCutoff*x) / (2 * math.Pi * blepCutoff * x)
+		}
+		if i > 0 {
+			sum += (h + prev) / (2 * blepRes)
+		}
+		table[i] = sum
+		prev = h
 	}
-	parameters := portaudio.HighLatencyParameters(nil, host.DefaultOutputDevice)
-	parameters.Output.Channels = 1
-	parameters.SampleRate = 44100
-	stream, err := portaudio.OpenStream(parameters, spk.Callback)
-	if err != nil {
-		return nil, err
+	for i := range table {
+		table[i] /= sum
 	}
-	spk.timer = timer
-	spk.cycPerSample = hertz / uint(parameters.SampleRate)
-	spk.channel = make(chan float32, 8192)
-	spk.avgBuf = make([]float32, spk.cycPerSample)
-	spk.mask = 1 << uint(pin)
-	spk.stream = stream
-	return spk, nil
+	return table
 }
 
-func (spk *Speaker) OnSlice() error {
-	if !spk.started {
-		spk.started = true
-		return spk.Start()
+// blep returns the band-limited unit step at x samples from the edge.
+func blep(x float64) float64 {
+	if x <= -blepWidth {
+		return 0
+	}
+	if x >= blepWidth {
+		return 1
 	}
-	return nil
+	pos := (x + blepWidth) * blepRes
+	i := int(pos)
+	f := pos - float64(i)
+	return blepTable[i] + f*(blepTable[i+1]-blepTable[i])
 }
 
-func (spk *Speaker) Start() error {
-	return spk.stream.Start()
+// A Speaker renders an output level, set by a pin or directly by
+// SetLevel, as audio at the backend's sample rate. Edges are placed at
+// their exact time, so the clock rate need not be a multiple of the
+// sample rate; output lags the simulation by blepWidth samples until
+// the speaker is closed.
+type Speaker struct {
+	// LowPass, if not zero, is the corner frequency in Hz of a
+	// one-pole filter on the output, like the RC filter after a
+	// PWM DAC.
+	LowPass  float64
+	backend  AudioBackend
+	clock    *Clock
+	rate     float64
+	level    float64
+	next     int64
+	resid    []float64
+	filtered float64
+	pin      byte
+	mask     byte
+	samples  []float32
+	err      error
 }
 
-func (spk *Speaker) Stop() error {
-	return spk.stream.Stop()
+// NewSpeaker returns a speaker following pin, timed by clock.
+func NewSpeaker(clock *Clock, pin int, backend AudioBackend) *Speaker {
+	return &Speaker{
+		backend: backend,
+		clock:   clock,
+		rate:    float64(backend.SampleRate()),
+		level:   -1.0,
+		mask:    1 << uint(pin),
+		samples: make([]float32, 0, speakerBlock),
+	}
 }
 
-func (spk *Speaker) Callback(out []float32) {
-	for i := range out {
-		select {
-		case sample := <-spk.channel:
-			out[i] = sample
-		default:
-			out[i] = 0
+// AttachPort makes the speaker follow the speaker pin of port, however
+// the pin is driven.
+func (spk *Speaker) AttachPort(port *Port) {
+	port.OnChange(func(levels, changed byte) {
+		if (changed & spk.mask) != 0 {
+			spk.setPin(levels & spk.mask)
 		}
+	})
+}
+
+// OnSlice renders samples up to the current cycle; it can be used as
+// the SliceFunc of a running system.
+func (spk *Speaker) OnSlice() error {
+	return spk.Flush()
+}
+
+// Flush renders all samples that can no longer be affected by future
+// level changes and passes them to the backend.
+func (spk *Speaker) Flush() error {
+	spk.emit(int64(math.Floor(spk.time())) - blepWidth)
+	spk.writeSamples()
+	return spk.err
+}
+
+// Close renders samples up to the current cycle and closes the
+// backend.
+func (spk *Speaker) Close() error {
+	spk.emit(int64(math.Ceil(spk.time())) - 1)
+	spk.writeSamples()
+	if err := spk.backend.Close(); spk.err == nil {
+		spk.err = err
 	}
+	return spk.err
 }
 
+func (spk *Speaker) Err() error {
+	return spk.err
+}
+
+// Write follows the speaker pin in a value written to a port register.
 func (spk *Speaker) Write(addr core.Addr, val byte) {
-	val &= spk.mask
+	spk.setPin(val & spk.mask)
+}
+
+func (spk *Speaker) setPin(val byte) {
 	if val == spk.pin {
 		return
 	}
 	spk.pin = val
-	spk.makeSamples()
-	spk.curSample *= -1.0
-}
-
-func (spk *Speaker) makeSamples() {
-	curCycle := spk.timer.GetCount()
-	elapsed := curCycle - spk.lastToggle
-	spk.lastToggle = curCycle
-
-	if spk.avgIdx != 0 {
-		for ; spk.avgIdx < len(spk.avgBuf); spk.avgIdx++ {
-			if elapsed == 0 {
-				break
-			}
-			spk.avgBuf[spk.avgIdx] = spk.curSample
-			elapsed--
-		}
-		if spk.avgIdx == len(spk.avgBuf) {
-			spk.avgIdx = 0
-			avg := float32(0.0)
-			for _, sample := range spk.avgBuf {
-				avg += sample
-			}
-			avg /= float32(len(spk.avgBuf))
-			spk.sendSample(avg)
-		}
+	if val != 0 {
+		spk.SetLevel(1.0)
+	} else {
+		spk.SetLevel(-1.0)
 	}
+}
 
-	for i := int64(0); i < elapsed/int64(spk.cycPerSample); i++ {
-		spk.sendSample(spk.curSample)
+// SetLevel changes the output level (from -1.0 to 1.0) at the current
+// cycle, for a DAC that is not a pin. A PWM compare output drives the
+// speaker through its pin, with LowPass as the filter.
+func (spk *Speaker) SetLevel(level float64) {
+	delta := level - spk.level
+	if delta == 0 {
+		return
+	}
+	t := spk.time()
+	spk.emit(int64(math.Floor(t)) - blepWidth)
+	end := int64(math.Ceil(t)) + blepWidth
+	for n := spk.next; n < end; n++ {
+		i := int(n - spk.next)
+		if i == len(spk.resid) {
+			spk.resid = append(spk.resid, 0)
+		}
+		spk.resid[i] += delta * (blep(float64(n)-t) - 1)
 	}
+	spk.level = level
+}
+
+// time returns the current time in units of output samples.
+func (spk *Speaker) time() float64 {
+	return spk.clock.Seconds() * spk.rate
+}
 
-	avgCycs := elapsed % int64(spk.cycPerSample)
-	if avgCycs != 0 {
-		for spk.avgIdx = 0; spk.avgIdx < int(avgCycs); spk.avgIdx++ {
-			spk.avgBuf[spk.avgIdx] = spk.curSample
+// emit renders the samples up to and including last.
+func (spk *Speaker) emit(last int64) {
+	for ; spk.next <= last; spk.next++ {
+		sample := spk.level
+		if len(spk.resid) > 0 {
+			sample += spk.resid[0]
+			spk.resid = spk.resid[1:]
 		}
+		if spk.LowPass != 0 {
+			a := 1 - math.Exp(-2*math.Pi*spk.LowPass/spk.rate)
+			spk.filtered += a * (sample - spk.filtered)
+			sample = spk.filtered
+		}
+		spk.sendSample(float32(sample))
 	}
 }
 
 func (spk *Speaker) sendSample(sample float32) {
-	select {
-	case spk.channel <- sample:
-	default:
+	spk.samples = append(spk.samples, sample)
+	if len(spk.samples) == speakerBlock {
+		spk.writeSamples()
+	}
+}
+
+func (spk *Speaker) writeSamples() {
+	if len(spk.samples) == 0 {
+		return
+	}
+	if err := spk.backend.WriteSamples(spk.samples); err != nil &&
+		spk.err == nil {
+		spk.err = err
 	}
+	spk.samples = spk.samples[:0]
 }
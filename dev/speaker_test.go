@@ -0,0 +1,143 @@
+package dev
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+// square toggles the speaker pin every half cycles, n times.
+func square(spk *Speaker, timer *core.Timer, half int64, n int) {
+	for i := 0; i < n; i++ {
+		timer.Tick(half)
+		spk.Write(0, byte((i+1)&1))
+	}
+}
+
+func TestSpeakerStep(t *testing.T) {
+	timer := core.NewTimer()
+	buf := NewAudioBuffer(44100)
+	// 1MHz is not a multiple of the sample rate
+	spk := NewSpeaker(NewClock(timer, FixedClock(1000000)), 0, buf)
+	timer.Tick(1000000)
+	spk.Write(0, 1)
+	timer.Tick(1000000)
+	if err := spk.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(buf.Samples) != 88200-blepWidth+1 {
+		t.Fatal("Bad sample count", len(buf.Samples))
+	}
+	if buf.Samples[44100-blepWidth] != -1 || buf.Samples[44100+blepWidth] != 1 {
+		t.Error("Step not confined to kernel")
+	}
+	if math.Abs(float64(buf.Samples[44100])) > 0.01 {
+		t.Error("Step not centered", buf.Samples[44100])
+	}
+	spk.Close()
+	if len(buf.Samples) != 88200 || buf.Samples[88199] != 1 {
+		t.Error("Close did not render to the current cycle")
+	}
+}
+
+func TestSpeakerClockChange(t *testing.T) {
+	timer := core.NewTimer()
+	buf := NewAudioBuffer(44100)
+	clk := NewClock(timer, FixedClock(1000000))
+	spk := NewSpeaker(clk, 0, buf)
+	timer.Tick(1000000)
+	clk.SetSource(FixedClock(2000000))
+	spk.Write(0, 1)
+	timer.Tick(2000000)
+	spk.Close()
+	if len(buf.Samples) != 88200 {
+		t.Fatal("Bad sample count", len(buf.Samples))
+	}
+	if buf.Samples[44100-blepWidth] != -1 || buf.Samples[44100+blepWidth] != 1 {
+		t.Error("Edge not at the time of the change")
+	}
+}
+
+func TestSpeakerPWM(t *testing.T) {
+	timer := core.NewTimer()
+	buf := NewAudioBuffer(44100)
+	spk := NewSpeaker(NewClock(timer, FixedClock(16000000)), 3, buf)
+	port := NewPort()
+	port.WriteDDR(0, 0x08)
+	spk.AttachPort(port)
+	// 62.5kHz carrier with a duty cycle of 3/4
+	for i := 0; i < 10000; i++ {
+		port.WritePORT(0, 0x08)
+		timer.Tick(192)
+		port.WritePORT(0, 0x00)
+		timer.Tick(64)
+	}
+	spk.Close()
+	for i, s := range buf.Samples[100 : len(buf.Samples)-100] {
+		if math.Abs(float64(s)-0.5) > 0.01 {
+			t.Fatal("Carrier not removed at", i+100, s)
+		}
+	}
+}
+
+func TestSpeakerCompareOutput(t *testing.T) {
+	timer := core.NewTimer()
+	buf := NewAudioBuffer(44100)
+	clk := NewClock(timer, FixedClock(16000000))
+	port := NewPort()
+	port.WriteDDR(0, 0x02)
+	spk := NewSpeaker(clk, 1, buf)
+	spk.AttachPort(port)
+	pt := NewPLLTimer(timer, core.NewInterrupts(3), 0, 1, 2, clk)
+	pt.AttachOutputs(port, 1, -1, -1, -1)
+	// 62.5kHz carrier on OC1A with a duty cycle of 3/4
+	pt.WriteOCR1C(0, 255)
+	pt.WriteOCR1A(0, 192)
+	pt.WriteTCCR1(0, tccr1PWM1A|0x10|0x01)
+	timer.Tick(2560000)
+	spk.Close()
+	for i, s := range buf.Samples[100 : len(buf.Samples)-100] {
+		if math.Abs(float64(s)-0.5) > 0.01 {
+			t.Fatal("Bad DAC level at", i+100, s)
+		}
+	}
+}
+
+func TestSpeakerWAV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "speaker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.wav")
+	wav, err := CreateWAV(path, 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timer := core.NewTimer()
+	spk := NewSpeaker(NewClock(timer, FixedClock(8000000)), 0, wav)
+	square(spk, timer, 40000, 50)
+	if err := spk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := readWAV(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.rate != 8000 || data.channels != 1 || len(data.samples) != 2000 {
+		t.Fatal("Bad WAV file", data.rate, data.channels, len(data.samples))
+	}
+	if data.samples[20] != -1 || data.samples[60] != 32767.0/32768 {
+		t.Error("Bad samples", data.samples[20], data.samples[60])
+	}
+}
@@ -0,0 +1,228 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	spcrSPIE  = 0x80
+	spcrSPE   = 0x40
+	spcrDORD  = 0x20
+	spcrMSTR  = 0x10
+	spcrSPR   = 0x03
+	spsrSPIF  = 0x80
+	spsrWCOL  = 0x40
+	spsrSPI2X = 0x01
+)
+
+var spiDivider = [4]int64{4, 16, 64, 128}
+
+// An SPIDevice is a simulated SPI slave. Bytes are exchanged MSB
+// first, and only while the device is selected.
+type SPIDevice interface {
+	Select(active bool)
+	Transfer(mosi byte) (miso byte)
+}
+
+type spiSlave struct {
+	dev      SPIDevice
+	port     *Port
+	mask     byte
+	selected bool
+}
+
+type SPI struct {
+	timer    *core.Timer
+	intr     *core.Interrupts
+	vec      int
+	ss       *Port
+	ssMask   byte
+	spcr     byte
+	spsr     byte
+	rx       byte
+	tx       byte
+	flagRead bool
+	xfer     *core.Counter
+	slaves   []*spiSlave
+}
+
+// NewSPI returns an SPI unit whose slave select input is pin ssPin of
+// port ss.
+func NewSPI(timer *core.Timer, intr *core.Interrupts, vec int,
+	ss *Port, ssPin int) *SPI {
+
+	spi := &SPI{
+		timer:  timer,
+		intr:   intr,
+		vec:    vec,
+		ss:     ss,
+		ssMask: 1 << uint(ssPin),
+	}
+	intr.SetAck(vec, func() {
+		spi.spsr &^= spsrSPIF
+		spi.updateIntr()
+	})
+	ss.OnChange(spi.ssChanged)
+	return spi
+}
+
+// Reset aborts any transfer, and clears the registers.
+func (spi *SPI) Reset() {
+	if spi.xfer != nil {
+		spi.timer.RemoveCounter(spi.xfer)
+		spi.xfer = nil
+	}
+	spi.spcr = 0
+	spi.spsr = 0
+	spi.rx = 0
+	spi.tx = 0
+	spi.flagRead = false
+	spi.updateIntr()
+}
+
+// Attach connects a slave device whose active-low chip select is pin
+// csPin of port cs.
+func (spi *SPI) Attach(dev SPIDevice, cs *Port, csPin int) {
+	spi.slaves = append(spi.slaves, newSPISlave(dev, cs, csPin))
+}
+
+func newSPISlave(dev SPIDevice, cs *Port, csPin int) *spiSlave {
+	slave := &spiSlave{dev: dev, port: cs, mask: 1 << uint(csPin)}
+	slave.selected = (cs.Levels() & slave.mask) == 0
+	dev.Select(slave.selected)
+	cs.OnChange(func(levels, changed byte) {
+		if (changed & slave.mask) == 0 {
+			return
+		}
+		slave.selected = (levels & slave.mask) == 0
+		slave.dev.Select(slave.selected)
+	})
+	return slave
+}
+
+func (spi *SPI) ReadSPCR(addr core.Addr) byte {
+	return spi.spcr
+}
+
+func (spi *SPI) WriteSPCR(addr core.Addr, val byte) {
+	spi.spcr = val
+	if !spi.master() && spi.xfer != nil {
+		spi.timer.RemoveCounter(spi.xfer)
+		spi.xfer = nil
+	}
+	spi.ssChanged(spi.ss.Levels(), spi.ssMask)
+	spi.updateIntr()
+}
+
+func (spi *SPI) ReadSPSR(addr core.Addr) byte {
+	spi.flagRead = (spi.spsr & (spsrSPIF | spsrWCOL)) != 0
+	return spi.spsr
+}
+
+func (spi *SPI) WriteSPSR(addr core.Addr, val byte) {
+	spi.spsr = (spi.spsr &^ spsrSPI2X) | (val & spsrSPI2X)
+}
+
+func (spi *SPI) ReadSPDR(addr core.Addr) byte {
+	spi.clearFlags()
+	return spi.rx
+}
+
+func (spi *SPI) WriteSPDR(addr core.Addr, val byte) {
+	spi.clearFlags()
+	if spi.xfer != nil {
+		spi.spsr |= spsrWCOL
+		return
+	}
+	spi.tx = val
+	if (spi.spcr&spcrSPE) == 0 || !spi.master() {
+		return
+	}
+	cycles := 8 * spiDivider[spi.spcr&spcrSPR]
+	if (spi.spsr & spsrSPI2X) != 0 {
+		cycles /= 2
+	}
+	spi.xfer = core.NewCounter(cycles, spi.finishMaster)
+	spi.timer.AddCounter(spi.xfer)
+}
+
+// SlaveTransfer performs a transfer with the SPI unit as slave, for
+// use by a simulated external master. It returns 0xff if the unit is
+// not enabled as a slave or its slave select input is high.
+func (spi *SPI) SlaveTransfer(mosi byte) byte {
+	if (spi.spcr&spcrSPE) == 0 || spi.master() ||
+		(spi.ss.Levels()&spi.ssMask) != 0 {
+		return 0xff
+	}
+	miso := spi.wireOrder(spi.tx)
+	spi.finish(spi.wireOrder(mosi))
+	return miso
+}
+
+func (spi *SPI) master() bool {
+	return (spi.spcr & spcrMSTR) != 0
+}
+
+// SPIF and WCOL are cleared by reading SPSR then accessing SPDR.
+func (spi *SPI) clearFlags() {
+	if spi.flagRead {
+		spi.spsr &^= spsrSPIF | spsrWCOL
+		spi.flagRead = false
+		spi.updateIntr()
+	}
+}
+
+func (spi *SPI) finishMaster() bool {
+	spi.xfer = nil
+	mosi := spi.wireOrder(spi.tx)
+	miso := byte(0xff)
+	for _, slave := range spi.slaves {
+		if slave.selected {
+			miso &= slave.dev.Transfer(mosi)
+		}
+	}
+	spi.finish(spi.wireOrder(miso))
+	return false
+}
+
+func (spi *SPI) finish(rx byte) {
+	spi.rx = rx
+	spi.spsr |= spsrSPIF
+	spi.updateIntr()
+}
+
+// wireOrder converts between register and MSB-first bit order.
+func (spi *SPI) wireOrder(val byte) byte {
+	if (spi.spcr & spcrDORD) == 0 {
+		return val
+	}
+	var rev byte
+	for i := uint(0); i < 8; i++ {
+		rev |= ((val >> i) & 1) << (7 - i)
+	}
+	return rev
+}
+
+// A master whose SS pin is an input driven low by another master
+// drops to slave mode.
+func (spi *SPI) ssChanged(levels, changed byte) {
+	if (changed&spi.ssMask) == 0 || (levels&spi.ssMask) != 0 {
+		return
+	}
+	if (spi.spcr&spcrSPE) == 0 || !spi.master() ||
+		(spi.ss.Direction()&spi.ssMask) != 0 {
+		return
+	}
+	spi.spcr &^= spcrMSTR
+	if spi.xfer != nil {
+		spi.timer.RemoveCounter(spi.xfer)
+		spi.xfer = nil
+	}
+	spi.spsr |= spsrSPIF
+	spi.updateIntr()
+}
+
+func (spi *SPI) updateIntr() {
+	spi.intr.Set(spi.vec, (spi.spsr&spsrSPIF) != 0 &&
+		(spi.spcr&(spcrSPIE|spcrSPE)) == (spcrSPIE|spcrSPE))
+}
@@ -0,0 +1,111 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+type echoDevice struct {
+	selected bool
+	last     byte
+	selects  int
+}
+
+func (d *echoDevice) Select(active bool) {
+	d.selected = active
+	if active {
+		d.selects++
+	}
+}
+
+func (d *echoDevice) Transfer(mosi byte) byte {
+	miso := d.last
+	d.last = mosi
+	return miso
+}
+
+func newTestSPI() (*SPI, *Port, *core.Timer, *core.Interrupts) {
+	timer := core.NewTimer()
+	intr := core.NewInterrupts(1)
+	port := NewPort()
+	port.WriteDDR(0, 0x06)
+	port.WritePORT(0, 0x06)
+	return NewSPI(timer, intr, 0, port, 2), port, timer, intr
+}
+
+func TestSPIMaster(t *testing.T) {
+	spi, port, timer, intr := newTestSPI()
+	dev := &echoDevice{}
+	spi.Attach(dev, port, 1)
+	if dev.selected {
+		t.Fatal("Device selected with CS high")
+	}
+	spi.WriteSPCR(0, spcrSPIE|spcrSPE|spcrMSTR|0x01)
+	port.WritePORT(0, 0x04)
+	if !dev.selected {
+		t.Fatal("Device not selected with CS low")
+	}
+
+	spi.WriteSPDR(0, 0xa5)
+	timer.Tick(8*16 - 1)
+	spi.WriteSPDR(0, 0x11)
+	if spi.ReadSPSR(0) != spsrWCOL {
+		t.Error("Write collision not flagged")
+	}
+	timer.Tick(1)
+	if spi.ReadSPSR(0) != spsrSPIF|spsrWCOL || !intr.IsSet(0) {
+		t.Error("Transfer did not complete")
+	}
+	spi.ReadSPDR(0)
+	if spi.ReadSPSR(0) != 0 || intr.IsSet(0) {
+		t.Error("Flags not cleared by SPSR/SPDR access")
+	}
+
+	spi.WriteSPSR(0, spsrSPI2X)
+	spi.WriteSPDR(0, 0x3c)
+	timer.Tick(8 * 8)
+	if spi.ReadSPDR(0) != 0xa5 || dev.last != 0x3c {
+		t.Error("Bad data exchange")
+	}
+}
+
+func TestSPIMasterDemoted(t *testing.T) {
+	spi, port, _, _ := newTestSPI()
+	port.WriteDDR(0, 0x00)
+	spi.WriteSPCR(0, spcrSPE|spcrMSTR)
+	port.Drive(2, false)
+	if spi.ReadSPCR(0)&spcrMSTR != 0 || spi.ReadSPSR(0)&spsrSPIF == 0 {
+		t.Error("Master not demoted by low SS input")
+	}
+}
+
+func TestSPISlave(t *testing.T) {
+	spi, port, _, _ := newTestSPI()
+	port.WriteDDR(0, 0x00)
+	port.WritePORT(0, 0x00)
+	spi.WriteSPCR(0, spcrSPE|spcrDORD)
+	spi.WriteSPDR(0, 0x01)
+	port.Drive(2, true)
+	if spi.SlaveTransfer(0x12) != 0xff {
+		t.Error("Deselected slave responded")
+	}
+	port.Drive(2, false)
+	if miso := spi.SlaveTransfer(0x80); miso != 0x80 {
+		t.Errorf("Bad slave output %02x", miso)
+	}
+	if spi.ReadSPSR(0)&spsrSPIF == 0 || spi.ReadSPDR(0) != 0x01 {
+		t.Error("Bad slave input")
+	}
+}
+
+func TestSPIReset(t *testing.T) {
+	spi, _, timer, intr := newTestSPI()
+	spi.WriteSPCR(0, spcrSPIE|spcrSPE|spcrMSTR)
+	spi.WriteSPDR(0, 0xa5)
+	spi.Reset()
+	timer.Tick(1000)
+	if spi.ReadSPCR(0) != 0 || spi.ReadSPSR(0) != 0 || intr.IsSet(0) {
+		t.Error("Not reset")
+	}
+}
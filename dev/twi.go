@@ -0,0 +1,404 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	twcrTWINT = 0x80
+	twcrTWEA  = 0x40
+	twcrTWSTA = 0x20
+	twcrTWSTO = 0x10
+	twcrTWWC  = 0x08
+	twcrTWEN  = 0x04
+	twcrTWIE  = 0x01
+	twsrTWPS  = 0x03
+)
+
+// TWSR status codes
+const (
+	twiStart        = 0x08
+	twiRepStart     = 0x10
+	twiMtSlaAck     = 0x18
+	twiMtSlaNack    = 0x20
+	twiMtDataAck    = 0x28
+	twiMtDataNack   = 0x30
+	twiMrSlaAck     = 0x40
+	twiMrSlaNack    = 0x48
+	twiMrDataAck    = 0x50
+	twiMrDataNack   = 0x58
+	twiSrSlaAck     = 0x60
+	twiSrGCallAck   = 0x70
+	twiSrDataAck    = 0x80
+	twiSrDataNack   = 0x88
+	twiSrGCDataAck  = 0x90
+	twiSrGCDataNack = 0x98
+	twiSrStop       = 0xa0
+	twiStSlaAck     = 0xa8
+	twiStDataAck    = 0xb8
+	twiStDataNack   = 0xc0
+	twiStLastData   = 0xc8
+	twiNoInfo       = 0xf8
+)
+
+type twiState int
+
+const (
+	twiIdle twiState = iota
+	twiMasterStart
+	twiMasterTx
+	twiMasterRx
+	twiSlaveRx
+	twiSlaveTx
+	twiSlaveDone
+)
+
+// A twiExternal is a transfer from a simulated external master to the
+// TWI unit acting as slave.
+type twiExternal struct {
+	addr  byte
+	read  bool
+	data  []byte
+	count int
+	gcall bool
+	done  func([]byte)
+}
+
+type TWI struct {
+	// SCL period in cycles used by simulated external masters.
+	ExternalSCLCycles int64
+	timer             *core.Timer
+	intr              *core.Interrupts
+	vec               int
+	bus               *I2CBus
+	twbr              byte
+	twsr              byte
+	twar              byte
+	twdr              byte
+	twcr              byte
+	state             twiState
+	op                *core.Counter
+	pending           []*twiExternal
+	ext               *twiExternal
+}
+
+func NewTWI(timer *core.Timer, intr *core.Interrupts, vec int,
+	bus *I2CBus) *TWI {
+
+	return &TWI{
+		ExternalSCLCycles: 80,
+		timer:             timer,
+		intr:              intr,
+		vec:               vec,
+		bus:               bus,
+		twsr:              twiNoInfo,
+		twar:              0xfe,
+		twdr:              0xff,
+	}
+}
+
+// Reset disables the unit, releasing the bus, and returns the
+// registers to their initial values.
+func (twi *TWI) Reset() {
+	twi.disable(0)
+	twi.twbr = 0
+	twi.twsr = twiNoInfo
+	twi.twar = 0xfe
+	twi.twdr = 0xff
+}
+
+func (twi *TWI) ReadTWBR(addr core.Addr) byte {
+	return twi.twbr
+}
+
+func (twi *TWI) WriteTWBR(addr core.Addr, val byte) {
+	twi.twbr = val
+}
+
+func (twi *TWI) ReadTWSR(addr core.Addr) byte {
+	return twi.twsr
+}
+
+func (twi *TWI) WriteTWSR(addr core.Addr, val byte) {
+	twi.twsr = (twi.twsr &^ twsrTWPS) | (val & twsrTWPS)
+}
+
+func (twi *TWI) ReadTWAR(addr core.Addr) byte {
+	return twi.twar
+}
+
+func (twi *TWI) WriteTWAR(addr core.Addr, val byte) {
+	twi.twar = val
+}
+
+func (twi *TWI) ReadTWDR(addr core.Addr) byte {
+	return twi.twdr
+}
+
+func (twi *TWI) WriteTWDR(addr core.Addr, val byte) {
+	if (twi.twcr & twcrTWINT) == 0 {
+		twi.twcr |= twcrTWWC
+		return
+	}
+	twi.twcr &^= twcrTWWC
+	twi.twdr = val
+}
+
+func (twi *TWI) ReadTWCR(addr core.Addr) byte {
+	return twi.twcr
+}
+
+func (twi *TWI) WriteTWCR(addr core.Addr, val byte) {
+	if (val & twcrTWEN) == 0 {
+		twi.disable(val)
+		return
+	}
+	flags := twi.twcr & (twcrTWINT | twcrTWWC)
+	if (val & twcrTWINT) != 0 {
+		flags &^= twcrTWINT
+	}
+	twi.twcr = (val &^ (twcrTWINT | twcrTWWC)) | flags
+	if (val & twcrTWINT) != 0 {
+		twi.next()
+	} else {
+		twi.pollExternal()
+	}
+	twi.updateIntr()
+}
+
+// ExternalWrite queues a write of data by a simulated external master
+// to the 7-bit address addr; done (if not nil) is called with the bytes
+// acknowledged by the TWI unit.
+func (twi *TWI) ExternalWrite(addr byte, data []byte, done func([]byte)) {
+	twi.queue(&twiExternal{addr: addr, data: data, done: done})
+}
+
+// ExternalRead queues a read of count bytes by a simulated external
+// master from the 7-bit address addr; done (if not nil) is called with
+// the bytes read.
+func (twi *TWI) ExternalRead(addr byte, count int, done func([]byte)) {
+	twi.queue(&twiExternal{addr: addr, read: true, count: count, done: done})
+}
+
+func (twi *TWI) queue(ext *twiExternal) {
+	twi.pending = append(twi.pending, ext)
+	twi.pollExternal()
+}
+
+func (twi *TWI) disable(val byte) {
+	if twi.op != nil {
+		twi.timer.RemoveCounter(twi.op)
+		twi.op = nil
+	}
+	if twi.state == twiMasterTx || twi.state == twiMasterRx {
+		twi.bus.stop()
+	}
+	twi.finishExternal()
+	twi.state = twiIdle
+	twi.twcr = val & (twcrTWEA | twcrTWSTA | twcrTWSTO | twcrTWIE)
+	twi.setStatus(twiNoInfo)
+	twi.updateIntr()
+}
+
+func (twi *TWI) sclCycles() int64 {
+	presc := int64(1) << (2 * uint(twi.twsr&twsrTWPS))
+	return 16 + 2*int64(twi.twbr)*presc
+}
+
+func (twi *TWI) schedule(cycles int64, action func()) {
+	twi.op = core.NewCounter(cycles, func() bool {
+		twi.op = nil
+		action()
+		twi.updateIntr()
+		return false
+	})
+	twi.timer.AddCounter(twi.op)
+}
+
+func (twi *TWI) interrupt(status byte) {
+	twi.setStatus(status)
+	twi.twcr |= twcrTWINT
+}
+
+func (twi *TWI) setStatus(status byte) {
+	twi.twsr = status | (twi.twsr & twsrTWPS)
+}
+
+// next performs the action requested by clearing TWINT.
+func (twi *TWI) next() {
+	if twi.op != nil {
+		return
+	}
+	sta := (twi.twcr & twcrTWSTA) != 0
+	sto := (twi.twcr & twcrTWSTO) != 0
+	scl := twi.sclCycles()
+
+	switch twi.state {
+	case twiIdle:
+		if sto {
+			twi.twcr &^= twcrTWSTO
+		}
+		if sta {
+			twi.schedule(scl, func() {
+				twi.state = twiMasterStart
+				twi.interrupt(twiStart)
+			})
+		} else {
+			twi.pollExternal()
+		}
+	case twiMasterStart, twiMasterTx, twiMasterRx:
+		if sto {
+			twi.schedule(scl, func() {
+				twi.bus.stop()
+				twi.state = twiIdle
+				twi.twcr &^= twcrTWSTO
+				twi.setStatus(twiNoInfo)
+				if sta {
+					twi.next()
+				} else {
+					twi.pollExternal()
+				}
+			})
+		} else if sta && twi.state != twiMasterStart {
+			twi.schedule(scl, func() {
+				twi.state = twiMasterStart
+				twi.interrupt(twiRepStart)
+			})
+		} else {
+			twi.schedule(9*scl, twi.masterByte)
+		}
+	case twiSlaveRx:
+		twi.schedule(9*twi.ExternalSCLCycles, twi.slaveReceive)
+	case twiSlaveTx:
+		twi.schedule(9*twi.ExternalSCLCycles, twi.slaveTransmit)
+	case twiSlaveDone:
+		twi.finishExternal()
+		twi.state = twiIdle
+		twi.setStatus(twiNoInfo)
+		twi.pollExternal()
+	}
+}
+
+func (twi *TWI) masterByte() {
+	switch twi.state {
+	case twiMasterStart:
+		read := (twi.twdr & 0x01) != 0
+		ack := twi.bus.address(twi.twdr>>1, read)
+		switch {
+		case read && ack:
+			twi.state = twiMasterRx
+			twi.interrupt(twiMrSlaAck)
+		case read:
+			twi.state = twiMasterRx
+			twi.interrupt(twiMrSlaNack)
+		case ack:
+			twi.state = twiMasterTx
+			twi.interrupt(twiMtSlaAck)
+		default:
+			twi.state = twiMasterTx
+			twi.interrupt(twiMtSlaNack)
+		}
+	case twiMasterTx:
+		if twi.bus.write(twi.twdr) {
+			twi.interrupt(twiMtDataAck)
+		} else {
+			twi.interrupt(twiMtDataNack)
+		}
+	case twiMasterRx:
+		twi.twdr = twi.bus.read()
+		if (twi.twcr & twcrTWEA) != 0 {
+			twi.interrupt(twiMrDataAck)
+		} else {
+			twi.interrupt(twiMrDataNack)
+		}
+	}
+}
+
+// pollExternal starts the next queued external transfer if the unit
+// is idle and listening for its address.
+func (twi *TWI) pollExternal() {
+	if twi.op != nil || twi.state != twiIdle || len(twi.pending) == 0 ||
+		(twi.twcr&(twcrTWEN|twcrTWEA)) != (twcrTWEN|twcrTWEA) {
+		return
+	}
+	ext := twi.pending[0]
+	twi.pending = twi.pending[1:]
+	own := (ext.addr & 0x7f) == (twi.twar >> 1)
+	ext.gcall = ext.addr == 0 && !ext.read && (twi.twar&0x01) != 0
+	twi.ext = ext
+	twi.schedule(9*twi.ExternalSCLCycles, func() {
+		switch {
+		case ext.gcall:
+			twi.state = twiSlaveRx
+			twi.interrupt(twiSrGCallAck)
+		case own && ext.read:
+			ext.data = nil
+			twi.state = twiSlaveTx
+			twi.interrupt(twiStSlaAck)
+		case own:
+			twi.state = twiSlaveRx
+			twi.interrupt(twiSrSlaAck)
+		default:
+			// not addressed; the external master sees a NACK
+			ext.data = nil
+			twi.finishExternal()
+			twi.pollExternal()
+		}
+	})
+}
+
+func (twi *TWI) slaveReceive() {
+	ext := twi.ext
+	if ext.count == len(ext.data) {
+		twi.state = twiSlaveDone
+		twi.interrupt(twiSrStop)
+		return
+	}
+	twi.twdr = ext.data[ext.count]
+	ack := (twi.twcr & twcrTWEA) != 0
+	status := byte(twiSrDataAck)
+	if ext.gcall {
+		status = twiSrGCDataAck
+	}
+	if ack {
+		ext.count++
+	} else {
+		status += 8
+		ext.data = ext.data[:ext.count]
+		twi.state = twiSlaveDone
+	}
+	twi.interrupt(status)
+}
+
+func (twi *TWI) slaveTransmit() {
+	ext := twi.ext
+	ext.data = append(ext.data, twi.twdr)
+	more := len(ext.data) < ext.count
+	switch {
+	case !more:
+		twi.state = twiSlaveDone
+		twi.interrupt(twiStDataNack)
+	case (twi.twcr & twcrTWEA) == 0:
+		twi.state = twiSlaveDone
+		twi.interrupt(twiStLastData)
+	default:
+		twi.interrupt(twiStDataAck)
+	}
+}
+
+func (twi *TWI) finishExternal() {
+	if ext := twi.ext; ext != nil {
+		twi.ext = nil
+		if !ext.read {
+			ext.data = ext.data[:ext.count]
+		}
+		if ext.done != nil {
+			ext.done(ext.data)
+		}
+	}
+}
+
+func (twi *TWI) updateIntr() {
+	twi.intr.Set(twi.vec, (twi.twcr&(twcrTWINT|twcrTWIE|twcrTWEN)) ==
+		(twcrTWINT|twcrTWIE|twcrTWEN))
+}
@@ -0,0 +1,139 @@
+package dev
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+type regTarget struct {
+	regs    [16]byte
+	ptr     int
+	first   bool
+	stopped int
+}
+
+func (r *regTarget) Start(read bool) bool {
+	r.first = !read
+	return true
+}
+
+func (r *regTarget) Write(data byte) bool {
+	if r.first {
+		r.ptr = int(data) & 0xf
+		r.first = false
+	} else {
+		r.regs[r.ptr] = data
+		r.ptr = (r.ptr + 1) & 0xf
+	}
+	return true
+}
+
+func (r *regTarget) Read() byte {
+	data := r.regs[r.ptr]
+	r.ptr = (r.ptr + 1) & 0xf
+	return data
+}
+
+func (r *regTarget) Stop() {
+	r.stopped++
+}
+
+type twiTest struct {
+	t     *testing.T
+	twi   *TWI
+	timer *core.Timer
+}
+
+func newTWITest(t *testing.T) (*twiTest, *I2CBus) {
+	bus := NewI2CBus()
+	timer := core.NewTimer()
+	twi := NewTWI(timer, core.NewInterrupts(1), 0, bus)
+	twi.WriteTWBR(0, 2)
+	return &twiTest{t: t, twi: twi, timer: timer}, bus
+}
+
+// step writes TWCR and waits for TWINT, checking the resulting status.
+func (tt *twiTest) step(twcr byte, status byte) {
+	tt.twi.WriteTWCR(0, twcr|twcrTWEN)
+	for i := 0; i < 1000; i++ {
+		if (tt.twi.ReadTWCR(0) & twcrTWINT) != 0 {
+			break
+		}
+		tt.timer.Tick(1)
+	}
+	if got := tt.twi.ReadTWSR(0); got != status {
+		tt.t.Fatalf("Status %02x, expected %02x", got, status)
+	}
+}
+
+func TestTWIInitial(t *testing.T) {
+	twi := NewTWI(core.NewTimer(), core.NewInterrupts(1), 0, NewI2CBus())
+	if twi.ReadTWAR(0) != 0xfe || twi.ReadTWDR(0) != 0xff ||
+		twi.ReadTWSR(0) != twiNoInfo {
+		t.Error("Bad initial values", twi.ReadTWAR(0), twi.ReadTWDR(0))
+	}
+}
+
+func TestTWIMaster(t *testing.T) {
+	tt, bus := newTWITest(t)
+	target := &regTarget{}
+	bus.Attach(0x50, target)
+
+	tt.step(twcrTWINT|twcrTWSTA, twiStart)
+	tt.twi.WriteTWDR(0, 0x50<<1)
+	tt.step(twcrTWINT, twiMtSlaAck)
+	tt.twi.WriteTWDR(0, 0x03)
+	tt.step(twcrTWINT, twiMtDataAck)
+	tt.twi.WriteTWDR(0, 0xab)
+	tt.step(twcrTWINT, twiMtDataAck)
+	tt.step(twcrTWINT|twcrTWSTA, twiRepStart)
+	tt.twi.WriteTWDR(0, 0x50<<1|1)
+	tt.step(twcrTWINT, twiMrSlaAck)
+	tt.step(twcrTWINT|twcrTWEA, twiMrDataAck)
+	tt.step(twcrTWINT, twiMrDataNack)
+	if target.regs[3] != 0xab || tt.twi.ReadTWDR(0) != target.regs[5] {
+		t.Error("Bad master transfer data")
+	}
+	tt.twi.WriteTWCR(0, twcrTWINT|twcrTWSTO|twcrTWEN)
+	tt.timer.Tick(100)
+	if target.stopped != 1 || tt.twi.ReadTWCR(0)&twcrTWSTO != 0 ||
+		tt.twi.ReadTWSR(0) != twiNoInfo {
+		t.Error("STOP not executed")
+	}
+
+	tt.step(twcrTWINT|twcrTWSTA, twiStart)
+	tt.twi.WriteTWDR(0, 0x51<<1)
+	tt.step(twcrTWINT, twiMtSlaNack)
+}
+
+func TestTWISlave(t *testing.T) {
+	tt, _ := newTWITest(t)
+	tt.twi.WriteTWAR(0, 0x20<<1)
+	tt.twi.WriteTWCR(0, twcrTWEN|twcrTWEA)
+
+	var written, read []byte
+	tt.twi.ExternalWrite(0x20, []byte{1, 2}, func(b []byte) { written = b })
+	tt.twi.ExternalRead(0x20, 2, func(b []byte) { read = b })
+
+	tt.step(twcrTWEA, twiSrSlaAck)
+	tt.step(twcrTWINT|twcrTWEA, twiSrDataAck)
+	if tt.twi.ReadTWDR(0) != 1 {
+		t.Error("Bad slave receive data")
+	}
+	tt.step(twcrTWINT|twcrTWEA, twiSrDataAck)
+	tt.step(twcrTWINT|twcrTWEA, twiSrStop)
+	tt.step(twcrTWINT|twcrTWEA, twiStSlaAck)
+	if !bytes.Equal(written, []byte{1, 2}) {
+		t.Error("External write not completed")
+	}
+	tt.twi.WriteTWDR(0, 0x77)
+	tt.step(twcrTWINT|twcrTWEA, twiStDataAck)
+	tt.twi.WriteTWDR(0, 0x88)
+	tt.step(twcrTWINT|twcrTWEA, twiStDataNack)
+	tt.twi.WriteTWCR(0, twcrTWINT|twcrTWEA|twcrTWEN)
+	if !bytes.Equal(read, []byte{0x77, 0x88}) {
+		t.Error("External read not completed")
+	}
+}
@@ -4,112 +4,471 @@ import (
 	"github.com/edmccard/avr-sim/core"
 )
 
-type USART struct {
-	ucsraU2X  byte
-	ucsrbRXEN byte
-	ucsrbTXEN byte
-	ubbrh     byte
-	ucsrc     byte
-	ucsrcRead int64
-	timer     *core.Timer
-	canRead   bool
-	read      chan byte
-	canWrite  bool
-	write     chan byte
+const (
+	ucsraRXC   = 0x80
+	ucsraTXC   = 0x40
+	ucsraUDRE  = 0x20
+	ucsraFE    = 0x10
+	ucsraDOR   = 0x08
+	ucsraPE    = 0x04
+	ucsraU2X   = 0x02
+	ucsraMPCM  = 0x01
+	ucsrbRXCIE = 0x80
+	ucsrbTXCIE = 0x40
+	ucsrbUDRIE = 0x20
+	ucsrbRXEN  = 0x10
+	ucsrbTXEN  = 0x08
+	ucsrbUCSZ2 = 0x04
+	ucsrbRXB8  = 0x02
+	ucsrbTXB8  = 0x01
+	ucsrcURSEL = 0x80
+	ucsrcUMSEL = 0x40
+	ucsrcUPM   = 0x30
+	ucsrcUSBS  = 0x08
+	ucsrcUCSZ  = 0x06
+)
+
+type Parity int
+
+const (
+	ParityNone Parity = iota
+	ParityEven
+	ParityOdd
+)
+
+// A SerialFormat describes the frames sent on a serial line.
+type SerialFormat struct {
+	BitCycles float64
+	DataBits  int
+	Parity    Parity
+	StopBits  int
 }
 
-func NewUSART(read, write chan byte, timer *core.Timer) *USART {
-	return &USART{timer: timer, read: read, write: write}
+func (f SerialFormat) FrameBits() int {
+	bits := 1 + f.DataBits + f.StopBits
+	if f.Parity != ParityNone {
+		bits++
+	}
+	return bits
 }
 
-func (usart *USART) ReadUCSRA(addr core.Addr) (val byte) {
-	usart.canRead = false
-	if len(usart.read) > 0 {
-		usart.canRead = true
-		val |= 0x80
+// levels returns the line levels for the bits of a frame.
+func (f SerialFormat) levels(data uint16) []bool {
+	line := make([]bool, 0, f.FrameBits())
+	line = append(line, false)
+	for i := uint(0); i < uint(f.DataBits); i++ {
+		line = append(line, (data&(1<<i)) != 0)
 	}
+	if f.Parity != ParityNone {
+		line = append(line, f.parity(data))
+	}
+	for i := 0; i < f.StopBits; i++ {
+		line = append(line, true)
+	}
+	return line
+}
 
-	// TXC is always set when TXEN = 1
-	if usart.ucsrbTXEN != 0 {
-		val |= 0x40
+func (f SerialFormat) parity(data uint16) bool {
+	odd := false
+	for i := uint(0); i < uint(f.DataBits); i++ {
+		if (data & (1 << i)) != 0 {
+			odd = !odd
+		}
 	}
+	return odd != (f.Parity == ParityOdd)
+}
+
+type rxFrame struct {
+	data uint16
+	fe   bool
+	pe   bool
+}
 
-	usart.canWrite = false
-	if len(usart.write) < cap(usart.write) {
-		usart.canWrite = true
-		val |= 0x20
+// A USART exchanges bytes with the host through the read and write
+// channels. Frames take the time given by the baud rate registers;
+// the host is flow-controlled only by the channel buffers.
+//
+// The RXC, UDRE and TXC interrupts use vectors vec, vec+1 and vec+2.
+type USART struct {
+	// OnFrame, if not nil, receives transmitted frames (including the
+	// ninth bit) instead of the write channel.
+	OnFrame func(data uint16)
+	// SharedUBRRH is set (the default) on devices where UCSRC and
+	// UBRRH share an address and are selected by URSEL.
+	SharedUBRRH bool
+	timer       *core.Timer
+	intr        *core.Interrupts
+	vec         int
+	read        chan byte
+	write       chan byte
+	remote      *SerialFormat
+	ucsra       byte
+	ucsrb       byte
+	ucsrc       byte
+	ubrr        int
+	ucsrcRead   int64
+	txBuf       uint16
+	txFull      bool
+	txShift     uint16
+	tx          *core.Counter
+	rxPoll      *core.Counter
+	rxBusy      bool
+	rxShift     uint16
+	rxQueue     []uint16
+	fifo        []rxFrame
+	dor         bool
+}
+
+func NewUSART(read, write chan byte, timer *core.Timer,
+	intr *core.Interrupts, vec int) *USART {
+
+	usart := &USART{
+		timer:       timer,
+		intr:        intr,
+		vec:         vec,
+		read:        read,
+		write:       write,
+		SharedUBRRH: true,
+		ucsrc:       0x06,
+		ucsrcRead:   -2,
 	}
+	intr.SetAck(vec+2, func() {
+		usart.ucsra &^= ucsraTXC
+		usart.updateIntr()
+	})
+	return usart
+}
 
-	val |= usart.ucsraU2X
+// Reset aborts reception and transmission, and returns the registers
+// to their initial values; frames queued by the host are kept.
+func (usart *USART) Reset() {
+	for _, ctr := range []**core.Counter{&usart.tx, &usart.rxPoll} {
+		if *ctr != nil {
+			usart.timer.RemoveCounter(*ctr)
+			*ctr = nil
+		}
+	}
+	usart.ucsra = 0
+	usart.ucsrb = 0
+	usart.ucsrc = 0x06
+	usart.ubrr = 0
+	usart.txFull = false
+	usart.rxBusy = false
+	usart.fifo = nil
+	usart.dor = false
+	usart.updateIntr()
+}
+
+// SetRemote sets the format of frames sent by the host, which
+// otherwise match the receiver's configuration. Mismatches produce
+// framing and parity errors as on a real line.
+func (usart *USART) SetRemote(format *SerialFormat) {
+	usart.remote = format
+}
 
+// SendFrame queues a frame (which may use more than 8 data bits) from
+// the host, ahead of any bytes in the read channel.
+func (usart *USART) SendFrame(data uint16) {
+	usart.rxQueue = append(usart.rxQueue, data)
+}
+
+// Format returns the frame format set by the control registers.
+func (usart *USART) Format() SerialFormat {
+	f := SerialFormat{DataBits: 8, StopBits: 1}
+	switch ucsz := (usart.ucsrb & ucsrbUCSZ2) | (usart.ucsrc&ucsrcUCSZ)>>1; ucsz {
+	case 0, 1, 2, 3:
+		f.DataBits = 5 + int(ucsz)
+	case 7:
+		f.DataBits = 9
+	}
+	switch usart.ucsrc & ucsrcUPM {
+	case 0x20:
+		f.Parity = ParityEven
+	case 0x30:
+		f.Parity = ParityOdd
+	}
+	if (usart.ucsrc & ucsrcUSBS) != 0 {
+		f.StopBits = 2
+	}
+	switch {
+	case (usart.ucsrc & ucsrcUMSEL) != 0:
+		f.BitCycles = float64(2 * (usart.ubrr + 1))
+	case (usart.ucsra & ucsraU2X) != 0:
+		f.BitCycles = float64(8 * (usart.ubrr + 1))
+	default:
+		f.BitCycles = float64(16 * (usart.ubrr + 1))
+	}
+	return f
+}
+
+func (usart *USART) frameCycles() int64 {
+	f := usart.Format()
+	return int64(f.BitCycles * float64(f.FrameBits()))
+}
+
+func (usart *USART) ReadUCSRA(addr core.Addr) byte {
+	val := usart.ucsra & (ucsraTXC | ucsraU2X | ucsraMPCM)
+	if len(usart.fifo) > 0 {
+		val |= ucsraRXC
+		if usart.fifo[0].fe {
+			val |= ucsraFE
+		}
+		if usart.fifo[0].pe {
+			val |= ucsraPE
+		}
+	}
+	if !usart.txFull {
+		val |= ucsraUDRE
+	}
+	if usart.dor {
+		val |= ucsraDOR
+	}
 	return val
 }
 
 func (usart *USART) WriteUCSRA(addr core.Addr, val byte) {
-	// do not accept MPCM = 1 or TXC = 1
-	if (val & 0x41) != 0 {
-		panic("unsupported UCSRA configuration")
+	// TXC is cleared by writing a one to it
+	txc := usart.ucsra & ucsraTXC
+	if (val & ucsraTXC) != 0 {
+		txc = 0
 	}
-	// store in case it is read back
-	usart.ucsraU2X = val & 0x02
+	u2x := usart.ucsra & ucsraU2X
+	usart.ucsra = txc | (val & (ucsraU2X | ucsraMPCM))
+	if (val & ucsraU2X) != u2x {
+		usart.restartReceiver()
+	}
+	usart.updateIntr()
 }
 
 func (usart *USART) ReadUCSRB(addr core.Addr) byte {
-	return usart.ucsrbRXEN | usart.ucsrbTXEN
+	val := usart.ucsrb &^ ucsrbRXB8
+	if len(usart.fifo) > 0 && (usart.fifo[0].data&0x100) != 0 {
+		val |= ucsrbRXB8
+	}
+	return val
 }
 
 func (usart *USART) WriteUCSRB(addr core.Addr, val byte) {
-	// ignore read-only bit 1 RXB8
-	val &^= 2
-	// accept ones only in RXEN/TXEN
-	if (val & 0xe7) != 0 {
-		panic("unsupported UCSRB configuration")
+	if (val & ucsrbRXEN) == 0 {
+		usart.fifo = nil
+		usart.dor = false
+	}
+	changed := (val ^ usart.ucsrb) & (ucsrbRXEN | ucsrbUCSZ2)
+	usart.ucsrb = (val &^ ucsrbRXB8) | (usart.ucsrb & ucsrbRXB8)
+	if changed != 0 {
+		usart.restartReceiver()
 	}
-	usart.ucsrbRXEN = val & 0x10
-	usart.ucsrbTXEN = val & 0x08
+	if (usart.ucsrb & ucsrbTXEN) != 0 {
+		usart.startTransmit()
+	}
+	usart.updateIntr()
 }
 
+// With SharedUBRRH, UCSRC is read by reading the location twice in
+// consecutive cycles.
 func (usart *USART) ReadUCSRC(addr core.Addr) byte {
+	if !usart.SharedUBRRH {
+		return usart.ucsrc
+	}
 	cyc := usart.timer.GetCount()
 	if cyc == (usart.ucsrcRead + 1) {
-		return usart.ucsrc
+		return usart.ucsrc | ucsrcURSEL
 	} else {
 		usart.ucsrcRead = cyc
-		return usart.ubbrh
+		return byte(usart.ubrr >> 8)
 	}
 }
 
 func (usart *USART) WriteUCSRC(addr core.Addr, val byte) {
-	if (val & 0x80) != 0 {
-		if (val & 0x06) == 0 {
-			panic("unsupported UCSRC configuration")
-		}
+	switch {
+	case !usart.SharedUBRRH:
 		usart.ucsrc = val
-	} else {
-		usart.ubbrh = val
+	case (val & ucsrcURSEL) != 0:
+		usart.ucsrc = val &^ ucsrcURSEL
+	default:
+		usart.ubrr = (usart.ubrr & 0xff) | int(val&0x0f)<<8
 	}
+	usart.restartReceiver()
+}
+
+func (usart *USART) ReadUBRRH(addr core.Addr) byte {
+	return byte(usart.ubrr >> 8)
+}
+
+func (usart *USART) WriteUBRRH(addr core.Addr, val byte) {
+	usart.ubrr = (usart.ubrr & 0xff) | int(val&0x0f)<<8
+	usart.restartReceiver()
+}
+
+func (usart *USART) ReadUBRRL(addr core.Addr) byte {
+	return byte(usart.ubrr)
+}
+
+func (usart *USART) WriteUBRRL(addr core.Addr, val byte) {
+	usart.ubrr = (usart.ubrr &^ 0xff) | int(val)
+	usart.restartReceiver()
 }
 
 func (usart *USART) ReadUDR(addr core.Addr) byte {
-	if usart.ucsrbRXEN == 0 || !usart.canRead {
+	if len(usart.fifo) == 0 {
 		return 0
 	}
-	var c byte
-	select {
-	case c = <-usart.read:
-		return c
-	default:
-		panic("read sync error")
-	}
+	frame := usart.fifo[0]
+	usart.fifo = usart.fifo[1:]
+	usart.dor = false
+	usart.updateIntr()
+	return byte(frame.data)
 }
 
 func (usart *USART) WriteUDR(addr core.Addr, val byte) {
-	if usart.ucsrbTXEN == 0 || !usart.canWrite {
+	if usart.txFull {
+		return
+	}
+	usart.txBuf = uint16(val)
+	if (usart.ucsrb & ucsrbTXB8) != 0 {
+		usart.txBuf |= 0x100
+	}
+	usart.txFull = true
+	if (usart.ucsrb & ucsrbTXEN) != 0 {
+		usart.startTransmit()
+	}
+	usart.updateIntr()
+}
+
+// startTransmit moves a pending byte into the shift register; once
+// written, pending data is sent even if TXEN is cleared.
+func (usart *USART) startTransmit() {
+	if usart.tx != nil || !usart.txFull {
+		return
+	}
+	usart.txShift = usart.txBuf
+	usart.txFull = false
+	usart.tx = core.NewCounter(usart.frameCycles(), usart.finishTransmit)
+	usart.timer.AddCounter(usart.tx)
+}
+
+func (usart *USART) finishTransmit() bool {
+	data := usart.txShift & (1<<uint(usart.Format().DataBits) - 1)
+	if usart.OnFrame != nil {
+		usart.OnFrame(data)
+	} else {
+		select {
+		case usart.write <- byte(data):
+		default:
+			// hold the line until the host has room
+			return true
+		}
+	}
+	usart.tx = nil
+	if usart.txFull {
+		usart.startTransmit()
+	} else {
+		usart.ucsra |= ucsraTXC
+	}
+	usart.updateIntr()
+	return false
+}
+
+// restartReceiver restarts the receive timer after a change to the
+// frame format or receiver enable.
+func (usart *USART) restartReceiver() {
+	if usart.rxPoll != nil {
+		usart.timer.RemoveCounter(usart.rxPoll)
+		usart.rxPoll = nil
+	}
+	if (usart.ucsrb & ucsrbRXEN) == 0 {
+		usart.rxBusy = false
+		return
+	}
+	usart.rxPoll = core.NewCounter(usart.frameCycles(), func() bool {
+		usart.receive()
+		return true
+	})
+	usart.timer.AddCounter(usart.rxPoll)
+}
+
+// receive completes the frame on the line (if any) and starts the next
+// one from the host.
+func (usart *USART) receive() {
+	if usart.rxBusy {
+		usart.rxBusy = false
+		usart.sampleFrame(usart.rxShift)
+	}
+	if len(usart.rxQueue) > 0 {
+		usart.rxShift = usart.rxQueue[0]
+		usart.rxQueue = usart.rxQueue[1:]
+		usart.rxBusy = true
 		return
 	}
 	select {
-	case usart.write <- val:
+	case c := <-usart.read:
+		usart.rxShift = uint16(c)
+		usart.rxBusy = true
 	default:
-		panic("write sync error")
 	}
 }
+
+// sampleFrame samples a frame sent in the remote format at the middle
+// of each bit of the local format.
+func (usart *USART) sampleFrame(data uint16) {
+	local := usart.Format()
+	remote := local
+	if usart.remote != nil {
+		remote = *usart.remote
+	}
+	line := remote.levels(data)
+	bit := func(n int) bool {
+		i := int((float64(n) + 0.5) * local.BitCycles / remote.BitCycles)
+		if i >= len(line) {
+			return true
+		}
+		return line[i]
+	}
+	if bit(0) {
+		// false start bit
+		return
+	}
+
+	var frame rxFrame
+	for i := 0; i < local.DataBits; i++ {
+		if bit(1 + i) {
+			frame.data |= 1 << uint(i)
+		}
+	}
+	n := 1 + local.DataBits
+	if local.Parity != ParityNone {
+		frame.pe = bit(n) != local.parity(frame.data)
+		n++
+	}
+	stop := bit(n)
+	frame.fe = !stop
+
+	// in multi-processor mode, frames without the address bit are
+	// ignored
+	if (usart.ucsra & ucsraMPCM) != 0 {
+		addr := stop
+		if local.DataBits == 9 {
+			addr = (frame.data & 0x100) != 0
+		}
+		if !addr {
+			return
+		}
+		frame.fe = false
+	}
+
+	if len(usart.fifo) == 2 {
+		usart.dor = true
+		return
+	}
+	usart.fifo = append(usart.fifo, frame)
+	usart.updateIntr()
+}
+
+func (usart *USART) updateIntr() {
+	usart.intr.Set(usart.vec, len(usart.fifo) > 0 &&
+		(usart.ucsrb&ucsrbRXCIE) != 0)
+	usart.intr.Set(usart.vec+1, !usart.txFull &&
+		(usart.ucsrb&ucsrbUDRIE) != 0)
+	usart.intr.Set(usart.vec+2, (usart.ucsra&ucsraTXC) != 0 &&
+		(usart.ucsrb&ucsrbTXCIE) != 0)
+}
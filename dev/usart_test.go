@@ -0,0 +1,170 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+type usartTest struct {
+	usart *USART
+	timer *core.Timer
+	intr  *core.Interrupts
+	read  chan byte
+	write chan byte
+}
+
+// newTestUSART returns a USART set up for 8N1 at 16 cycles per bit.
+func newTestUSART() *usartTest {
+	ut := &usartTest{
+		timer: core.NewTimer(),
+		intr:  core.NewInterrupts(3),
+		read:  make(chan byte, 16),
+		write: make(chan byte, 16),
+	}
+	ut.usart = NewUSART(ut.read, ut.write, ut.timer, ut.intr, 0)
+	ut.usart.WriteUBRRL(0, 0)
+	ut.usart.WriteUCSRB(0, ucsrbRXEN|ucsrbTXEN)
+	return ut
+}
+
+func TestUSARTTransmit(t *testing.T) {
+	ut := newTestUSART()
+	ut.usart.WriteUCSRB(0, ucsrbTXEN|ucsrbUDRIE|ucsrbTXCIE)
+	if !ut.intr.IsSet(1) {
+		t.Error("UDRE interrupt not raised")
+	}
+	ut.usart.WriteUDR(0, 'a')
+	ut.usart.WriteUDR(0, 'b')
+	if ut.usart.ReadUCSRA(0)&ucsraUDRE != 0 || ut.intr.IsSet(1) {
+		t.Error("UDRE set with full buffer")
+	}
+	ut.timer.Tick(10*16 - 1)
+	if len(ut.write) != 0 {
+		t.Error("Frame sent early")
+	}
+	ut.timer.Tick(1)
+	if len(ut.write) != 1 || ut.usart.ReadUCSRA(0)&ucsraUDRE == 0 {
+		t.Error("First frame not sent")
+	}
+	if ut.usart.ReadUCSRA(0)&ucsraTXC != 0 {
+		t.Error("TXC set with data pending")
+	}
+	ut.timer.Tick(10 * 16)
+	if <-ut.write != 'a' || <-ut.write != 'b' {
+		t.Error("Bad transmitted data")
+	}
+	if !ut.intr.IsSet(2) {
+		t.Error("TXC interrupt not raised")
+	}
+	ut.intr.Ack(2)
+	if ut.usart.ReadUCSRA(0)&ucsraTXC != 0 {
+		t.Error("TXC not cleared by interrupt entry")
+	}
+}
+
+func TestUSARTReceive(t *testing.T) {
+	ut := newTestUSART()
+	ut.usart.WriteUCSRB(0, ucsrbRXEN|ucsrbRXCIE)
+	for _, c := range []byte("xyz") {
+		ut.read <- c
+	}
+	ut.timer.Tick(4 * 10 * 16)
+	if ut.usart.ReadUCSRA(0) != ucsraRXC|ucsraUDRE|ucsraDOR ||
+		!ut.intr.IsSet(0) {
+		t.Error("Overrun not detected")
+	}
+	if ut.usart.ReadUDR(0) != 'x' || ut.usart.ReadUDR(0) != 'y' {
+		t.Error("Bad received data")
+	}
+	if ut.usart.ReadUCSRA(0)&(ucsraRXC|ucsraDOR) != 0 || ut.intr.IsSet(0) {
+		t.Error("Receive flags not cleared")
+	}
+}
+
+func TestUSARTFormatErrors(t *testing.T) {
+	ut := newTestUSART()
+	// local 7E1
+	ut.usart.WriteUCSRC(0, ucsrcURSEL|0x20|0x04)
+	remote := ut.usart.Format()
+	remote.Parity = ParityOdd
+	ut.usart.SetRemote(&remote)
+	ut.read <- 0x41
+	ut.timer.Tick(2 * 10 * 16)
+	if ut.usart.ReadUCSRA(0)&(ucsraPE|ucsraFE) != ucsraPE {
+		t.Error("Parity error not detected")
+	}
+	ut.usart.ReadUDR(0)
+
+	remote.Parity = ParityEven
+	remote.BitCycles = 24
+	ut.read <- 0x41
+	ut.timer.Tick(2 * 10 * 16)
+	if ut.usart.ReadUCSRA(0)&ucsraFE == 0 {
+		t.Error("Framing error not detected")
+	}
+}
+
+func TestUSARTMultiprocessor(t *testing.T) {
+	ut := newTestUSART()
+	ut.usart.WriteUCSRA(0, ucsraMPCM)
+	// 9-bit frames with the address bit in bit 8
+	ut.usart.WriteUCSRB(0, ucsrbRXEN|ucsrbUCSZ2)
+	ut.usart.SendFrame(0x012)
+	ut.usart.SendFrame(0x134)
+	ut.timer.Tick(3 * 12 * 16)
+	if ut.usart.ReadUCSRB(0)&ucsrbRXB8 == 0 || ut.usart.ReadUDR(0) != 0x34 {
+		t.Error("Address frame not received")
+	}
+	if ut.usart.ReadUCSRA(0)&ucsraRXC != 0 {
+		t.Error("Data frame received in multi-processor mode")
+	}
+}
+
+func TestUSARTBaudRegisters(t *testing.T) {
+	ut := newTestUSART()
+	ut.usart.WriteUCSRC(0, 0x01)
+	ut.usart.WriteUBRRL(0, 0x23)
+	ut.usart.WriteUCSRA(0, ucsraU2X)
+	if f := ut.usart.Format(); f.BitCycles != 8*0x124 {
+		t.Error("Bad bit time", f.BitCycles)
+	}
+	ut.timer.Tick(5)
+	if ut.usart.ReadUCSRC(0) != 0x01 {
+		t.Error("Bad UBRRH read")
+	}
+	ut.timer.Tick(1)
+	if ut.usart.ReadUCSRC(0) != 0x86 {
+		t.Error("Bad UCSRC read")
+	}
+}
+
+func TestUSARTSeparateUBRRH(t *testing.T) {
+	ut := newTestUSART()
+	ut.usart.SharedUBRRH = false
+	ut.usart.WriteUBRRH(0, 0x01)
+	ut.usart.WriteUCSRC(0, 0x06)
+	if ut.usart.ReadUCSRC(0) != 0x06 || ut.usart.ReadUBRRH(0) != 0x01 {
+		t.Error("Bad register read")
+	}
+	if f := ut.usart.Format(); f.BitCycles != 16*0x101 {
+		t.Error("Bad bit time", f.BitCycles)
+	}
+}
+
+func TestUSARTReset(t *testing.T) {
+	ut := newTestUSART()
+	ut.usart.WriteUCSRB(0, ucsrbTXEN|ucsrbUDRIE)
+	ut.usart.WriteUDR(0, 'a')
+	ut.usart.Reset()
+	if ut.usart.ReadUCSRB(0) != 0 || ut.intr.IsSet(1) {
+		t.Error("Registers not reset")
+	}
+	if ut.usart.ReadUCSRA(0) != ucsraUDRE {
+		t.Error("Bad UCSRA", ut.usart.ReadUCSRA(0))
+	}
+	ut.timer.Tick(1000)
+	if len(ut.write) != 0 {
+		t.Error("Transmission not aborted")
+	}
+}
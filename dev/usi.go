@@ -0,0 +1,401 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	usicrUSISIE = 0x80
+	usicrUSIOIE = 0x40
+	usicrUSIWM  = 0x30
+	usicrUSICS  = 0x0c
+	usicrUSICS0 = 0x04
+	usicrUSICLK = 0x02
+	usicrUSITC  = 0x01
+	usisrUSISIF = 0x80
+	usisrUSIOIF = 0x40
+	usisrUSIPF  = 0x20
+	usisrUSIDC  = 0x10
+	usisrUSICNT = 0x0f
+)
+
+// USIWM wire modes
+const (
+	usiOff     = 0x00
+	usiThree   = 0x10
+	usiTwo     = 0x20
+	usiTwoHold = 0x30
+)
+
+// USICS clock sources
+const (
+	usiSoftware = 0x00
+	usiExternal = 0x08
+)
+
+// A USI is a Universal Serial Interface: a shift register and 4-bit
+// clock counter that software uses to build SPI (three-wire) and I2C
+// (two-wire) transfers. Clocking from Timer0 compare matches is not
+// modelled.
+type USI struct {
+	intr     *core.Interrupts
+	vecStart int
+	vecOvf   int
+	port     *Port
+	diPin    int
+	di       byte
+	do       byte
+	sck      byte
+	usicr    byte
+	usisr    byte
+	usidr    byte
+	usibr    byte
+	latch    bool
+	levels   byte
+	fell     bool
+	busy     bool
+	dirty    bool
+	slaves   []*spiSlave
+	spiBit   int
+	miso     byte
+	useMiso  bool
+	bus      *usiBus
+}
+
+// NewUSI returns a USI using pins of port for DI/SDA, DO and USCK/SCL.
+func NewUSI(intr *core.Interrupts, vecStart, vecOvf int, port *Port,
+	diPin, doPin, sckPin int) *USI {
+
+	usi := &USI{
+		intr:     intr,
+		vecStart: vecStart,
+		vecOvf:   vecOvf,
+		port:     port,
+		diPin:    diPin,
+		di:       1 << uint(diPin),
+		do:       1 << uint(doPin),
+		sck:      1 << uint(sckPin),
+		levels:   port.Levels(),
+	}
+	port.OnChange(func(levels, changed byte) {
+		usi.sync()
+	})
+	return usi
+}
+
+// AttachSPI connects a slave device for three-wire mode, whose
+// active-low chip select is pin csPin of port cs. While it is selected
+// it supplies the data shifted in, instead of the DI pin.
+func (usi *USI) AttachSPI(dev SPIDevice, cs *Port, csPin int) {
+	usi.slaves = append(usi.slaves, newSPISlave(dev, cs, csPin))
+}
+
+// AttachI2C connects the two-wire lines to bus, decoding the START,
+// STOP, address and data bits produced by software and driving SDA
+// for the targets' ACKs and data.
+func (usi *USI) AttachI2C(bus *I2CBus) {
+	usi.bus = &usiBus{bus: bus}
+}
+
+func (usi *USI) ReadUSICR(addr core.Addr) byte {
+	return usi.usicr
+}
+
+func (usi *USI) WriteUSICR(addr core.Addr, val byte) {
+	usi.usicr = val &^ (usicrUSICLK | usicrUSITC)
+	if (val & usicrUSICS) == usiSoftware {
+		usi.usicr |= val & usicrUSICLK
+		if (val & usicrUSICLK) != 0 {
+			usi.shift()
+			usi.count()
+		}
+	} else if (val & usicrUSICS) >= usiExternal {
+		usi.usicr |= val & usicrUSICLK
+		if (val&usicrUSICLK) != 0 && (val&usicrUSITC) != 0 {
+			usi.count()
+		}
+	}
+	if (val & usicrUSITC) != 0 {
+		usi.port.WritePORT(addr, usi.port.Output()^usi.sck)
+	}
+	usi.sync()
+	usi.updateIntr()
+}
+
+func (usi *USI) ReadUSISR(addr core.Addr) byte {
+	val := usi.usisr
+	if usi.twoWire() && usi.latch != ((usi.levels&usi.di) != 0) {
+		val |= usisrUSIDC
+	}
+	return val
+}
+
+// Flags are cleared by writing a one to them.
+func (usi *USI) WriteUSISR(addr core.Addr, val byte) {
+	flags := usi.usisr & (usisrUSISIF | usisrUSIOIF | usisrUSIPF)
+	flags &^= val
+	usi.usisr = flags | (val & usisrUSICNT)
+	usi.spiBit = 0
+	usi.sync()
+	usi.updateIntr()
+}
+
+func (usi *USI) ReadUSIDR(addr core.Addr) byte {
+	return usi.usidr
+}
+
+func (usi *USI) WriteUSIDR(addr core.Addr, val byte) {
+	usi.usidr = val
+	usi.sync()
+}
+
+func (usi *USI) ReadUSIBR(addr core.Addr) byte {
+	return usi.usibr
+}
+
+func (usi *USI) wireMode() byte {
+	return usi.usicr & usicrUSIWM
+}
+
+func (usi *USI) twoWire() bool {
+	return usi.wireMode() >= usiTwo
+}
+
+func (usi *USI) external() bool {
+	return (usi.usicr & usicrUSICS) >= usiExternal
+}
+
+// sampleLevel returns the USCK level on which data is shifted in; the
+// output latch holds its value while the clock is at this level.
+func (usi *USI) sampleLevel() bool {
+	return (usi.usicr & usicrUSICS0) == 0
+}
+
+func (usi *USI) shift() {
+	var in bool
+	if usi.wireMode() == usiThree && usi.spiBit == 0 {
+		usi.useMiso = false
+		usi.miso = 0xff
+		for _, slave := range usi.slaves {
+			if slave.selected {
+				usi.useMiso = true
+				usi.miso &= slave.dev.Transfer(usi.usidr)
+			}
+		}
+	}
+	if usi.wireMode() == usiThree && usi.useMiso {
+		in = (usi.miso & (0x80 >> uint(usi.spiBit))) != 0
+	} else {
+		in = (usi.levels & usi.di) != 0
+	}
+	usi.spiBit = (usi.spiBit + 1) % 8
+	usi.usidr <<= 1
+	if in {
+		usi.usidr |= 1
+	}
+}
+
+func (usi *USI) count() {
+	cnt := (usi.usisr + 1) & usisrUSICNT
+	usi.usisr = (usi.usisr &^ usisrUSICNT) | cnt
+	if cnt == 0 {
+		usi.usisr |= usisrUSIOIF
+		usi.usibr = usi.usidr
+	}
+	usi.updateIntr()
+}
+
+// sync follows the pin levels until they are stable, since driving the
+// outputs can change them again.
+func (usi *USI) sync() {
+	if usi.busy {
+		usi.dirty = true
+		return
+	}
+	usi.busy = true
+	for {
+		usi.dirty = false
+		usi.step(usi.port.Levels())
+		usi.drive()
+		if !usi.dirty {
+			break
+		}
+	}
+	usi.busy = false
+}
+
+func (usi *USI) step(levels byte) {
+	changed := levels ^ usi.levels
+	usi.levels = levels
+	sck := (levels & usi.sck) != 0
+	sda := (levels & usi.di) != 0
+
+	if (changed & usi.sck) != 0 {
+		if usi.external() && usi.wireMode() != usiOff {
+			if sck == usi.sampleLevel() {
+				usi.shift()
+			}
+			if (usi.usicr & usicrUSICLK) == 0 {
+				usi.count()
+			}
+		}
+		if !sck && (usi.usisr&usisrUSISIF) != 0 {
+			usi.fell = true
+		}
+		if usi.bus != nil && usi.twoWire() {
+			usi.bus.clock(sck, sda)
+		}
+	} else if (changed&usi.di) != 0 && sck && usi.twoWire() {
+		if !sda {
+			usi.usisr |= usisrUSISIF
+			usi.fell = false
+		} else {
+			usi.usisr |= usisrUSIPF
+		}
+		if usi.bus != nil {
+			usi.bus.condition(!sda)
+		}
+		usi.updateIntr()
+	}
+
+	if !usi.external() || sck != usi.sampleLevel() {
+		usi.latch = (usi.usidr & 0x80) != 0
+	}
+}
+
+// drive applies the USI's outputs to the port.
+func (usi *USI) drive() {
+	switch usi.wireMode() {
+	case usiOff:
+		usi.port.ClearOverride(usi.di | usi.do | usi.sck)
+	case usiThree:
+		var do byte
+		if usi.latch {
+			do = usi.do
+		}
+		usi.port.Override(usi.do, do)
+		usi.port.ClearOverride(usi.di | usi.sck)
+	default:
+		// SDA is pulled low if either PORT or the latch is zero
+		if usi.latch {
+			usi.port.ClearOverride(usi.di)
+		} else {
+			usi.port.Override(usi.di, 0)
+		}
+		hold := (usi.usisr&usisrUSISIF) != 0 && usi.fell
+		if usi.wireMode() == usiTwoHold && (usi.usisr&usisrUSIOIF) != 0 {
+			hold = true
+		}
+		if hold {
+			usi.port.Override(usi.sck, 0)
+		} else {
+			usi.port.ClearOverride(usi.sck)
+		}
+		usi.port.ClearOverride(usi.do)
+		if usi.bus != nil {
+			usi.port.Drive(usi.diPin, !usi.bus.pull)
+		}
+	}
+}
+
+func (usi *USI) updateIntr() {
+	usi.intr.Set(usi.vecStart, (usi.usisr&usisrUSISIF) != 0 &&
+		(usi.usicr&usicrUSISIE) != 0)
+	usi.intr.Set(usi.vecOvf, (usi.usisr&usisrUSIOIF) != 0 &&
+		(usi.usicr&usicrUSIOIE) != 0)
+}
+
+type usiBusState int
+
+const (
+	usiBusIdle usiBusState = iota
+	usiBusAddr
+	usiBusWrite
+	usiBusRead
+)
+
+// A usiBus decodes the two-wire lines for the targets on an I2CBus.
+type usiBus struct {
+	bus   *I2CBus
+	state usiBusState
+	bit   int
+	data  byte
+	read  bool
+	ack   bool
+	pull  bool
+	high  bool
+}
+
+// condition handles a START (or repeated START) or a STOP.
+func (b *usiBus) condition(start bool) {
+	b.pull, b.high = false, false
+	b.bit, b.data = 0, 0
+	if start {
+		b.state = usiBusAddr
+	} else {
+		b.bus.stop()
+		b.state = usiBusIdle
+	}
+}
+
+func (b *usiBus) clock(scl, sda bool) {
+	if b.state == usiBusIdle {
+		return
+	}
+	if scl {
+		b.high = true
+		switch {
+		case b.bit < 8 && b.state != usiBusRead:
+			b.data <<= 1
+			if sda {
+				b.data |= 1
+			}
+		case b.bit == 8 && b.state == usiBusRead:
+			b.ack = !sda
+		}
+		return
+	}
+	// the SCL fall that completes a START is not a clock
+	if !b.high {
+		return
+	}
+	b.high = false
+	b.bit++
+	switch {
+	case b.bit == 8:
+		switch b.state {
+		case usiBusAddr:
+			b.read = (b.data & 1) != 0
+			b.ack = b.bus.address(b.data>>1, b.read)
+			b.pull = b.ack
+		case usiBusWrite:
+			b.pull = b.bus.write(b.data)
+		case usiBusRead:
+			b.pull = false
+		}
+	case b.bit == 9:
+		b.bit, b.pull = 0, false
+		if b.state == usiBusAddr {
+			switch {
+			case !b.ack:
+				b.state = usiBusIdle
+			case b.read:
+				b.state = usiBusRead
+			default:
+				b.state = usiBusWrite
+			}
+		}
+		switch {
+		case b.state == usiBusRead && b.ack:
+			b.data = b.bus.read()
+			b.pull = (b.data & 0x80) == 0
+		case b.state == usiBusRead:
+			// NACK from the master; wait for STOP
+			b.state = usiBusIdle
+		default:
+			b.data = 0
+		}
+	case b.state == usiBusRead:
+		b.pull = (b.data & (0x80 >> uint(b.bit))) == 0
+	}
+}
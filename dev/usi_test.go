@@ -0,0 +1,160 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	usiSDA = 0x01
+	usiDO  = 0x02
+	usiSCL = 0x04
+)
+
+func newTestUSI() (*USI, *Port, *core.Interrupts) {
+	intr := core.NewInterrupts(2)
+	port := NewPort()
+	return NewUSI(intr, 0, 1, port, 0, 1, 2), port, intr
+}
+
+func TestUSIThreeWire(t *testing.T) {
+	usi, port, intr := newTestUSI()
+	dev := &echoDevice{last: 0x3c}
+	cs := NewPort()
+	cs.WriteDDR(0, 0x01)
+	usi.AttachSPI(dev, cs, 0)
+	port.WriteDDR(0, usiDO|usiSCL)
+	usi.WriteUSICR(0, usiThree|usiExternal)
+	usi.WriteUSIDR(0, 0xa5)
+	usi.WriteUSISR(0, usisrUSIOIF)
+	if !port.Level(1) {
+		t.Error("DO does not follow USIDR")
+	}
+	for i := 0; i < 16; i++ {
+		if usi.ReadUSISR(0)&usisrUSIOIF != 0 {
+			t.Fatal("Counter overflow after", i, "edges")
+		}
+		usi.WriteUSICR(0, usicrUSIOIE|usiThree|usiExternal|
+			usicrUSICLK|usicrUSITC)
+	}
+	if !intr.IsSet(1) {
+		t.Error("Overflow interrupt not raised")
+	}
+	if dev.last != 0xa5 {
+		t.Errorf("Slave got %02x", dev.last)
+	}
+	if usi.ReadUSIDR(0) != 0x3c || usi.ReadUSIBR(0) != 0x3c {
+		t.Errorf("Master got %02x", usi.ReadUSIDR(0))
+	}
+	if port.Output() != 0 {
+		t.Error("PORT changed by USCK strobes", port.Output())
+	}
+}
+
+// usiMaster drives a two-wire bus the way Atmel's AVR310 does.
+type usiMaster struct {
+	usi  *USI
+	port *Port
+}
+
+func (m *usiMaster) set(mask byte) {
+	m.port.WritePORT(0, m.port.Output()|mask)
+}
+
+func (m *usiMaster) clear(mask byte) {
+	m.port.WritePORT(0, m.port.Output()&^mask)
+}
+
+func (m *usiMaster) start() {
+	m.set(usiSCL)
+	m.clear(usiSDA)
+	m.clear(usiSCL)
+	m.set(usiSDA)
+}
+
+func (m *usiMaster) stop() {
+	m.clear(usiSDA)
+	m.set(usiSCL)
+	m.set(usiSDA)
+}
+
+func (m *usiMaster) transfer(usisr byte) byte {
+	m.usi.WriteUSISR(0, usisr)
+	for m.usi.ReadUSISR(0)&usisrUSIOIF == 0 {
+		m.usi.WriteUSICR(0, usiTwo|usiExternal|usicrUSICLK|usicrUSITC)
+		m.usi.WriteUSICR(0, usiTwo|usiExternal|usicrUSICLK|usicrUSITC)
+	}
+	data := m.usi.ReadUSIDR(0)
+	m.usi.WriteUSIDR(0, 0xff)
+	m.port.WriteDDR(0, m.port.Direction()|usiSDA)
+	return data
+}
+
+func (m *usiMaster) write(data byte) bool {
+	m.usi.WriteUSIDR(0, data)
+	m.transfer(0xf0)
+	m.port.WriteDDR(0, m.port.Direction()&^usiSDA)
+	return m.transfer(0xfe)&1 == 0
+}
+
+func (m *usiMaster) read(last bool) byte {
+	m.port.WriteDDR(0, m.port.Direction()&^usiSDA)
+	data := m.transfer(0xf0)
+	if last {
+		m.usi.WriteUSIDR(0, 0xff)
+	} else {
+		m.usi.WriteUSIDR(0, 0x00)
+	}
+	m.transfer(0xfe)
+	return data
+}
+
+func TestUSITwoWire(t *testing.T) {
+	usi, port, _ := newTestUSI()
+	bus := NewI2CBus()
+	target := &regTarget{}
+	bus.Attach(0x50, target)
+	usi.AttachI2C(bus)
+	m := &usiMaster{usi, port}
+	port.WritePORT(0, usiSDA|usiSCL)
+	port.WriteDDR(0, usiSDA|usiSCL)
+	usi.WriteUSIDR(0, 0xff)
+	usi.WriteUSICR(0, usiTwo|usiExternal|usicrUSICLK)
+	usi.WriteUSISR(0, 0xf0)
+
+	m.start()
+	if usi.ReadUSISR(0)&usisrUSISIF == 0 {
+		t.Error("START not detected")
+	}
+	if !m.write(0x50<<1) || !m.write(0x03) || !m.write(0x42) ||
+		!m.write(0x43) {
+		t.Fatal("Write not acknowledged")
+	}
+	m.stop()
+	if usi.ReadUSISR(0)&usisrUSIPF == 0 || target.stopped != 1 {
+		t.Error("STOP not detected")
+	}
+	if target.regs[3] != 0x42 || target.regs[4] != 0x43 {
+		t.Error("Bad target registers", target.regs)
+	}
+
+	m.start()
+	if m.write(0x51 << 1) {
+		t.Error("Missing target acknowledged")
+	}
+	m.stop()
+
+	m.start()
+	m.write(0x50 << 1)
+	m.write(0x03)
+	m.start()
+	m.write(0x50<<1 | 1)
+	if a, b := m.read(false), m.read(true); a != 0x42 || b != 0x43 {
+		t.Errorf("Read %02x %02x", a, b)
+	}
+	m.stop()
+	if target.stopped != 2 {
+		t.Error("Bad STOP count", target.stopped)
+	}
+}
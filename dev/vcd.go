@@ -0,0 +1,214 @@
+package dev
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+// A VCD records signals as a Value Change Dump, with timestamps taken
+// from the system clock. All variables must be added before the first
+// value changes; their initial values are dumped at time zero.
+type VCD struct {
+	w         *bufio.Writer
+	closer    io.Closer
+	clock     *Clock
+	timescale string
+	perSec    int64
+	vars      []*VCDVar
+	started   bool
+	time      int64
+	cpu       *core.Cpu
+	cpuVars   []*VCDVar
+	err       error
+}
+
+// A VCDVar is one signal in a VCD.
+type VCDVar struct {
+	vcd   *VCD
+	id    string
+	name  string
+	width int
+	value uint64
+}
+
+// NewVCD writes a VCD to w for a system timed by clock.
+func NewVCD(w io.Writer, clock *Clock) *VCD {
+	vcd := &VCD{w: bufio.NewWriter(w), clock: clock}
+	// use the coarsest timescale that makes a cycle at the starting
+	// frequency a whole number of units; otherwise the finest, where
+	// rounding hardly matters
+	units := []string{"1ns", "100ps", "10ps", "1ps", "100fs", "10fs"}
+	hz := int64(clock.Hertz())
+	vcd.perSec = 1000000000
+	for i, unit := range units {
+		vcd.timescale = unit
+		if i == len(units)-1 || (hz > 0 && vcd.perSec%hz == 0) {
+			break
+		}
+		vcd.perSec *= 10
+	}
+	return vcd
+}
+
+func CreateVCD(path string, clock *Clock) (*VCD, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	vcd := NewVCD(file, clock)
+	vcd.closer = file
+	return vcd, nil
+}
+
+// AddVar adds a signal of width bits, with an initial value of zero.
+func (vcd *VCD) AddVar(name string, width int) *VCDVar {
+	if vcd.started {
+		panic("VCD variable added after start")
+	}
+	id := ""
+	for n := len(vcd.vars); ; n /= 94 {
+		id += string(rune('!' + n%94))
+		if n < 94 {
+			break
+		}
+	}
+	v := &VCDVar{vcd: vcd, id: id, name: name, width: width}
+	vcd.vars = append(vcd.vars, v)
+	return v
+}
+
+// AddPin records the level of a port pin.
+func (vcd *VCD) AddPin(name string, port *Port, pin int) *VCDVar {
+	v := vcd.AddVar(name, 1)
+	v.value = uint64(port.Levels()>>uint(pin)) & 1
+	port.OnChange(func(levels, changed byte) {
+		v.Set(uint64(levels>>uint(pin)) & 1)
+	})
+	return v
+}
+
+// AddPort records the levels of all pins of a port as one vector.
+func (vcd *VCD) AddPort(name string, port *Port) *VCDVar {
+	v := vcd.AddVar(name, 8)
+	v.value = uint64(port.Levels())
+	port.OnChange(func(levels, changed byte) {
+		v.Set(uint64(levels))
+	})
+	return v
+}
+
+// TraceWrite records the values written to an I/O register, and
+// returns a writer wrapping w.
+func (vcd *VCD) TraceWrite(name string, w core.MemWrite) core.MemWrite {
+	v := vcd.AddVar(name, 8)
+	return func(addr core.Addr, val byte) {
+		v.Set(uint64(val))
+		w(addr, val)
+	}
+}
+
+var sregNames = []string{"C", "Z", "N", "V", "S", "H", "T", "I"}
+
+// AddCPU records PC (as a word address), SP and the SREG flags, which
+// are sampled by SampleCPU.
+func (vcd *VCD) AddCPU(cpu *core.Cpu) {
+	vcd.cpu = cpu
+	vcd.cpuVars = append(vcd.cpuVars, vcd.AddVar("PC", 22),
+		vcd.AddVar("SP", 16))
+	for _, name := range sregNames {
+		vcd.cpuVars = append(vcd.cpuVars, vcd.AddVar("SREG_"+name, 1))
+	}
+}
+
+// SampleCPU records changes to the state added by AddCPU; call it after
+// every step.
+func (vcd *VCD) SampleCPU() {
+	if vcd.cpu == nil {
+		return
+	}
+	vcd.cpuVars[0].Set(uint64(vcd.cpu.GetPC()))
+	vcd.cpuVars[1].Set(uint64(vcd.cpu.GetSP()))
+	sreg := vcd.cpu.ByteFromSreg()
+	for i := range sregNames {
+		vcd.cpuVars[2+i].Set(uint64(sreg>>uint(i)) & 1)
+	}
+}
+
+// Set changes the value of the signal at the current cycle.
+func (v *VCDVar) Set(val uint64) {
+	vcd := v.vcd
+	vcd.start()
+	if val == v.value {
+		return
+	}
+	v.value = val
+	if t := vcd.now(); t != vcd.time {
+		vcd.time = t
+		fmt.Fprintf(vcd.w, "#%d\n", t)
+	}
+	v.dump()
+}
+
+// now returns the current time in timescale units.
+func (vcd *VCD) now() int64 {
+	return int64(math.Round(vcd.clock.Seconds() * float64(vcd.perSec)))
+}
+
+func (v *VCDVar) dump() {
+	if v.width == 1 {
+		fmt.Fprintf(v.vcd.w, "%d%s\n", v.value, v.id)
+	} else {
+		fmt.Fprintf(v.vcd.w, "b%s %s\n", strconv.FormatUint(v.value, 2), v.id)
+	}
+}
+
+func (vcd *VCD) start() {
+	if vcd.started {
+		return
+	}
+	vcd.started = true
+	fmt.Fprintf(vcd.w, "$version avr-sim $end\n$timescale %s $end\n",
+		vcd.timescale)
+	fmt.Fprintf(vcd.w, "$scope module avr $end\n")
+	for _, v := range vcd.vars {
+		fmt.Fprintf(vcd.w, "$var wire %d %s %s $end\n", v.width, v.id, v.name)
+	}
+	fmt.Fprintf(vcd.w, "$upscope $end\n$enddefinitions $end\n")
+	fmt.Fprintf(vcd.w, "#%d\n$dumpvars\n", vcd.time)
+	for _, v := range vcd.vars {
+		v.dump()
+	}
+	fmt.Fprintf(vcd.w, "$end\n")
+}
+
+func (vcd *VCD) Flush() error {
+	vcd.start()
+	if err := vcd.w.Flush(); vcd.err == nil {
+		vcd.err = err
+	}
+	return vcd.err
+}
+
+// Close writes a final timestamp for the current cycle, so viewers
+// show the last values up to the end of the run.
+func (vcd *VCD) Close() error {
+	vcd.start()
+	if t := vcd.now(); t != vcd.time {
+		vcd.time = t
+		fmt.Fprintf(vcd.w, "#%d\n", t)
+	}
+	vcd.Flush()
+	if vcd.closer != nil {
+		if err := vcd.closer.Close(); vcd.err == nil {
+			vcd.err = err
+		}
+		vcd.closer = nil
+	}
+	return vcd.err
+}
@@ -0,0 +1,93 @@
+package dev
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func TestVCD(t *testing.T) {
+	var out bytes.Buffer
+	timer := core.NewTimer()
+	vcd := NewVCD(&out, NewClock(timer, FixedClock(16000000)))
+	port := NewPort()
+	vcd.AddPin("PB1", port, 1)
+	var reg byte
+	write := vcd.TraceWrite("OCR1A", func(addr core.Addr, val byte) {
+		reg = val
+	})
+
+	timer.Tick(2)
+	port.WriteDDR(0, 0x02)
+	port.WritePORT(0, 0x02)
+	write(0, 0x0a)
+	timer.Tick(3)
+	port.WritePORT(0, 0x00)
+	port.WritePORT(0, 0x01)
+	timer.Tick(1)
+	if err := vcd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if reg != 0x0a {
+		t.Error("Write not passed through")
+	}
+
+	expect := `$version avr-sim $end
+$timescale 100ps $end
+$scope module avr $end
+$var wire 1 ! PB1 $end
+$var wire 8 " OCR1A $end
+$upscope $end
+$enddefinitions $end
+#0
+$dumpvars
+0!
+b0 "
+$end
+#1250
+1!
+b1010 "
+#3125
+0!
+#3750
+`
+	if out.String() != expect {
+		t.Errorf("Bad VCD output:\n%s", out.String())
+	}
+}
+
+func TestVCDClockChange(t *testing.T) {
+	var out bytes.Buffer
+	timer := core.NewTimer()
+	clk := NewClock(timer, FixedClock(1000000))
+	vcd := NewVCD(&out, clk)
+	v := vcd.AddVar("X", 1)
+	timer.Tick(10)
+	clk.SetSource(FixedClock(4000000))
+	timer.Tick(10)
+	v.Set(1)
+	if vcd.time != 12500 {
+		t.Error("Bad time after clock change", vcd.time)
+	}
+}
+
+func TestVCDTimescale(t *testing.T) {
+	for _, c := range []struct {
+		hertz     int
+		timescale string
+	}{
+		{1000000, "1ns"},
+		{8000000, "1ns"},
+		{16000000, "100ps"},
+		{3686400, "10fs"},
+		{18432000, "10fs"},
+		{0, "10fs"},
+	} {
+		clk := NewClock(core.NewTimer(), FixedClock(c.hertz))
+		vcd := NewVCD(&bytes.Buffer{}, clk)
+		if vcd.timescale != c.timescale {
+			t.Errorf("%d Hz: got %s", c.hertz, vcd.timescale)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package dev
+
+import (
+	"time"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+const (
+	wdtcrWDCE = 0x10
+	wdtcrWDE  = 0x08
+	wdtcrWDP  = 0x07
+)
+
+// The shortest timeout, 16K cycles of the 1MHz watchdog oscillator;
+// each step of WDP2:0 doubles it.
+const wdtTimeout = 16 * 1024 * time.Microsecond
+
+// A Watchdog is the watchdog timer of classic megas: while enabled, it
+// calls onReset unless WDR restarts it within the timeout set by
+// WDP2:0. WDE can only be cleared within four cycles of writing WDCE
+// and WDE together.
+type Watchdog struct {
+	timer   *core.Timer
+	clock   ClockSource
+	onReset func()
+	forced  bool
+	wdtcr   byte
+	wdce    *core.Counter
+	timeout *core.Counter
+}
+
+// NewWatchdog returns a watchdog for a CPU clocked by clock, which the
+// watchdog oscillator does not depend on.
+func NewWatchdog(timer *core.Timer, clock ClockSource,
+	onReset func()) *Watchdog {
+
+	return &Watchdog{timer: timer, clock: clock, onReset: onReset}
+}
+
+// Force keeps the watchdog enabled, as the WDTON fuse does; WDP2:0 can
+// then only be changed with the timed sequence.
+func (wd *Watchdog) Force(forced bool) {
+	wd.forced = forced
+	wd.restart()
+}
+
+func (wd *Watchdog) Enabled() bool {
+	return wd.forced || (wd.wdtcr&wdtcrWDE) != 0
+}
+
+// Reset returns WDTCR to its value after a system reset.
+func (wd *Watchdog) Reset() {
+	wd.wdtcr = 0
+	if wd.wdce != nil {
+		wd.timer.RemoveCounter(wd.wdce)
+		wd.wdce = nil
+	}
+	wd.restart()
+}
+
+// WDR restarts the timeout; it is the action of the WDR instruction.
+func (wd *Watchdog) WDR() {
+	wd.restart()
+}
+
+func (wd *Watchdog) restart() {
+	if wd.timeout != nil {
+		wd.timer.RemoveCounter(wd.timeout)
+		wd.timeout = nil
+	}
+	if !wd.Enabled() {
+		return
+	}
+	cycles := cyclesAt(wd.clock.Hertz(), wdtTimeout<<(wd.wdtcr&wdtcrWDP))
+	wd.timeout = core.NewCounter(cycles, func() bool {
+		wd.timeout = nil
+		wd.onReset()
+		return false
+	})
+	wd.timer.AddCounter(wd.timeout)
+}
+
+func (wd *Watchdog) ReadWDTCR(addr core.Addr) byte {
+	val := wd.wdtcr
+	if wd.forced {
+		val |= wdtcrWDE
+	}
+	return val
+}
+
+func (wd *Watchdog) WriteWDTCR(addr core.Addr, val byte) {
+	old := wd.wdtcr
+	change := wd.wdce != nil
+	wde := val & wdtcrWDE
+	if !change && wd.Enabled() {
+		wde = wdtcrWDE
+	}
+	wdp := val & wdtcrWDP
+	if wd.forced && !change {
+		wdp = old & wdtcrWDP
+	}
+	wd.wdtcr = (old & wdtcrWDCE) | wde | wdp
+
+	if (val & (wdtcrWDCE | wdtcrWDE)) == wdtcrWDCE|wdtcrWDE {
+		wd.wdtcr |= wdtcrWDCE
+		if wd.wdce != nil {
+			wd.timer.RemoveCounter(wd.wdce)
+		}
+		wd.wdce = core.NewCounter(4, func() bool {
+			wd.wdtcr &^= wdtcrWDCE
+			wd.wdce = nil
+			return false
+		})
+		wd.timer.AddCounter(wd.wdce)
+	}
+
+	if (old^wd.wdtcr)&(wdtcrWDE|wdtcrWDP) != 0 {
+		wd.restart()
+	}
+}
@@ -0,0 +1,82 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+// The shortest timeout at 1MHz.
+const wdtCycles = 16 * 1024
+
+func newTestWatchdog() (*Watchdog, *core.Timer, *int) {
+	timer := core.NewTimer()
+	resets := 0
+	wd := NewWatchdog(timer, FixedClock(1000000), func() { resets++ })
+	return wd, timer, &resets
+}
+
+func TestWatchdogTimeout(t *testing.T) {
+	wd, timer, resets := newTestWatchdog()
+	timer.Tick(wdtCycles)
+	if *resets != 0 {
+		t.Fatal("Reset while disabled")
+	}
+	wd.WriteWDTCR(0, wdtcrWDE|0x01)
+	timer.Tick(2*wdtCycles - 1)
+	wd.WDR()
+	timer.Tick(2*wdtCycles - 1)
+	if *resets != 0 {
+		t.Fatal("Reset after WDR")
+	}
+	timer.Tick(1)
+	if *resets != 1 {
+		t.Fatal("No reset after timeout")
+	}
+}
+
+func TestWatchdogDisable(t *testing.T) {
+	wd, timer, resets := newTestWatchdog()
+	wd.WriteWDTCR(0, wdtcrWDE)
+	wd.WriteWDTCR(0, 0)
+	if !wd.Enabled() {
+		t.Error("Disabled without WDCE")
+	}
+	wd.WriteWDTCR(0, wdtcrWDCE|wdtcrWDE)
+	timer.Tick(4)
+	wd.WriteWDTCR(0, 0)
+	if !wd.Enabled() {
+		t.Error("Disabled after WDCE timed out")
+	}
+	wd.WriteWDTCR(0, wdtcrWDCE|wdtcrWDE)
+	timer.Tick(3)
+	wd.WriteWDTCR(0, 0)
+	if wd.Enabled() {
+		t.Error("Not disabled")
+	}
+	timer.Tick(wdtCycles)
+	if *resets != 0 {
+		t.Error("Reset while disabled")
+	}
+}
+
+func TestWatchdogForced(t *testing.T) {
+	wd, timer, resets := newTestWatchdog()
+	wd.Force(true)
+	if wd.ReadWDTCR(0)&wdtcrWDE == 0 {
+		t.Error("WDE clear while forced")
+	}
+	wd.WriteWDTCR(0, 0x07)
+	if wd.ReadWDTCR(0)&wdtcrWDP != 0 {
+		t.Error("WDP changed without WDCE")
+	}
+	wd.WriteWDTCR(0, wdtcrWDCE|wdtcrWDE)
+	wd.WriteWDTCR(0, 0x01)
+	if !wd.Enabled() || wd.ReadWDTCR(0)&wdtcrWDP != 0x01 {
+		t.Error("Bad timed sequence", wd.ReadWDTCR(0))
+	}
+	timer.Tick(2 * wdtCycles)
+	if *resets != 1 {
+		t.Error("No reset")
+	}
+}
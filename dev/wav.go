@@ -0,0 +1,173 @@
+package dev
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+const (
+	wavPCM   = 1
+	wavFloat = 3
+)
+
+type wavData struct {
+	rate     int
+	channels int
+	samples  []float64 // interleaved, -1.0 to 1.0
+}
+
+func readWAV(r io.Reader) (*wavData, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 12 || string(buf[0:4]) != "RIFF" ||
+		string(buf[8:12]) != "WAVE" {
+		return nil, errors.New("not a WAV file")
+	}
+
+	var format, bits int
+	wav := &wavData{}
+	var data []byte
+	for pos := 12; pos+8 <= len(buf); {
+		id := string(buf[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(buf[pos+4:]))
+		pos += 8
+		if pos+size > len(buf) {
+			size = len(buf) - pos
+		}
+		chunk := buf[pos : pos+size]
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("bad WAV format chunk")
+			}
+			format = int(binary.LittleEndian.Uint16(chunk[0:]))
+			wav.channels = int(binary.LittleEndian.Uint16(chunk[2:]))
+			wav.rate = int(binary.LittleEndian.Uint32(chunk[4:]))
+			bits = int(binary.LittleEndian.Uint16(chunk[14:]))
+		case "data":
+			data = chunk
+		}
+		pos += size + size&1
+	}
+	if wav.channels == 0 || wav.rate == 0 || data == nil {
+		return nil, errors.New("incomplete WAV file")
+	}
+
+	switch {
+	case format == wavPCM && bits == 8:
+		for _, b := range data {
+			wav.samples = append(wav.samples, (float64(b)-128)/128)
+		}
+	case format == wavPCM && bits == 16:
+		for i := 0; i+2 <= len(data); i += 2 {
+			s := int16(binary.LittleEndian.Uint16(data[i:]))
+			wav.samples = append(wav.samples, float64(s)/32768)
+		}
+	case format == wavFloat && bits == 32:
+		for i := 0; i+4 <= len(data); i += 4 {
+			s := math.Float32frombits(binary.LittleEndian.Uint32(data[i:]))
+			wav.samples = append(wav.samples, float64(s))
+		}
+	default:
+		return nil, errors.New("unsupported WAV sample format")
+	}
+	wav.samples = wav.samples[:len(wav.samples)/wav.channels*wav.channels]
+	return wav, nil
+}
+
+// A WAVWriter is an AudioBackend that writes 16-bit mono PCM.
+type WAVWriter struct {
+	w      io.WriteSeeker
+	closer io.Closer
+	rate   int
+	size   int
+	buf    []byte
+}
+
+// NewWAVWriter writes a WAV file to w; the header is completed when
+// the writer is closed.
+func NewWAVWriter(w io.WriteSeeker, rate int) (*WAVWriter, error) {
+	wav := &WAVWriter{w: w, rate: rate}
+	if err := wav.writeHeader(); err != nil {
+		return nil, err
+	}
+	return wav, nil
+}
+
+// CreateWAV creates the file at path and writes a WAV file to it.
+func CreateWAV(path string, rate int) (*WAVWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	wav, err := NewWAVWriter(file, rate)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	wav.closer = file
+	return wav, nil
+}
+
+func (wav *WAVWriter) writeHeader() error {
+	var hdr [44]byte
+	copy(hdr[0:], "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(36+wav.size))
+	copy(hdr[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(hdr[16:], 16)
+	binary.LittleEndian.PutUint16(hdr[20:], wavPCM)
+	binary.LittleEndian.PutUint16(hdr[22:], 1)
+	binary.LittleEndian.PutUint32(hdr[24:], uint32(wav.rate))
+	binary.LittleEndian.PutUint32(hdr[28:], uint32(2*wav.rate))
+	binary.LittleEndian.PutUint16(hdr[32:], 2)
+	binary.LittleEndian.PutUint16(hdr[34:], 16)
+	copy(hdr[36:], "data")
+	binary.LittleEndian.PutUint32(hdr[40:], uint32(wav.size))
+	_, err := wav.w.Write(hdr[:])
+	return err
+}
+
+func (wav *WAVWriter) SampleRate() int {
+	return wav.rate
+}
+
+func (wav *WAVWriter) WriteSamples(samples []float32) error {
+	wav.buf = wav.buf[:0]
+	for _, s := range samples {
+		v := int(math.Floor(float64(s)*32768 + 0.5))
+		if v > math.MaxInt16 {
+			v = math.MaxInt16
+		} else if v < math.MinInt16 {
+			v = math.MinInt16
+		}
+		wav.buf = append(wav.buf, byte(v), byte(v>>8))
+	}
+	n, err := wav.w.Write(wav.buf)
+	wav.size += n
+	return err
+}
+
+// Close completes the header and closes the file if the writer was
+// made by CreateWAV.
+func (wav *WAVWriter) Close() error {
+	_, err := wav.w.Seek(0, io.SeekStart)
+	if err == nil {
+		err = wav.writeHeader()
+	}
+	if err == nil {
+		_, err = wav.w.Seek(0, io.SeekEnd)
+	}
+	if wav.closer != nil {
+		if cerr := wav.closer.Close(); err == nil {
+			err = cerr
+		}
+		wav.closer = nil
+	}
+	return err
+}
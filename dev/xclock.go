@@ -0,0 +1,241 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+// Clock sources, as selected by SCLKSEL and as bit numbers in the OSC
+// CTRL and STATUS registers.
+const (
+	clkRC2M = iota
+	clkRC32M
+	clkRC32K
+	clkXOSC
+	clkPLL
+)
+
+const (
+	clkSCLKSEL   = 0x07
+	clkPSADIV    = 0x7c
+	clkPSBCDIV   = 0x03
+	clkLOCK      = 0x01
+	oscPLLSRC    = 0xc0
+	oscPLLFAC    = 0x1f
+	oscPLLRC2M   = 0x00
+	oscPLLRC32M  = 0x80
+	oscPLLXOSC   = 0xc0
+	oscCtrlMask  = 0x1f
+	oscSourceCnt = 5
+)
+
+// Oscillator startup times in microseconds (approximate)
+var oscStartupUs = [oscSourceCnt]int64{10, 10, 1000, 1000, 64}
+
+var oscHertz = [3]int{2000000, 32000000, 32768}
+
+// An XClock is the xmega clock system: the CLK module, which selects
+// the system clock and its prescalers, and the OSC module, which
+// enables the oscillators and the PLL. Oscillators become ready a
+// fixed time after being enabled. Calibration, the DFLLs and clock
+// failure detection are not modelled.
+type XClock struct {
+	// XOSCHertz is the frequency of the external oscillator or
+	// crystal; it cannot be enabled when zero.
+	XOSCHertz int
+	timer     *core.Timer
+	ctrl      byte
+	psctrl    byte
+	lock      byte
+	rtcctrl   byte
+	oscCtrl   byte
+	oscStatus byte
+	xoscCtrl  byte
+	pllCtrl   byte
+	startups  [oscSourceCnt]*core.Counter
+}
+
+// NewXClock returns a clock system running from the 2MHz RC oscillator,
+// as after reset.
+func NewXClock(timer *core.Timer) *XClock {
+	return &XClock{
+		timer:     timer,
+		oscCtrl:   1 << clkRC2M,
+		oscStatus: 1 << clkRC2M,
+	}
+}
+
+func (clk *XClock) ReadCTRL(addr core.Addr) byte {
+	return clk.ctrl
+}
+
+// The system clock can only be switched to an oscillator that is
+// ready. CTRL is protected by CCP.
+func (clk *XClock) WriteCTRL(addr core.Addr, val byte) {
+	sel := val & clkSCLKSEL
+	if clk.locked() || sel >= oscSourceCnt ||
+		(clk.oscStatus&(1<<sel)) == 0 {
+		return
+	}
+	clk.ctrl = sel
+}
+
+func (clk *XClock) ReadPSCTRL(addr core.Addr) byte {
+	return clk.psctrl
+}
+
+// PSCTRL is protected by CCP.
+func (clk *XClock) WritePSCTRL(addr core.Addr, val byte) {
+	if clk.locked() {
+		return
+	}
+	if diva := (val & clkPSADIV) >> 2; diva != 0 && (diva&1) == 0 ||
+		diva > 17 {
+		return
+	}
+	clk.psctrl = val & (clkPSADIV | clkPSBCDIV)
+}
+
+func (clk *XClock) ReadLOCK(addr core.Addr) byte {
+	return clk.lock
+}
+
+// LOCK is protected by CCP, and once set is only cleared by a reset.
+func (clk *XClock) WriteLOCK(addr core.Addr, val byte) {
+	clk.lock |= val & clkLOCK
+}
+
+func (clk *XClock) locked() bool {
+	return (clk.lock & clkLOCK) != 0
+}
+
+func (clk *XClock) ReadRTCCTRL(addr core.Addr) byte {
+	return clk.rtcctrl
+}
+
+func (clk *XClock) WriteRTCCTRL(addr core.Addr, val byte) {
+	clk.rtcctrl = val & 0x0f
+}
+
+func (clk *XClock) ReadOSCCTRL(addr core.Addr) byte {
+	return clk.oscCtrl
+}
+
+// The oscillator used for the system clock, and the PLL's source while
+// it is enabled, cannot be disabled.
+func (clk *XClock) WriteOSCCTRL(addr core.Addr, val byte) {
+	val &= oscCtrlMask
+	keep := byte(1) << clk.ctrl
+	if (clk.oscCtrl & (1 << clkPLL)) != 0 {
+		if src := clk.pllSource(); src >= 0 {
+			keep |= 1 << uint(src)
+		}
+	}
+	if clk.XOSCHertz == 0 {
+		val &^= 1 << clkXOSC
+	}
+	val |= clk.oscCtrl & keep
+	for src := 0; src < oscSourceCnt; src++ {
+		bit := byte(1) << uint(src)
+		switch {
+		case (val&bit) != 0 && (clk.oscCtrl&bit) == 0:
+			clk.start(src)
+		case (val&bit) == 0 && (clk.oscCtrl&bit) != 0:
+			clk.stop(src)
+		}
+	}
+	clk.oscCtrl = val
+}
+
+func (clk *XClock) ReadOSCSTATUS(addr core.Addr) byte {
+	return clk.oscStatus
+}
+
+func (clk *XClock) WriteOSCSTATUS(addr core.Addr, val byte) {
+}
+
+func (clk *XClock) ReadXOSCCTRL(addr core.Addr) byte {
+	return clk.xoscCtrl
+}
+
+func (clk *XClock) WriteXOSCCTRL(addr core.Addr, val byte) {
+	if (clk.oscCtrl & (1 << clkXOSC)) == 0 {
+		clk.xoscCtrl = val
+	}
+}
+
+func (clk *XClock) ReadPLLCTRL(addr core.Addr) byte {
+	return clk.pllCtrl
+}
+
+// PLLCTRL can only be changed while the PLL is disabled.
+func (clk *XClock) WritePLLCTRL(addr core.Addr, val byte) {
+	if (clk.oscCtrl & (1 << clkPLL)) == 0 {
+		clk.pllCtrl = val & (oscPLLSRC | oscPLLFAC)
+	}
+}
+
+func (clk *XClock) start(src int) {
+	cycles := oscStartupUs[src]*int64(clk.Hertz())/1000000 + 1
+	clk.startups[src] = core.NewCounter(cycles, func() bool {
+		clk.startups[src] = nil
+		clk.oscStatus |= 1 << uint(src)
+		return false
+	})
+	clk.timer.AddCounter(clk.startups[src])
+}
+
+func (clk *XClock) stop(src int) {
+	if clk.startups[src] != nil {
+		clk.timer.RemoveCounter(clk.startups[src])
+		clk.startups[src] = nil
+	}
+	clk.oscStatus &^= 1 << uint(src)
+}
+
+// pllSource returns the oscillator feeding the PLL, or -1.
+func (clk *XClock) pllSource() int {
+	switch clk.pllCtrl & oscPLLSRC {
+	case oscPLLRC2M:
+		return clkRC2M
+	case oscPLLRC32M:
+		return clkRC32M
+	case oscPLLXOSC:
+		return clkXOSC
+	}
+	return -1
+}
+
+func (clk *XClock) sourceHertz(src int) int {
+	switch src {
+	case clkXOSC:
+		return clk.XOSCHertz
+	case clkPLL:
+		in := clk.pllSource()
+		if in < 0 {
+			return 0
+		}
+		hz := clk.sourceHertz(in)
+		if in == clkRC32M {
+			hz /= 4
+		}
+		return hz * int(clk.pllCtrl&oscPLLFAC)
+	}
+	return oscHertz[src]
+}
+
+// Hertz returns the CPU and peripheral clock frequency.
+func (clk *XClock) Hertz() int {
+	hz := clk.sourceHertz(int(clk.ctrl))
+	if diva := (clk.psctrl & clkPSADIV) >> 2; diva != 0 {
+		hz >>= (diva + 1) / 2
+	}
+	switch clk.psctrl & clkPSBCDIV {
+	case 1:
+		hz /= 2
+	case 2:
+		hz /= 4
+	case 3:
+		hz /= 4
+	}
+	return hz
+}
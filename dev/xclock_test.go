@@ -0,0 +1,52 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func TestXClock(t *testing.T) {
+	timer := core.NewTimer()
+	clk := NewXClock(timer)
+	if clk.Hertz() != 2000000 {
+		t.Error("Bad reset frequency", clk.Hertz())
+	}
+	clk.WriteCTRL(0, clkRC32M)
+	if clk.ReadCTRL(0) != clkRC2M {
+		t.Error("Switched to disabled oscillator")
+	}
+	clk.WriteOSCCTRL(0, 1<<clkRC32M)
+	if clk.ReadOSCCTRL(0) != 0x03 {
+		t.Error("System clock source disabled")
+	}
+	timer.Tick(20)
+	if clk.ReadOSCSTATUS(0) != 0x01 {
+		t.Error("Oscillator ready early")
+	}
+	timer.Tick(1)
+	if clk.ReadOSCSTATUS(0) != 0x03 {
+		t.Error("Oscillator not ready")
+	}
+	clk.WriteCTRL(0, clkRC32M)
+	clk.WritePSCTRL(0, 0x03<<2|0x01)
+	if clk.Hertz() != 4000000 {
+		t.Error("Bad prescaled frequency", clk.Hertz())
+	}
+
+	// PLL from RC32M/4, times 6
+	clk.WritePLLCTRL(0, oscPLLRC32M|6)
+	clk.WriteOSCCTRL(0, 1<<clkRC32M|1<<clkPLL)
+	timer.Tick(257)
+	clk.WriteLOCK(0, clkLOCK)
+	clk.WriteCTRL(0, clkPLL)
+	if clk.ReadCTRL(0) != clkRC32M {
+		t.Error("Locked CTRL changed")
+	}
+	clk.lock = 0
+	clk.WriteCTRL(0, clkPLL)
+	clk.WritePSCTRL(0, 0)
+	if clk.Hertz() != 48000000 {
+		t.Error("Bad PLL frequency", clk.Hertz())
+	}
+}
@@ -0,0 +1,205 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+// XPort register offsets
+const (
+	xportDIR      = 0x00
+	xportDIRSET   = 0x01
+	xportDIRCLR   = 0x02
+	xportDIRTGL   = 0x03
+	xportOUT      = 0x04
+	xportOUTSET   = 0x05
+	xportOUTCLR   = 0x06
+	xportOUTTGL   = 0x07
+	xportIN       = 0x08
+	xportINTCTRL  = 0x09
+	xportINT0MASK = 0x0a
+	xportINT1MASK = 0x0b
+	xportINTFLAGS = 0x0c
+	xportPINCTRL  = 0x10
+)
+
+// XPortSize is the size of a PORT module in the data space.
+const XPortSize = 0x20
+
+const (
+	pinctrlOPC    = 0x38
+	pinctrlISC    = 0x07
+	opcPullUp     = 0x18
+	iscBothEdges  = 0x00
+	iscRising     = 0x01
+	iscFalling    = 0x02
+	iscLevel      = 0x03
+	iscInputDisab = 0x07
+)
+
+// An XPort is an xmega PORT module, built on a Port. OUT only pulls an
+// input pin up when its PINnCTRL selects the pull-up; the other output
+// configurations, slew rate and inversion are not modelled.
+type XPort struct {
+	Port     *Port
+	intr     *core.Interrupts
+	pmic     *PMIC
+	vecs     [2]int
+	out      byte
+	intctrl  byte
+	masks    [2]byte
+	intflags byte
+	pinctrl  [8]byte
+}
+
+// NewXPort returns a PORT module with interrupt vectors vecInt0 and
+// vecInt1, whose levels are set in pmic.
+func NewXPort(intr *core.Interrupts, pmic *PMIC, vecInt0,
+	vecInt1 int) *XPort {
+
+	p := &XPort{
+		Port: NewPort(),
+		intr: intr,
+		pmic: pmic,
+		vecs: [2]int{vecInt0, vecInt1},
+	}
+	for i := range p.vecs {
+		flag := byte(1) << uint(i)
+		intr.SetAck(p.vecs[i], func() {
+			p.intflags &^= flag
+			p.sense(p.Port.Levels(), 0)
+		})
+	}
+	p.Port.OnChange(p.sense)
+	return p
+}
+
+// Read reads the register at offset addr within the module.
+func (p *XPort) Read(addr core.Addr) byte {
+	switch off := addr & (XPortSize - 1); {
+	case off <= xportDIRTGL:
+		return p.Port.Direction()
+	case off <= xportOUTTGL:
+		return p.out
+	case off == xportIN:
+		return p.Port.Levels() &^ p.disabled()
+	case off == xportINTCTRL:
+		return p.intctrl
+	case off == xportINT0MASK, off == xportINT1MASK:
+		return p.masks[off-xportINT0MASK]
+	case off == xportINTFLAGS:
+		return p.intflags
+	case off >= xportPINCTRL && off < xportPINCTRL+8:
+		return p.pinctrl[off-xportPINCTRL]
+	}
+	return 0
+}
+
+// Write writes the register at offset addr within the module.
+func (p *XPort) Write(addr core.Addr, val byte) {
+	dir := p.Port.Direction()
+	switch off := addr & (XPortSize - 1); {
+	case off == xportDIR:
+		p.setDir(val)
+	case off == xportDIRSET:
+		p.setDir(dir | val)
+	case off == xportDIRCLR:
+		p.setDir(dir &^ val)
+	case off == xportDIRTGL:
+		p.setDir(dir ^ val)
+	case off == xportOUT:
+		p.setOut(val)
+	case off == xportOUTSET:
+		p.setOut(p.out | val)
+	case off == xportOUTCLR:
+		p.setOut(p.out &^ val)
+	case off == xportOUTTGL:
+		p.setOut(p.out ^ val)
+	case off == xportINTCTRL:
+		p.intctrl = val & 0x0f
+		p.updateIntr()
+	case off == xportINT0MASK, off == xportINT1MASK:
+		p.masks[off-xportINT0MASK] = val
+		p.sense(p.Port.Levels(), 0)
+	case off == xportINTFLAGS:
+		// flags are cleared by writing a one to them
+		p.intflags &^= val
+		p.sense(p.Port.Levels(), 0)
+	case off >= xportPINCTRL && off < xportPINCTRL+8:
+		p.pinctrl[off-xportPINCTRL] = val
+		p.update()
+	}
+}
+
+func (p *XPort) setDir(val byte) {
+	p.Port.WriteDDR(0, val)
+	p.update()
+}
+
+func (p *XPort) setOut(val byte) {
+	p.out = val
+	p.update()
+}
+
+// update drives the outputs, and pulls up the inputs configured for it.
+func (p *XPort) update() {
+	var pull byte
+	for i, ctrl := range p.pinctrl {
+		if (ctrl & pinctrlOPC) == opcPullUp {
+			pull |= 1 << uint(i)
+		}
+	}
+	dir := p.Port.Direction()
+	p.Port.WritePORT(0, (p.out&dir)|(pull&^dir))
+}
+
+// disabled returns the pins whose input buffers are disabled.
+func (p *XPort) disabled() byte {
+	var mask byte
+	for i, ctrl := range p.pinctrl {
+		if (ctrl & pinctrlISC) == iscInputDisab {
+			mask |= 1 << uint(i)
+		}
+	}
+	return mask
+}
+
+// sense sets the interrupt flags for pins whose level or change matches
+// their input sense configuration.
+func (p *XPort) sense(levels, changed byte) {
+	var match byte
+	for i, ctrl := range p.pinctrl {
+		bit := byte(1) << uint(i)
+		high := (levels & bit) != 0
+		switch ctrl & pinctrlISC {
+		case iscBothEdges:
+			if (changed & bit) != 0 {
+				match |= bit
+			}
+		case iscRising:
+			if (changed&bit) != 0 && high {
+				match |= bit
+			}
+		case iscFalling:
+			if (changed&bit) != 0 && !high {
+				match |= bit
+			}
+		case iscLevel:
+			if !high {
+				match |= bit
+			}
+		}
+	}
+	for i, mask := range p.masks {
+		if (match & mask) != 0 {
+			p.intflags |= 1 << uint(i)
+		}
+	}
+	p.updateIntr()
+}
+
+func (p *XPort) updateIntr() {
+	for i, vec := range p.vecs {
+		p.pmic.SetLevel(vec, (p.intctrl>>(2*uint(i)))&0x03)
+		p.intr.Set(vec, (p.intflags&(1<<uint(i))) != 0)
+	}
+}
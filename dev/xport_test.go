@@ -0,0 +1,54 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func TestXPort(t *testing.T) {
+	intr := core.NewInterrupts(2)
+	pmic := NewPMIC(intr, 2)
+	p := NewXPort(intr, pmic, 0, 1)
+	p.Write(xportDIRSET, 0x0f)
+	p.Write(xportOUTSET, 0x05)
+	p.Write(xportOUTTGL, 0x03)
+	if p.Read(xportOUT) != 0x06 || p.Read(xportIN)&0x0f != 0x06 {
+		t.Error("Bad output", p.Read(xportOUT), p.Read(xportIN))
+	}
+	p.Write(xportDIRCLR, 0x04)
+	if p.Read(xportIN)&0x04 != 0 {
+		t.Error("OUT pulled up an input")
+	}
+	p.Write(xportPINCTRL+2, opcPullUp)
+	if p.Read(xportIN)&0x04 == 0 {
+		t.Error("Pull-up not applied")
+	}
+
+	p.Write(xportPINCTRL+4, iscRising)
+	p.Write(xportPINCTRL+5, iscLevel)
+	p.Write(xportINT0MASK, 0x10)
+	p.Write(xportINT1MASK, 0x20)
+	p.Write(xportINTCTRL, 0x06)
+	if pmic.Level(0) != IntMed || pmic.Level(1) != IntLo {
+		t.Error("Bad interrupt levels")
+	}
+	p.Port.Drive(4, false)
+	if intr.IsSet(0) {
+		t.Error("Falling edge sensed as rising")
+	}
+	p.Port.Drive(4, true)
+	if p.Read(xportINTFLAGS) != 0x03 || !intr.IsSet(0) || !intr.IsSet(1) {
+		t.Error("Bad flags", p.Read(xportINTFLAGS))
+	}
+	intr.Ack(0)
+	p.Write(xportINTFLAGS, 0x02)
+	if p.Read(xportINTFLAGS) != 0x02 {
+		t.Error("Level flag cleared while pin is low")
+	}
+	p.Port.Drive(5, true)
+	p.Write(xportINTFLAGS, 0x02)
+	if p.Read(xportINTFLAGS) != 0 {
+		t.Error("Flags not cleared", p.Read(xportINTFLAGS))
+	}
+}
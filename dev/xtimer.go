@@ -0,0 +1,457 @@
+package dev
+
+import (
+	"github.com/edmccard/avr-sim/core"
+)
+
+// XTimer register offsets
+const (
+	tcCTRLA    = 0x00
+	tcCTRLB    = 0x01
+	tcCTRLC    = 0x02
+	tcCTRLD    = 0x03
+	tcCTRLE    = 0x04
+	tcINTCTRLA = 0x06
+	tcINTCTRLB = 0x07
+	tcCTRLFCLR = 0x08
+	tcCTRLFSET = 0x09
+	tcCTRLGCLR = 0x0a
+	tcCTRLGSET = 0x0b
+	tcINTFLAGS = 0x0c
+	tcTEMP     = 0x0f
+	tcCNT      = 0x20
+	tcPER      = 0x26
+	tcCC       = 0x28
+	tcPERBUF   = 0x36
+	tcCCBUF    = 0x38
+)
+
+// XTimerSize is the size of a TC module in the data space.
+const XTimerSize = 0x40
+
+const (
+	tcCLKSEL  = 0x0f
+	tcWGMODE  = 0x07
+	tcCCEN    = 0xf0
+	tcLUPD    = 0x02
+	tcCMD     = 0x0c
+	tcPERBV   = 0x01
+	tcOVFIF   = 0x01
+	tcERRIF   = 0x02
+	tcCCIF    = 0x10
+	tcCmdUpd  = 0x04
+	tcCmdRest = 0x08
+	tcCmdRes  = 0x0c
+)
+
+// Waveform generation modes
+const (
+	tcNormal = 0x00
+	tcFrq    = 0x01
+	tcSS     = 0x03
+)
+
+var tcPrescale = [8]int64{0, 1, 2, 4, 8, 64, 256, 1024}
+
+// An XTimer is an xmega 16-bit timer/counter: type 0 with four compare
+// channels, or type 1 with two. It supports the normal, frequency and
+// single-slope PWM modes, with buffered period and compare values;
+// the dual-slope modes count as single-slope, and event actions, event
+// clock sources and down-counting are not modelled.
+type XTimer struct {
+	timer    *core.Timer
+	intr     *core.Interrupts
+	pmic     *PMIC
+	vecOvf   int
+	vecErr   int
+	vecCC    int
+	channels int
+	ctrla    byte
+	ctrlb    byte
+	ctrld    byte
+	ctrle    byte
+	intctrla byte
+	intctrlb byte
+	ctrlf    byte
+	ctrlg    byte
+	intflags byte
+	temp     byte
+	cnt      uint16
+	per      uint16
+	perbuf   uint16
+	cc       [4]uint16
+	ccbuf    [4]uint16
+	oc       byte
+	port     *Port
+	pins     [4]byte
+	last     int64
+	frac     int64
+	event    *core.Counter
+}
+
+// NewXTimer returns a timer/counter with the given number of compare
+// channels; its overflow, error and compare vectors are consecutive,
+// starting at vecOvf.
+func NewXTimer(timer *core.Timer, intr *core.Interrupts, pmic *PMIC,
+	vecOvf int, channels int) *XTimer {
+
+	t := &XTimer{
+		timer:    timer,
+		intr:     intr,
+		pmic:     pmic,
+		vecOvf:   vecOvf,
+		vecErr:   vecOvf + 1,
+		vecCC:    vecOvf + 2,
+		channels: channels,
+		per:      0xffff,
+		perbuf:   0xffff,
+	}
+	vecs := []int{t.vecOvf, t.vecErr}
+	flags := []byte{tcOVFIF, tcERRIF}
+	for i := 0; i < channels; i++ {
+		vecs = append(vecs, t.vecCC+i)
+		flags = append(flags, tcCCIF<<uint(i))
+	}
+	for i, flag := range flags {
+		flag := flag
+		intr.SetAck(vecs[i], func() {
+			t.intflags &^= flag
+			t.updateIntr()
+		})
+	}
+	return t
+}
+
+// AttachOutputs connects the compare outputs to consecutive pins of
+// port, starting with channel A on pin.
+func (t *XTimer) AttachOutputs(port *Port, pin int) {
+	t.port = port
+	for i := 0; i < t.channels; i++ {
+		t.pins[i] = pinMask(pin + i)
+	}
+	t.updateOutputs()
+}
+
+// Read reads the register at offset addr within the module.
+func (t *XTimer) Read(addr core.Addr) byte {
+	off := addr & (XTimerSize - 1)
+	if off >= tcCNT {
+		return t.read16(off)
+	}
+	switch off {
+	case tcCTRLA:
+		return t.ctrla
+	case tcCTRLB:
+		return t.ctrlb
+	case tcCTRLC:
+		return t.oc
+	case tcCTRLD:
+		return t.ctrld
+	case tcCTRLE:
+		return t.ctrle
+	case tcINTCTRLA:
+		return t.intctrla
+	case tcINTCTRLB:
+		return t.intctrlb
+	case tcCTRLFCLR, tcCTRLFSET:
+		return t.ctrlf
+	case tcCTRLGCLR, tcCTRLGSET:
+		return t.ctrlg
+	case tcINTFLAGS:
+		t.sync()
+		return t.intflags
+	case tcTEMP:
+		return t.temp
+	}
+	return 0
+}
+
+// Write writes the register at offset addr within the module.
+func (t *XTimer) Write(addr core.Addr, val byte) {
+	off := addr & (XTimerSize - 1)
+	if off >= tcCNT {
+		t.write16(off, val)
+		return
+	}
+	t.sync()
+	switch off {
+	case tcCTRLA:
+		t.ctrla = val & tcCLKSEL
+	case tcCTRLB:
+		t.ctrlb = val & (tcCCEN | tcWGMODE)
+	case tcCTRLC:
+		t.oc = val & 0x0f
+	case tcCTRLD:
+		t.ctrld = val
+	case tcCTRLE:
+		t.ctrle = val & 0x03
+	case tcINTCTRLA:
+		t.intctrla = val & 0x0f
+	case tcINTCTRLB:
+		t.intctrlb = val
+	case tcCTRLFCLR:
+		t.ctrlf &^= val & (tcLUPD | 0x01)
+	case tcCTRLFSET:
+		t.ctrlf |= val & (tcLUPD | 0x01)
+		t.command(val & tcCMD)
+	case tcCTRLGCLR:
+		t.ctrlg &^= val
+	case tcCTRLGSET:
+		t.ctrlg |= val & 0x1f
+	case tcINTFLAGS:
+		// flags are cleared by writing a one to them
+		t.intflags &^= val
+	case tcTEMP:
+		t.temp = val
+	}
+	t.updateOutputs()
+	t.updateIntr()
+	t.schedule()
+}
+
+// reg16 returns the 16-bit register at off, ignoring the low bit.
+func (t *XTimer) reg16(off core.Addr) *uint16 {
+	off &^= 1
+	switch {
+	case off == tcCNT:
+		return &t.cnt
+	case off == tcPER:
+		return &t.per
+	case off >= tcCC && off < tcCC+8:
+		return &t.cc[(off-tcCC)/2]
+	case off == tcPERBUF:
+		return &t.perbuf
+	case off >= tcCCBUF:
+		return &t.ccbuf[(off-tcCCBUF)/2]
+	}
+	return nil
+}
+
+// Reading the low byte of a 16-bit register latches the high byte in
+// TEMP, which is returned by reading the high byte.
+func (t *XTimer) read16(off core.Addr) byte {
+	reg := t.reg16(off)
+	if reg == nil {
+		return 0
+	}
+	if (off & 1) != 0 {
+		return t.temp
+	}
+	t.sync()
+	t.temp = byte(*reg >> 8)
+	return byte(*reg)
+}
+
+// Writing the low byte of a 16-bit register stores it in TEMP, and
+// writing the high byte updates the whole register.
+func (t *XTimer) write16(off core.Addr, val byte) {
+	reg := t.reg16(off)
+	if reg == nil {
+		return
+	}
+	if (off & 1) == 0 {
+		t.temp = val
+		return
+	}
+	t.sync()
+	*reg = uint16(val)<<8 | uint16(t.temp)
+	switch off &^ 1 {
+	case tcPERBUF:
+		t.ctrlg |= tcPERBV
+	case tcCCBUF, tcCCBUF + 2, tcCCBUF + 4, tcCCBUF + 6:
+		t.ctrlg |= tcPERBV << (1 + uint(off-tcCCBUF)/2)
+	}
+	t.schedule()
+}
+
+func (t *XTimer) command(cmd byte) {
+	switch cmd {
+	case tcCmdUpd:
+		t.update()
+	case tcCmdRest:
+		t.cnt, t.frac = 0, 0
+		t.oc = 0
+	case tcCmdRes:
+		if t.ctrla == 0 {
+			t.reset()
+		}
+	}
+}
+
+func (t *XTimer) reset() {
+	t.ctrlb, t.ctrld, t.ctrle = 0, 0, 0
+	t.intctrla, t.intctrlb = 0, 0
+	t.ctrlf, t.ctrlg, t.intflags = 0, 0, 0
+	t.temp, t.cnt, t.oc = 0, 0, 0
+	t.per, t.perbuf = 0xffff, 0xffff
+	t.cc, t.ccbuf = [4]uint16{}, [4]uint16{}
+}
+
+func (t *XTimer) mode() byte {
+	mode := t.ctrlb & tcWGMODE
+	if mode > tcSS {
+		return tcSS
+	}
+	return mode
+}
+
+func (t *XTimer) enabled(ch int) bool {
+	return (t.ctrlb & (0x10 << uint(ch))) != 0
+}
+
+// top returns the value after which the counter returns to zero.
+func (t *XTimer) top() int {
+	top := int(t.per)
+	if t.mode() == tcFrq {
+		top = int(t.cc[0])
+	}
+	if int(t.cnt) > top {
+		top = 0xffff
+	}
+	return top
+}
+
+// nextEvent returns the number of ticks until the counter next wraps
+// or matches a compare register.
+func (t *XTimer) nextEvent() int64 {
+	cnt, top := int(t.cnt), t.top()
+	d := top - cnt + 1
+	for _, cc := range t.cc[:t.channels] {
+		if c := int(cc); c > cnt && c <= top && c-cnt < d {
+			d = c - cnt
+		}
+	}
+	return int64(d)
+}
+
+func (t *XTimer) prescale() int64 {
+	if t.ctrla >= 8 {
+		return 0
+	}
+	return tcPrescale[t.ctrla]
+}
+
+func (t *XTimer) sync() {
+	now := t.timer.GetCount()
+	elapsed := now - t.last
+	t.last = now
+	div := t.prescale()
+	if div == 0 {
+		return
+	}
+	total := t.frac + elapsed
+	t.frac = total % div
+	t.advance(total / div)
+}
+
+func (t *XTimer) advance(ticks int64) {
+	for ticks > 0 {
+		d := t.nextEvent()
+		if ticks < d {
+			t.cnt += uint16(ticks)
+			break
+		}
+		ticks -= d
+		if top := t.top(); int(t.cnt)+int(d) > top {
+			t.cnt = 0
+			t.wrap()
+		} else {
+			t.cnt += uint16(d)
+		}
+		for i := 0; i < t.channels; i++ {
+			if t.cnt == t.cc[i] {
+				t.intflags |= tcCCIF << uint(i)
+				t.compareOutput(i)
+			}
+		}
+		t.updateOutputs()
+	}
+	t.updateIntr()
+}
+
+// wrap handles the UPDATE condition at the end of a period.
+func (t *XTimer) wrap() {
+	t.intflags |= tcOVFIF
+	if (t.ctrlf & tcLUPD) == 0 {
+		t.update()
+	}
+	if t.mode() == tcSS {
+		t.oc |= t.ctrlb >> 4
+	}
+}
+
+// update copies the valid buffers to the period and compare registers.
+func (t *XTimer) update() {
+	if (t.ctrlg & tcPERBV) != 0 {
+		t.per = t.perbuf
+	}
+	for i := 0; i < t.channels; i++ {
+		if bv := byte(tcPERBV << uint(i+1)); (t.ctrlg & bv) != 0 {
+			t.cc[i] = t.ccbuf[i]
+		}
+	}
+	t.ctrlg &^= 0x1f
+}
+
+func (t *XTimer) compareOutput(i int) {
+	bit := byte(1) << uint(i)
+	switch t.mode() {
+	case tcFrq:
+		if i == 0 {
+			t.oc ^= bit
+		}
+	case tcSS:
+		t.oc &^= bit
+	}
+}
+
+func (t *XTimer) updateOutputs() {
+	if t.port == nil {
+		return
+	}
+	for i := 0; i < t.channels; i++ {
+		pin := t.pins[i]
+		if !t.enabled(i) {
+			t.port.ClearOverride(pin)
+			continue
+		}
+		var val byte
+		if (t.oc & (1 << uint(i))) != 0 {
+			val = pin
+		}
+		t.port.Override(pin, val)
+	}
+}
+
+func (t *XTimer) schedule() {
+	if t.event != nil {
+		t.timer.RemoveCounter(t.event)
+		t.event = nil
+	}
+	div := t.prescale()
+	if div == 0 {
+		return
+	}
+	cycles := t.nextEvent()*div - t.frac
+	if cycles < 1 {
+		cycles = 1
+	}
+	t.event = core.NewCounter(cycles, func() bool {
+		t.event = nil
+		t.sync()
+		t.schedule()
+		return false
+	})
+	t.timer.AddCounter(t.event)
+}
+
+func (t *XTimer) updateIntr() {
+	t.pmic.SetLevel(t.vecOvf, t.intctrla&0x03)
+	t.pmic.SetLevel(t.vecErr, (t.intctrla>>2)&0x03)
+	t.intr.Set(t.vecOvf, (t.intflags&tcOVFIF) != 0)
+	t.intr.Set(t.vecErr, (t.intflags&tcERRIF) != 0)
+	for i := 0; i < t.channels; i++ {
+		t.pmic.SetLevel(t.vecCC+i, (t.intctrlb>>(2*uint(i)))&0x03)
+		t.intr.Set(t.vecCC+i, (t.intflags&(tcCCIF<<uint(i))) != 0)
+	}
+}
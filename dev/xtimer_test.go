@@ -0,0 +1,97 @@
+package dev
+
+import (
+	"testing"
+
+	"github.com/edmccard/avr-sim/core"
+)
+
+func writeTC16(tc *XTimer, off core.Addr, val uint16) {
+	tc.Write(off, byte(val))
+	tc.Write(off+1, byte(val>>8))
+}
+
+func readTC16(tc *XTimer, off core.Addr) uint16 {
+	lo := tc.Read(off)
+	return uint16(tc.Read(off+1))<<8 | uint16(lo)
+}
+
+func TestXTimerCount(t *testing.T) {
+	timer := core.NewTimer()
+	intr := core.NewInterrupts(6)
+	pmic := NewPMIC(intr, 6)
+	tc := NewXTimer(timer, intr, pmic, 0, 4)
+	writeTC16(tc, tcPER, 999)
+	writeTC16(tc, tcCC+2, 300)
+	tc.Write(tcINTCTRLA, IntLo)
+	tc.Write(tcINTCTRLB, IntHi<<2)
+	tc.Write(tcCTRLA, 0x03)
+	timer.Tick(1200)
+	if n := readTC16(tc, tcCNT); n != 300 || !intr.IsSet(3) {
+		t.Error("Bad count or no compare B", n)
+	}
+	if pmic.Level(3) != IntHi || pmic.Level(0) != IntLo {
+		t.Error("Bad interrupt levels")
+	}
+	intr.Ack(3)
+	if tc.Read(tcINTFLAGS) != 0 {
+		t.Error("CCBIF not cleared by interrupt entry")
+	}
+
+	writeTC16(tc, tcPERBUF, 499)
+	if tc.Read(tcCTRLGSET) != tcPERBV || readTC16(tc, tcPER) != 999 {
+		t.Error("PERBUF not buffered")
+	}
+	timer.Tick(4 * 700)
+	if tc.Read(tcINTFLAGS)&tcOVFIF == 0 || readTC16(tc, tcPER) != 499 {
+		t.Error("No update at overflow")
+	}
+	if n := readTC16(tc, tcCNT); n != 0 {
+		t.Error("Bad count after update", n)
+	}
+}
+
+func TestXTimerPWM(t *testing.T) {
+	timer := core.NewTimer()
+	intr := core.NewInterrupts(6)
+	tc := NewXTimer(timer, intr, NewPMIC(intr, 6), 0, 4)
+	port := NewPort()
+	port.WriteDDR(0, 0xff)
+	tc.AttachOutputs(port, 0)
+	writeTC16(tc, tcPER, 99)
+	writeTC16(tc, tcCC, 25)
+	writeTC16(tc, tcCC+2, 200)
+	tc.Write(tcCTRLB, 0x30|tcSS)
+	tc.Write(tcCTRLA, 0x01)
+	// outputs are set at the first BOTTOM
+	timer.Tick(100)
+
+	var high, low int
+	for i := 0; i < 1000; i++ {
+		timer.Tick(1)
+		if port.Level(0) {
+			high++
+		}
+		if port.Level(1) {
+			low++
+		}
+	}
+	if high != 250 || low != 1000 {
+		t.Error("Bad duty cycles", high, low)
+	}
+
+	tc.Write(tcCTRLB, 0x10|tcFrq)
+	writeTC16(tc, tcCNT, 0)
+	var toggles int
+	last := port.Level(0)
+	for i := 0; i < 260; i++ {
+		timer.Tick(1)
+		if port.Level(0) != last {
+			toggles++
+			last = port.Level(0)
+		}
+	}
+	if toggles != 10 {
+		t.Error("Bad frequency output", toggles)
+	}
+}